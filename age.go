@@ -0,0 +1,48 @@
+package diskqueue
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// OldestMessageAge returns how long ago the message at the head of the
+// queue was written, or 0 if there is none
+//
+// messages without an envelope (see PutMessage) are dated by the mtime of
+// their data file, which is never earlier than when they were written, so
+// the age returned for them is a lower bound
+func (d *diskQueue) OldestMessageAge() time.Duration {
+	head := atomic.LoadInt64(&d.headTime)
+	if head == 0 {
+		return 0
+	}
+	age := time.Since(time.Unix(0, head))
+	if age < 0 {
+		return 0
+	}
+	return age
+}
+
+// updateHeadTime records when the message pending delivery (if any) was
+// written, for OldestMessageAge
+func (d *diskQueue) updateHeadTime(pending bool) {
+	if !pending {
+		atomic.StoreInt64(&d.headTime, 0)
+		return
+	}
+	if d.headFileNum == d.readFileNum && d.headPos == d.readPos &&
+		atomic.LoadInt64(&d.headTime) != 0 {
+		return
+	}
+	d.headFileNum, d.headPos = d.readFileNum, d.readPos
+
+	written := d.readTimestamp
+	if written.IsZero() {
+		mtime, err := d.fileModTime(d.readFileNum)
+		if err != nil {
+			return
+		}
+		written = mtime
+	}
+	atomic.StoreInt64(&d.headTime, written.UnixNano())
+}
@@ -0,0 +1,139 @@
+package diskqueue
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// recoverAppendPos derives writePos from the size of the write file when
+// running with WithAppendWrites, complete frames found past the persisted
+// writePos (written before a crash but after the last metadata sync) are
+// kept and counted while a torn frame at the end of the file is truncated,
+// as is a transaction that fails its checksum
+func (d *diskQueue) recoverAppendPos() error {
+	for {
+		fileName := d.fileName(d.writeFileNum)
+		var size int64
+		stat, err := os.Stat(fileName)
+		if err == nil {
+			size = stat.Size()
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		if size < d.writePos {
+			d.log(ERROR, "write file is shorter than writePos, messages were lost", "file", fileName, "size", size, "writePos", d.writePos)
+			return d.shrinkWritePos(size)
+		}
+		if size == d.writePos {
+			return nil
+		}
+
+		rolled, err := d.adoptAppendedFrames(fileName, size)
+		if err != nil || !rolled {
+			return err
+		}
+	}
+}
+
+// adoptAppendedFrames walks the frames in fileName between writePos and
+// size, advancing writePos and depth past each complete one, it returns
+// true if the file turned out to be full and the write file was rolled
+func (d *diskQueue) adoptAppendedFrames(fileName string, size int64) (bool, error) {
+	var msgSize int32
+	var flags uint32
+
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0600)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	header, err := readFileHeader(f)
+	if err != nil {
+		return false, err
+	}
+	_, err = f.Seek(d.writePos, 0)
+	if err != nil {
+		return false, err
+	}
+	reader := bufio.NewReader(f)
+
+	pos := d.writePos
+	var found int64
+	for pos < size {
+		var padding int64
+		padding, msgSize, flags, err = d.readFrameStart(reader, pos, header)
+		end := pos + padding + int64(msgSize) + d.frameOverhead(header.version, msgSize)
+		if err != nil || end > size {
+			break
+		}
+		skip := int(end - pos - padding - frameHeaderLen(header.version, msgSize))
+		msgs := int64(1)
+		if flags&frameFlagTxn != 0 {
+			data := make([]byte, msgSize)
+			_, err = io.ReadFull(reader, data)
+			if err == nil {
+				msgs, err = checkTxn(data)
+			}
+			skip -= int(msgSize)
+		}
+		if err == nil {
+			_, err = reader.Discard(skip)
+		}
+		if err != nil {
+			break
+		}
+		pos = end
+		found += msgs
+		if pos > d.maxBytesOf(header) {
+			break
+		}
+	}
+
+	if found > 0 {
+		d.log(WARN, "recovered messages past writePos", "file", fileName, "count", found)
+	}
+	if pos < size {
+		d.log(WARN, "truncating torn frame", "file", fileName, "pos", pos)
+		err = f.Truncate(pos)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	atomic.AddInt64(&d.depthBytes, pos-d.writePos)
+	d.writePos = pos
+	atomic.AddInt64(&d.depth, found)
+	d.writeFileCount += found
+	d.needSync = true
+	if d.writePos > d.maxBytesOf(header) {
+		d.writeFileNum++
+		d.writePos = 0
+		d.writeFileCount = 0
+		d.writeFileCRC = 0
+		return true, nil
+	}
+	return false, nil
+}
+
+// shrinkWritePos moves writePos (and the read position, if it is past the
+// new end) back to size and recounts the depth from the read position
+func (d *diskQueue) shrinkWritePos(size int64) error {
+	d.writePos = size
+	if d.readFileNum == d.writeFileNum && d.readPos > size {
+		d.readPos = size
+		d.nextReadPos = size
+		d.commitReadPos = size
+	}
+	d.needSync = true
+
+	depth, err := d.depthInFiles(d.readFileNum, d.readPos)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&d.depth, depth)
+	atomic.StoreInt64(&d.depthBytes, d.unreadBytes(d.readFileNum, d.readPos))
+	return nil
+}
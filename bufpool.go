@@ -0,0 +1,47 @@
+package diskqueue
+
+import "sync"
+
+// readBufClasses are the capacities of the buffers messages are read into,
+// the buffers of larger messages are allocated to size
+var readBufClasses = [...]int{1 << 10, 16 << 10, 256 << 10}
+
+// bufPool holds the buffers handed back once read messages are done with,
+// by size class, so that a buffer a large message was read into isn't kept
+// around for small ones
+type bufPool struct {
+	classes [len(readBufClasses)]sync.Pool
+	large   sync.Pool
+}
+
+// get returns a buffer of n bytes
+func (p *bufPool) get(n int) []byte {
+	for i, size := range readBufClasses {
+		if n > size {
+			continue
+		}
+		if buf, ok := p.classes[i].Get().([]byte); ok {
+			return buf[:n]
+		}
+		return make([]byte, n, size)
+	}
+	if buf, ok := p.large.Get().([]byte); ok && cap(buf) >= n {
+		return buf[:n]
+	}
+	return make([]byte, n)
+}
+
+// put hands back buf, which get may return again
+func (p *bufPool) put(buf []byte) {
+	c := cap(buf)
+	if c > readBufClasses[len(readBufClasses)-1] {
+		p.large.Put(buf[:0])
+		return
+	}
+	for i := len(readBufClasses) - 1; i >= 0; i-- {
+		if c >= readBufClasses[i] {
+			p.classes[i].Put(buf[:0])
+			return
+		}
+	}
+}
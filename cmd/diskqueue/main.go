@@ -0,0 +1,380 @@
+// Command diskqueue inspects and repairs the files of a queue
+//
+//	diskqueue <command> -dir <dataPath> -name <name> [flags] [args]
+//
+// meta, dump and tail only read the queue's files and can be used on a
+// queue that is open elsewhere, verify, repair, trim and compact open the
+// queue and fail if it is (see lock.go)
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	diskqueue "github.com/masknu/go-diskqueue"
+)
+
+type command struct {
+	usage string
+	run   func(c *config, args []string) error
+}
+
+var commands = map[string]command{
+	"meta":    {"show the persisted positions, depth and cursors", runMeta},
+	"dump":    {"print the unread messages with their positions", runDump},
+	"tail":    {"print messages as they are written, until interrupted", runTail},
+	"verify":  {"check the checksums and depth of the unread messages", runVerify},
+	"repair":  {"re-enqueue the readable messages of the .bad files given", runRepair},
+	"trim":    {"drop unread messages written before -before or the first -count", runTrim},
+	"compact": {"merge the small data files holding unread messages", runCompact},
+}
+
+// config holds the flags shared by every command
+type config struct {
+	flags *flag.FlagSet
+
+	dir             string
+	name            string
+	maxBytesPerFile int64
+	minMsgSize      int
+	maxMsgSize      int
+	trailer         bool
+	compression     bool
+
+	// dump and tail
+	from   string
+	limit  int
+	hexOut bool
+	// tail
+	interval time.Duration
+	// trim
+	before string
+	count  int64
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	c := &config{flags: flag.NewFlagSet(os.Args[1], flag.ExitOnError)}
+	c.flags.StringVar(&c.dir, "dir", ".", "the queue's data path")
+	c.flags.StringVar(&c.name, "name", "", "the queue's name")
+	c.flags.Int64Var(&c.maxBytesPerFile, "max-bytes-per-file", 100*1024*1024, "the queue's maxBytesPerFile")
+	c.flags.IntVar(&c.minMsgSize, "min-msg-size", 0, "the queue's minMsgSize")
+	c.flags.IntVar(&c.maxMsgSize, "max-msg-size", 1024*1024, "the queue's maxMsgSize")
+	c.flags.BoolVar(&c.trailer, "trailer", false, "the queue was written with WithFrameTrailer")
+	c.flags.BoolVar(&c.compression, "flate", false, "the queue was written with flate compression")
+	c.flags.StringVar(&c.from, "from", "", "the position (<file>:<pos>) to start at rather than the read position")
+	c.flags.IntVar(&c.limit, "limit", 0, "the most messages to print, 0 for all")
+	c.flags.BoolVar(&c.hexOut, "hex", false, "print messages as a hex dump rather than quoted")
+	c.flags.DurationVar(&c.interval, "interval", time.Second, "how often tail checks for new messages")
+	c.flags.StringVar(&c.before, "before", "", "trim messages written before this RFC 3339 time")
+	c.flags.Int64Var(&c.count, "count", 0, "trim this many messages")
+	c.flags.Parse(os.Args[2:])
+	if c.name == "" {
+		fmt.Fprintln(os.Stderr, "diskqueue: -name is required")
+		os.Exit(2)
+	}
+
+	err := cmd.run(c, c.flags.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "diskqueue %s: %s\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: diskqueue <command> -dir <dataPath> -name <name> [flags] [args]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-7s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nrun diskqueue <command> -h for its flags")
+}
+
+// options returns the options describing how the queue's messages are
+// stored, as set with the flags
+func (c *config) options() ([]diskqueue.Option, error) {
+	opts := []diskqueue.Option{
+		diskqueue.WithMaxBytesPerFile(c.maxBytesPerFile),
+		diskqueue.WithMsgSize(int32(c.minMsgSize), int32(c.maxMsgSize)),
+	}
+	if c.trailer {
+		opts = append(opts, diskqueue.WithFrameTrailer())
+	}
+	if c.compression {
+		compressor, err := diskqueue.NewFlateCompressor(-1)
+		if err != nil {
+			return nil, err
+		}
+		// messages are only compressed above the threshold, which doesn't
+		// matter for reading them
+		opts = append(opts, diskqueue.WithCompression(compressor, 1<<30))
+	}
+	return opts, nil
+}
+
+func (c *config) inspector() (*diskqueue.Inspector, error) {
+	opts, err := c.options()
+	if err != nil {
+		return nil, err
+	}
+	return diskqueue.NewInspector(c.name, c.dir, opts...), nil
+}
+
+// open opens the queue, logging its warnings and errors to stderr
+func (c *config) open() (diskqueue.Interface, error) {
+	opts, err := c.options()
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, diskqueue.WithLogger(func(lvl diskqueue.LogLevel, f string, args ...interface{}) {
+		if lvl >= diskqueue.WARN {
+			fmt.Fprintf(os.Stderr, lvl.String()+": "+f+"\n", args...)
+		}
+	}))
+	dq, err := diskqueue.NewWithOptions(c.name, c.dir, opts...)
+	if err != nil {
+		return nil, err
+	}
+	err = dq.LastError()
+	if err != nil {
+		dq.Close()
+		return nil, err
+	}
+	return dq, nil
+}
+
+// start returns the position set with -from, or else def
+func (c *config) start(def diskqueue.Position) (diskqueue.Position, error) {
+	if c.from == "" {
+		return def, nil
+	}
+	parts := strings.SplitN(c.from, ":", 2)
+	if len(parts) != 2 {
+		return def, fmt.Errorf("invalid position %q, must be <file>:<pos>", c.from)
+	}
+	fileNum, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return def, fmt.Errorf("invalid position %q - %s", c.from, err)
+	}
+	pos, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return def, fmt.Errorf("invalid position %q - %s", c.from, err)
+	}
+	return diskqueue.Position{FileNum: fileNum, Pos: pos}, nil
+}
+
+func (c *config) printMessage(pos diskqueue.Position, m diskqueue.Message) {
+	line := fmt.Sprintf("%d:%d\t%d bytes", pos.FileNum, pos.Pos, len(m.Data))
+	if !m.Timestamp.IsZero() {
+		line += "\t" + m.Timestamp.Format(time.RFC3339Nano)
+	}
+	if c.hexOut {
+		fmt.Printf("%s\n%s", line, hex.Dump(m.Data))
+		return
+	}
+	fmt.Printf("%s\t%q\n", line, m.Data)
+}
+
+func runMeta(c *config, args []string) error {
+	i, err := c.inspector()
+	if err != nil {
+		return err
+	}
+	md, err := i.MetaData()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("read position:   %d:%d\n", md.Read.FileNum, md.Read.Pos)
+	fmt.Printf("write position:  %d:%d\n", md.Write.FileNum, md.Write.Pos)
+	fmt.Printf("depth:           %d\n", md.Depth)
+	if md.DepthBytes >= 0 {
+		fmt.Printf("depth in bytes:  %d\n", md.DepthBytes)
+	}
+	fmt.Printf("generation:      %d\n", md.Generation)
+	fmt.Printf("closed cleanly:  %t\n", md.Clean)
+	var names []string
+	for name := range md.Cursors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := md.Cursors[name]
+		fmt.Printf("cursor %s: %d:%d\n", name, p.FileNum, p.Pos)
+	}
+	return nil
+}
+
+func runDump(c *config, args []string) error {
+	i, err := c.inspector()
+	if err != nil {
+		return err
+	}
+	md, err := i.MetaData()
+	if err != nil {
+		return err
+	}
+	from, err := c.start(md.Read)
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	_, err = i.Walk(from, func(pos diskqueue.Position, m diskqueue.Message) bool {
+		if c.limit > 0 && n >= c.limit {
+			return false
+		}
+		c.printMessage(pos, m)
+		n++
+		return true
+	})
+	return err
+}
+
+func runTail(c *config, args []string) error {
+	i, err := c.inspector()
+	if err != nil {
+		return err
+	}
+	md, err := i.MetaData()
+	if err != nil {
+		return err
+	}
+	from, err := c.start(md.Write)
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	for {
+		from, err = i.Walk(from, func(pos diskqueue.Position, m diskqueue.Message) bool {
+			c.printMessage(pos, m)
+			n++
+			return c.limit == 0 || n < c.limit
+		})
+		if err != nil || (c.limit > 0 && n >= c.limit) {
+			return err
+		}
+		time.Sleep(c.interval)
+
+		// skip ahead if what was left to print has been read and removed
+		md, err = i.MetaData()
+		if err != nil {
+			return err
+		}
+		if from.FileNum < md.Read.FileNum {
+			from = md.Read
+		}
+	}
+}
+
+func runVerify(c *config, args []string) error {
+	dq, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer dq.Close()
+
+	report, err := dq.Verify()
+	if err != nil {
+		return err
+	}
+	for _, f := range report.Files {
+		if f.Err != nil {
+			fmt.Printf("file %d: %d messages, corrupt at %d - %s\n", f.FileNum, f.Messages, f.CorruptPos, f.Err)
+		} else {
+			fmt.Printf("file %d: %d messages\n", f.FileNum, f.Messages)
+		}
+	}
+	fmt.Printf("depth %d, counted %d\n", report.Depth, report.CountedDepth)
+	if !report.OK() {
+		return errors.New("the queue is not intact")
+	}
+	return nil
+}
+
+func runRepair(c *config, args []string) error {
+	if len(args) == 0 {
+		return errors.New("no .bad files given")
+	}
+	dq, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer dq.Close()
+
+	for _, fileName := range args {
+		n, err := dq.Recover(fileName)
+		if err != nil {
+			return fmt.Errorf("%s - %s", fileName, err)
+		}
+		fmt.Printf("%s: re-enqueued %d messages\n", fileName, n)
+	}
+	return nil
+}
+
+func runTrim(c *config, args []string) error {
+	if (c.before == "") == (c.count == 0) {
+		return errors.New("exactly one of -before and -count is required")
+	}
+	var before time.Time
+	if c.before != "" {
+		var err error
+		before, err = time.Parse(time.RFC3339, c.before)
+		if err != nil {
+			return err
+		}
+	}
+	dq, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer dq.Close()
+
+	var n int64
+	if c.count > 0 {
+		n, err = dq.Skip(c.count)
+	} else {
+		n, err = dq.TrimBefore(before)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("dropped %d messages, depth %d\n", n, dq.Depth())
+	return nil
+}
+
+func runCompact(c *config, args []string) error {
+	dq, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer dq.Close()
+
+	n, err := dq.Compact()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("removed %d data files\n", n)
+	return nil
+}
@@ -0,0 +1,64 @@
+package diskqueue
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// compact rewrites the unread messages into full sized data files if
+// several of the rolled files holding them are small, see Compact
+func (d *diskQueue) compact() (int64, error) {
+	if len(d.cursors) > 0 {
+		return 0, errors.New("can't compact while there are cursors")
+	}
+
+	small := 0
+	for i := d.readFileNum; i < d.writeFileNum; i++ {
+		if d.dataEnd(i) < d.maxBytesPerFile/2 {
+			small++
+		}
+	}
+	if small < 2 {
+		return 0, nil
+	}
+
+	files := d.writeFileNum - d.readFileNum + 1
+
+	span := d.startSpan(context.Background(), "diskqueue.compact")
+	_, _, err := d.rewriteUnread(func([]byte) bool { return false })
+	if err != nil {
+		endSpan(span, err)
+		return 0, err
+	}
+
+	removed := files - (d.writeFileNum - d.readFileNum + 1)
+	d.log(INFO, "compacted data files", "files", files, "removed", removed)
+	span.SetAttribute("diskqueue.removed", removed)
+	endSpan(span, nil)
+	return removed, nil
+}
+
+// Compact merges the data files holding unread messages into full sized
+// ones (as set with WithMaxBytesPerFile), e.g. after many were rotated or
+// abandoned early, returning how many fewer files hold them
+//
+// it does nothing unless at least two of those files are under half that
+// size, otherwise the messages are written again after the last one and
+// the read position moved to them as with DeleteWhere, with the same
+// caveats, the queue must not have cursors
+func (d *diskQueue) Compact() (int64, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return 0, ErrExiting
+	}
+	if atomic.LoadInt32(&d.draining) == 1 {
+		return 0, ErrDraining
+	}
+
+	d.compactChan <- 1
+	res := <-d.trimResponseChan
+	return res.n, res.err
+}
@@ -0,0 +1,129 @@
+package diskqueue
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Compressor compresses and decompresses message data, see WithCompression
+//
+// both methods append to dst[:0] and return the result, they may be called
+// concurrently by different queues sharing the same Compressor, what
+// Decompress returns is checked against maxMsgSize (the one returned by
+// NewFlateCompressor stops decompressing past it)
+type Compressor interface {
+	Compress(dst []byte, src []byte) ([]byte, error)
+	Decompress(dst []byte, src []byte) ([]byte, error)
+}
+
+type flateCompressor struct {
+	level   int
+	writers sync.Pool
+}
+
+// NewFlateCompressor returns a Compressor using DEFLATE (compress/flate) at
+// the given level, bindings for e.g. snappy or zstd can be plugged in by
+// implementing Compressor instead
+func NewFlateCompressor(level int) (Compressor, error) {
+	// validate the level up front
+	_, err := flate.NewWriter(ioutil.Discard, level)
+	if err != nil {
+		return nil, err
+	}
+	return &flateCompressor{level: level}, nil
+}
+
+func (c *flateCompressor) Compress(dst []byte, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst[:0])
+
+	w, _ := c.writers.Get().(*flate.Writer)
+	if w == nil {
+		w, _ = flate.NewWriter(buf, c.level)
+	} else {
+		w.Reset(buf)
+	}
+	defer c.writers.Put(w)
+
+	_, err := w.Write(src)
+	if err == nil {
+		err = w.Close()
+	}
+	return buf.Bytes(), err
+}
+
+// Decompress fails for data that decompresses to more than any message
+// can hold
+func (c *flateCompressor) Decompress(dst []byte, src []byte) ([]byte, error) {
+	return c.decompressLimit(dst, src, frameMaxSize+envelopeMaxOverhead)
+}
+
+// decompressLimit is Decompress for data that must not decompress to more
+// than limit bytes, it stops reading past that so that a corrupt (or
+// hostile) frame can't expand to gigabytes
+func (c *flateCompressor) decompressLimit(dst []byte, src []byte, limit int64) ([]byte, error) {
+	buf := bytes.NewBuffer(dst[:0])
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+
+	n, err := buf.ReadFrom(io.LimitReader(r, limit+1))
+	if err == nil && n > limit {
+		err = fmt.Errorf("decompresses to more than %d bytes", limit)
+	}
+	return buf.Bytes(), err
+}
+
+// limitedDecompressor is implemented by the Compressors that can stop
+// decompressing past a limit, see flateCompressor
+type limitedDecompressor interface {
+	decompressLimit(dst []byte, src []byte, limit int64) ([]byte, error)
+}
+
+// compress returns data compressed along with the frame flags to store it
+// with, data is returned as is when it is below the threshold or doesn't
+// get any smaller
+func (d *diskQueue) compress(data []byte) ([]byte, uint32) {
+	if d.compressor == nil || len(data) < d.compressThreshold {
+		return data, 0
+	}
+
+	c, err := d.compressor.Compress(d.compressBuf, data)
+	if err != nil {
+		d.log(ERROR, "failed to compress message", "err", err)
+		return data, 0
+	}
+	d.compressBuf = c
+	if len(c) >= len(data) {
+		return data, 0
+	}
+	return c, frameFlagCompressed
+}
+
+// decompress returns the original data of a compressed message, the buffer
+// holding the compressed data is kept around for the next read
+func (d *diskQueue) decompress(data []byte) ([]byte, error) {
+	if d.compressor == nil {
+		return nil, errors.New("compressed message but no compressor configured")
+	}
+	// the envelope (if any) is compressed along with the message
+	limit := int64(d.maxMsgSize) + envelopeMaxOverhead
+	var out []byte
+	var err error
+	if c, ok := d.compressor.(limitedDecompressor); ok {
+		out, err = c.decompressLimit(nil, data, limit)
+	} else {
+		out, err = d.compressor.Decompress(nil, data)
+		if err == nil && int64(len(out)) > limit {
+			err = fmt.Errorf("decompresses to more than %d bytes", limit)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress message - %s", err)
+	}
+	d.spareReadBuf = data
+	return out, nil
+}
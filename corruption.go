@@ -0,0 +1,168 @@
+package diskqueue
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// Corruption describes a message that failed to read, see CorruptionHandler
+type Corruption struct {
+	FileName string
+	Pos      int64
+	Err      error
+	// Intact is true if the bounds of the message could be read, i.e. it
+	// failed its checksum or to decode, and it can be skipped on its own
+	Intact bool
+}
+
+// CorruptionError is what the queue panics with for PanicOnCorruption and
+// what methods that read messages on the caller's behalf (e.g. FastForward)
+// return for one that failed to read
+type CorruptionError struct {
+	Corruption
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corrupt message at %d of %s - %s", e.Pos, e.FileName, e.Err)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches ErrCorruptRecord
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorruptRecord
+}
+
+type corruptionKind int
+
+const (
+	corruptionSkipFile corruptionKind = iota
+	corruptionSkipRecord
+	corruptionQuarantine
+	corruptionPanic
+)
+
+// CorruptionAction is what a CorruptionHandler decides to do about a
+// message that failed to read
+type CorruptionAction struct {
+	kind corruptionKind
+	dir  string
+}
+
+// SkipCorruptFile renames the data file to .bad and carries on with the
+// next one, this is what happens without a CorruptionHandler
+func SkipCorruptFile() CorruptionAction {
+	return CorruptionAction{kind: corruptionSkipFile}
+}
+
+// SkipCorruptRecord drops just the message if it is intact (see
+// Corruption) and falls back to SkipCorruptFile otherwise
+func SkipCorruptRecord() CorruptionAction {
+	return CorruptionAction{kind: corruptionSkipRecord}
+}
+
+// QuarantineCorruptFile moves the data file to dir (which should be on the
+// same filesystem) and carries on with the next one, the file is renamed to
+// .bad in place if it can't be moved
+func QuarantineCorruptFile(dir string) CorruptionAction {
+	return CorruptionAction{kind: corruptionQuarantine, dir: dir}
+}
+
+// PanicOnCorruption panics with a *CorruptionError, unlike other panics
+// in ioLoop it isn't recovered, see LastError
+func PanicOnCorruption() CorruptionAction {
+	return CorruptionAction{kind: corruptionPanic}
+}
+
+// CorruptionHandler decides what happens to a message that fails to read,
+// see WithCorruptionHandler
+type CorruptionHandler interface {
+	// HandleCorruption is called from ioLoop, it must not block on the queue
+	HandleCorruption(c Corruption) CorruptionAction
+}
+
+// CorruptionHandlerFunc adapts a function to a CorruptionHandler
+type CorruptionHandlerFunc func(c Corruption) CorruptionAction
+
+func (f CorruptionHandlerFunc) HandleCorruption(c Corruption) CorruptionAction {
+	return f(c)
+}
+
+// handleCorruption deals with the message at readPos that failed to read
+// with err as the CorruptionHandler decides
+func (d *diskQueue) handleCorruption(err error) {
+	c := Corruption{
+		FileName: d.fileName(d.readFileNum),
+		Pos:      d.readPos,
+		Err:      err,
+		Intact:   d.readIntact,
+	}
+	d.readIntact = false
+
+	action := SkipCorruptFile()
+	if d.corruptionHandler != nil {
+		action = d.corruptionHandler.HandleCorruption(c)
+	}
+	switch action.kind {
+	case corruptionSkipRecord:
+		if c.Intact {
+			d.skipCorruptRecord()
+			return
+		}
+	case corruptionQuarantine:
+		d.skipReadFile(filepath.Join(action.dir, filepath.Base(c.FileName)))
+		return
+	case corruptionPanic:
+		panic(&CorruptionError{c})
+	}
+	d.handleReadError()
+}
+
+// markIntact records the bounds of the frame of data at readPos, which
+// failed its checksum or to decode
+func (d *diskQueue) markIntact(padding int64, data []byte, flags uint32) {
+	size := int32(len(data))
+	d.readIntact = true
+	d.readFrameSize = padding + int64(size) + d.frameOverhead(d.readHeader.version, size)
+	d.readCorruptCount = 1
+	if flags&frameFlagTxn != 0 {
+		// the count isn't covered by the checksum, so it is bound by the
+		// number of sub-frames that could fit
+		count, err := txnCount(data)
+		if err == nil && count <= int64(size-txnHeaderSize)/frameHeaderSize {
+			d.readCorruptCount = count
+		}
+	}
+}
+
+// skipCorruptRecord moves the read position past the intact frame at
+// readPos that failed to read
+func (d *diskQueue) skipCorruptRecord() {
+	atomic.AddInt64(&d.stats.readErrors, 1)
+	addCount(d.telemetry.readErrors, 1)
+	d.log(WARN, "dropping corrupt message", "file", d.fileName(d.readFileNum), "pos", d.readPos)
+
+	d.nextReadFileNum = d.readFileNum
+	d.nextReadPos = d.readPos + d.readFrameSize
+	if d.nextReadPos > d.maxBytesOf(d.readHeader) {
+		d.nextReadFileNum++
+		d.nextReadPos = 0
+	}
+	d.readTxn = pendingTxn{count: d.readCorruptCount}
+	d.moveForward()
+}
+
+// quarantineFile moves the bad data file fileName to target, falling back
+// to renaming it to .bad, returning where it ended up
+func (d *diskQueue) quarantineFile(fileName string, target string) (string, error) {
+	err := renameFile(fileName, target)
+	if err == nil {
+		return target, nil
+	}
+	d.log(ERROR, "failed to quarantine bad file", "file", fileName, "to", target, "err", err)
+	target = fileName + ".bad"
+	return target, renameFile(fileName, target)
+}
@@ -0,0 +1,428 @@
+package diskqueue
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Cursor is an independent, named consumer of a queue, see NewCursor
+type Cursor interface {
+	// ReadChan is expected to be an *unbuffered* channel, it is closed
+	// should the queue fail (see LastError)
+	ReadChan() chan []byte
+	Depth() int64
+	// Close stops reading, the cursor's position is kept
+	Close() error
+	// Delete stops reading and forgets the cursor's position
+	Delete() error
+}
+
+// cursor is both the state ioLoop keeps for a named cursor and, while
+// open, its Cursor
+type cursor struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	depth int64
+
+	d    *diskQueue
+	name string
+
+	// owned by ioLoop
+	fileNum     int64
+	pos         int64
+	nextFileNum int64
+	nextPos     int64
+	readFile    *os.File
+	reader      *bufio.Reader
+	header      fileHeader
+	open        bool
+	waiting     bool // a read was requested
+	transient   bool // not persisted, see Scan
+
+	readChan chan []byte
+	respChan chan []byte
+	exitChan chan int
+	exitWg   sync.WaitGroup
+	// a message was delivered but the position not yet advanced past it
+	delivered bool
+	// the rest of the transaction being read, see PutTransaction
+	txn pendingTxn
+}
+
+type cursorRequest struct {
+	c       *cursor
+	advance bool
+	delete  bool
+}
+
+type cursorOpenResult struct {
+	c   *cursor
+	err error
+}
+
+// NewCursor opens the named cursor, reading from its persisted position or,
+// for a new cursor, from the queue's read position
+//
+// data files are only removed once the queue and every cursor, open or not,
+// have read past them, Delete a cursor that is no longer needed
+func (d *diskQueue) NewCursor(name string) (Cursor, error) {
+	if name == "" || strings.IndexFunc(name, isSpace) >= 0 {
+		return nil, fmt.Errorf("invalid cursor name %q", name)
+	}
+
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return nil, ErrExiting
+	}
+
+	d.cursorOpenChan <- name
+	res := <-d.cursorOpenResponseChan
+	if res.err != nil {
+		return nil, res.err
+	}
+	res.c.exitWg.Add(1)
+	go res.c.readLoop()
+	return res.c, nil
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+}
+
+func (c *cursor) ReadChan() chan []byte {
+	return c.readChan
+}
+
+func (c *cursor) Depth() int64 {
+	return atomic.LoadInt64(&c.depth)
+}
+
+func (c *cursor) Close() error {
+	return c.exit(false)
+}
+
+func (c *cursor) Delete() error {
+	return c.exit(true)
+}
+
+func (c *cursor) exit(deleted bool) error {
+	close(c.exitChan)
+	c.exitWg.Wait()
+
+	c.d.RLock()
+	defer c.d.RUnlock()
+
+	if c.d.exitFlag == 1 {
+		return ErrExiting
+	}
+
+	c.d.cursorCloseChan <- cursorRequest{c: c, advance: c.delivered, delete: deleted}
+	return <-c.d.cursorCloseResponseChan
+}
+
+// readLoop asks ioLoop for messages and hands them out on readChan, the
+// position is advanced past a message along with the request for the next
+func (c *cursor) readLoop() {
+	defer c.exitWg.Done()
+
+	for {
+		select {
+		case c.d.cursorReadChan <- cursorRequest{c: c, advance: c.delivered}:
+			c.delivered = false
+		case <-c.exitChan:
+			return
+		case <-c.d.exitChan:
+			return
+		}
+
+		var data []byte
+		var ok bool
+		select {
+		case data, ok = <-c.respChan:
+			if !ok {
+				// the queue failed, see failedLoop
+				close(c.readChan)
+				return
+			}
+		case <-c.exitChan:
+			return
+		case <-c.d.exitChan:
+			return
+		}
+
+		select {
+		case c.readChan <- data:
+			c.delivered = true
+		case <-c.exitChan:
+			return
+		case <-c.d.exitChan:
+			return
+		}
+	}
+}
+
+// openCursor returns the named cursor's state prepared for reading
+func (d *diskQueue) openCursor(name string) (*cursor, error) {
+	c, ok := d.cursors[name]
+	if ok && c.open {
+		return nil, fmt.Errorf("cursor %s is already open", name)
+	}
+	if !ok {
+		c = &cursor{
+			d:       d,
+			name:    name,
+			fileNum: d.commitReadFileNum,
+			pos:     d.commitReadPos,
+		}
+		if d.readerless && len(d.cursors) > 0 {
+			// a new channel only gets the messages written from now on
+			c.fileNum, c.pos = d.writeFileNum, d.writePos
+		}
+		d.cursors[name] = c
+		d.needSync = true
+	}
+
+	depth, err := d.depthInFiles(c.fileNum, c.pos)
+	if err != nil {
+		return nil, err
+	}
+	atomic.StoreInt64(&c.depth, depth)
+
+	c.resetRead()
+	c.open = true
+	c.readChan = make(chan []byte)
+	c.respChan = make(chan []byte, 1)
+	c.exitChan = make(chan int)
+	c.delivered = false
+	return c, nil
+}
+
+// closeCursor detaches an open cursor, forgetting its position if deleted
+func (d *diskQueue) closeCursor(req cursorRequest) error {
+	c := req.c
+	if req.advance {
+		d.advanceCursor(c)
+	}
+	c.resetRead()
+	c.open = false
+	c.waiting = false
+	if req.delete {
+		delete(d.cursors, c.name)
+		if d.readerless && len(d.cursors) == 0 {
+			// the messages the last channel hadn't read are dropped
+			d.skipReadTo(d.writeFileNum, d.writePos, atomic.LoadInt64(&d.depth))
+		}
+		d.removeFiles()
+	}
+	d.needSync = true
+	return nil
+}
+
+// resetRead discards a message read but not yet delivered, and the file
+// it was read from, so that reading resumes from the cursor's position
+func (c *cursor) resetRead() {
+	if c.readFile != nil {
+		c.readFile.Close()
+		c.readFile = nil
+	}
+	c.nextFileNum = c.fileNum
+	c.nextPos = c.pos
+	c.txn = pendingTxn{}
+}
+
+// moveCursor sets a cursor's position, recomputing its depth
+func (d *diskQueue) moveCursor(c *cursor, fileNum int64, pos int64) {
+	c.fileNum = fileNum
+	c.pos = pos
+	c.resetRead()
+	depth, err := d.depthInFiles(fileNum, pos)
+	if err != nil {
+		d.log(ERROR, "failed to count messages for cursor", "cursor", c.name, "err", err)
+	}
+	atomic.StoreInt64(&c.depth, depth)
+}
+
+// advanceCursor moves a cursor past the message it last read
+func (d *diskQueue) advanceCursor(c *cursor) {
+	if c.nextFileNum == c.fileNum && c.nextPos == c.pos {
+		// the cursor was moved since
+		return
+	}
+	msgs := int64(1)
+	if c.txn.count > 0 {
+		msgs = c.txn.count
+		c.txn = pendingTxn{}
+	}
+	fileChanged := c.nextFileNum != c.fileNum
+	c.fileNum = c.nextFileNum
+	c.pos = c.nextPos
+	atomic.AddInt64(&c.depth, -msgs)
+	d.readsSinceSync += msgs
+	if fileChanged {
+		d.removeFiles()
+	}
+}
+
+// serveCursors reads the next message for every cursor waiting for one
+func (d *diskQueue) serveCursors() {
+	for _, c := range d.cursors {
+		if c.waiting {
+			d.serveCursor(c)
+		}
+	}
+}
+
+func (d *diskQueue) serveCursor(c *cursor) {
+	if c.fileNum == d.writeFileNum && c.pos >= d.writePos-int64(d.pendingWrite.Len()) {
+		if c.pos >= d.writePos {
+			// nothing to read yet
+			return
+		}
+		// the next message has not been written out yet
+		d.flushPending()
+	}
+
+	m, err := d.cursorReadOne(c)
+	if err == errFileEnd {
+		c.fileNum++
+		c.pos = 0
+		d.serveCursor(c)
+		return
+	}
+	if err != nil {
+		d.log(ERROR, "cursor failed to read", "cursor", c.name, "file", d.fileName(c.fileNum), "pos", c.pos, "err", err)
+		// skip the rest of the file
+		if c.fileNum < d.writeFileNum {
+			d.moveCursor(c, c.fileNum+1, 0)
+		} else {
+			d.moveCursor(c, d.writeFileNum, d.writePos)
+		}
+		return
+	}
+	c.waiting = false
+	c.respChan <- m.Data
+}
+
+// cursorReadOne is readOne for a cursor
+func (d *diskQueue) cursorReadOne(c *cursor) (Message, error) {
+	var err error
+
+	if len(c.txn.msgs) > 0 {
+		m := c.txn.msgs[0]
+		c.txn.msgs[0] = Message{}
+		c.txn.msgs = c.txn.msgs[1:]
+		if len(c.txn.msgs) == 0 {
+			c.nextFileNum, c.nextPos = c.txn.nextFileNum, c.txn.nextPos
+		}
+		return m, nil
+	}
+
+	if c.readFile == nil {
+		c.readFile, err = openReadFile(d.fileName(c.fileNum))
+		if err != nil {
+			return Message{}, err
+		}
+		c.header, err = readFileHeader(c.readFile)
+		if err == nil {
+			_, err = c.readFile.Seek(c.pos, 0)
+		}
+		if err != nil {
+			c.resetRead()
+			return Message{}, err
+		}
+		if d.mmapWrites || d.directIO {
+			c.reader = bufio.NewReader(&mmapReader{d: d, f: c.readFile, fileNum: c.fileNum, off: c.pos})
+		} else {
+			c.reader = bufio.NewReader(c.readFile)
+		}
+	}
+
+	padding, msgSize, flags, err := d.readFrameStart(c.reader, c.pos, c.header)
+	if fileEnded(err, c.fileNum, d.writeFileNum) {
+		err = errFileEnd
+	}
+	if err != nil {
+		c.resetRead()
+		return Message{}, err
+	}
+	data := make([]byte, msgSize)
+	_, err = io.ReadFull(c.reader, data)
+	if err == nil && d.frameTrailer {
+		var trailer [frameTrailerSize]byte
+		_, err = io.ReadFull(c.reader, trailer[:])
+		if err == nil {
+			err = checkFrameTrailer(trailer[:], data)
+		}
+	}
+	var msgs []Message
+	if err == nil {
+		msgs, err = d.decodeFrameMessages(data, flags)
+	}
+	if err != nil {
+		c.resetRead()
+		return Message{}, err
+	}
+	m := msgs[0]
+
+	c.nextFileNum = c.fileNum
+	c.nextPos = c.pos + padding + int64(msgSize) + d.frameOverhead(c.header.version, msgSize)
+	if c.nextPos > d.maxBytesOf(c.header) {
+		c.readFile.Close()
+		c.readFile = nil
+		c.nextFileNum++
+		c.nextPos = 0
+	}
+	if len(msgs) > 1 {
+		// the position only moves past the transaction once all of its
+		// messages have been read
+		c.txn = pendingTxn{msgs: msgs[1:], count: int64(len(msgs)),
+			nextFileNum: c.nextFileNum, nextPos: c.nextPos}
+		c.nextFileNum, c.nextPos = c.fileNum, c.pos
+	}
+	return m, nil
+}
+
+// skipCursorsIn moves the cursors reading fileNum to the start of the next
+// file, e.g. when it is dropped to make room
+func (d *diskQueue) skipCursorsIn(fileNum int64) {
+	for _, c := range d.cursors {
+		if c.fileNum == fileNum {
+			d.log(WARN, "cursor skipping file", "cursor", c.name, "file", d.fileName(fileNum))
+			d.moveCursor(c, fileNum+1, 0)
+		}
+	}
+}
+
+// resetCursors moves every cursor to pos in fileNum, which must be empty
+func (d *diskQueue) resetCursors(fileNum int64, pos int64) {
+	for _, c := range d.cursors {
+		c.fileNum = fileNum
+		c.pos = pos
+		c.resetRead()
+		atomic.StoreInt64(&c.depth, 0)
+	}
+}
+
+// closeCursorFiles closes the files cursors are reading from
+func (d *diskQueue) closeCursorFiles() {
+	for _, c := range d.cursors {
+		c.resetRead()
+	}
+}
+
+// cursorNames returns the names of all cursors in a stable order
+func (d *diskQueue) cursorNames() []string {
+	names := make([]string, 0, len(d.cursors))
+	for name := range d.cursors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,127 @@
+package diskqueue
+
+import (
+	"bufio"
+	"io"
+	"os"
+)
+
+// openDeadLetterQueue opens the companion queue salvaged messages are
+// moved to, see WithDeadLetterQueue
+func (d *diskQueue) openDeadLetterQueue() {
+	dlq := newDiskQueue(d.name+".dlq", d.dataPath, d.maxBytesPerFile,
+		d.minMsgSize, d.maxMsgSize, d.logf)
+	dlq.syncPolicy = d.syncPolicy
+	dlq.syncMode = d.syncMode
+	dlq.fileFormat = d.fileFormat
+	dlq.start()
+	d.dlq = dlq
+}
+
+// salvageBadFile moves the messages that can still be read from a bad data
+// file, starting at pos, to the dead letter queue
+//
+// messages are read forwards from pos up to the corruption and, if the file
+// was written with trailers, backwards from the end of the file down to it
+func (d *diskQueue) salvageBadFile(fileName string, pos int64) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		d.log(ERROR, "failed to open bad file", "file", fileName, "err", err)
+		return
+	}
+	defer f.Close()
+
+	var salvaged []Message
+	_, err = f.Seek(pos, 0)
+	if err != nil {
+		d.log(ERROR, "failed to seek in bad file", "file", fileName, "err", err)
+		return
+	}
+	header, err := readFileHeader(f)
+	if err != nil {
+		d.log(ERROR, "failed to read header of bad file", "file", fileName, "err", err)
+		return
+	}
+	reader := bufio.NewReader(f)
+	for pos <= d.maxBytesOf(header) {
+		msgs, frameSize, err := d.salvageNext(reader, pos, header)
+		if err != nil {
+			break
+		}
+		salvaged = append(salvaged, msgs...)
+		pos += frameSize
+	}
+
+	if d.frameTrailer {
+		var tail []Message
+		end := d.salvageEnd(f, fileName)
+		maxSize := d.maxMsgSize + envelopeMaxOverhead + encryptionOverhead
+		for end > pos {
+			data, flags, start, err := readFrameBefore(f, end, header.version, d.minMsgSize, maxSize)
+			if err != nil || start < pos || start < header.size {
+				break
+			}
+			msgs, err := d.decodeFrameMessages(data, flags)
+			if err != nil {
+				break
+			}
+			for i := len(msgs) - 1; i >= 0; i-- {
+				tail = append(tail, msgs[i])
+			}
+			end = start
+		}
+		for i := len(tail) - 1; i >= 0; i-- {
+			salvaged = append(salvaged, tail[i])
+		}
+	}
+
+	for _, m := range salvaged {
+		if m.Timestamp.IsZero() && m.Headers == nil {
+			err = d.dlq.Put(m.Data)
+		} else {
+			err = d.dlq.PutMessage(m)
+		}
+		if err != nil {
+			d.log(ERROR, "failed to move message to dead letter queue", "err", err)
+			return
+		}
+	}
+	d.log(WARN, "moved messages to dead letter queue", "file", fileName, "count", len(salvaged))
+}
+
+// salvageNext reads the frame at pos, returning its messages and size
+func (d *diskQueue) salvageNext(r *bufio.Reader, pos int64, header fileHeader) ([]Message, int64, error) {
+	padding, msgSize, flags, err := d.readFrameStart(r, pos, header)
+	if err != nil {
+		return nil, 0, err
+	}
+	data := make([]byte, msgSize)
+	_, err = io.ReadFull(r, data)
+	if err == nil && d.frameTrailer {
+		var trailer [frameTrailerSize]byte
+		_, err = io.ReadFull(r, trailer[:])
+		if err == nil {
+			err = checkFrameTrailer(trailer[:], data)
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	msgs, err := d.decodeFrameMessages(data, flags)
+	return msgs, padding + int64(msgSize) + d.frameOverhead(header.version, msgSize), err
+}
+
+// salvageEnd returns the position the last frame in a bad file ends at
+func (d *diskQueue) salvageEnd(f *os.File, fileName string) int64 {
+	if d.segmentFooters {
+		footer, ok := d.readSegmentFooter(fileName)
+		if ok {
+			return footer.span
+		}
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		return 0
+	}
+	return stat.Size()
+}
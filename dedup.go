@@ -0,0 +1,67 @@
+package diskqueue
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"path"
+)
+
+// ErrDuplicate is returned by Put for a message with the same contents as
+// one written within the dedup window (see WithDedup), the message hasn't
+// been written
+var ErrDuplicate = errors.New("duplicate message")
+
+func (d *diskQueue) dedupFileName() string {
+	return fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.dedup.dat"), d.name)
+}
+
+// dedupID identifies a message by its contents, the dedup window is a
+// deliveryLedger of these rather than of positions
+func dedupID(data []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(data)
+	id := h.Sum64()
+	if id == 0 {
+		// zero marks an empty slot
+		id = 1
+	}
+	return id
+}
+
+func (d *diskQueue) openDedup() {
+	if d.dedupSize == 0 {
+		return
+	}
+	var err error
+	d.dedup, err = openDeliveryLedger(d.dedupFileName(), d.dedupSize)
+	if err != nil {
+		d.log(ERROR, "failed to open dedup window", "err", err)
+	}
+}
+
+// writeDeduped writes data unless a message with the same contents is in
+// the dedup window, in which case it's dropped or rejected with
+// ErrDuplicate
+func (d *diskQueue) writeDeduped(data []byte) error {
+	id := dedupID(data)
+	if d.dedup.contains(id) {
+		d.log(DEBUG, "duplicate message", "size", len(data))
+		if d.dedupReject {
+			return ErrDuplicate
+		}
+		return nil
+	}
+
+	err := d.writeOne(data)
+	if err != nil {
+		return err
+	}
+	// the message is written either way, failing the Put would have it
+	// retried
+	err = d.dedup.record(id)
+	if err != nil {
+		d.log(ERROR, "failed to record message in dedup window", "err", err)
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package diskqueue
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"time"
+)
+
+// messages written with PutDelayed are kept aside in a log of:
+//
+//	[8-byte due time (unix nanoseconds)][frame]
+//
+// until they are due, at which point they are written to the queue and
+// the log is rewritten without them
+
+// delayRetryInterval is how long to wait before trying to write a due
+// message to the queue again after failing to do so
+const delayRetryInterval = time.Second
+
+type delayedWrite struct {
+	data []byte
+	due  time.Time
+}
+
+type delayedMessage struct {
+	due   time.Time
+	frame []byte
+}
+
+// delayedHeap orders delayed messages by due time (see container/heap)
+type delayedHeap []delayedMessage
+
+func (h delayedHeap) Len() int            { return len(h) }
+func (h delayedHeap) Less(i, j int) bool  { return h[i].due.Before(h[j].due) }
+func (h delayedHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *delayedHeap) Push(x interface{}) { *h = append(*h, x.(delayedMessage)) }
+func (h *delayedHeap) Pop() interface{} {
+	old := *h
+	m := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return m
+}
+
+func (d *diskQueue) delayedFileName() string {
+	return fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.delayed.dat"), d.name)
+}
+
+// writeDelayed appends a message to the delayed log
+func (d *diskQueue) writeDelayed(data []byte, due time.Time) error {
+	var err error
+
+	dataLen := int32(len(data))
+	if dataLen < d.minMsgSize || dataLen > d.maxMsgSize {
+		return &MsgSizeError{int64(dataLen), d.minMsgSize, d.maxMsgSize}
+	}
+
+	if d.delayedFile == nil {
+		d.delayedFile, err = os.OpenFile(d.delayedFileName(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+	}
+
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(due.UnixNano()))
+	d.writeBuf.Reset()
+	d.writeBuf.Write(b[:])
+	// the delayed log is always written in format version 1
+	_, err = d.appendFrame(Message{Data: data}, 0, fileHeader{version: fileFormatV1})
+	if err != nil {
+		return err
+	}
+
+	_, err = d.delayedFile.Write(d.writeBuf.Bytes())
+	if err != nil {
+		d.delayedFile.Close()
+		d.delayedFile = nil
+		return err
+	}
+
+	frame := append([]byte(nil), d.writeBuf.Bytes()[8:]...)
+	heap.Push(&d.delayed, delayedMessage{due: due, frame: frame})
+	return nil
+}
+
+// releaseDelayed writes the delayed messages that are due to the queue
+func (d *diskQueue) releaseDelayed() {
+	var released int
+
+	now := time.Now()
+	for len(d.delayed) > 0 && !d.delayed[0].due.After(now) {
+		m, err := d.decodeDelayed(d.delayed[0].frame)
+		if err == nil {
+			err = d.writeMessage(m)
+		}
+		if err != nil {
+			d.log(ERROR, "failed to write delayed message", "err", err)
+			d.delayed[0].due = now.Add(delayRetryInterval)
+			heap.Fix(&d.delayed, 0)
+			break
+		}
+		heap.Pop(&d.delayed)
+		d.writesSinceSync++
+		released++
+	}
+
+	if released > 0 {
+		// the released messages must be on disk before they're dropped from the log
+		err := d.sync()
+		if err == nil {
+			err = d.rewriteDelayed()
+		}
+		if err != nil {
+			d.log(ERROR, "failed to rewrite delayed messages", "err", err)
+		}
+	}
+}
+
+// decodeDelayed returns the message stored in a delayed frame
+func (d *diskQueue) decodeDelayed(frame []byte) (Message, error) {
+	msgSize, flags, err := d.readFrameHeader(bytes.NewReader(frame), fileFormatV1)
+	if err != nil {
+		return Message{}, err
+	}
+	// decodeFrame may hand the buffer to readOne for reuse
+	data := append([]byte(nil), frame[frameHeaderSize:frameHeaderSize+msgSize]...)
+	return d.decodeFrame(data, flags)
+}
+
+// rewriteDelayed atomically replaces the delayed log with one holding
+// only the messages still pending
+func (d *diskQueue) rewriteDelayed() error {
+	if d.delayedFile != nil {
+		d.delayedFile.Close()
+		d.delayedFile = nil
+	}
+
+	fileName := d.delayedFileName()
+	if len(d.delayed) == 0 {
+		err := removeFile(fileName)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
+	f, err := os.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, m := range d.delayed {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(m.due.UnixNano()))
+		w.Write(b[:])
+		w.Write(m.frame)
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmpFileName)
+		return err
+	}
+
+	return renameFile(tmpFileName, fileName)
+}
+
+// loadDelayed reads the delayed log, a log cut short by a crash is
+// rewritten without its last (partial) message
+func (d *diskQueue) loadDelayed() error {
+	if d.delayedFile != nil {
+		d.delayedFile.Close()
+		d.delayedFile = nil
+	}
+	d.delayed = d.delayed[:0]
+
+	f, err := os.Open(d.delayedFileName())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for {
+		var b [8]byte
+		_, err = io.ReadFull(reader, b[:])
+		if err == io.EOF {
+			return nil
+		}
+		var frame []byte
+		if err == nil {
+			frame, err = d.readDelayedFrame(reader)
+		}
+		if err != nil {
+			d.log(WARN, "discarding corrupt delayed messages", "err", err)
+			return d.rewriteDelayed()
+		}
+		due := time.Unix(0, int64(binary.BigEndian.Uint64(b[:])))
+		heap.Push(&d.delayed, delayedMessage{due: due, frame: frame})
+	}
+}
+
+// readDelayedFrame reads a whole frame from r
+func (d *diskQueue) readDelayedFrame(r io.Reader) ([]byte, error) {
+	var header bytes.Buffer
+
+	msgSize, _, err := d.readFrameHeader(io.TeeReader(r, &header), fileFormatV1)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, int64(msgSize)+d.frameOverhead(fileFormatV1, msgSize))
+	copy(frame, header.Bytes())
+	_, err = io.ReadFull(r, frame[frameHeaderSize:])
+	if err != nil {
+		return nil, err
+	}
+	if d.frameTrailer {
+		err = checkFrameTrailer(frame[frameHeaderSize+msgSize:], frame[frameHeaderSize:frameHeaderSize+msgSize])
+	}
+	return frame, err
+}
@@ -0,0 +1,165 @@
+package diskqueue
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// deleteWhere removes the unread messages pred matches, see DeleteWhere
+func (d *diskQueue) deleteWhere(pred func([]byte) bool) (int64, error) {
+	if len(d.cursors) > 0 {
+		return 0, errors.New("can't delete messages while there are cursors")
+	}
+
+	span := d.startSpan(context.Background(), "diskqueue.delete_where")
+	_, deleted, err := d.rewriteUnread(pred)
+	if err != nil {
+		endSpan(span, err)
+		return 0, err
+	}
+
+	d.log(INFO, "deleted messages", "count", deleted)
+	span.SetAttribute("diskqueue.deleted", deleted)
+	endSpan(span, nil)
+	return deleted, nil
+}
+
+// rewriteUnread writes the unread messages pred doesn't match after the
+// write position, then moves the read position to the first of them so
+// that the data files read in full are removed, returning how many were
+// kept and how many dropped
+//
+// the queue is left as it was if it fails, the caller checks there are no
+// cursors
+func (d *diskQueue) rewriteUnread(pred func([]byte) bool) (int64, int64, error) {
+	if d.writeFile != nil {
+		err := d.flushPending()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	// the message pending delivery (if any) is passed to pred as well
+	d.rewindRead()
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
+	}
+	d.takePreopened(-1)
+
+	end := Position{d.writeFileNum, d.writePos}
+	depth, depthBytes := atomic.LoadInt64(&d.depth), atomic.LoadInt64(&d.depthBytes)
+	writeFileCount, writeFileCRC := d.writeFileCount, d.writeFileCRC
+	// the messages kept take up space until those they replace are removed
+	maxBytes, manager := d.maxBytes, d.manager
+	d.maxBytes, d.manager = 0, nil
+
+	var kept, deleted int64
+	var err error
+	var writeErr error
+	_, err = d.walkFrames(Position{d.readFileNum, d.readPos}, end, func(_ Position, _ Position, msgs []Message) bool {
+		var keep []Message
+		for _, m := range msgs {
+			if pred(m.Data) {
+				deleted++
+			} else {
+				keep = append(keep, m)
+			}
+		}
+		writeErr = d.writeKept(keep)
+		if writeErr != nil {
+			return false
+		}
+		kept += int64(len(keep))
+		return true
+	})
+	if err == nil {
+		err = writeErr
+	}
+	d.maxBytes, d.manager = maxBytes, manager
+
+	if err != nil {
+		// drop what was written, the queue is left as it was
+		d.dropWritesAfter(end, writeFileCount, writeFileCRC)
+		atomic.StoreInt64(&d.depth, depth)
+		atomic.StoreInt64(&d.depthBytes, depthBytes)
+		return 0, 0, err
+	}
+
+	d.readFileNum, d.readPos = end.FileNum, end.Pos
+	d.nextReadFileNum, d.nextReadPos = end.FileNum, end.Pos
+	d.bufferedReads = nil
+	atomic.StoreInt64(&d.depth, kept)
+	atomic.StoreInt64(&d.depthBytes, d.unreadBytes(end.FileNum, end.Pos))
+	d.commitReads()
+	d.needSync = true
+	return kept, deleted, nil
+}
+
+// dropWritesAfter drops whatever was written past end, the write position
+// at which the write file held writeFileCount messages with the CRC
+// writeFileCRC (see WithSegmentFooters), the caller restores the depth
+func (d *diskQueue) dropWritesAfter(end Position, writeFileCount int64, writeFileCRC uint32) {
+	d.pendingWrite.Reset()
+	d.pendingMsgs = 0
+	if d.writeFile != nil {
+		d.writeFile.Close()
+		d.writeFile = nil
+	}
+	for i := end.FileNum + 1; i <= d.writeFileNum; i++ {
+		d.removeDataFile(d.fileName(i))
+	}
+	d.writeFileNum, d.writePos = end.FileNum, end.Pos
+	d.writeFileCount, d.writeFileCRC = writeFileCount, writeFileCRC
+	if d.writeIndexFileNum == end.FileNum {
+		for len(d.writeIndex) > 0 && d.writeIndex[len(d.writeIndex)-1].count > writeFileCount {
+			d.writeIndex = d.writeIndex[:len(d.writeIndex)-1]
+		}
+	}
+	d.loadDoneFileBytes()
+	// a rotation meanwhile persisted the write position
+	d.needSync = true
+}
+
+// writeKept writes the messages of a frame that weren't deleted, those of
+// a transaction together
+func (d *diskQueue) writeKept(msgs []Message) error {
+	switch len(msgs) {
+	case 0:
+		return nil
+	case 1:
+		return d.writeMessage(msgs[0])
+	}
+	data := make([][]byte, len(msgs))
+	for i, m := range msgs {
+		data[i] = m.Data
+	}
+	return d.writeTransaction(data)
+}
+
+// DeleteWhere removes the unread messages pred returns true for, returning
+// how many were removed
+//
+// the messages kept are written again after the last one and the read
+// position moved to them, so the queue's data files take up to twice the
+// space meanwhile (limits set with WithMaxBytes don't apply), if the
+// queue crashes before it's done the messages kept may be read twice
+//
+// pred is called from ioLoop and must not call into the queue, messages
+// read but not committed (see WithManualCommit) are consumed, the queue
+// must not have cursors
+func (d *diskQueue) DeleteWhere(pred func([]byte) bool) (int64, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return 0, ErrExiting
+	}
+	if atomic.LoadInt32(&d.draining) == 1 {
+		return 0, ErrDraining
+	}
+
+	d.deleteWhereChan <- pred
+	res := <-d.trimResponseChan
+	return res.n, res.err
+}
@@ -0,0 +1,45 @@
+package diskqueue
+
+import (
+	"sync/atomic"
+)
+
+// DepthBytes returns the size of the unread part of the queue's data
+// files, i.e. of the messages counted by Depth, framing included
+func (d *diskQueue) DepthBytes() int64 {
+	return atomic.LoadInt64(&d.depthBytes)
+}
+
+// unreadBytes returns the size of the data files from pos in fileNum up to
+// the write position
+func (d *diskQueue) unreadBytes(fileNum int64, pos int64) int64 {
+	return d.bytesBetween(fileNum, pos, d.writeFileNum, d.writePos)
+}
+
+// bytesBetween returns the size of the data files from pos in fileNum up
+// to endPos in endFileNum
+func (d *diskQueue) bytesBetween(fileNum int64, pos int64, endFileNum int64, endPos int64) int64 {
+	var n int64
+	for ; fileNum < endFileNum; fileNum++ {
+		if end := d.dataEnd(fileNum); end > pos {
+			n += end - pos
+		}
+		pos = 0
+	}
+	if endPos > pos {
+		n += endPos - pos
+	}
+	return n
+}
+
+// dataEnd returns where the frames of a rolled data file end, which
+// is its size unless it has a footer
+func (d *diskQueue) dataEnd(fileNum int64) int64 {
+	if d.segmentFooters {
+		footer, ok := d.readSegmentFooter(d.fileName(fileNum))
+		if ok {
+			return footer.span
+		}
+	}
+	return d.fileSize(fileNum)
+}
@@ -0,0 +1,116 @@
+package diskqueue
+
+import (
+	"errors"
+	"io"
+	"os"
+	"unsafe"
+)
+
+const (
+	// the alignment of memory, offsets and sizes O_DIRECT I/O requires,
+	// which is at most the page size
+	directIOAlign = 4096
+	// the most a single write to an O_DIRECT file covers
+	directIOBufferSize = 1 << 20
+)
+
+// directFile appends to a data file opened with O_DIRECT, which only takes
+// writes of whole aligned blocks from aligned memory: the block being
+// appended to is kept in memory and written out (zero padded) along with
+// every write, Close() trims the file back to the bytes actually written
+type directFile struct {
+	f   *os.File
+	buf []byte // aligned, holds the blocks starting at off
+	off int64  // the aligned offset of buf in f
+	n   int    // the bytes of buf in use
+}
+
+func newDirectFile(f *os.File) *directFile {
+	return &directFile{f: f, buf: alignedBuffer(directIOBufferSize)}
+}
+
+// alignedBuffer returns size bytes of memory aligned to directIOAlign
+func alignedBuffer(size int) []byte {
+	b := make([]byte, size+directIOAlign)
+	shift := int(uintptr(unsafe.Pointer(&b[0])) & (directIOAlign - 1))
+	if shift > 0 {
+		shift = directIOAlign - shift
+	}
+	return b[shift : shift+size]
+}
+
+func (w *directFile) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := copy(w.buf[w.n:], p)
+		w.n += n
+		err := w.flush()
+		if err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// flush writes out the blocks in use and moves the last, partial, one
+// (if any) to the start of buf
+func (w *directFile) flush() error {
+	end := (w.n + directIOAlign - 1) &^ (directIOAlign - 1)
+	for i := w.n; i < end; i++ {
+		w.buf[i] = 0
+	}
+	_, err := w.f.WriteAt(w.buf[:end], w.off)
+	if err != nil {
+		return err
+	}
+	full := w.n &^ (directIOAlign - 1)
+	copy(w.buf, w.buf[full:w.n])
+	w.off += int64(full)
+	w.n -= full
+	return nil
+}
+
+// Seek only supports absolute offsets, reading in the block containing offset
+func (w *directFile) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekStart {
+		return 0, errors.New("unsupported seek")
+	}
+	w.off = offset &^ (directIOAlign - 1)
+	w.n = int(offset - w.off)
+	if w.n > 0 {
+		block := w.buf[:directIOAlign]
+		for i := range block {
+			block[i] = 0
+		}
+		_, err := w.f.ReadAt(block, w.off)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+	}
+	return offset, nil
+}
+
+func (w *directFile) Truncate(size int64) error {
+	err := w.f.Truncate(size)
+	if err != nil {
+		return err
+	}
+	_, err = w.Seek(size, io.SeekStart)
+	return err
+}
+
+func (w *directFile) Sync() error {
+	return fdatasync(w.f)
+}
+
+func (w *directFile) Close() error {
+	err := w.f.Truncate(w.off + int64(w.n))
+	closeErr := w.f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,15 @@
+//go:build linux
+// +build linux
+
+package diskqueue
+
+import (
+	"os"
+	"syscall"
+)
+
+// openDirect opens a data file with O_DIRECT, which fails on file systems
+// that don't support it (e.g. tmpfs)
+func openDirect(name string, flag int) (*os.File, error) {
+	return os.OpenFile(name, flag|syscall.O_DIRECT, 0600)
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package diskqueue
+
+import (
+	"errors"
+	"os"
+)
+
+var errDirectIOUnsupported = errors.New("O_DIRECT not supported on this platform")
+
+func openDirect(name string, flag int) (*os.File, error) {
+	return nil, errDirectIOUnsupported
+}
@@ -0,0 +1,20 @@
+package diskqueue
+
+import (
+	"os"
+)
+
+// syncDirHook fsyncs a directory, tests replace it to see the calls
+var syncDirHook = syncDir
+
+// syncDir fsyncs the directory dir, making the files created in it and
+// renamed into it survive a power loss, see WithDirSync
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	f.Close()
+	return err
+}
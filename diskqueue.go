@@ -3,13 +3,18 @@ package diskqueue
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/cipher"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"log/slog"
 	"math/rand"
 	"os"
 	"path"
+	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -47,11 +52,72 @@ func (l LogLevel) String() string {
 
 type Interface interface {
 	Put([]byte) error
+	PutPosition(data []byte) (Position, error)
+	PutMany([][]byte) error
+	PutTransaction(msgs [][]byte) error
+	PutContext(ctx context.Context, data []byte) error
+	TryPut([]byte) error
+	PutTimeout(data []byte, timeout time.Duration) error
+	PutReader(r io.Reader, size int64) error
+	PutDurable([]byte) error
+	PutMessage(m Message) error
+	PutDelayed(data []byte, deliverAt time.Time) error
+	WriteBarrier() error
+	Sync() error
+	Stats() Stats
 	ReadChan() chan []byte // this is expected to be an *unbuffered* channel
+	ReadMessageChan() chan Message
+	ReadEnvelopeChan() chan *Envelope
+	ReadInFlightChan() chan *InFlight
+	ReadInto(buf []byte) (int, error)
+	ReadWith(fn func([]byte) error) error
+	ReadBatch(max int, wait time.Duration) ([][]byte, error)
+	Subscribe(ctx context.Context, handler func(Message) error) error
 	Close() error
+	CloseContext(ctx context.Context) error
+	Drain(ctx context.Context) error
 	Delete() error
 	Depth() int64
+	DepthBytes() int64
+	OldestMessageAge() time.Duration
 	Empty() error
+	EmptyTo(p Position) error
+	Checkpoint() []byte
+	SeekCheckpoint(token []byte) error
+	ReadPosition() Position
+	SeekTo(p Position) error
+	SeekToTime(t time.Time) error
+	Commit(position []byte) error
+	TrimBefore(t time.Time) (int64, error)
+	Rewind(n int64) (int64, error)
+	Skip(n int64) (int64, error)
+	TrimToDepth(max int64) (int64, error)
+	Recover(badFile string) (int64, error)
+	DeleteWhere(pred func([]byte) bool) (int64, error)
+	Compact() (int64, error)
+	MoveTo(dst Interface, n int64) (int64, error)
+	SpliceFrom(dataPath string, name string) error
+	FastBackward(fn func([]byte) int) error
+	FastForward(ctx context.Context, fn func([]byte) int) (FastForwardResult, error)
+	LastError() error
+	DeadLetterQueue() Interface
+	FailoverTo(dataPath string) error
+	Snapshot(dir string) error
+	Export(w io.Writer) error
+	Scan(fn func(pos Position, data []byte) bool) error
+	Import(r io.Reader) error
+	NewCursor(name string) (Cursor, error)
+	Reconfigure(opts ...Option) error
+	Verify() (Report, error)
+}
+
+// Message is a single message along with its metadata, see PutMessage
+type Message struct {
+	Data []byte
+	// when the message was written, zero for messages written without
+	// an envelope
+	Timestamp time.Time
+	Headers   map[string]string
 }
 
 // diskQueue implements a filesystem backed FIFO queue
@@ -64,401 +130,3257 @@ type diskQueue struct {
 	readFileNum  int64
 	writeFileNum int64
 	depth        int64
+	depthBytes   int64
+
+	// when the message pending delivery was written, see OldestMessageAge
+	headTime int64
+
+	stats queueStats
 
 	sync.RWMutex
 
 	// instantiation time metadata
 	name            string
 	dataPath        string
-	maxBytesPerFile int64 // currently this cannot change once created
+	maxBytesPerFile int64 // only applies to new data files in format version 2
 	minMsgSize      int32
 	maxMsgSize      int32
-	syncEvery       int64         // number of writes per fsync
-	syncTimeout     time.Duration // duration of time per fsync
+	syncPolicy      SyncPolicy
+	syncOptions     syncOptions // which sync options were applied, see validateLimits
+	syncMode        SyncMode
+	frameTrailer    bool // currently this cannot change once created
+	checksumHandler func(data []byte, err error) bool
+	dropRead        bool // the message pending delivery failed its checksum
+	writeGate       *fifoGate
+	blockSize       int64 // currently this cannot change once created
 	exitFlag        int32
+	draining        int32 // Puts are rejected, see Drain
 	needSync        bool
 
+	// see WithCorruptionHandler
+	corruptionHandler CorruptionHandler
+
+	// see WithCompression
+	compressor        Compressor
+	compressThreshold int
+	compressBuf       []byte
+
+	// see WithEncryption
+	keys       KeyProvider
+	ciphers    map[uint32]cipher.AEAD
+	encryptBuf []byte
+
+	// see WithTimestamps
+	timestamps  bool
+	envelopeBuf []byte
+
+	// see WithMaxBytes
+	maxBytes       int64
+	overflowPolicy OverflowPolicy
+	// the size of the data files preceding the write file
+	doneFileBytes int64
+
+	// set once ioLoop has given up restarting, see ioLoop
+	failed  bool
+	errMtx  sync.Mutex
+	lastErr error
+
+	// held while the queue is open, see lock.go
+	lockFile *os.File
+	// the generation of the metadata last written, see metadata.go
+	metaGeneration uint64
+	// the position headTime was last worked out for
+	headFileNum int64
+	headPos     int64
+	// whether the queue was closed cleanly and hasn't been written to
+	// since, persisted with the metadata
+	clean bool
+
+	// activity since the last sync, as seen by syncPolicy
+	writesSinceSync int64
+	readsSinceSync  int64
+	bytesSinceSync  int64
+	lastSync        time.Time
+
 	// keeps track of the position where we have read
 	// (but not yet sent over readChan)
 	nextReadPos     int64
 	nextReadFileNum int64
 
+	// keeps track of the position that has been read and committed,
+	// this is what is persisted and where reading resumes after a crash
+	commitReadPos     int64
+	commitReadFileNum int64
+	uncommittedReads  int64
+	lastCommit        time.Time
+	commitEvery       int64         // number of reads per commit
+	commitInterval    time.Duration // duration of time per commit
+	manualCommit      bool          // only commit when asked to
+
+	// named cursors (see NewCursor) and the first data file still on
+	// disk, which may precede commitReadFileNum for their sake or for
+	// replay (see WithReplayRetention)
+	cursors      map[string]*cursor
+	firstFileNum int64
+	// the queue's own reader is unused and follows the slowest cursor,
+	// see Topic
+	readerless bool
+	// the batch of messages on its way to another queue, see MoveTo
+	move *pendingMove
+	// the last batch moved to the queue by each queue moving messages to
+	// it, by dataPath and name
+	movesIn map[string]*incomingMove
+
+	// see WithSparseIndex, the write file's index is kept in memory
+	indexEvery        int64
+	writeIndex        []indexEntry
+	writeIndexFileNum int64
+	writeIndexUndated bool
+	encodedTimestamp  time.Time // of the message last encoded, if any
+
+	// see WithRotateInterval and WithRotateCount
+	rotateInterval time.Duration
+	rotateCount    int64
+
+	// see OnFileCreate, OnFileRotate, OnFileDelete, OnBadFile and OnSync
+	onFileCreate func(fileName string)
+	onFileRotate func(fileName string)
+	onFileDelete func(fileName string)
+	onBadFile    func(fileName string)
+	onSync       func(latency time.Duration)
+	hooks        *hookQueue
+
+	// see WithReplayRetention
+	retain      bool
+	retainAge   time.Duration
+	retainBytes int64
+
+	// see WithBadFileRetention
+	badRetain      bool
+	badRetainAge   time.Duration
+	badRetainBytes int64
+
+	// see OnDepthAbove and OnDepthBelow
+	watermarks []watermark
+
+	// see WithTelemetry
+	telemetry telemetry
+
+	// see Manager
+	manager       *Manager
+	reportedBytes int64
+
+	// see WithReadBuffer, readSeq counts the messages read
+	readBufferSize int
+	bufferedReads  []bufferedRead
+	readSeq        int64
+
+	// see WithOwnedReads
+	ownedReads bool
+
+	// where the last frame written by writeFrame starts, see PutPosition
+	lastWrite Position
+
+	// recently delivered messages, see WithDeliveryLedger
+	ledgerSize   int
+	ledger       *deliveryLedger
+	onRedelivery func([]byte) bool
+
+	// recently written messages, see WithDedup
+	dedupSize   int
+	dedupReject bool
+	dedup       *deliveryLedger
+
+	// messages written with PutDelayed that are not due yet
+	delayed     delayedHeap
+	delayedFile *os.File
+
+	// messages read from ReadInFlightChan that aren't finished yet, see
+	// WithInFlight
+	inFlightTimeout time.Duration
+	maxAttempts     int
+	inFlight        map[uint64]*inFlightEntry
+	inFlightOrder   []*inFlightEntry // by due time
+	inFlightSeq     uint64
+	inFlightDone    int // finished since the journal was last rewritten
+	inFlightFile    *os.File
+
+	// messages salvaged from bad files, see WithDeadLetterQueue
+	deadLetters bool
+	dlq         *diskQueue
+
+	// where data files and metadata are mirrored to, see WithMirror
+	mirrorPath string
+
 	readFile  *os.File
-	writeFile *os.File
-	reader    *bufio.Reader
-	writeBuf  bytes.Buffer
+	writeFile writeHandle
+	// append through a memory mapping of the write file, see WithMmapWrites
+	mmapWrites bool
+	// open the write file with O_APPEND, see WithAppendWrites
+	appendWrites bool
+	// bypass the page cache when writing, see WithDirectIO
+	directIO bool
+	// reserve the space of new data files up front, see WithPreallocate
+	preallocate bool
+	// fsync dataPath after creating and renaming files, see WithDirSync
+	dirSync bool
+	// check the persisted positions on startup, see WithStartupScan
+	startupScan bool
+	// see WithFileRecycling
+	recycleFiles int
+	spareFiles   []string
+	nextSpare    int64
+	// close off rolled files with a footer, see WithSegmentFooters
+	segmentFooters bool
+	writeFileCount int64
+	writeFileCRC   uint32
+	reader         *bufio.Reader
+	writeBuf       bytes.Buffer
+
+	// the format data files are created in and that of the read and
+	// write files, see WithFileFormat
+	fileFormat  int
+	readHeader  fileHeader
+	writeHeader fileHeader
 
-	// exposed via ReadChan()
-	readChan chan []byte
+	// packed frames accepted (and included in writePos) but not yet written,
+	// see WithBlockPacking and WithWriteBuffer
+	pendingWrite    bytes.Buffer
+	pendingMsgs     int64
+	writeBufferSize int64
+
+	// Puts written together and how many of them are still to be
+	// answered, see gatherWrites
+	writeGroup     [][]byte
+	inFlightWrites int
+
+	// the data of the transaction frame being written and the messages
+	// of the one being read, see PutTransaction
+	txnBuf  []byte
+	readTxn pendingTxn
+
+	// a buffer read by readOne but handed back by ReadInto, reused by the next readOne
+	spareReadBuf []byte
+	// buffers handed back once a ReadWith callback is done with them
+	readBufPool bufPool
+	// when the message currently pending delivery was read from disk
+	readReadyTime time.Time
+	// the envelope metadata of the message currently pending delivery
+	readTimestamp time.Time
+	readHeaders   map[string]string
+	// how many times it was delivered from ReadInFlightChan, which isn't
+	// part of readHeaders
+	readAttempts int
+	// the size of its frame (padding included), see DepthBytes
+	readFrameSize int64
+	// the frame at readPos failed to read but its bounds are known, see
+	// skipCorruptRecord
+	readIntact       bool
+	readCorruptCount int64
+
+	// the next read file being opened in the background, see WithReadPreopen
+	preopen          bool
+	preopenReadahead int64
+	preopenFileNum   int64
+	preopenChan      chan preopenResult
+
+	// exposed via ReadChan() and ReadMessageChan()
+	readChan        chan []byte
+	readMessageChan chan Message
+
+	// see ReadEnvelopeChan, envelopes is set once it has been called so
+	// that they're only allocated if used
+	readEnvelopeChan chan *Envelope
+	envelopes        int32
+	envelopesChan    chan int
+
+	// see WithInFlight
+	readInFlightChan   chan *InFlight
+	finishChan         chan uint64
+	finishResponseChan chan error
 
 	// internal channels
-	writeChan         chan []byte
-	writeResponseChan chan error
-	emptyChan         chan int
-	emptyResponseChan chan error
-	exitChan          chan int
-	exitSyncChan      chan int
+	writeChan              chan []byte
+	writeReaderChan        chan readerWrite
+	writeDurableChan       chan []byte
+	writeManyChan          chan [][]byte
+	writeMessageChan       chan Message
+	writeTxnChan           chan [][]byte
+	writeDelayedChan       chan delayedWrite
+	writeResponseChan      chan error
+	putPosChan             chan []byte
+	putPosResponseChan     chan putPosResult
+	readIntoChan           chan []byte
+	readIntoResponseChan   chan readIntoResult
+	readWithChan           chan []byte
+	emptyChan              chan int
+	emptyToChan            chan Position
+	emptyResponseChan      chan error
+	checkpointChan         chan int
+	checkpointResponseChan chan []byte
+	seekChan               chan []byte
+	seekTimeChan           chan time.Time
+	fastBackwardChan       chan func([]byte) int
+	seekResponseChan       chan error
+	commitChan             chan []byte
+	commitResponseChan     chan error
+	trimChan               chan time.Time
+	trimResponseChan       chan trimResult
+	rewindChan             chan int64
+	skipChan               chan int64
+	trimDepthChan          chan int64
+	recoverChan            chan string
+	deleteWhereChan        chan func([]byte) bool
+	moveChan               chan moveRequest
+	moveEndChan            chan int
+	moveResponseChan       chan moveResult
+	moveInChan             chan moveInRequest
+	compactChan            chan int
+	barrierChan            chan int
+	barrierResponseChan    chan error
+	closingChan            chan int
+	exitChan               chan int
+	exitSyncChan           chan int
+
+	// see NewCursor
+	cursorOpenChan          chan string
+	cursorOpenResponseChan  chan cursorOpenResult
+	cursorReadChan          chan cursorRequest
+	cursorCloseChan         chan cursorRequest
+	cursorCloseResponseChan chan error
+
+	// see FailoverTo
+	failoverChan         chan string
+	failoverResponseChan chan error
+
+	// see Snapshot
+	snapshotChan         chan string
+	snapshotResponseChan chan error
+
+	// see SpliceFrom
+	spliceChan         chan spliceRequest
+	spliceResponseChan chan error
+
+	// see ReadBatch
+	readBatchChan         chan int
+	readBatchResponseChan chan readBatchResult
+
+	// see Reconfigure
+	reconfigureChan         chan []Option
+	reconfigureResponseChan chan error
+
+	// see FastForward
+	fastForwardChan         chan fastForwardRequest
+	fastForwardResponseChan chan fastForwardResult
+
+	// see Scan and Export
+	scanChan         chan *scanRequest
+	scanResponseChan chan error
+
+	// see Stats
+	statsChan         chan int
+	statsResponseChan chan Stats
 
-	logf AppLogFunc
+	// see Verify
+	verifyChan         chan int
+	verifyResponseChan chan verifyResult
+
+	logf    AppLogFunc
+	slogger *slog.Logger
 }
 
-// New instantiates an instance of diskQueue, retrieving metadata
-// from the filesystem and starting the read ahead goroutine
-func New(name string, dataPath string, maxBytesPerFile int64,
-	minMsgSize int32, maxMsgSize int32,
-	syncEvery int64, syncTimeout time.Duration, logf AppLogFunc) Interface {
-	d := diskQueue{
-		name:              name,
-		dataPath:          dataPath,
-		maxBytesPerFile:   maxBytesPerFile,
-		minMsgSize:        minMsgSize,
-		maxMsgSize:        maxMsgSize,
-		readChan:          make(chan []byte),
-		writeChan:         make(chan []byte),
-		writeResponseChan: make(chan error),
-		emptyChan:         make(chan int),
-		emptyResponseChan: make(chan error),
-		exitChan:          make(chan int),
-		exitSyncChan:      make(chan int),
-		syncEvery:         syncEvery,
-		syncTimeout:       syncTimeout,
-		logf:              logf,
+// Option configures optional behavior of a diskQueue created by New
+type Option func(*diskQueue)
+
+// WithMaxBytesPerFile sets the size at which data files are rolled, see NewWithOptions
+func WithMaxBytesPerFile(n int64) Option {
+	return func(d *diskQueue) {
+		d.maxBytesPerFile = n
 	}
+}
 
-	// no need to lock here, nothing else could possibly be touching this instance
-	err := d.retrieveMetaData()
-	if err != nil && !os.IsNotExist(err) {
-		d.logf(ERROR, "DISKQUEUE(%s) failed to retrieveMetaData - %s", d.name, err)
+// WithMsgSize sets the range of accepted message sizes, see NewWithOptions
+func WithMsgSize(min int32, max int32) Option {
+	return func(d *diskQueue) {
+		d.minMsgSize = min
+		d.maxMsgSize = max
 	}
+}
 
-	go d.ioLoop()
-	return &d
+// WithSyncEvery sets the number of operations between syncs of the
+// default SyncPolicy, see NewWithOptions, it can't be combined with
+// WithSyncPolicy
+func WithSyncEvery(n int64) Option {
+	return func(d *diskQueue) {
+		d.syncOptions |= syncThresholdsSet
+		if p, ok := d.syncPolicy.(ThresholdSyncPolicy); ok && d.syncOptions&syncPolicySet == 0 {
+			p.Ops = n
+			d.syncPolicy = p
+		}
+	}
 }
 
-// Depth returns the depth of the queue
-func (d *diskQueue) Depth() int64 {
-	return atomic.LoadInt64(&d.depth)
+// WithSyncTimeout sets the longest time between syncs of the default
+// SyncPolicy, see NewWithOptions, it can't be combined with WithSyncPolicy
+func WithSyncTimeout(t time.Duration) Option {
+	return func(d *diskQueue) {
+		d.syncOptions |= syncThresholdsSet
+		if p, ok := d.syncPolicy.(ThresholdSyncPolicy); ok && d.syncOptions&syncPolicySet == 0 {
+			p.MaxDelay = t
+			d.syncPolicy = p
+		}
+	}
 }
 
-// ReadChan returns the []byte channel for reading data
-func (d *diskQueue) ReadChan() chan []byte {
-	return d.readChan
+// WithLogger sets the function log messages are passed to, see NewWithOptions
+func WithLogger(logf AppLogFunc) Option {
+	return func(d *diskQueue) {
+		d.logf = logf
+	}
 }
 
-// Put writes a []byte to the queue
-func (d *diskQueue) Put(data []byte) error {
-	d.RLock()
-	defer d.RUnlock()
+// WithSlogLogger logs to l rather than the AppLogFunc, with the message's
+// details (the queue's name, file, position, error...) as attributes
+func WithSlogLogger(l *slog.Logger) Option {
+	return func(d *diskQueue) {
+		d.slogger = l
+	}
+}
 
-	if d.exitFlag == 1 {
-		return errors.New("exiting")
+// WithTelemetry traces the queue's slower operations with tracer and
+// reports its activity to counters created with meter, see Tracer and
+// Meter, either can be nil
+func WithTelemetry(tracer Tracer, meter Meter) Option {
+	return func(d *diskQueue) {
+		d.telemetry = newTelemetry(tracer, meter)
 	}
+}
 
-	d.writeChan <- data
-	return <-d.writeResponseChan
+// WithSyncMode sets when writes are fsynced, by default whenever the
+// SyncPolicy says so
+func WithSyncMode(m SyncMode) Option {
+	return func(d *diskQueue) {
+		d.syncMode = m
+	}
 }
 
-// Close cleans up the queue and persists metadata
-func (d *diskQueue) Close() error {
-	err := d.exit(false)
-	if err != nil {
-		return err
+// WithFileFormat sets the format version (1 or 2, see format.go) data files
+// are created in, existing files are read (and written to) in the format
+// they were created in whatever it is set to, version 2 files can't be
+// read by earlier versions of this package
+//
+// version 2 files record the maxBytesPerFile they were created with, which
+// can then be changed between restarts
+func WithFileFormat(version int) Option {
+	return func(d *diskQueue) {
+		d.fileFormat = version
 	}
-	return d.sync()
 }
 
-func (d *diskQueue) Delete() error {
-	return d.exit(true)
+// WithSyncPolicy overrides the syncEvery/syncTimeout policy passed to New,
+// setting thresholds on it with WithSyncEvery or WithSyncTimeout as well
+// is an error whichever comes first (New logs it and keeps p)
+func WithSyncPolicy(p SyncPolicy) Option {
+	return func(d *diskQueue) {
+		d.syncOptions |= syncPolicySet
+		d.syncPolicy = p
+	}
 }
 
-func (d *diskQueue) exit(deleted bool) error {
-	d.Lock()
-	defer d.Unlock()
+// WithReadCommitBatch defers committing the read position until n messages
+// have been read or t has elapsed since the last commit, whichever comes first
+//
+// this keeps metadata writes off the read path at the cost of redelivering
+// up to that many messages after a crash, data files are only removed once
+// the committed read position has moved past them
+func WithReadCommitBatch(n int64, t time.Duration) Option {
+	return func(d *diskQueue) {
+		d.commitEvery = n
+		d.commitInterval = t
+	}
+}
 
-	d.exitFlag = 1
+// WithManualCommit only considers messages consumed once the caller commits
+// a position past them (see Commit), uncommitted messages are redelivered
+// after the queue is reopened
+func WithManualCommit() Option {
+	return func(d *diskQueue) {
+		d.manualCommit = true
+	}
+}
 
-	if deleted {
-		d.logf(INFO, "DISKQUEUE(%s): deleting", d.name)
-	} else {
-		d.logf(INFO, "DISKQUEUE(%s): closing", d.name)
+// WithReadBuffer gives ReadChan a buffer of n messages, so that a fast
+// consumer doesn't wait on ioLoop for each one
+//
+// messages in the buffer are read but not yet committed, on Close those
+// that haven't been received are taken back and read again once the queue
+// is reopened, it can't be used with WithManualCommit
+func WithReadBuffer(n int) Option {
+	return func(d *diskQueue) {
+		d.readBufferSize = n
 	}
+}
 
-	close(d.exitChan)
-	// ensure that ioLoop has exited
-	<-d.exitSyncChan
+// WithOwnedReads hands out each message read in an allocation of its own
+// size, rather than in the buffer it was read into, which may be larger
+// (the buffers of small messages are rounded up to 1KB) and is shared by
+// the messages of a transaction
+//
+// this costs a copy per message, but suits applications that keep messages
+// around, the buffer read into is reused for the next read
+func WithOwnedReads() Option {
+	return func(d *diskQueue) {
+		d.ownedReads = true
+	}
+}
 
-	if d.readFile != nil {
-		d.readFile.Close()
-		d.readFile = nil
+// WithCompression compresses messages of at least threshold bytes with c,
+// each message records whether it was compressed so this can be changed
+// at any time as long as c can still decompress older messages, messages
+// written with PutReader are never compressed
+func WithCompression(c Compressor, threshold int) Option {
+	return func(d *diskQueue) {
+		d.compressor = c
+		d.compressThreshold = threshold
 	}
+}
 
-	if d.writeFile != nil {
-		d.writeFile.Close()
-		d.writeFile = nil
+// WithEncryption encrypts messages (after compressing them, if enabled)
+// with AES-GCM using keys from p, each message records the id of its key
+// so that keys can be rotated without rewriting older data files
+func WithEncryption(p KeyProvider) Option {
+	return func(d *diskQueue) {
+		d.keys = p
 	}
+}
 
-	return nil
+// WithTimestamps stores every message in an envelope recording when it was
+// written, like PutMessage does, rather than only those written with
+// PutMessage, messages written with PutReader never have an envelope
+func WithTimestamps() Option {
+	return func(d *diskQueue) {
+		d.timestamps = true
+	}
 }
 
-// Empty destructively clears out any pending data in the queue
-// by fast forwarding read positions and removing intermediate files
-func (d *diskQueue) Empty() error {
-	d.RLock()
-	defer d.RUnlock()
+// WithMaxBytes limits the total size of the queue's data files to n bytes,
+// policy decides what happens to writes that would exceed it
+//
+// space is only freed once a data file has been read (and committed) in full
+func WithMaxBytes(n int64, policy OverflowPolicy) Option {
+	return func(d *diskQueue) {
+		d.maxBytes = n
+		d.overflowPolicy = policy
+	}
+}
 
-	if d.exitFlag == 1 {
-		return errors.New("exiting")
+// WithReplayRetention keeps data files once they have been read in full,
+// rather than removing them right away, so that Rewind, SeekTo or
+// SeekToTime can replay their messages
+//
+// files are removed once last modified more than maxAge ago or, oldest
+// first, when the files kept exceed maxBytes, a limit of 0 doesn't apply,
+// they are also removed when writes need their space, see WithMaxBytes
+func WithReplayRetention(maxAge time.Duration, maxBytes int64) Option {
+	return func(d *diskQueue) {
+		d.retain = true
+		d.retainAge = maxAge
+		d.retainBytes = maxBytes
 	}
+}
 
-	d.logf(INFO, "DISKQUEUE(%s): emptying", d.name)
+// WithBadFileRetention removes the data files renamed to .bad after they
+// failed to read (see CorruptionHandler) once last modified more than
+// maxAge ago or, oldest first, when those kept exceed maxBytes, a limit of
+// 0 doesn't apply, without it they're kept until removed by hand
+func WithBadFileRetention(maxAge time.Duration, maxBytes int64) Option {
+	return func(d *diskQueue) {
+		d.badRetain = true
+		d.badRetainAge = maxAge
+		d.badRetainBytes = maxBytes
+	}
+}
 
-	d.emptyChan <- 1
-	return <-d.emptyResponseChan
+// WithSparseIndex writes an index alongside every data file with an entry
+// every n messages, which Skip, Rewind and SeekToTime use to jump ahead
+// within a data file rather than reading every message from its start
+func WithSparseIndex(n int64) Option {
+	return func(d *diskQueue) {
+		d.indexEvery = n
+	}
 }
 
-func (d *diskQueue) deleteAllFiles() error {
-	err := d.skipToNextRWFile()
+// WithDeadLetterQueue moves the messages that can still be read from a data
+// file found to be corrupt into a companion queue named name + ".dlq", see
+// DeadLetterQueue, rather than skipping the whole file
+func WithDeadLetterQueue() Option {
+	return func(d *diskQueue) {
+		d.deadLetters = true
+	}
+}
 
-	innerErr := os.Remove(d.metaDataFileName())
-	if innerErr != nil && !os.IsNotExist(innerErr) {
-		d.logf(ERROR, "DISKQUEUE(%s) failed to remove metadata file - %s", d.name, innerErr)
-		return innerErr
+// WithMirror also appends every write to a copy of the queue's data files
+// in dataPath, along with its metadata, so that the queue can carry on from
+// there with FailoverTo should its own dataPath be lost
+//
+// writes fail unless they make it to both, data files found to differ from
+// their copy on startup are copied over, the delivery ledger and
+// dedup window are not mirrored
+func WithMirror(dataPath string) Option {
+	return func(d *diskQueue) {
+		d.mirrorPath = dataPath
 	}
+}
 
-	return err
+// WithChecksumHandler passes messages that fail their checksum (see
+// WithFrameTrailer) to h instead of treating them like any other read error,
+// which skips the rest of the data file, h returns true for the message to
+// be delivered anyway or false for it to be dropped
+func WithChecksumHandler(h func(data []byte, err error) bool) Option {
+	return func(d *diskQueue) {
+		d.checksumHandler = h
+	}
 }
 
-func (d *diskQueue) skipToNextRWFile() error {
-	var err error
+// WithCorruptionHandler has h decide what happens when a message fails to
+// read (see CorruptionHandler) rather than renaming the data file to .bad
+// and skipping the rest of it, WithChecksumHandler still takes precedence
+// for messages that fail their checksum
+func WithCorruptionHandler(h CorruptionHandler) Option {
+	return func(d *diskQueue) {
+		d.corruptionHandler = h
+	}
+}
 
-	if d.readFile != nil {
-		d.readFile.Close()
-		d.readFile = nil
+// WithFrameTrailer appends a CRC32-C and a copy of the size to every message
+// written, which is verified on read and allows data files to be scanned
+// backwards, this must be set consistently every time a queue is opened
+func WithFrameTrailer() Option {
+	return func(d *diskQueue) {
+		d.frameTrailer = true
 	}
+}
 
-	if d.writeFile != nil {
-		d.writeFile.Close()
-		d.writeFile = nil
+// WithFairAdmission hands writes to ioLoop strictly in the order Put
+// (and friends) were called so that a goroutine calling Put in a tight
+// loop cannot starve other producers
+func WithFairAdmission() Option {
+	return func(d *diskQueue) {
+		d.writeGate = &fifoGate{}
 	}
+}
 
-	for i := d.readFileNum; i <= d.writeFileNum; i++ {
-		fn := d.fileName(i)
-		innerErr := os.Remove(fn)
-		if innerErr != nil && !os.IsNotExist(innerErr) {
-			d.logf(ERROR, "DISKQUEUE(%s) failed to remove data file - %s", d.name, innerErr)
-			err = innerErr
-		}
+// WithBlockPacking packs messages into blockSize aligned blocks, written to
+// the data file as a single unit once full (or when the data is needed by
+// a reader, a sync or a file roll)
+//
+// a message that does not fit in the remainder of a block is moved to the
+// start of the next one, maxBytesPerFile must be a multiple of blockSize and
+// this must be set consistently every time a queue is opened
+func WithBlockPacking(blockSize int64) Option {
+	return func(d *diskQueue) {
+		d.blockSize = blockSize
 	}
+}
 
-	d.writeFileNum++
-	d.writePos = 0
-	d.readFileNum = d.writeFileNum
-	d.readPos = 0
-	d.nextReadFileNum = d.writeFileNum
-	d.nextReadPos = 0
-	atomic.StoreInt64(&d.depth, 0)
+// WithWriteBuffer buffers frames in memory until size bytes are pending,
+// a sync, a file roll or a reader catching up with them, so that small
+// messages don't cost a write each, it can't be combined with
+// WithBlockPacking (which buffers whole blocks)
+//
+// a failed write of the buffer drops the messages in it from the queue
+// although their Put succeeded, see SyncAlways for acknowledged writes
+func WithWriteBuffer(size int64) Option {
+	return func(d *diskQueue) {
+		d.writeBufferSize = size
+	}
+}
 
-	return err
+// WithReadPreopen opens the next data file in the background once the
+// reader nears the end of the current one so that rolling over to it
+// doesn't add latency, its header and first readahead bytes are also read
+// in the background for the reader to start off from
+func WithReadPreopen(readahead int64) Option {
+	return func(d *diskQueue) {
+		d.preopen = true
+		d.preopenReadahead = readahead
+	}
 }
 
-// readOne performs a low level filesystem read for a single []byte
-// while advancing read positions and rolling files, if necessary
-func (d *diskQueue) readOne() ([]byte, error) {
-	var err error
-	var msgSize int32
+// WithMmapWrites appends frames to a memory mapping of a preallocated
+// write file instead of issuing a write syscall per message, the mapping
+// is msynced whenever the SyncPolicy calls for a sync, platforms without
+// mmap support fall back to regular writes
+func WithMmapWrites() Option {
+	return func(d *diskQueue) {
+		d.mmapWrites = true
+	}
+}
 
-	if d.readFile == nil {
-		curFileName := d.fileName(d.readFileNum)
-		d.readFile, err = os.OpenFile(curFileName, os.O_RDONLY, 0600)
-		if err != nil {
-			return nil, err
-		}
+// WithDirectIO writes data files with O_DIRECT, bypassing the page cache so
+// that a queue moving a lot of data doesn't crowd out the page cache of
+// the rest of the host, it can't be combined with WithAppendWrites or
+// WithMmapWrites
+//
+// where O_DIRECT isn't supported (by the platform or the file system) the
+// queue falls back to regular writes
+func WithDirectIO() Option {
+	return func(d *diskQueue) {
+		d.directIO = true
+	}
+}
 
-		d.logf(INFO, "DISKQUEUE(%s): readOne() opened %s", d.name, curFileName)
+// WithStartupScan checks on startup that the persisted read and write
+// positions are where a message ends (or the next one starts), moving them
+// back to the closest one before if they aren't, and counts the depth
+// rather than trusting the persisted one, which takes reading the unread
+// data files (save for those with a footer, see WithSegmentFooters), it is
+// skipped if the queue was closed cleanly and hasn't been written to since
+func WithStartupScan() Option {
+	return func(d *diskQueue) {
+		d.startupScan = true
+	}
+}
 
-		if d.readPos > 0 {
-			_, err = d.readFile.Seek(d.readPos, 0)
-			if err != nil {
-				d.readFile.Close()
-				d.readFile = nil
-				return nil, err
-			}
-		}
+// WithDirSync decides whether the directories of the queue are fsynced
+// after the metadata file is renamed into place (when it's fsynced itself,
+// see SyncMode) and after a data file is created, so that both survive a
+// power loss, it's on by default on Linux only
+func WithDirSync(enabled bool) Option {
+	return func(d *diskQueue) {
+		d.dirSync = enabled
+	}
+}
 
-		d.reader = bufio.NewReader(d.readFile)
+// WithPreallocate reserves the disk space of a full data file
+// (fallocate/F_PREALLOCATE) when it is created, so that it is laid out in
+// one piece and running out of space is more likely to show when a file is
+// created than halfway through writing it, what's left unused is given
+// back once the file is complete
+//
+// the size of data files still goes by what was written, platforms other
+// than Linux and macOS, filesystems that don't support it and mmap writes
+// (see WithMmapWrites) don't preallocate
+func WithPreallocate() Option {
+	return func(d *diskQueue) {
+		d.preallocate = true
 	}
+}
 
-	err = binary.Read(d.reader, binary.BigEndian, &msgSize)
-	if err != nil {
-		d.readFile.Close()
-		d.readFile = nil
-		return nil, err
+// WithFileRecycling keeps up to n data files that have been read as spares,
+// emptied (and preallocated, see WithPreallocate), to be renamed into place
+// as new data files, rather than removing them and creating new ones
+func WithFileRecycling(n int) Option {
+	return func(d *diskQueue) {
+		d.recycleFiles = n
 	}
+}
 
-	if msgSize < d.minMsgSize || msgSize > d.maxMsgSize {
-		// this file is corrupt and we have no reasonable guarantee on
-		// where a new message should begin
-		d.readFile.Close()
-		d.readFile = nil
-		return nil, fmt.Errorf("invalid message read size (%d)", msgSize)
+// WithAppendWrites opens the write file with O_APPEND so that data files
+// only ever grow by whole writes, making them safe to follow with external
+// tail tools, writePos is derived from the size of the write file on
+// startup rather than trusted from metadata, it can't be combined with
+// WithMmapWrites
+func WithAppendWrites() Option {
+	return func(d *diskQueue) {
+		d.appendWrites = true
 	}
+}
 
-	readBuf := make([]byte, msgSize)
-	_, err = io.ReadFull(d.reader, readBuf)
-	if err != nil {
-		d.readFile.Close()
-		d.readFile = nil
-		return nil, err
+// WithSegmentFooters writes a footer recording the message count and byte
+// span of each data file when it rolls, so that counting the messages in
+// full files (e.g. when seeking to a checkpoint) doesn't have to read every
+// frame
+func WithSegmentFooters() Option {
+	return func(d *diskQueue) {
+		d.segmentFooters = true
+	}
+}
+
+// WithDeliveryLedger keeps a persistent record of the last size messages
+// delivered so that messages redelivered after a crash rewinds the read
+// position (see WithReadCommitBatch) can be detected, size should be
+// larger than the number of messages that can be redelivered
+//
+// onRedelivery is called with such a message and decides whether it is
+// delivered again (true) or skipped (false), a nil func skips every one
+func WithDeliveryLedger(size int, onRedelivery func(data []byte) bool) Option {
+	return func(d *diskQueue) {
+		d.ledgerSize = size
+		d.onRedelivery = onRedelivery
+	}
+}
+
+// WithDedup keeps a persistent record of the contents of the last size
+// messages written with Put (and PutContext, TryPut and PutTimeout), and
+// drops a message with the same contents as one of them, or rejects it
+// with ErrDuplicate if reject is set, for producers that retry a Put that
+// timed out without knowing whether it was written
+//
+// messages are told apart by a 64-bit hash of their contents, Puts are no
+// longer grouped into a single write (see gatherWrites)
+func WithDedup(size int, reject bool) Option {
+	return func(d *diskQueue) {
+		d.dedupSize = size
+		d.dedupReject = reject
+	}
+}
+
+// WithInFlight has messages read from ReadInFlightChan put back on the
+// queue (after the last message) unless they're finished (see
+// InFlight.Finish) within timeout, turning the queue into a work queue
+// whose consumers may fail
+//
+// the messages in flight are kept in a journal, those still in flight when
+// the queue is closed (or crashes) are put back on the queue once it's
+// reopened, so a message may be delivered more than once, messages in
+// flight don't count towards Depth
+func WithInFlight(timeout time.Duration) Option {
+	return func(d *diskQueue) {
+		d.inFlightTimeout = timeout
+	}
+}
+
+// WithMaxAttempts moves a message read from ReadInFlightChan (see
+// WithInFlight) to the dead letter queue (see WithDeadLetterQueue, which
+// is required) rather than putting it back on the queue once it has been
+// delivered n times without being finished
+//
+// the number of attempts is kept in the message's envelope, see
+// InFlight.Attempts, it isn't part of the headers of the message read from
+// the queue (whichever way) or moved to the dead letter queue
+func WithMaxAttempts(n int) Option {
+	return func(d *diskQueue) {
+		d.maxAttempts = n
+	}
+}
+
+// WithRotateInterval also rolls to a new data file at every multiple of
+// interval since the zero time (e.g. on the hour for time.Hour, in UTC),
+// unless nothing was written to the write file since, so that each file
+// holds the messages of one interval and is removed (see
+// WithReplayRetention) or indexed (see WithSparseIndex) as such
+//
+// a write file last written before the current interval started is rolled
+// when the queue is opened
+func WithRotateInterval(interval time.Duration) Option {
+	return func(d *diskQueue) {
+		d.rotateInterval = interval
+	}
+}
+
+// WithRotateCount also rolls to a new data file once n messages were
+// written to the write file, a transaction counts as its messages and
+// isn't split across files so a file may hold more than n
+func WithRotateCount(n int64) Option {
+	return func(d *diskQueue) {
+		d.rotateCount = n
+	}
+}
+
+// OnDepthAbove calls fn with the depth once it goes above n, it isn't
+// called again until depth has dropped back to n or below, a queue that
+// starts out above n calls it right away
+//
+// fn is called from ioLoop and must not call into the queue, it's meant
+// to e.g. tell producers to hold back until a func set with OnDepthBelow
+// is called
+func OnDepthAbove(n int64, fn func(depth int64)) Option {
+	return func(d *diskQueue) {
+		d.watermarks = append(d.watermarks, watermark{n: n, above: true, fn: fn})
+	}
+}
+
+// OnDepthBelow calls fn with the depth once it drops below n, it isn't
+// called again until depth has gone back up to n or above, a queue that
+// starts out below n calls it right away
+//
+// fn is called from ioLoop and must not call into the queue
+func OnDepthBelow(n int64, fn func(depth int64)) Option {
+	return func(d *diskQueue) {
+		d.watermarks = append(d.watermarks, watermark{n: n, fn: fn})
+	}
+}
+
+// OnFileCreate calls fn with the name of each data file created
+//
+// fn (like the funcs set with OnFileRotate, OnFileDelete, OnBadFile and
+// OnSync) is called from a goroutine of its own rather than from ioLoop,
+// one event at a time and in the order they happened, so it may take its
+// time or call into the queue, the events that happen in the meantime are
+// queued, those of closing the queue (e.g. its final sync) included, and
+// still handled after Close (or Delete) returns
+func OnFileCreate(fn func(fileName string)) Option {
+	return func(d *diskQueue) {
+		d.onFileCreate = fn
+	}
+}
+
+// OnFileRotate calls fn with the name of each data file closed off for the
+// next one, which is synced and no longer written to, e.g. for it to be
+// archived, see OnFileCreate
+func OnFileRotate(fn func(fileName string)) Option {
+	return func(d *diskQueue) {
+		d.onFileRotate = fn
+	}
+}
+
+// OnFileDelete calls fn with the name of each data file removed (or kept
+// as a spare, see WithFileRecycling) once read, skipped or emptied, see
+// OnFileCreate
+func OnFileDelete(fn func(fileName string)) Option {
+	return func(d *diskQueue) {
+		d.onFileDelete = fn
+	}
+}
+
+// OnBadFile calls fn with the name a data file that failed to read was
+// renamed (or quarantined) to, see OnFileCreate
+func OnBadFile(fn func(fileName string)) Option {
+	return func(d *diskQueue) {
+		d.onBadFile = fn
+	}
+}
+
+// OnSync calls fn with how long each sync of the data and metadata files
+// took, see OnFileCreate
+func OnSync(fn func(latency time.Duration)) Option {
+	return func(d *diskQueue) {
+		d.onSync = fn
+	}
+}
+
+// New instantiates an instance of diskQueue, retrieving metadata
+// from the filesystem and starting the read ahead goroutine
+//
+// a queue already open elsewhere (see lock.go) fails every request with
+// the error also returned by LastError
+func New(name string, dataPath string, maxBytesPerFile int64,
+	minMsgSize int32, maxMsgSize int32,
+	syncEvery int64, syncTimeout time.Duration, logf AppLogFunc,
+	opts ...Option) Interface {
+	d := newDiskQueue(name, dataPath, maxBytesPerFile, minMsgSize, maxMsgSize, logf)
+	d.syncPolicy = ThresholdSyncPolicy{Ops: syncEvery, MaxDelay: syncTimeout}
+
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	if d.blockSize > 0 && d.maxBytesPerFile%d.blockSize != 0 {
+		d.log(ERROR, "maxBytesPerFile is not a multiple of blockSize, disabling block packing",
+			"maxBytesPerFile", d.maxBytesPerFile, "blockSize", d.blockSize)
+		d.blockSize = 0
+	}
+
+	if d.appendWrites && d.mmapWrites {
+		d.log(ERROR, "mmap writes can't be used in append mode, disabling mmap writes")
+		d.mmapWrites = false
+	}
+
+	if d.directIO && (d.appendWrites || d.mmapWrites) {
+		d.log(ERROR, "direct I/O can't be used with append mode or mmap writes, disabling direct I/O")
+		d.directIO = false
+	}
+
+	// leave room for the envelope and encryption in the frame's size, the
+	// bits above it hold the frame's flags
+	if maxSize := int32(frameMaxSize - envelopeMaxOverhead - encryptionOverhead); d.maxMsgSize > maxSize {
+		d.log(ERROR, "maxMsgSize is too large for a frame, lowering it",
+			"maxMsgSize", d.maxMsgSize, "max", maxSize)
+		d.maxMsgSize = maxSize
+	}
+
+	if err := d.checkSyncOptions(); err != nil {
+		d.log(ERROR, "ignoring WithSyncEvery and WithSyncTimeout in favour of WithSyncPolicy")
+	}
+
+	if d.fileFormat != fileFormatV1 && d.fileFormat != fileFormatV2 {
+		d.log(ERROR, "unsupported file format, using version 1")
+		d.fileFormat = fileFormatV1
+	}
+
+	if d.writeBufferSize > 0 && d.blockSize > 0 {
+		d.log(ERROR, "a write buffer can't be used with block packing, disabling the write buffer")
+		d.writeBufferSize = 0
+	}
+
+	d.start()
+	return d
+}
+
+// NewWithSlog is New but logs to logger, see WithSlogLogger
+func NewWithSlog(name string, dataPath string, maxBytesPerFile int64,
+	minMsgSize int32, maxMsgSize int32,
+	syncEvery int64, syncTimeout time.Duration, logger *slog.Logger,
+	opts ...Option) Interface {
+	return New(name, dataPath, maxBytesPerFile, minMsgSize, maxMsgSize,
+		syncEvery, syncTimeout, nil, append([]Option{WithSlogLogger(logger)}, opts...)...)
+}
+
+const (
+	defaultMaxBytesPerFile = 100 * 1024 * 1024
+	defaultMaxMsgSize      = 1024 * 1024
+	defaultSyncEvery       = 2500
+	defaultSyncTimeout     = 2 * time.Second
+)
+
+// NewWithOptions instantiates an instance of diskQueue like New, taking
+// its settings from opts (see WithMaxBytesPerFile, WithMsgSize, WithSyncEvery,
+// WithSyncTimeout and WithLogger) on top of defaults
+//
+// unlike New the settings are validated, an error is returned rather than
+// a queue being created with settings that make no sense
+func NewWithOptions(name string, dataPath string, opts ...Option) (Interface, error) {
+	d := newDiskQueue(name, dataPath, defaultMaxBytesPerFile, 0, defaultMaxMsgSize,
+		func(LogLevel, string, ...interface{}) {})
+	d.syncPolicy = ThresholdSyncPolicy{Ops: defaultSyncEvery, MaxDelay: defaultSyncTimeout}
+
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	err := d.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.start()
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// validate checks that the queue's settings are consistent
+func (d *diskQueue) validate() error {
+	if d.name == "" {
+		return errors.New("name must not be empty")
+	}
+	stat, err := os.Stat(d.dataPath)
+	if err != nil {
+		return err
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("dataPath %s is not a directory", d.dataPath)
+	}
+	if d.logf == nil && d.slogger == nil {
+		return errors.New("logger must not be nil")
+	}
+	err = d.validateLimits()
+	if err != nil {
+		return err
+	}
+	if d.appendWrites && d.mmapWrites {
+		return errors.New("mmap writes can't be used in append mode")
+	}
+	if d.directIO && (d.appendWrites || d.mmapWrites) {
+		return errors.New("direct I/O can't be used with append mode or mmap writes")
+	}
+	if d.writeBufferSize < 0 || (d.writeBufferSize > 0 && d.blockSize > 0) {
+		return fmt.Errorf("invalid write buffer size (%d), it can't be used with block packing", d.writeBufferSize)
+	}
+	if d.commitEvery < 0 || d.commitInterval < 0 {
+		return fmt.Errorf("invalid read commit batch (%d, %s)", d.commitEvery, d.commitInterval)
+	}
+	if d.readBufferSize < 0 || (d.readBufferSize > 0 && d.manualCommit) {
+		return fmt.Errorf("invalid read buffer size (%d), it can't be used with manual commits", d.readBufferSize)
+	}
+	if d.readerless && (d.manualCommit || d.readBufferSize > 0) {
+		return errors.New("a Topic can't use manual commits or a read buffer")
+	}
+	if d.overflowPolicy < OverflowReject || d.overflowPolicy > OverflowDropOldest {
+		return fmt.Errorf("invalid overflow policy (%d)", d.overflowPolicy)
+	}
+	for _, w := range d.watermarks {
+		if w.fn == nil {
+			return fmt.Errorf("nil func for depth watermark (%d)", w.n)
+		}
+	}
+	if d.ledgerSize < 0 {
+		return fmt.Errorf("delivery ledger size (%d) must not be negative", d.ledgerSize)
+	}
+	if d.dedupSize < 0 {
+		return fmt.Errorf("dedup window size (%d) must not be negative", d.dedupSize)
+	}
+	if d.inFlightTimeout < 0 {
+		return fmt.Errorf("in flight timeout (%s) must not be negative", d.inFlightTimeout)
+	}
+	if d.maxAttempts < 0 || (d.maxAttempts > 0 && (d.inFlightTimeout == 0 || !d.deadLetters)) {
+		return fmt.Errorf("invalid max attempts (%d), it requires WithInFlight and WithDeadLetterQueue", d.maxAttempts)
+	}
+	if d.recycleFiles < 0 {
+		return fmt.Errorf("number of spare files (%d) must not be negative", d.recycleFiles)
+	}
+	if d.indexEvery < 0 {
+		return fmt.Errorf("sparse index interval (%d) must not be negative", d.indexEvery)
+	}
+	if d.rotateInterval < 0 || d.rotateCount < 0 {
+		return fmt.Errorf("invalid rotation (%s, %d)", d.rotateInterval, d.rotateCount)
+	}
+	if d.retainAge < 0 || d.retainBytes < 0 {
+		return fmt.Errorf("invalid replay retention (%s, %d)", d.retainAge, d.retainBytes)
+	}
+	if d.badRetainAge < 0 || d.badRetainBytes < 0 {
+		return fmt.Errorf("invalid bad file retention (%s, %d)", d.badRetainAge, d.badRetainBytes)
+	}
+	if d.syncMode < SyncDefault || d.syncMode > SyncNever {
+		return fmt.Errorf("invalid sync mode (%d)", d.syncMode)
+	}
+	if d.fileFormat != fileFormatV1 && d.fileFormat != fileFormatV2 {
+		return errors.New("file format version must be 1 or 2")
+	}
+	if d.mirrorPath != "" {
+		stat, err := os.Stat(d.mirrorPath)
+		if err != nil {
+			return err
+		}
+		if !stat.IsDir() {
+			return fmt.Errorf("mirror %s is not a directory", d.mirrorPath)
+		}
+		if path.Clean(d.mirrorPath) == path.Clean(d.dataPath) {
+			return errors.New("mirror must not be the queue's dataPath")
+		}
+	}
+	return nil
+}
+
+// validateLimits checks the settings that can also change on a running
+// queue, see Reconfigure
+func (d *diskQueue) validateLimits() error {
+	if d.maxBytesPerFile <= 0 {
+		return fmt.Errorf("maxBytesPerFile (%d) must be positive", d.maxBytesPerFile)
+	}
+	if d.minMsgSize < 0 || d.maxMsgSize <= 0 || d.minMsgSize > d.maxMsgSize {
+		return fmt.Errorf("invalid message size range (%d - %d)", d.minMsgSize, d.maxMsgSize)
+	}
+	if d.syncPolicy == nil {
+		return errors.New("syncPolicy must not be nil")
+	}
+	if err := d.checkSyncOptions(); err != nil {
+		return err
+	}
+	if p, ok := d.syncPolicy.(ThresholdSyncPolicy); ok {
+		if p.Ops < 0 || p.Bytes < 0 || p.MaxDelay < 0 {
+			return fmt.Errorf("invalid sync thresholds (%d ops, %d bytes, %s)", p.Ops, p.Bytes, p.MaxDelay)
+		}
+	}
+	// leave room for the envelope and encryption in the frame's size
+	if maxSize := int32(frameMaxSize - envelopeMaxOverhead - encryptionOverhead); d.maxMsgSize > maxSize {
+		return fmt.Errorf("maxMsgSize (%d) must not exceed %d", d.maxMsgSize, maxSize)
+	}
+	if d.blockSize < 0 || (d.blockSize > 0 && d.maxBytesPerFile%d.blockSize != 0) {
+		return fmt.Errorf("maxBytesPerFile (%d) is not a multiple of blockSize (%d)",
+			d.maxBytesPerFile, d.blockSize)
+	}
+	if d.maxBytes < 0 || (d.maxBytes > 0 && d.maxBytes < d.maxBytesPerFile) {
+		return fmt.Errorf("maxBytes (%d) must be at least maxBytesPerFile (%d)", d.maxBytes, d.maxBytesPerFile)
+	}
+	return nil
+}
+
+func newDiskQueue(name string, dataPath string, maxBytesPerFile int64,
+	minMsgSize int32, maxMsgSize int32, logf AppLogFunc) *diskQueue {
+	return &diskQueue{
+		name:                   name,
+		dataPath:               dataPath,
+		maxBytesPerFile:        maxBytesPerFile,
+		minMsgSize:             minMsgSize,
+		maxMsgSize:             maxMsgSize,
+		fileFormat:             fileFormatV1,
+		dirSync:                runtime.GOOS == "linux",
+		readChan:               make(chan []byte),
+		readMessageChan:        make(chan Message),
+		readEnvelopeChan:       make(chan *Envelope),
+		envelopesChan:          make(chan int, 1),
+		readInFlightChan:       make(chan *InFlight),
+		finishChan:             make(chan uint64),
+		finishResponseChan:     make(chan error),
+		writeChan:              make(chan []byte),
+		writeReaderChan:        make(chan readerWrite),
+		writeDurableChan:       make(chan []byte),
+		writeManyChan:          make(chan [][]byte),
+		writeMessageChan:       make(chan Message),
+		writeTxnChan:           make(chan [][]byte),
+		writeDelayedChan:       make(chan delayedWrite),
+		writeResponseChan:      make(chan error),
+		putPosChan:             make(chan []byte),
+		putPosResponseChan:     make(chan putPosResult),
+		readIntoChan:           make(chan []byte),
+		readIntoResponseChan:   make(chan readIntoResult),
+		readWithChan:           make(chan []byte),
+		emptyChan:              make(chan int),
+		emptyToChan:            make(chan Position),
+		emptyResponseChan:      make(chan error),
+		checkpointChan:         make(chan int),
+		checkpointResponseChan: make(chan []byte),
+		seekChan:               make(chan []byte),
+		seekTimeChan:           make(chan time.Time),
+		fastBackwardChan:       make(chan func([]byte) int),
+		seekResponseChan:       make(chan error),
+		commitChan:             make(chan []byte),
+		commitResponseChan:     make(chan error),
+		trimChan:               make(chan time.Time),
+		trimResponseChan:       make(chan trimResult),
+		rewindChan:             make(chan int64),
+		skipChan:               make(chan int64),
+		trimDepthChan:          make(chan int64),
+		recoverChan:            make(chan string),
+		deleteWhereChan:        make(chan func([]byte) bool),
+		moveChan:               make(chan moveRequest),
+		moveEndChan:            make(chan int),
+		moveResponseChan:       make(chan moveResult),
+		moveInChan:             make(chan moveInRequest),
+		compactChan:            make(chan int),
+		barrierChan:            make(chan int),
+		barrierResponseChan:    make(chan error),
+		closingChan:            make(chan int),
+		exitChan:               make(chan int),
+		exitSyncChan:           make(chan int),
+		lastSync:               time.Now(),
+		logf:                   logf,
+
+		cursors:                 make(map[string]*cursor),
+		cursorOpenChan:          make(chan string),
+		cursorOpenResponseChan:  make(chan cursorOpenResult),
+		cursorReadChan:          make(chan cursorRequest),
+		cursorCloseChan:         make(chan cursorRequest),
+		cursorCloseResponseChan: make(chan error),
+
+		failoverChan:         make(chan string),
+		failoverResponseChan: make(chan error),
+
+		snapshotChan:         make(chan string),
+		snapshotResponseChan: make(chan error),
+
+		spliceChan:         make(chan spliceRequest),
+		spliceResponseChan: make(chan error),
+
+		readBatchChan:         make(chan int),
+		readBatchResponseChan: make(chan readBatchResult),
+
+		reconfigureChan:         make(chan []Option),
+		reconfigureResponseChan: make(chan error),
+
+		fastForwardChan:         make(chan fastForwardRequest),
+		fastForwardResponseChan: make(chan fastForwardResult),
+
+		scanChan:         make(chan *scanRequest),
+		scanResponseChan: make(chan error),
+
+		statsChan:         make(chan int),
+		statsResponseChan: make(chan Stats),
+
+		verifyChan:         make(chan int),
+		verifyResponseChan: make(chan verifyResult),
+	}
+}
+
+// start loads the persisted state and starts ioLoop
+func (d *diskQueue) start() error {
+	if d.readBufferSize > 0 {
+		d.readChan = make(chan []byte, d.readBufferSize)
+	}
+
+	err := d.lock()
+	if err != nil {
+		// the persisted state belongs to whoever holds the lock, leave it be
+		d.log(ERROR, "failed to lock", "err", err)
+		d.lastErr = err
+		d.failed = true
+		go func() {
+			d.failedLoop(err)
+			d.exitSyncChan <- 1
+		}()
+		return err
+	}
+
+	if d.hasHooks() {
+		d.hooks = newHookQueue()
+	}
+
+	// no need to lock here, nothing else could possibly be touching this instance
+	d.loadState()
+
+	if d.ledgerSize > 0 {
+		d.ledger, err = openDeliveryLedger(d.ledgerFileName(), d.ledgerSize)
+		if err != nil {
+			d.log(ERROR, "failed to open delivery ledger", "err", err)
+		}
+	}
+	d.openDedup()
+
+	if d.deadLetters {
+		d.openDeadLetterQueue()
+	}
+
+	if d.mirrorPath != "" {
+		err = d.syncMirror()
+		if err != nil {
+			d.log(ERROR, "failed to sync mirror", "err", err)
+		}
+	}
+
+	go d.ioLoop()
+	return nil
+}
+
+// loadState restores the queue's positions from the persisted metadata
+// and the data files themselves
+func (d *diskQueue) loadState() {
+	err := d.retrieveMetaData()
+	if err != nil && !os.IsNotExist(err) {
+		d.log(ERROR, "failed to retrieveMetaData", "err", err)
+	}
+
+	if d.appendWrites {
+		span := d.startSpan(context.Background(), "diskqueue.recover_append")
+		err = d.recoverAppendPos()
+		endSpan(span, err)
+		if err != nil {
+			d.log(ERROR, "failed to recover writePos", "err", err)
+		}
+	}
+
+	if d.startupScan && d.clean {
+		d.log(INFO, "was closed cleanly, skipping the startup scan")
+	} else if d.startupScan {
+		span := d.startSpan(context.Background(), "diskqueue.startup_scan")
+		err = d.scanOnStartup()
+		endSpan(span, err)
+		if err != nil {
+			d.log(ERROR, "failed to scan data files", "err", err)
+		}
+	}
+
+	if d.segmentFooters || d.rotateCount > 0 {
+		d.writeFileCount, err = d.depthInFiles(d.writeFileNum, 0)
+		if err != nil {
+			d.log(ERROR, "failed to count messages in write file", "err", err)
+		}
+		if d.segmentFooters && d.writePos > 0 {
+			d.writeFileCRC, err = segmentCRC(d.fileName(d.writeFileNum), d.writePos)
+			if err != nil {
+				d.log(ERROR, "failed to checksum write file", "err", err)
+			}
+		}
+	}
+
+	err = d.loadSpareFiles()
+	if err != nil && !os.IsNotExist(err) {
+		d.log(ERROR, "failed to load spare files", "err", err)
+	}
+
+	d.collectGarbage()
+
+	if d.indexEvery > 0 {
+		err = d.loadWriteIndex()
+		if err != nil {
+			d.log(ERROR, "failed to index write file", "err", err)
+		}
+	}
+
+	err = d.loadMove()
+	if err != nil {
+		d.log(ERROR, "failed to load move journal", "err", err)
+	}
+
+	d.firstFileNum = d.consumedFileNum()
+	if d.retain {
+		// pick up the files kept for replay before the queue was closed
+		for d.firstFileNum > 0 {
+			_, err = os.Stat(d.fileName(d.firstFileNum - 1))
+			if err != nil {
+				break
+			}
+			d.firstFileNum--
+		}
+	}
+	d.loadDoneFileBytes()
+	if d.retain {
+		d.removeFiles()
+	}
+
+	err = d.loadMovesIn()
+	if err != nil {
+		d.log(ERROR, "failed to load move records", "err", err)
+	}
+
+	err = d.loadDelayed()
+	if err != nil {
+		d.log(ERROR, "failed to load delayed messages", "err", err)
+	}
+
+	err = d.loadInFlight()
+	if err != nil {
+		d.log(ERROR, "failed to load messages in flight", "err", err)
+	}
+}
+
+// LastError returns the error that last interrupted the queue's ioLoop,
+// e.g. a recovered panic, or nil
+func (d *diskQueue) LastError() error {
+	d.errMtx.Lock()
+	defer d.errMtx.Unlock()
+	return d.lastErr
+}
+
+// DeadLetterQueue returns the queue salvaged messages are moved to, nil
+// unless the queue was created with WithDeadLetterQueue
+func (d *diskQueue) DeadLetterQueue() Interface {
+	if d.dlq == nil {
+		return nil
+	}
+	return d.dlq
+}
+
+// Depth returns the depth of the queue
+func (d *diskQueue) Depth() int64 {
+	return atomic.LoadInt64(&d.depth)
+}
+
+// Stats returns a snapshot of the queue's activity counters and positions,
+// once the queue is closed only the counters are filled in
+func (d *diskQueue) Stats() Stats {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return d.stats.snapshot()
+	}
+
+	d.statsChan <- 1
+	return <-d.statsResponseChan
+}
+
+// ReadChan returns the []byte channel for reading data
+func (d *diskQueue) ReadChan() chan []byte {
+	return d.readChan
+}
+
+// ReadMessageChan returns the channel for reading messages along with their
+// timestamp and headers, it can be used alongside ReadChan
+func (d *diskQueue) ReadMessageChan() chan Message {
+	return d.readMessageChan
+}
+
+// Put writes a []byte to the queue
+func (d *diskQueue) Put(data []byte) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+	if atomic.LoadInt32(&d.draining) == 1 {
+		return ErrDraining
+	}
+
+	// checked here rather than in ioLoop, where the Put may be part of a
+	// group write, see gatherWrites
+	err := d.checkMsgSize(len(data))
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	if d.writeGate != nil {
+		d.writeGate.enter()
+		defer d.writeGate.leave()
+	}
+	// writes are held back while the queue is full, see OverflowBlock
+	select {
+	case d.writeChan <- data:
+	case <-d.closingChan:
+		return ErrExiting
+	}
+	addTiming(&d.stats.putWaits, &d.stats.putWaitNanos, start)
+	return <-d.writeResponseChan
+}
+
+// PutContext is Put but gives up once ctx is done if the ioLoop hasn't
+// accepted the message yet (e.g. because it is stalled on a slow disk),
+// once accepted the message is always written
+func (d *diskQueue) PutContext(ctx context.Context, data []byte) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+	if atomic.LoadInt32(&d.draining) == 1 {
+		return ErrDraining
+	}
+
+	err := d.checkMsgSize(len(data))
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	if d.writeGate != nil {
+		err = d.writeGate.enterContext(ctx)
+		if err != nil {
+			return err
+		}
+		defer d.writeGate.leave()
+	}
+	select {
+	case d.writeChan <- data:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-d.closingChan:
+		return ErrExiting
+	}
+	addTiming(&d.stats.putWaits, &d.stats.putWaitNanos, start)
+	return <-d.writeResponseChan
+}
+
+// PutMany writes a batch of messages to the queue in a single pass through
+// ioLoop, the batch counts as one write towards the SyncPolicy, follow it
+// with WriteBarrier() for the batch to be fsync'd
+//
+// a batch containing a message of invalid size is rejected as a whole
+func (d *diskQueue) PutMany(batch [][]byte) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+	if atomic.LoadInt32(&d.draining) == 1 {
+		return ErrDraining
+	}
+
+	start := time.Now()
+	if d.writeGate != nil {
+		d.writeGate.enter()
+		defer d.writeGate.leave()
+	}
+	select {
+	case d.writeManyChan <- batch:
+	case <-d.closingChan:
+		return ErrExiting
+	}
+	addTiming(&d.stats.putWaits, &d.stats.putWaitNanos, start)
+	return <-d.writeResponseChan
+}
+
+// PutDurable writes a []byte to the queue and returns only once it
+// (along with every message written before it) has been fsync'd
+func (d *diskQueue) PutDurable(data []byte) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+	if atomic.LoadInt32(&d.draining) == 1 {
+		return ErrDraining
+	}
+
+	start := time.Now()
+	if d.writeGate != nil {
+		d.writeGate.enter()
+		defer d.writeGate.leave()
+	}
+	select {
+	case d.writeDurableChan <- data:
+	case <-d.closingChan:
+		return ErrExiting
+	}
+	addTiming(&d.stats.putWaits, &d.stats.putWaitNanos, start)
+	return <-d.writeResponseChan
+}
+
+// PutMessage writes m to the queue in an envelope preserving its Timestamp
+// (which defaults to now) and Headers, both are available to consumers via
+// ReadMessageChan while ReadChan only delivers the Data
+//
+// the min/max message size applies to Data, Headers are limited to 64KiB
+func (d *diskQueue) PutMessage(m Message) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+	if atomic.LoadInt32(&d.draining) == 1 {
+		return ErrDraining
+	}
+
+	if m.Timestamp.IsZero() {
+		m.Timestamp = time.Now()
+	}
+
+	start := time.Now()
+	if d.writeGate != nil {
+		d.writeGate.enter()
+		defer d.writeGate.leave()
+	}
+	select {
+	case d.writeMessageChan <- m:
+	case <-d.closingChan:
+		return ErrExiting
+	}
+	addTiming(&d.stats.putWaits, &d.stats.putWaitNanos, start)
+	return <-d.writeResponseChan
+}
+
+// PutDelayed writes data to the queue at deliverAt, until then the message
+// is kept aside (and doesn't count towards Depth) but is persisted along
+// with the queue
+func (d *diskQueue) PutDelayed(data []byte, deliverAt time.Time) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+	if atomic.LoadInt32(&d.draining) == 1 {
+		return ErrDraining
+	}
+
+	start := time.Now()
+	if d.writeGate != nil {
+		d.writeGate.enter()
+		defer d.writeGate.leave()
+	}
+	select {
+	case d.writeDelayedChan <- delayedWrite{data: data, due: deliverAt}:
+	case <-d.closingChan:
+		return ErrExiting
+	}
+	addTiming(&d.stats.putWaits, &d.stats.putWaitNanos, start)
+	return <-d.writeResponseChan
+}
+
+// WriteBarrier returns once every message accepted by a prior Put has been
+// fsync'd and metadata has been persisted
+func (d *diskQueue) WriteBarrier() error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+
+	d.barrierChan <- 1
+	return <-d.barrierResponseChan
+}
+
+// Sync fsyncs the data files and persists metadata right away, whatever
+// the sync policy, returning once every write accepted before the call
+// (and every read committed) is durable, for applications with commit
+// points of their own, it is WriteBarrier under another name
+func (d *diskQueue) Sync() error {
+	return d.WriteBarrier()
+}
+
+type readIntoResult struct {
+	n   int
+	err error
+}
+
+// ReadInto blocks until a message is available, copies it into buf and
+// advances the read position
+//
+// if buf is too small to hold the message io.ErrShortBuffer is returned along
+// with the required size and the message is left in the queue
+func (d *diskQueue) ReadInto(buf []byte) (int, error) {
+	select {
+	case d.readIntoChan <- buf:
+	case <-d.exitChan:
+		return 0, ErrExiting
+	}
+	res := <-d.readIntoResponseChan
+	return res.n, res.err
+}
+
+// ReadWith blocks until a message is available, advances the read position
+// and calls fn with it, returning fn's error, or the error the queue failed
+// with (see LastError)
+//
+// the message's memory is reused once fn returns, fn must not keep it
+func (d *diskQueue) ReadWith(fn func([]byte) error) error {
+	var data []byte
+	var ok bool
+	select {
+	case data, ok = <-d.readWithChan:
+		if !ok {
+			return d.LastError()
+		}
+	case <-d.exitChan:
+		return ErrExiting
+	}
+	err := fn(data)
+	d.readBufPool.put(data)
+	return err
+}
+
+// Subscribe reads messages from the queue and passes them to handler until
+// ctx is done or the queue is closed
+//
+// a message for which handler returns an error is put back at the tail of
+// the queue (keeping its timestamp and headers), the in-flight handler call
+// always completes before returning
+func (d *diskQueue) Subscribe(ctx context.Context, handler func(Message) error) error {
+	for {
+		select {
+		case m := <-d.readMessageChan:
+			err := handler(m)
+			if err == nil {
+				continue
+			}
+			d.log(WARN, "handler failed, requeueing message", "err", err)
+			if m.Timestamp.IsZero() && m.Headers == nil {
+				err = d.Put(m.Data)
+			} else {
+				err = d.PutMessage(m)
+			}
+			if err != nil {
+				d.log(ERROR, "failed to requeue message", "err", err)
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-d.exitChan:
+			return ErrExiting
+		}
+	}
+}
+
+// readerWrite is a single streamed message sent to ioLoop by PutReader
+type readerWrite struct {
+	r    io.Reader
+	size int64
+}
+
+// PutReader writes a message of exactly size bytes read from r to the queue,
+// streaming it directly into the data file rather than buffering it in memory
+func (d *diskQueue) PutReader(r io.Reader, size int64) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+	if atomic.LoadInt32(&d.draining) == 1 {
+		return ErrDraining
+	}
+
+	start := time.Now()
+	if d.writeGate != nil {
+		d.writeGate.enter()
+		defer d.writeGate.leave()
+	}
+	select {
+	case d.writeReaderChan <- readerWrite{r: r, size: size}:
+	case <-d.closingChan:
+		return ErrExiting
+	}
+	addTiming(&d.stats.putWaits, &d.stats.putWaitNanos, start)
+	return <-d.writeResponseChan
+}
+
+// Close cleans up the queue and persists metadata
+func (d *diskQueue) Close() error {
+	defer d.closeHooks()
+	err := d.exit(false)
+	if err != nil {
+		return err
+	}
+	if d.failed {
+		// in-memory state can't be trusted, leave the persisted state as is
+		d.closeLedger()
+		d.unlock()
+		return nil
+	}
+	if !d.manualCommit {
+		d.commitReads()
+	}
+	d.clean = true
+	err = d.sync()
+	d.closeLedger()
+	d.unlock()
+	return err
+}
+
+// CloseContext is Close but returns ctx.Err() once ctx is done, the queue
+// carries on closing in the background
+func (d *diskQueue) CloseContext(ctx context.Context) error {
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- d.Close()
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// drainPollInterval is how often Drain checks whether the queue is empty
+const drainPollInterval = 10 * time.Millisecond
+
+// Drain stops accepting Puts and waits for the queue's consumers to read
+// it until Depth reaches zero, or ctx is done, before closing it
+//
+// the queue is closed either way, ctx.Err() is returned if it still held
+// messages, delayed messages that aren't due yet don't count towards Depth
+// and are kept along with the queue
+func (d *diskQueue) Drain(ctx context.Context) error {
+	atomic.StoreInt32(&d.draining, 1)
+	d.log(INFO, "draining")
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	var err error
+	for d.Depth() > 0 && err == nil {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-d.exitChan:
+			return ErrExiting
+		}
+	}
+
+	closeErr := d.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (d *diskQueue) Delete() error {
+	defer d.closeHooks()
+	err := d.exit(true)
+	d.closeLedger()
+	d.unlock()
+	return err
+}
+
+func (d *diskQueue) closeLedger() {
+	if d.ledger != nil {
+		d.ledger.close()
+		d.ledger = nil
+	}
+	if d.dedup != nil {
+		d.dedup.close()
+		d.dedup = nil
+	}
+}
+
+func (d *diskQueue) exit(deleted bool) error {
+	// release writers blocked on a full queue, they hold the read lock
+	close(d.closingChan)
+
+	d.Lock()
+	defer d.Unlock()
+
+	d.exitFlag = 1
+
+	if deleted {
+		d.log(INFO, "deleting")
+	} else {
+		d.log(INFO, "closing")
+	}
+
+	close(d.exitChan)
+	// ensure that ioLoop has exited
+	<-d.exitSyncChan
+
+	if d.readBufferSize > 0 {
+		d.drainReadBuffer()
+	}
+
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
+	}
+
+	d.takePreopened(-1)
+	d.closeCursorFiles()
+
+	if d.writeFile != nil {
+		d.flushPending()
+	}
+
+	if d.writeFile != nil {
+		d.writeFile.Close()
+		d.writeFile = nil
+	}
+
+	if d.delayedFile != nil {
+		d.delayedFile.Sync()
+		d.delayedFile.Close()
+		d.delayedFile = nil
+	}
+
+	if d.inFlightFile != nil {
+		d.inFlightFile.Sync()
+		d.inFlightFile.Close()
+		d.inFlightFile = nil
+	}
+
+	if d.manager != nil && deleted {
+		d.manager.forget(d)
+	}
+
+	if d.dlq != nil && deleted {
+		d.dlq.Delete()
+	} else if d.dlq != nil {
+		d.dlq.Close()
+	}
+
+	return nil
+}
+
+// Empty destructively clears out any pending data in the queue
+// by fast forwarding read positions and removing intermediate files
+func (d *diskQueue) Empty() error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+
+	d.log(INFO, "emptying")
+
+	d.emptyChan <- 1
+	return <-d.emptyResponseChan
+}
+
+// Checkpoint returns an opaque token identifying the current read position
+//
+// the token can be stored externally (e.g. alongside the result of processing
+// the last message read) and later passed to SeekCheckpoint
+func (d *diskQueue) Checkpoint() []byte {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		// ioLoop has exited, the read position can no longer change
+		return encodeCheckpoint(d.readFileNum, d.readPos)
+	}
+
+	d.checkpointChan <- 1
+	return <-d.checkpointResponseChan
+}
+
+// SeekCheckpoint repositions the reader at a token returned by Checkpoint
+//
+// the position must not precede data that has already been removed
+// from disk, depth is recomputed from the data files
+func (d *diskQueue) SeekCheckpoint(token []byte) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+
+	d.seekChan <- token
+	return <-d.seekResponseChan
+}
+
+// Commit marks every message before position, a token returned by
+// Checkpoint, as consumed when running with WithManualCommit
+func (d *diskQueue) Commit(position []byte) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+
+	d.commitChan <- position
+	return <-d.commitResponseChan
+}
+
+// TrimBefore drops every message written before t that has not been read
+// yet (or, with WithManualCommit, committed) and returns how many were
+// dropped, data files holding only such messages are deleted as a whole
+//
+// a message is dated by its envelope (see PutMessage and WithTimestamps)
+// or else by the last modification of its data file
+func (d *diskQueue) TrimBefore(t time.Time) (int64, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return 0, ErrExiting
+	}
+
+	d.trimChan <- t
+	res := <-d.trimResponseChan
+	return res.n, res.err
+}
+
+// FailoverTo switches the queue over to the mirror at dataPath (see
+// WithMirror), which from then on is the queue's dataPath, e.g. once the
+// disk holding the queue's original dataPath has failed
+//
+// reading and writing carry on where they were, mirroring stops
+func (d *diskQueue) FailoverTo(dataPath string) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+
+	d.failoverChan <- dataPath
+	return <-d.failoverResponseChan
+}
+
+// Snapshot writes a point-in-time copy of the queue to dir, which
+// RestoreFromSnapshot turns back into a queue, while it keeps running
+//
+// data files that are done being written to are hardlinked into dir
+// where possible, the file being written to is copied, writes wait for
+// the copy to complete
+func (d *diskQueue) Snapshot(dir string) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+
+	d.snapshotChan <- dir
+	return <-d.snapshotResponseChan
+}
+
+const (
+	checkpointVersion = 1
+	checkpointLen     = 1 + 8 + 8 + 4
+)
+
+func encodeCheckpoint(fileNum int64, pos int64) []byte {
+	token := make([]byte, checkpointLen)
+	token[0] = checkpointVersion
+	binary.BigEndian.PutUint64(token[1:9], uint64(fileNum))
+	binary.BigEndian.PutUint64(token[9:17], uint64(pos))
+	binary.BigEndian.PutUint32(token[17:], crc32.ChecksumIEEE(token[:17]))
+	return token
+}
+
+func decodeCheckpoint(token []byte) (int64, int64, error) {
+	if len(token) != checkpointLen || token[0] != checkpointVersion ||
+		binary.BigEndian.Uint32(token[17:]) != crc32.ChecksumIEEE(token[:17]) {
+		return 0, 0, errors.New("invalid checkpoint token")
+	}
+	fileNum := int64(binary.BigEndian.Uint64(token[1:9]))
+	pos := int64(binary.BigEndian.Uint64(token[9:17]))
+	return fileNum, pos, nil
+}
+
+// seekTo moves the read position to pos in fileNum, removing any
+// data files skipped over and recomputing depth
+func (d *diskQueue) seekTo(fileNum int64, pos int64) error {
+	if fileNum < d.firstFileNum || fileNum > d.writeFileNum ||
+		(fileNum == d.writeFileNum && pos > d.writePos) || pos < 0 {
+		return fmt.Errorf("position %d:%d out of range (%d:%d - %d:%d)",
+			fileNum, pos, d.firstFileNum, 0, d.writeFileNum, d.writePos)
+	}
+
+	if d.writeFile != nil {
+		d.flushPending()
+	}
+
+	err := d.checkFrameStart(fileNum, pos)
+	if err != nil {
+		return err
+	}
+	depth, err := d.depthInFiles(fileNum, pos)
+	if err != nil {
+		return err
+	}
+
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
+	}
+
+	d.readFileNum = fileNum
+	d.readPos = pos
+	d.nextReadFileNum = fileNum
+	d.nextReadPos = pos
+	d.readTxn = pendingTxn{}
+	d.bufferedReads = nil
+	atomic.StoreInt64(&d.depth, depth)
+	atomic.StoreInt64(&d.depthBytes, d.unreadBytes(fileNum, pos))
+	d.commitReads()
+	d.needSync = true
+
+	return nil
+}
+
+// checkFrameStart returns an error unless a frame starts at pos in fileNum
+// (or its frames end there), so that the read position isn't moved into
+// the middle of one
+func (d *diskQueue) checkFrameStart(fileNum int64, pos int64) error {
+	if pos == 0 {
+		return nil
+	}
+	found := false
+	err := d.walkMessages(fileNum, 0, func(p int64, next Position, _ []Message) bool {
+		found = p == pos || (next.FileNum == fileNum && next.Pos == pos)
+		return !found && p < pos
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("position %d:%d is not the start of a message", fileNum, pos)
+	}
+	return nil
+}
+
+// depthInFiles counts the messages between pos in fileNum and the write position
+// by walking the message size prefixes in the data files
+func (d *diskQueue) depthInFiles(fileNum int64, pos int64) (int64, error) {
+	return d.framesBetween(fileNum, pos, d.writeFileNum, d.writePos)
+}
+
+// framesBetween counts the messages between pos in fileNum and endPos in endFileNum
+func (d *diskQueue) framesBetween(fileNum int64, pos int64, endFileNum int64, endPos int64) (int64, error) {
+	var depth int64
+	var msgSize int32
+
+	for fileNum < endFileNum || (fileNum == endFileNum && pos < endPos) {
+		if d.segmentFooters && fileNum < endFileNum && pos == 0 {
+			footer, ok := d.readSegmentFooter(d.fileName(fileNum))
+			if ok {
+				depth += footer.count
+				fileNum++
+				continue
+			}
+		}
+
+		f, err := os.OpenFile(d.fileName(fileNum), os.O_RDONLY, 0600)
+		if err != nil {
+			return 0, err
+		}
+		header, err := readFileHeader(f)
+		if err == nil {
+			_, err = f.Seek(pos, 0)
+		}
+		if err != nil {
+			f.Close()
+			return 0, err
+		}
+		reader := bufio.NewReader(f)
+
+		for {
+			if fileNum == endFileNum && pos >= endPos {
+				break
+			}
+			var padding int64
+			var flags uint32
+			padding, msgSize, flags, err = d.readFrameStart(reader, pos, header)
+			pos += padding
+			if fileEnded(err, fileNum, endFileNum) {
+				break
+			}
+			frameSize := int64(msgSize) + d.frameOverhead(header.version, msgSize)
+			msgs := int64(1)
+			if err == nil && flags&frameFlagTxn != 0 {
+				var txnHeader []byte
+				txnHeader, err = reader.Peek(txnHeaderSize)
+				if err == nil {
+					msgs, err = txnCount(txnHeader)
+				}
+			}
+			if err == nil {
+				_, err = reader.Discard(int(frameSize - frameHeaderLen(header.version, msgSize)))
+			}
+			if err != nil {
+				f.Close()
+				return 0, fmt.Errorf("failed to count messages at %d of %s - %s",
+					pos, d.fileName(fileNum), err)
+			}
+			depth += msgs
+			pos += frameSize
+			if pos > d.maxBytesOf(header) {
+				break
+			}
+		}
+		f.Close()
+
+		if fileNum == endFileNum {
+			break
+		}
+		fileNum++
+		pos = 0
+	}
+
+	return depth, nil
+}
+
+func (d *diskQueue) deleteAllFiles() error {
+	err := d.skipToNextRWFile()
+
+	d.delayed = d.delayed[:0]
+	innerErr := d.rewriteDelayed()
+	if innerErr != nil {
+		d.log(ERROR, "failed to remove delayed messages", "err", innerErr)
+		err = innerErr
+	}
+
+	// and the messages in flight
+	d.inFlight = make(map[uint64]*inFlightEntry)
+	d.inFlightOrder = nil
+	innerErr = d.rewriteInFlight()
+	if innerErr != nil {
+		d.log(ERROR, "failed to remove messages in flight", "err", innerErr)
+		err = innerErr
+	}
+
+	// the batch of a pending move goes too
+	d.move = nil
+	innerErr = removeFile(d.moveFileName())
+	if innerErr != nil && !os.IsNotExist(innerErr) {
+		d.log(ERROR, "failed to remove move journal", "err", innerErr)
+		err = innerErr
+	}
+	// the data files (and their positions) start over once the metadata
+	// is gone, so must the ids of the messages delivered
+	if d.ledger != nil {
+		innerErr = d.ledger.reset()
+		if innerErr != nil {
+			d.log(ERROR, "failed to reset delivery ledger", "err", innerErr)
+			err = innerErr
+		}
+	}
+
+	// the records of batches moved in are kept for the moves to be
+	// finished, though not pointing into the files removed
+	if len(d.movesIn) > 0 {
+		for _, rec := range d.movesIn {
+			rec.from = Position{d.writeFileNum, d.writePos}
+		}
+		innerErr = d.writeMovesIn()
+		if innerErr != nil {
+			d.log(ERROR, "failed to record moved messages", "err", innerErr)
+			err = innerErr
+		}
+	}
+
+	for _, fileName := range metaDataSlots(d.metaDataFileName()) {
+		innerErr = d.removeDataFile(fileName)
+		if innerErr != nil && !os.IsNotExist(innerErr) {
+			d.log(ERROR, "failed to remove metadata file", "file", fileName, "err", innerErr)
+			return innerErr
+		}
+	}
+
+	return err
+}
+
+func (d *diskQueue) skipToNextRWFile() error {
+	var err error
+
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
+	}
+
+	if d.writeFile != nil {
+		d.writeFile.Close()
+		d.writeFile = nil
+	}
+	d.pendingWrite.Reset()
+	d.pendingMsgs = 0
+	d.writeFileCount = 0
+	d.writeFileCRC = 0
+	d.doneFileBytes = 0
+
+	for i := d.firstFileNum; i <= d.writeFileNum; i++ {
+		fn := d.fileName(i)
+		innerErr := d.removeDataFile(fn)
+		if innerErr != nil && !os.IsNotExist(innerErr) {
+			d.log(ERROR, "failed to remove data file", "file", fn, "err", innerErr)
+			err = innerErr
+		}
+	}
+
+	d.writeFileNum++
+	d.writePos = 0
+	d.readFileNum = d.writeFileNum
+	d.readPos = 0
+	d.nextReadFileNum = d.writeFileNum
+	d.nextReadPos = 0
+	d.readTxn = pendingTxn{}
+	d.bufferedReads = nil
+	d.commitReadFileNum = d.writeFileNum
+	d.commitReadPos = 0
+	d.firstFileNum = d.writeFileNum
+	d.uncommittedReads = 0
+	atomic.StoreInt64(&d.depth, 0)
+	atomic.StoreInt64(&d.depthBytes, 0)
+	d.resetCursors(d.writeFileNum, 0)
+
+	return err
+}
+
+// readOne performs a low level filesystem read for a single []byte
+// while advancing read positions and rolling files, if necessary
+func (d *diskQueue) readOne() ([]byte, error) {
+	var err error
+
+	d.readIntact = false
+	if len(d.readTxn.msgs) > 0 {
+		m := d.readTxn.msgs[0]
+		d.readTxn.msgs[0] = Message{}
+		d.readTxn.msgs = d.readTxn.msgs[1:]
+		d.setReadEnvelope(m)
+		d.nextReadFileNum, d.nextReadPos = d.readTxn.nextFileNum, d.readTxn.nextPos
+		return d.ownedData(m.Data), nil
+	}
+
+	if d.readFile == nil {
+		curFileName := d.fileName(d.readFileNum)
+		start := time.Now()
+		pre := d.takePreopened(d.readFileNum)
+		d.readFile = pre.f
+		if d.readFile == nil {
+			d.readFile, err = openReadFile(curFileName)
+		}
+		addTiming(&d.stats.fileOpens, &d.stats.fileOpenNanos, start)
+		if err != nil {
+			return nil, err
+		}
+
+		d.log(INFO, "readOne() opened file", "file", curFileName)
+
+		if pre.f != nil {
+			d.readHeader = pre.header
+		} else {
+			d.readHeader, err = readFileHeader(d.readFile)
+		}
+		if err != nil {
+			d.readFile.Close()
+			d.readFile = nil
+			return nil, err
+		}
+
+		if d.readPos > 0 {
+			_, err = d.readFile.Seek(d.readPos, 0)
+			if err != nil {
+				d.readFile.Close()
+				d.readFile = nil
+				return nil, err
+			}
+		}
+
+		if d.mmapWrites || d.directIO {
+			d.reader = bufio.NewReader(&mmapReader{d: d, f: d.readFile, fileNum: d.readFileNum, off: d.readPos})
+		} else if len(pre.head) > 0 && d.readPos == 0 {
+			// the file is positioned after the head read ahead
+			d.reader = bufio.NewReader(io.MultiReader(bytes.NewReader(pre.head), d.readFile))
+		} else {
+			d.reader = bufio.NewReader(d.readFile)
+		}
+	}
+
+	// an invalid size means this file is corrupt and we have no
+	// reasonable guarantee on where a new message should begin
+	padding, msgSize, flags, err := d.readFrameStart(d.reader, d.readPos, d.readHeader)
+	if fileEnded(err, d.readFileNum, d.writeFileNum) {
+		err = errFileEnd
+	}
+	if err != nil {
+		d.readFile.Close()
+		d.readFile = nil
+		return nil, err
+	}
+
+	var readBuf []byte
+	if int32(cap(d.spareReadBuf)) >= msgSize {
+		readBuf = d.spareReadBuf[:msgSize]
+	} else {
+		if d.spareReadBuf != nil {
+			d.readBufPool.put(d.spareReadBuf)
+		}
+		readBuf = d.readBufPool.get(int(msgSize))
+	}
+	d.spareReadBuf = nil
+
+	_, err = io.ReadFull(d.reader, readBuf)
+	if err == nil && d.frameTrailer {
+		var trailer [frameTrailerSize]byte
+		_, err = io.ReadFull(d.reader, trailer[:])
+		if err == nil {
+			err = checkFrameTrailer(trailer[:], readBuf)
+		}
+		if err == errChecksumMismatch && d.checksumHandler != nil {
+			d.dropRead = !d.checksumHandler(readBuf, err)
+			err = nil
+		}
+		if err == errChecksumMismatch {
+			d.markIntact(padding, readBuf, flags)
+		}
+	}
+	if err != nil {
+		d.readFile.Close()
+		d.readFile = nil
+		return nil, err
+	}
+
+	frameBuf := readBuf
+	var m Message
+	if flags&frameFlagTxn != 0 {
+		var msgs []Message
+		msgs, err = d.decodeTxn(readBuf)
+		if err == nil {
+			d.spareReadBuf = readBuf
+			m = msgs[0]
+			d.readTxn = pendingTxn{msgs: msgs[1:], count: int64(len(msgs))}
+		}
+	} else {
+		m, err = d.decodeFrame(readBuf, flags)
+	}
+	if err != nil {
+		d.markIntact(padding, readBuf, flags)
+	}
+	readBuf = m.Data
+	d.setReadEnvelope(m)
+	if err != nil {
+		d.readFile.Close()
+		d.readFile = nil
+		return nil, err
+	}
+
+	totalBytes := padding + int64(msgSize) + d.frameOverhead(d.readHeader.version, msgSize)
+	d.readFrameSize = totalBytes
+
+	// we only advance next* because we have not yet sent this to consumers
+	// (where readFileNum, readPos will actually be advanced)
+	d.nextReadPos = d.readPos + totalBytes
+	d.nextReadFileNum = d.readFileNum
+
+	// files in format version 1 don't record the maxBytesPerFile they
+	// were written with, it must not change while they're around
+	if d.nextReadPos > d.maxBytesOf(d.readHeader) {
+		if d.readFile != nil {
+			d.readFile.Close()
+			d.readFile = nil
+		}
+
+		d.nextReadFileNum++
+		d.nextReadPos = 0
+	} else {
+		d.maybePreopen()
+	}
+	d.readTxn.nextFileNum, d.readTxn.nextPos = d.nextReadFileNum, d.nextReadPos
+
+	if !d.ownedReads {
+		return readBuf, nil
+	}
+	data := d.ownedData(readBuf)
+	if d.spareReadBuf == nil {
+		// nothing refers to the buffer read into anymore
+		d.spareReadBuf = frameBuf
+	}
+	return data, nil
+}
+
+// ownedData returns data in an allocation of its own with WithOwnedReads
+func (d *diskQueue) ownedData(data []byte) []byte {
+	if !d.ownedReads {
+		return data
+	}
+	owned := make([]byte, len(data))
+	copy(owned, data)
+	return owned
+}
+
+// openWriteFile opens the current write file (if necessary) and seeks to writePos
+func (d *diskQueue) openWriteFile() error {
+	var err error
+
+	if d.writeFile != nil {
+		return nil
+	}
+
+	curFileName := d.fileName(d.writeFileNum)
+	start := time.Now()
+	flag := os.O_RDWR | os.O_CREATE
+	if d.appendWrites {
+		flag |= os.O_APPEND
+	}
+	if d.writePos == 0 {
+		d.takeSpareFile(curFileName)
+	}
+	var f *os.File
+	if d.directIO {
+		f, err = openDirect(curFileName, flag)
+		if err != nil {
+			d.log(ERROR, "failed to open with O_DIRECT, falling back to buffered writes",
+				"file", curFileName, "err", err)
+			d.directIO = false
+		}
+	}
+	if f == nil {
+		f, err = os.OpenFile(curFileName, flag, 0600)
+	}
+	addTiming(&d.stats.fileOpens, &d.stats.fileOpenNanos, start)
+	if err != nil {
+		return err
+	}
+	if d.writePos == 0 && d.dirSync && d.syncMode != SyncNever {
+		err = syncDirHook(d.dataPath)
+		if err != nil {
+			d.log(ERROR, "failed to sync directory", "dir", d.dataPath, "err", err)
+		}
+	}
+
+	if d.writePos > 0 {
+		// keep writing the file in the format it was created in
+		d.writeHeader, err = readFileHeaderOf(curFileName)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	} else {
+		d.writeHeader = d.newFileHeader()
+		if d.preallocate && !d.mmapWrites {
+			d.preallocateWriteFile(f)
+		}
+	}
+
+	d.writeFile = f
+	if d.directIO {
+		d.writeFile = newDirectFile(f)
+	}
+
+	if d.mmapWrites {
+		// a file only rolls once writePos exceeds maxBytesPerFile so
+		// leave room for one more maximum sized frame
+		size := d.maxBytesOf(d.writeHeader) + int64(d.maxMsgSize) + envelopeMaxOverhead + encryptionOverhead +
+			frameHeaderSize + frameTrailerSize + segmentFooterSize
+		m, err := openMmapFile(f, size)
+		if err != nil {
+			d.log(ERROR, "failed to mmap, falling back to writes", "file", curFileName, "err", err)
+			d.mmapWrites = false
+		} else {
+			d.writeFile = m
+		}
+	}
+
+	if d.mirrorPath != "" {
+		err = d.openMirrorFile(flag)
+		if err != nil {
+			d.writeFile.Close()
+			d.writeFile = nil
+			return err
+		}
+	}
+
+	d.log(INFO, "writeOne() opened file", "file", curFileName)
+	if d.writePos == 0 {
+		d.fileHook(d.onFileCreate, curFileName)
+	}
+
+	if d.writePos > 0 {
+		_, err = d.writeFile.Seek(d.writePos, 0)
+		if err != nil {
+			d.writeFile.Close()
+			d.writeFile = nil
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeOne performs a low level filesystem write for a single []byte
+// while advancing write positions and rolling files, if necessary
+func (d *diskQueue) writeOne(data []byte) error {
+	return d.writeMessage(Message{Data: data})
+}
+
+// writeMessage is writeOne for a message which, if it has a Timestamp or
+// Headers, is written in an envelope
+func (d *diskQueue) writeMessage(m Message) error {
+	var err error
+
+	err = d.openWriteFile()
+	if err != nil {
+		return err
+	}
+
+	dataLen := int32(len(m.Data))
+
+	if dataLen < d.minMsgSize || dataLen > d.maxMsgSize {
+		return &MsgSizeError{int64(dataLen), d.minMsgSize, d.maxMsgSize}
+	}
+
+	d.writeBuf.Reset()
+	frameSize, err := d.appendFrame(m, d.writePos, d.writeHeader)
+	if err != nil {
+		return err
+	}
+	return d.writeFrame(frameSize, 1)
+}
+
+// writeFrame writes out the frame of frameSize bytes (holding msgs
+// messages) in writeBuf
+func (d *diskQueue) writeFrame(frameSize int64, msgs int64) error {
+	err := d.makeRoom(frameSize)
+	if err != nil {
+		return err
+	}
+
+	if d.blockSize > 0 {
+		return d.writePacked(d.writeBuf.Bytes(), msgs)
+	}
+	d.lastWrite = Position{d.writeFileNum, d.writePos}
+	if d.writeBufferSize > 0 {
+		return d.writeBuffered(msgs, frameSize)
+	}
+
+	// only write to the file once
+	_, err = d.writeFile.Write(d.writeBuf.Bytes())
+	if err != nil {
+		d.writeFile.Close()
+		d.writeFile = nil
+		return err
+	}
+	d.addSegmentCRC(d.writeBuf.Bytes())
+
+	return d.advanceWritePosN(frameSize, msgs)
+}
+
+// appendFrame appends the frame for m, to be written at pos in a file with
+// header h, to writeBuf returning its size, a file's first frame is
+// preceded by the file header
+func (d *diskQueue) appendFrame(m Message, pos int64, h fileHeader) (int64, error) {
+	data, flags, err := d.encodeMessage(m)
+	if err != nil {
+		return 0, err
+	}
+	return d.appendRawFrame(data, flags, pos, h), nil
+}
+
+// encodeMessage returns m as stored in a frame, i.e. in an envelope,
+// compressed and/or encrypted as configured, along with the frame's flags,
+// the data is only valid until the next call
+func (d *diskQueue) encodeMessage(m Message) ([]byte, uint32, error) {
+	var err error
+	var flags uint32
+
+	data := m.Data
+	d.encodedTimestamp = time.Time{}
+	if d.timestamps || !m.Timestamp.IsZero() || m.Headers != nil {
+		if m.Timestamp.IsZero() {
+			m.Timestamp = time.Now()
+		}
+		d.encodedTimestamp = m.Timestamp
+		d.envelopeBuf, err = appendEnvelope(d.envelopeBuf[:0], m)
+		if err != nil {
+			return nil, 0, err
+		}
+		data = d.envelopeBuf
+		flags = frameFlagEnvelope
+	}
+
+	data, compressed := d.compress(data)
+	flags |= compressed
+	if d.keys != nil {
+		data, err = d.encrypt(data)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to encrypt message - %s", err)
+		}
+		flags |= frameFlagEncrypted
+	}
+	return data, flags, nil
+}
+
+// appendRawFrame is appendFrame for data already encoded with flags
+func (d *diskQueue) appendRawFrame(data []byte, flags uint32, pos int64, h fileHeader) int64 {
+	var fileHeaderLen int64
+	if pos == 0 {
+		appendFileHeader(&d.writeBuf, h)
+		fileHeaderLen = h.size
+	}
+
+	var header [frameMaxHeaderSize]byte
+	n := putFrameHeader(header[:], h.version, int32(len(data)), flags)
+	d.writeBuf.Write(header[:n])
+	d.writeBuf.Write(data)
+
+	if d.frameTrailer {
+		var trailer [frameTrailerSize]byte
+		putFrameTrailer(trailer[:], crc32.Checksum(data, crc32cTable), int32(len(data)))
+		d.writeBuf.Write(trailer[:])
+	}
+	return fileHeaderLen + int64(len(data)) + d.frameOverhead(h.version, int32(len(data)))
+}
+
+// writeMany performs a low level filesystem write for a batch of messages,
+// frames bound for the same file are written with a single write
+func (d *diskQueue) writeMany(batch [][]byte) error {
+	var err error
+	var frameSizes []int64
+
+	// reject the whole batch rather than writing part of it
+	for _, data := range batch {
+		dataLen := int32(len(data))
+		if dataLen < d.minMsgSize || dataLen > d.maxMsgSize {
+			return &MsgSizeError{int64(dataLen), d.minMsgSize, d.maxMsgSize}
+		}
+	}
+
+	if d.blockSize > 0 {
+		// packed frames are already buffered
+		for _, data := range batch {
+			err = d.writeOne(data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for len(batch) > 0 {
+		err = d.openWriteFile()
+		if err != nil {
+			return err
+		}
+
+		// gather frames up to the one that rolls the file
+		d.writeBuf.Reset()
+		frameSizes = frameSizes[:0]
+		pos := d.writePos
+		for len(frameSizes) < len(batch) && !d.writeFileFull(pos, d.writeFileCount+int64(len(frameSizes))) {
+			frameSize, err := d.appendFrame(Message{Data: batch[len(frameSizes)]}, pos, d.writeHeader)
+			if err != nil {
+				return err
+			}
+			frameSizes = append(frameSizes, frameSize)
+			pos += frameSize
+		}
+
+		err = d.makeRoom(int64(d.writeBuf.Len()))
+		if err != nil {
+			return err
+		}
+
+		if d.writeBufferSize > 0 {
+			err = d.writeBuffered(1, frameSizes...)
+			if err != nil {
+				return err
+			}
+			batch = batch[len(frameSizes):]
+			continue
+		}
+
+		_, err = d.writeFile.Write(d.writeBuf.Bytes())
+		if err != nil {
+			d.writeFile.Close()
+			d.writeFile = nil
+			return err
+		}
+		d.addSegmentCRC(d.writeBuf.Bytes())
+
+		for _, frameSize := range frameSizes {
+			err = d.advanceWritePos(frameSize)
+			if err != nil {
+				return err
+			}
+		}
+		batch = batch[len(frameSizes):]
+	}
+
+	return nil
+}
+
+// blockPaddingByte fills the unused remainder of a block, a size prefix of
+// all padding bytes marks the rest of the block as unused
+const blockPaddingByte = 0xff
+
+// writePacked appends frame to the pending block, moving it to the start of
+// the next block if it does not fit and writing out the block once complete
+func (d *diskQueue) writePacked(frame []byte, msgs int64) error {
+	frameLen := int64(len(frame))
+	room := d.blockSize - d.writePos%d.blockSize
+	if frameLen > room && room < d.blockSize {
+		for i := int64(0); i < room; i++ {
+			d.pendingWrite.WriteByte(blockPaddingByte)
+		}
+		d.writePos += room
+		atomic.AddInt64(&d.depthBytes, room)
+		// the block is complete
+		err := d.flushPending()
+		if err != nil {
+			return err
+		}
+	}
+
+	d.lastWrite = Position{d.writeFileNum, d.writePos}
+	d.pendingWrite.Write(frame)
+	d.pendingMsgs += msgs
+
+	err := d.advanceWritePosN(frameLen, msgs)
+	if err != nil {
+		return err
+	}
+
+	flushedPos := d.writePos - int64(d.pendingWrite.Len())
+	if d.writePos/d.blockSize > flushedPos/d.blockSize {
+		return d.flushPending()
+	}
+	return nil
+}
+
+// writeBuffered adds the frames in writeBuf to the pending write, writing
+// it out once it reaches writeBufferSize, see WithWriteBuffer
+func (d *diskQueue) writeBuffered(frameMsgs int64, frameSizes ...int64) error {
+	d.pendingWrite.Write(d.writeBuf.Bytes())
+	for _, frameSize := range frameSizes {
+		d.pendingMsgs += frameMsgs
+		err := d.advanceWritePosN(frameSize, frameMsgs)
+		if err != nil {
+			return err
+		}
+	}
+
+	if int64(d.pendingWrite.Len()) >= d.writeBufferSize {
+		return d.flushPending()
+	}
+	return nil
+}
+
+// flushPending writes out packed (or buffered) frames that have not been written yet,
+// on failure they are dropped from the queue
+func (d *diskQueue) flushPending() error {
+	if d.pendingWrite.Len() == 0 {
+		return nil
+	}
+
+	_, err := d.writeFile.Write(d.pendingWrite.Bytes())
+	if err == nil {
+		d.addSegmentCRC(d.pendingWrite.Bytes())
+	} else {
+		d.log(ERROR, "failed to write pending messages", "count", d.pendingMsgs, "err", err)
+		d.writePos -= int64(d.pendingWrite.Len())
+		d.writeFileCount -= d.pendingMsgs
+		d.unindexFrom(d.writePos)
+		atomic.AddInt64(&d.depth, -d.pendingMsgs)
+		atomic.AddInt64(&d.depthBytes, -int64(d.pendingWrite.Len()))
+		d.writeFile.Close()
+		d.writeFile = nil
+	}
+
+	d.pendingWrite.Reset()
+	d.pendingMsgs = 0
+	return err
+}
+
+// blockPadding returns the number of padding bytes at pos in
+// a data file written with block packing, skipping over them in r
+func (d *diskQueue) blockPadding(r *bufio.Reader, pos int64) (int64, error) {
+	if d.blockSize <= 0 {
+		return 0, nil
+	}
+
+	room := d.blockSize - pos%d.blockSize
+	if room == d.blockSize {
+		return 0, nil
+	}
+
+	if room >= frameHeaderSize {
+		// the end marker of a version 2 file can be shorter than a
+		// frame header
+		b, err := r.Peek(frameHeaderSize)
+		if err != nil && len(b) == 0 {
+			return 0, err
+		}
+		if !bytes.Equal(b, []byte{blockPaddingByte, blockPaddingByte, blockPaddingByte, blockPaddingByte}) {
+			return 0, nil
+		}
+	}
+
+	_, err := r.Discard(int(room))
+	return room, err
+}
+
+// writeOneReader performs a low level filesystem write for a single message
+// streamed from r, rewinding the write file if the stream ends early
+func (d *diskQueue) writeOneReader(r io.Reader, size int64) error {
+	var err error
+
+	if size < int64(d.minMsgSize) || size > int64(d.maxMsgSize) {
+		return &MsgSizeError{size, d.minMsgSize, d.maxMsgSize}
+	}
+
+	err = d.openWriteFile()
+	if err != nil {
+		return err
+	}
+
+	// streamed messages are never packed
+	err = d.flushPending()
+	if err != nil {
+		return err
+	}
+
+	frameSize := size + d.frameOverhead(d.writeHeader.version, int32(size))
+	d.writeBuf.Reset()
+	if d.writePos == 0 {
+		appendFileHeader(&d.writeBuf, d.writeHeader)
+		frameSize += d.writeHeader.size
+	}
+
+	err = d.makeRoom(frameSize)
+	if err != nil {
+		return err
+	}
+
+	var header [frameMaxHeaderSize]byte
+	n := putFrameHeader(header[:], d.writeHeader.version, int32(size), 0)
+	d.writeBuf.Write(header[:n])
+	crc := d.writeFileCRC
+	_, err = d.writeFile.Write(d.writeBuf.Bytes())
+	if err == nil {
+		d.addSegmentCRC(d.writeBuf.Bytes())
+		h := crc32.New(crc32cTable)
+		if d.frameTrailer {
+			r = io.TeeReader(r, h)
+		}
+		_, err = io.CopyN(io.MultiWriter(d.writeFile, segmentHash{d}), r, size)
+		if err == nil && d.frameTrailer {
+			var trailer [frameTrailerSize]byte
+			putFrameTrailer(trailer[:], h.Sum32(), int32(size))
+			_, err = d.writeFile.Write(trailer[:])
+			d.addSegmentCRC(trailer[:])
+		}
+	}
+	if err != nil {
+		d.writeFileCRC = crc
+		// discard the partial message so that it is never visible to readers
+		if rewindErr := d.rewindWriteFile(); rewindErr != nil {
+			d.log(ERROR, "failed to rewind write file", "err", rewindErr)
+		}
+		return err
+	}
+
+	d.encodedTimestamp = time.Time{}
+	return d.advanceWritePos(frameSize)
+}
+
+// rewindWriteFile truncates the current write file back to writePos
+func (d *diskQueue) rewindWriteFile() error {
+	err := d.writeFile.Truncate(d.writePos)
+	if err == nil {
+		_, err = d.writeFile.Seek(d.writePos, 0)
+	}
+	if err != nil {
+		d.writeFile.Close()
+		d.writeFile = nil
 	}
+	return err
+}
 
-	totalBytes := int64(4 + msgSize)
+// advanceWritePos accounts for a successfully written message of totalBytes,
+// rolling to a new file if necessary
+func (d *diskQueue) advanceWritePos(totalBytes int64) error {
+	return d.advanceWritePosN(totalBytes, 1)
+}
 
-	// we only advance next* because we have not yet sent this to consumers
-	// (where readFileNum, readPos will actually be advanced)
-	d.nextReadPos = d.readPos + totalBytes
-	d.nextReadFileNum = d.readFileNum
+// advanceWritePosN is advanceWritePos for a frame holding msgs messages,
+// see PutTransaction
+func (d *diskQueue) advanceWritePosN(totalBytes int64, msgs int64) error {
+	var err error
 
-	// TODO: each data file should embed the maxBytesPerFile
-	// as the first 8 bytes (at creation time) ensuring that
-	// the value can change without affecting runtime
-	if d.nextReadPos > d.maxBytesPerFile {
-		if d.readFile != nil {
-			d.readFile.Close()
-			d.readFile = nil
-		}
+	if d.indexEvery > 0 {
+		d.indexFrame(d.writePos, d.encodedTimestamp)
+	}
+	if d.clean {
+		// cleared before writePos moves, so that it is never persisted
+		// along with a position the startup scan hasn't vouched for
+		d.clean = false
+	}
+	d.writePos += totalBytes
+	d.bytesSinceSync += totalBytes
+	d.writeFileCount += msgs
+	atomic.AddInt64(&d.depth, msgs)
+	atomic.AddInt64(&d.depthBytes, totalBytes)
+	atomic.AddInt64(&d.stats.writes, msgs)
+	addCount(d.telemetry.writes, msgs)
+	for _, c := range d.cursors {
+		atomic.AddInt64(&c.depth, msgs)
+	}
 
-		d.nextReadFileNum++
-		d.nextReadPos = 0
+	if d.writeFileFull(d.writePos, d.writeFileCount) {
+		err = d.rotate()
 	}
 
-	return readBuf, nil
+	return err
 }
 
-// writeOne performs a low level filesystem write for a single []byte
-// while advancing write positions and rolling files, if necessary
-func (d *diskQueue) writeOne(data []byte) error {
+// writeFileFull returns whether the write file is rolled once it holds
+// count messages up to pos, see WithRotateCount
+func (d *diskQueue) writeFileFull(pos int64, count int64) bool {
+	return pos > d.maxBytesOf(d.writeHeader) || (d.rotateCount > 0 && count >= d.rotateCount)
+}
+
+// rotate closes off the write file and moves on to the next one
+func (d *diskQueue) rotate() error {
 	var err error
+	span := d.startSpan(context.Background(), "diskqueue.rotate")
+	span.SetAttribute("diskqueue.file_num", d.writeFileNum)
+	addCount(d.telemetry.rotations, 1)
 
-	if d.writeFile == nil {
-		curFileName := d.fileName(d.writeFileNum)
-		d.writeFile, err = os.OpenFile(curFileName, os.O_RDWR|os.O_CREATE, 0600)
+	// written out before the file is closed off, rather than by the
+	// sync below once writePos has moved on to the next file
+	if d.writeFile != nil {
+		err = d.flushPending()
 		if err != nil {
+			endSpan(span, err)
 			return err
 		}
+	}
 
-		d.logf(INFO, "DISKQUEUE(%s): writeOne() opened %s", d.name, curFileName)
-
-		if d.writePos > 0 {
-			_, err = d.writeFile.Seek(d.writePos, 0)
-			if err != nil {
-				d.writeFile.Close()
-				d.writeFile = nil
-				return err
-			}
+	// readers only look for a footer past maxBytesPerFile, a file rolled
+	// before that (see WithRotateCount) ends with an end marker instead
+	if d.writePos <= d.maxBytesOf(d.writeHeader) {
+		err = d.writeEndMarker()
+		if err != nil {
+			// the message is in the queue, the next write rolls the file
+			d.log(ERROR, "failed to write end marker", "err", err)
+			endSpan(span, err)
+			return nil
+		}
+	} else if d.segmentFooters {
+		err = d.writeSegmentFooter()
+		if err != nil {
+			d.log(ERROR, "failed to write segment footer", "err", err)
 		}
 	}
-
-	dataLen := int32(len(data))
-
-	if dataLen < d.minMsgSize || dataLen > d.maxMsgSize {
-		return fmt.Errorf("invalid message write size (%d) maxMsgSize=%d", dataLen, d.maxMsgSize)
+	if d.indexEvery > 0 {
+		err = d.writeIndexFile()
+		if err != nil {
+			d.log(ERROR, "failed to write index", "err", err)
+		}
 	}
 
-	d.writeBuf.Reset()
-	err = binary.Write(&d.writeBuf, binary.BigEndian, dataLen)
-	if err != nil {
-		return err
-	}
+	d.writeFileNum++
+	d.writePos = 0
+	d.writeFileCount = 0
+	d.writeFileCRC = 0
 
-	_, err = d.writeBuf.Write(data)
+	// sync every time we start writing to a new file
+	err = d.sync()
 	if err != nil {
-		return err
+		d.log(ERROR, "failed to sync", "err", err)
 	}
 
-	// only write to the file once
-	_, err = d.writeFile.Write(d.writeBuf.Bytes())
-	if err != nil {
+	if d.writeFile != nil {
 		d.writeFile.Close()
 		d.writeFile = nil
-		return err
 	}
+	if d.preallocate {
+		d.releasePreallocated(d.writeFileNum - 1)
+	}
+	d.doneFileBytes += d.fileSize(d.writeFileNum - 1)
+	d.fileHook(d.onFileRotate, d.fileName(d.writeFileNum-1))
+	endSpan(span, err)
+	return err
+}
 
-	totalBytes := int64(4 + dataLen)
-	d.writePos += totalBytes
-	atomic.AddInt64(&d.depth, 1)
+// untilRotation returns how long until the write file is rolled by
+// WithRotateInterval
+func (d *diskQueue) untilRotation() time.Duration {
+	now := time.Now()
+	return now.Truncate(d.rotateInterval).Add(d.rotateInterval).Sub(now)
+}
 
-	if d.writePos > d.maxBytesPerFile {
-		d.writeFileNum++
-		d.writePos = 0
+// rotateDue rolls the write file at the end of an interval of
+// WithRotateInterval, unless nothing was written to it
+func (d *diskQueue) rotateDue() {
+	if d.writePos == 0 {
+		return
+	}
+	err := d.openWriteFile()
+	if err == nil {
+		err = d.rotate()
+	}
+	if err != nil {
+		d.log(ERROR, "failed to roll write file", "err", err)
+	}
+}
 
-		// sync every time we start writing to a new file
+// sync fsyncs the current writeFile and persists metadata
+func (d *diskQueue) sync() error {
+	return d.syncDurable(d.syncMode != SyncNever)
+}
+
+// ackWrite syncs a successful write before it is acknowledged, see SyncAlways
+func (d *diskQueue) ackWrite(err error) error {
+	if err == nil && d.syncMode == SyncAlways {
 		err = d.sync()
+	}
+	return err
+}
+
+// syncDurable is sync, but only fsyncs if durable is set
+func (d *diskQueue) syncDurable(durable bool) error {
+	span := d.startSpan(context.Background(), "diskqueue.sync")
+	span.SetAttribute("diskqueue.durable", durable)
+	start := time.Now()
+	err := d.syncFiles(durable)
+	endSpan(span, err)
+	addCount(d.telemetry.syncs, 1)
+	if err == nil {
+		d.syncHook(time.Since(start))
+	}
+	return err
+}
+
+// syncFiles does the work of syncDurable
+func (d *diskQueue) syncFiles(durable bool) error {
+	start := time.Now()
+	defer addTiming(&d.stats.syncs, &d.stats.syncNanos, start)
+
+	if d.writeFile != nil {
+		err := d.flushPending()
 		if err != nil {
-			d.logf(ERROR, "DISKQUEUE(%s) failed to sync - %s", d.name, err)
+			return err
 		}
+	}
 
-		if d.writeFile != nil {
+	if d.writeFile != nil && durable {
+		err := syncWriteHandle(d.writeFile)
+		if err != nil {
 			d.writeFile.Close()
 			d.writeFile = nil
+			return err
 		}
 	}
 
-	return err
-}
+	if d.ledger != nil && durable {
+		err := d.ledger.sync()
+		if err != nil {
+			return err
+		}
+	}
 
-// sync fsyncs the current writeFile and persists metadata
-func (d *diskQueue) sync() error {
-	if d.writeFile != nil {
-		err := d.writeFile.Sync()
+	if d.dedup != nil && durable {
+		err := d.dedup.sync()
 		if err != nil {
-			d.writeFile.Close()
-			d.writeFile = nil
 			return err
 		}
 	}
 
-	err := d.persistMetaData()
+	if d.delayedFile != nil && durable {
+		err := fdatasync(d.delayedFile)
+		if err != nil {
+			d.delayedFile.Close()
+			d.delayedFile = nil
+			return err
+		}
+	}
+
+	if d.inFlightFile != nil && durable {
+		err := fdatasync(d.inFlightFile)
+		if err != nil {
+			d.inFlightFile.Close()
+			d.inFlightFile = nil
+			return err
+		}
+	}
+
+	err := d.persistMetaData(durable)
 	if err != nil {
 		return err
 	}
 
+	if o, ok := d.syncPolicy.(SyncObserver); ok {
+		o.SyncDone(time.Since(start), d.syncState())
+	}
+
 	d.needSync = false
+	d.resetSyncState()
 	return nil
 }
 
+func (d *diskQueue) resetSyncState() {
+	d.writesSinceSync = 0
+	d.readsSinceSync = 0
+	d.bytesSinceSync = 0
+	d.lastSync = time.Now()
+}
+
+func (d *diskQueue) syncState() SyncState {
+	return SyncState{
+		Writes:  d.writesSinceSync,
+		Reads:   d.readsSinceSync,
+		Bytes:   d.bytesSinceSync,
+		Elapsed: time.Since(d.lastSync),
+		Depth:   atomic.LoadInt64(&d.depth),
+	}
+}
+
 // retrieveMetaData initializes state from the filesystem
 func (d *diskQueue) retrieveMetaData() error {
-	var f *os.File
-	var err error
-
-	fileName := d.metaDataFileName()
-	f, err = os.OpenFile(fileName, os.O_RDONLY, 0600)
+	md, err := readMetaData(d.metaDataFileName())
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	d.metaGeneration = md.generation
+	d.clean = md.clean
 
-	var depth int64
-	_, err = fmt.Fscanf(f, "%d\n%d,%d\n%d,%d\n",
-		&depth,
-		&d.readFileNum, &d.readPos,
-		&d.writeFileNum, &d.writePos)
-	if err != nil {
-		return err
+	d.readFileNum, d.readPos = md.readFileNum, md.readPos
+	d.writeFileNum, d.writePos = md.writeFileNum, md.writePos
+	if md.depthBytes < 0 {
+		md.depthBytes = d.unreadBytes(d.readFileNum, d.readPos)
 	}
-	atomic.StoreInt64(&d.depth, depth)
+	atomic.StoreInt64(&d.depth, md.depth)
+	atomic.StoreInt64(&d.depthBytes, md.depthBytes)
 	d.nextReadFileNum = d.readFileNum
 	d.nextReadPos = d.readPos
+	d.commitReadFileNum = d.readFileNum
+	d.commitReadPos = d.readPos
+
+	for _, cm := range md.cursors {
+		c, ok := d.cursors[cm.name]
+		if !ok {
+			c = &cursor{d: d, name: cm.name}
+			d.cursors[cm.name] = c
+		}
+		c.fileNum = cm.fileNum
+		c.pos = cm.pos
+		c.resetRead()
+	}
 
 	return nil
 }
 
-// persistMetaData atomically writes state to the filesystem
-func (d *diskQueue) persistMetaData() error {
+// persistMetaData atomically writes state to the filesystem, to the
+// metadata file not written last time, see metaDataSlots
+func (d *diskQueue) persistMetaData(durable bool) error {
+	d.metaGeneration++
+	fileName := metaDataSlots(d.metaDataFileName())[d.metaGeneration%2]
+	err := d.writeMetaData(fileName, durable)
+	if err == nil && d.mirrorPath != "" {
+		err = d.writeMetaData(d.mirrorFileName(fileName), durable)
+	}
+	return err
+}
+
+func (d *diskQueue) writeMetaData(fileName string, durable bool) error {
 	var f *os.File
 	var err error
 
-	fileName := d.metaDataFileName()
 	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
 
 	// write to tmp file
@@ -467,25 +3389,32 @@ func (d *diskQueue) persistMetaData() error {
 		return err
 	}
 
-	_, err = fmt.Fprintf(f, "%d\n%d,%d\n%d,%d\n",
-		atomic.LoadInt64(&d.depth),
-		d.readFileNum, d.readPos,
-		d.writeFileNum, d.writePos)
+	_, err = f.Write(d.metaData().encode())
 	if err != nil {
 		f.Close()
 		return err
 	}
-	f.Sync()
+	if durable {
+		f.Sync()
+	}
 	f.Close()
 
 	// atomically rename
-	return os.Rename(tmpFileName, fileName)
+	err = renameFile(tmpFileName, fileName)
+	if err == nil && durable && d.dirSync {
+		err = syncDirHook(path.Dir(fileName))
+	}
+	return err
 }
 
 func (d *diskQueue) metaDataFileName() string {
 	return fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.meta.dat"), d.name)
 }
 
+func (d *diskQueue) ledgerFileName() string {
+	return fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.ledger.dat"), d.name)
+}
+
 func (d *diskQueue) fileName(fileNum int64) string {
 	return fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.%06d.dat"), d.name, fileNum)
 }
@@ -499,30 +3428,25 @@ func (d *diskQueue) checkTailCorruption(depth int64) {
 	// if depth isn't 0 something went wrong
 	if depth != 0 {
 		if depth < 0 {
-			d.logf(ERROR,
-				"DISKQUEUE(%s) negative depth at tail (%d), metadata corruption, resetting 0...",
-				d.name, depth)
+			d.log(ERROR, "negative depth at tail, metadata corruption, resetting 0...", "depth", depth)
 		} else if depth > 0 {
-			d.logf(ERROR,
-				"DISKQUEUE(%s) positive depth at tail (%d), data loss, resetting 0...",
-				d.name, depth)
+			d.log(ERROR, "positive depth at tail, data loss, resetting 0...", "depth", depth)
 		}
 		// force set depth 0
 		atomic.StoreInt64(&d.depth, 0)
+		atomic.StoreInt64(&d.depthBytes, 0)
 		d.needSync = true
 	}
 
 	if d.readFileNum != d.writeFileNum || d.readPos != d.writePos {
 		if d.readFileNum > d.writeFileNum {
-			d.logf(ERROR,
-				"DISKQUEUE(%s) readFileNum > writeFileNum (%d > %d), corruption, skipping to next writeFileNum and resetting 0...",
-				d.name, d.readFileNum, d.writeFileNum)
+			d.log(ERROR, "readFileNum > writeFileNum, corruption, skipping to next writeFileNum and resetting 0...",
+				"readFileNum", d.readFileNum, "writeFileNum", d.writeFileNum)
 		}
 
 		if d.readPos > d.writePos {
-			d.logf(ERROR,
-				"DISKQUEUE(%s) readPos > writePos (%d > %d), corruption, skipping to next writeFileNum and resetting 0...",
-				d.name, d.readPos, d.writePos)
+			d.log(ERROR, "readPos > writePos, corruption, skipping to next writeFileNum and resetting 0...",
+				"readPos", d.readPos, "writePos", d.writePos)
 		}
 
 		d.skipToNextRWFile()
@@ -530,64 +3454,269 @@ func (d *diskQueue) checkTailCorruption(depth int64) {
 	}
 }
 
+// readNext reads the message at readPos, returning false if there is
+// nothing to deliver (yet), e.g. because it failed to read or was skipped
+func (d *diskQueue) readNext() ([]byte, bool) {
+	if d.readFileNum == d.writeFileNum &&
+		d.readPos >= d.writePos-int64(d.pendingWrite.Len()) {
+		// the next message has not been written out yet
+		d.flushPending()
+	}
+	dataRead, err := d.readOne()
+	d.readReadyTime = time.Now()
+	if err == errFileEnd {
+		d.skipFileEnd()
+		return nil, false
+	}
+	if err != nil {
+		d.log(ERROR, "failed to read message", "file", d.fileName(d.readFileNum), "pos", d.readPos, "err", err)
+		d.handleCorruption(err)
+		return nil, false
+	}
+	if d.dropRead {
+		d.dropRead = false
+		d.log(WARN, "dropping corrupt message", "file", d.fileName(d.readFileNum), "pos", d.readPos)
+		d.moveForward()
+		return nil, false
+	}
+	if d.isRedelivery(dataRead) {
+		d.log(WARN, "skipping redelivered message", "file", d.fileName(d.readFileNum), "pos", d.readPos)
+		d.moveForward()
+		return nil, false
+	}
+	return dataRead, true
+}
+
+// skipFileEnd moves the read position from the end of a data file that
+// was abandoned before reaching maxBytesPerFile (e.g. by SpliceFrom) to
+// the start of the next one
+func (d *diskQueue) skipFileEnd() {
+	d.log(INFO, "reached the end of an abandoned file", "file", d.fileName(d.readFileNum))
+	// i.e. the end marker
+	if rest := d.dataEnd(d.readFileNum) - d.readPos; rest > 0 {
+		atomic.AddInt64(&d.depthBytes, -rest)
+	}
+	d.readFileNum++
+	d.readPos = 0
+	d.nextReadFileNum = d.readFileNum
+	d.nextReadPos = 0
+	if !d.manualCommit && d.commitEvery == 0 && d.commitInterval == 0 {
+		d.commitReads()
+	}
+	d.needSync = true
+}
+
 func (d *diskQueue) moveForward() {
-	oldReadFileNum := d.readFileNum
+	if d.ledger != nil {
+		err := d.ledger.record(d.readMessageID())
+		if err != nil {
+			d.log(ERROR, "failed to record delivery", "err", err)
+		}
+	}
+
+	atomic.AddInt64(&d.stats.reads, 1)
+	addCount(d.telemetry.reads, 1)
+	if len(d.readTxn.msgs) > 0 {
+		// the read position only moves past a transaction once all of
+		// its messages have been read, see readOne
+		d.nextReadFileNum, d.nextReadPos = d.readFileNum, d.readPos
+		return
+	}
+	msgs := int64(1)
+	if d.readTxn.count > 0 {
+		msgs = d.readTxn.count
+		d.readTxn = pendingTxn{}
+	}
+
 	d.readFileNum = d.nextReadFileNum
 	d.readPos = d.nextReadPos
-	depth := atomic.AddInt64(&d.depth, -1)
+	depth := atomic.AddInt64(&d.depth, -msgs)
+	atomic.AddInt64(&d.depthBytes, -d.readFrameSize)
+	d.readSeq += msgs
+
+	if d.manualCommit {
+		d.uncommittedReads += msgs
+	} else if d.commitEvery > 0 || d.commitInterval > 0 {
+		d.uncommittedReads += msgs
+		if d.commitEvery > 0 && d.uncommittedReads >= d.commitEvery {
+			d.commitReads()
+			d.needSync = true
+		}
+	} else {
+		d.readsSinceSync += msgs
+		// commitReads sets needSync flag if a file is removed
+		d.commitReads()
+	}
 
-	// see if we need to clean up the old file
-	if oldReadFileNum != d.nextReadFileNum {
+	d.checkTailCorruption(depth)
+}
+
+// commitReads marks every message read so far as consumed,
+// cleaning up data files that have been read in full
+func (d *diskQueue) commitReads() {
+	d.lastCommit = time.Now()
+	if d.commitBufferedReads() {
+		return
+	}
+	d.removeReadFiles(d.readFileNum)
+	d.commitReadPos = d.readPos
+	d.uncommittedReads = 0
+}
+
+// commitTo marks the messages before pos in fileNum as consumed, see WithManualCommit
+func (d *diskQueue) commitTo(fileNum int64, pos int64) error {
+	if fileNum < d.commitReadFileNum || (fileNum == d.commitReadFileNum && pos < d.commitReadPos) ||
+		fileNum > d.readFileNum || (fileNum == d.readFileNum && pos > d.readPos) {
+		return fmt.Errorf("position %d:%d out of range (%d:%d - %d:%d)",
+			fileNum, pos, d.commitReadFileNum, d.commitReadPos, d.readFileNum, d.readPos)
+	}
+
+	n, err := d.framesBetween(d.commitReadFileNum, d.commitReadPos, fileNum, pos)
+	if err != nil {
+		return err
+	}
+
+	d.removeReadFiles(fileNum)
+	d.commitReadPos = pos
+	d.uncommittedReads -= n
+	d.lastCommit = time.Now()
+	d.needSync = true
+	return nil
+}
+
+// removeReadFiles moves the committed read file up to fileNum, removing
+// the data files no longer needed
+func (d *diskQueue) removeReadFiles(fileNum int64) {
+	if d.commitReadFileNum < fileNum {
+		d.commitReadFileNum = fileNum
+	}
+	d.removeFiles()
+}
+
+// removeFiles removes the data files preceding both the committed read
+// file and every cursor, other than those kept for replay
+func (d *diskQueue) removeFiles() {
+	if d.readerless {
+		d.followCursors()
+	}
+	fileNum := d.consumedFileNum()
+	if d.retain {
+		fileNum = d.retainedFrom(fileNum)
+	}
+	d.removeFilesBefore(fileNum)
+}
+
+// consumedFileNum returns the first data file that is still to be read,
+// by the queue's reader or any cursor
+func (d *diskQueue) consumedFileNum() int64 {
+	fileNum := d.commitReadFileNum
+	if d.move != nil && d.move.from.FileNum < fileNum {
+		fileNum = d.move.from.FileNum
+	}
+	for _, c := range d.cursors {
+		if c.fileNum < fileNum {
+			fileNum = c.fileNum
+		}
+	}
+	return fileNum
+}
+
+// removeFilesBefore removes the data files preceding fileNum
+func (d *diskQueue) removeFilesBefore(fileNum int64) {
+	for ; d.firstFileNum < fileNum; d.firstFileNum++ {
 		// sync every time we start reading from a new file
 		d.needSync = true
 
-		fn := d.fileName(oldReadFileNum)
-		err := os.Remove(fn)
-		if err != nil {
-			d.logf(ERROR, "DISKQUEUE(%s) failed to Remove(%s) - %s", d.name, fn, err)
+		fn := d.fileName(d.firstFileNum)
+		d.doneFileBytes -= d.fileSize(d.firstFileNum)
+		err := d.recycleDataFile(fn)
+		// bad files have already been renamed
+		if err != nil && !os.IsNotExist(err) {
+			d.log(ERROR, "failed to remove data file", "file", fn, "err", err)
 		}
 	}
-
-	d.checkTailCorruption(depth)
 }
 
 func (d *diskQueue) handleReadError() {
+	d.skipReadFile(d.fileName(d.readFileNum) + ".bad")
+}
+
+// skipReadFile moves the current (bad) read file to badRenameFn and jumps
+// to the next one
+func (d *diskQueue) skipReadFile(badRenameFn string) {
+	atomic.AddInt64(&d.stats.readErrors, 1)
+	addCount(d.telemetry.readErrors, 1)
+
+	// everything read up to the bad file is considered consumed
+	d.commitReads()
+
 	// jump to the next read file and rename the current (bad) file
 	if d.readFileNum == d.writeFileNum {
 		// if you can't properly read from the current write file it's safe to
 		// assume that something is fucked and we should skip the current file too
+		if d.writeFile != nil {
+			d.flushPending()
+		}
 		if d.writeFile != nil {
 			d.writeFile.Close()
 			d.writeFile = nil
 		}
 		d.writeFileNum++
 		d.writePos = 0
+		d.writeFileCount = 0
+		d.writeFileCRC = 0
 	}
 
 	badFn := d.fileName(d.readFileNum)
-	badRenameFn := badFn + ".bad"
 
-	d.logf(WARN,
-		"DISKQUEUE(%s) jump to next file and saving bad file as %s",
-		d.name, badRenameFn)
+	d.log(WARN, "jump to next file and saving bad file", "file", d.fileName(d.readFileNum), "to", badRenameFn)
 
-	err := os.Rename(badFn, badRenameFn)
+	var err error
+	if badRenameFn == badFn+".bad" {
+		err = renameFile(badFn, badRenameFn)
+	} else {
+		badRenameFn, err = d.quarantineFile(badFn, badRenameFn)
+	}
 	if err != nil {
-		d.logf(ERROR,
-			"DISKQUEUE(%s) failed to rename bad diskqueue file %s to %s",
-			d.name, badFn, badRenameFn)
+		d.log(ERROR, "failed to rename bad diskqueue file", "file", badFn, "to", badRenameFn)
+	} else {
+		atomic.AddInt64(&d.stats.badFiles, 1)
+		addCount(d.telemetry.badFiles, 1)
+		os.Remove(indexFileName(badFn))
+		d.fileHook(d.onBadFile, badRenameFn)
+		if d.dlq != nil {
+			d.salvageBadFile(badRenameFn, d.readPos)
+		}
 	}
 
 	d.readFileNum++
 	d.readPos = 0
 	d.nextReadFileNum = d.readFileNum
 	d.nextReadPos = 0
+	d.readTxn = pendingTxn{}
+	d.bufferedReads = nil
+	d.commitReadFileNum = d.readFileNum
+	d.commitReadPos = 0
+	d.loadDoneFileBytes()
+	atomic.StoreInt64(&d.depthBytes, d.unreadBytes(d.readFileNum, 0))
 
 	// significant state change, schedule a sync on the next iteration
 	d.needSync = true
 }
 
-// ioLoop provides the backend for exposing a go channel (via ReadChan())
+// isRedelivery returns true if the message at the current read position
+// was already delivered and should be skipped
+func (d *diskQueue) isRedelivery(data []byte) bool {
+	if d.ledger == nil || !d.ledger.contains(d.readMessageID()) {
+		return false
+	}
+	if d.onRedelivery != nil {
+		return !d.onRedelivery(data)
+	}
+	return true
+}
+
+// runIOLoop provides the backend for exposing a go channel (via ReadChan())
 // in support of multiple concurrent queue consumers
 //
 // it works by looping and branching based on whether or not the queue has data
@@ -595,69 +3724,377 @@ func (d *diskQueue) handleReadError() {
 // go channels
 //
 // conveniently this also means that we're asynchronously reading from the filesystem
-func (d *diskQueue) ioLoop() {
+func (d *diskQueue) runIOLoop() {
 	var dataRead []byte
 	var err error
-	var count int64
 	var r chan []byte
+	var rm chan Message
+	var re chan *Envelope
+	var envelope *Envelope
+	var rf chan *InFlight
+	var inFlight *InFlight
+	var ri chan []byte
+	var rw chan []byte
+	var rb chan int
+	var w, wd chan []byte
+	var wm, wt chan [][]byte
+	var wmsg chan Message
+	var wr chan readerWrite
+	var wp chan []byte
+	var wmv chan moveInRequest
+	var syncTickerChan <-chan time.Time
+	var commitTickerChan <-chan time.Time
+	var retainTickerChan <-chan time.Time
+	var gcTickerChan <-chan time.Time
+	var delayedTimerChan <-chan time.Time
+	var delayedTimerDue time.Time
+	var inFlightTimerChan <-chan time.Time
+	var inFlightTimerDue time.Time
+	var rotateTimerChan <-chan time.Time
+
+	delayedTimer := time.NewTimer(time.Hour)
+	delayedTimer.Stop()
+	defer delayedTimer.Stop()
+	inFlightTimer := time.NewTimer(time.Hour)
+	inFlightTimer.Stop()
+	defer inFlightTimer.Stop()
 
-	syncTicker := time.NewTicker(d.syncTimeout)
+	// replaced when Reconfigure changes the sync policy's interval
+	var syncTicker *time.Ticker
+	startSyncTicker := func() {
+		if syncTicker != nil {
+			syncTicker.Stop()
+			syncTicker, syncTickerChan = nil, nil
+		}
+		if interval := d.syncPolicy.Interval(); interval > 0 {
+			syncTicker = time.NewTicker(interval)
+			syncTickerChan = syncTicker.C
+		}
+	}
+	startSyncTicker()
+	defer func() {
+		if syncTicker != nil {
+			syncTicker.Stop()
+		}
+	}()
+
+	if d.commitInterval > 0 {
+		commitTicker := time.NewTicker(d.commitInterval)
+		defer commitTicker.Stop()
+		commitTickerChan = commitTicker.C
+	}
+
+	if d.retainAge > 0 {
+		retainTicker := time.NewTicker(d.retainAge)
+		defer retainTicker.Stop()
+		retainTickerChan = retainTicker.C
+	}
+
+	var rotateTimer *time.Timer
+	if d.rotateInterval > 0 {
+		// written to in an earlier interval, before the queue was closed
+		mtime, err := d.fileModTime(d.writeFileNum)
+		if err == nil && mtime.Before(time.Now().Truncate(d.rotateInterval)) {
+			d.rotateDue()
+		}
+		rotateTimer = time.NewTimer(d.untilRotation())
+		defer rotateTimer.Stop()
+		rotateTimerChan = rotateTimer.C
+	}
+
+	if d.badRetain {
+		gcTicker := time.NewTicker(d.badFileCheckEvery())
+		defer gcTicker.Stop()
+		gcTickerChan = gcTicker.C
+	}
 
 	for {
+		if d.uncommittedReads > 0 && d.commitInterval > 0 &&
+			time.Since(d.lastCommit) >= d.commitInterval {
+			d.commitReads()
+			d.needSync = true
+		}
+
+		if len(d.delayed) > 0 && !d.delayed[0].due.After(time.Now()) {
+			d.releaseDelayed()
+		}
+		if len(d.delayed) == 0 {
+			delayedTimerChan = nil
+		} else if due := d.delayed[0].due; delayedTimerChan == nil || !due.Equal(delayedTimerDue) {
+			delayedTimer.Stop()
+			delayedTimer.Reset(time.Until(due))
+			delayedTimerChan = delayedTimer.C
+			delayedTimerDue = due
+		}
+
+		if len(d.inFlightOrder) > 0 && !d.inFlightOrder[0].due.After(time.Now()) {
+			d.requeueInFlight()
+		}
+		if len(d.inFlightOrder) == 0 {
+			inFlightTimerChan = nil
+		} else if due := d.inFlightOrder[0].due; inFlightTimerChan == nil || !due.Equal(inFlightTimerDue) {
+			inFlightTimer.Stop()
+			inFlightTimer.Reset(time.Until(due))
+			inFlightTimerChan = inFlightTimer.C
+			inFlightTimerDue = due
+		}
+
+		d.serveCursors()
+		d.checkWatermarks()
+		d.reportDiskBytes()
+
 		// dont sync all the time :)
-		if count == d.syncEvery {
+		if !d.needSync && d.syncPolicy.ShouldSync(d.syncState()) {
 			d.needSync = true
 		}
 
 		if d.needSync {
 			err = d.sync()
 			if err != nil {
-				d.logf(ERROR, "DISKQUEUE(%s) failed to sync - %s", d.name, err)
+				d.log(ERROR, "failed to sync", "err", err)
 			}
-			count = 0
 		}
 
-		if (d.readFileNum < d.writeFileNum) || (d.readPos < d.writePos) {
+		if !d.readerless && ((d.readFileNum < d.writeFileNum) || (d.readPos < d.writePos)) {
 			if d.nextReadPos == d.readPos {
-				dataRead, err = d.readOne()
-				if err != nil {
-					d.logf(ERROR, "DISKQUEUE(%s) reading at %d of %s - %s",
-						d.name, d.readPos, d.fileName(d.readFileNum), err)
-					d.handleReadError()
+				var ok bool
+				dataRead, ok = d.readNext()
+				envelope = nil
+				inFlight = nil
+				if !ok {
 					continue
 				}
 			}
 			r = d.readChan
+			rm = d.readMessageChan
+			if atomic.LoadInt32(&d.envelopes) == 1 {
+				if envelope == nil {
+					envelope = d.newEnvelope(dataRead)
+				}
+				re = d.readEnvelopeChan
+			}
+			if d.inFlightTimeout > 0 {
+				if inFlight == nil {
+					inFlight = d.newInFlight(dataRead)
+				}
+				rf = d.readInFlightChan
+			}
+			ri = d.readIntoChan
+			rw = d.readWithChan
+			rb = d.readBatchChan
 		} else {
 			r = nil
+			rm = nil
+			re = nil
+			rf = nil
+			ri = nil
+			rw = nil
+			rb = nil
+		}
+		d.updateHeadTime(r != nil)
+
+		// files kept for replay give way to writes
+		for d.overflowBlocked() && d.dropReplayFile() {
+		}
+		if d.overflowBlocked() {
+			w, wd, wm, wt, wmsg, wr, wp, wmv = nil, nil, nil, nil, nil, nil, nil, nil
+		} else {
+			w, wd, wm, wmsg, wr = d.writeChan, d.writeDurableChan, d.writeManyChan, d.writeMessageChan, d.writeReaderChan
+			wt, wp, wmv = d.writeTxnChan, d.putPosChan, d.moveInChan
 		}
 
 		select {
 		// the Go channel spec dictates that nil channel operations (read or write)
 		// in a select are skipped, we set r to d.readChan only when there is data to read
 		case r <- dataRead:
-			count++
+			addTiming(&d.stats.readChanSends, &d.stats.readChanSendNanos, d.readReadyTime)
+			if d.readBufferSize > 0 {
+				d.bufferRead()
+			}
 			// moveForward sets needSync flag if a file is removed
 			d.moveForward()
+		case rm <- Message{Data: dataRead, Timestamp: d.readTimestamp, Headers: d.readHeaders}:
+			addTiming(&d.stats.readChanSends, &d.stats.readChanSendNanos, d.readReadyTime)
+			d.moveForward()
+		case re <- envelope:
+			addTiming(&d.stats.readChanSends, &d.stats.readChanSendNanos, d.readReadyTime)
+			envelope = nil
+			d.moveForward()
+		case <-d.envelopesChan:
+			// offered from the next iteration
+		case rf <- inFlight:
+			addTiming(&d.stats.readChanSends, &d.stats.readChanSendNanos, d.readReadyTime)
+			d.trackInFlight(inFlight)
+			inFlight = nil
+			d.moveForward()
+		case id := <-d.finishChan:
+			d.finishResponseChan <- d.finishInFlight(id)
+		case rw <- dataRead:
+			addTiming(&d.stats.readChanSends, &d.stats.readChanSendNanos, d.readReadyTime)
+			d.moveForward()
+		case buf := <-ri:
+			if len(buf) < len(dataRead) {
+				d.readIntoResponseChan <- readIntoResult{len(dataRead), io.ErrShortBuffer}
+				continue
+			}
+			n := copy(buf, dataRead)
+			addTiming(&d.stats.readChanSends, &d.stats.readChanSendNanos, d.readReadyTime)
+			// dataRead was never handed out so its memory can be reused
+			d.spareReadBuf = dataRead
+			dataRead = nil
+			d.moveForward()
+			d.readIntoResponseChan <- readIntoResult{n, nil}
+		case max := <-rb:
+			batch := d.readBatch(dataRead, max)
+			dataRead = nil
+			d.readBatchResponseChan <- readBatchResult{batch, nil}
 		case <-d.emptyChan:
 			d.emptyResponseChan <- d.deleteAllFiles()
-			count = 0
-		case dataWrite := <-d.writeChan:
-			count++
-			d.writeResponseChan <- d.writeOne(dataWrite)
-		case <-syncTicker.C:
-			if count == 0 {
-				// avoid sync when there's no activity
-				continue
+			d.resetSyncState()
+		case <-d.barrierChan:
+			d.barrierResponseChan <- d.syncDurable(true)
+		case <-d.checkpointChan:
+			d.checkpointResponseChan <- encodeCheckpoint(d.readFileNum, d.readPos)
+		case token := <-d.commitChan:
+			fileNum, pos, err := decodeCheckpoint(token)
+			if err == nil {
+				err = d.commitTo(fileNum, pos)
 			}
-			d.needSync = true
+			d.commitResponseChan <- err
+		case name := <-d.cursorOpenChan:
+			c, err := d.openCursor(name)
+			d.cursorOpenResponseChan <- cursorOpenResult{c, err}
+		case req := <-d.cursorReadChan:
+			if req.advance {
+				d.advanceCursor(req.c)
+			}
+			req.c.waiting = true
+			d.serveCursor(req.c)
+		case req := <-d.cursorCloseChan:
+			d.cursorCloseResponseChan <- d.closeCursor(req)
+		case p := <-d.emptyToChan:
+			d.seekResponseChan <- d.emptyTo(p)
+		case t := <-d.trimChan:
+			n, err := d.trimBefore(t)
+			d.trimResponseChan <- trimResult{n, err}
+		case n := <-d.rewindChan:
+			n, err := d.rewind(n)
+			d.trimResponseChan <- trimResult{n, err}
+		case n := <-d.skipChan:
+			n, err := d.skip(n)
+			d.trimResponseChan <- trimResult{n, err}
+		case max := <-d.trimDepthChan:
+			n, err := d.trimToDepth(max)
+			d.trimResponseChan <- trimResult{n, err}
+		case fileName := <-d.recoverChan:
+			span := d.startSpan(context.Background(), "diskqueue.recover")
+			n, err := d.recoverFile(fileName)
+			span.SetAttribute("diskqueue.recovered", n)
+			endSpan(span, err)
+			d.trimResponseChan <- trimResult{n, err}
+		case pred := <-d.deleteWhereChan:
+			n, err := d.deleteWhere(pred)
+			d.trimResponseChan <- trimResult{n, err}
+		case <-d.compactChan:
+			n, err := d.compact()
+			d.trimResponseChan <- trimResult{n, err}
+		case req := <-d.moveChan:
+			d.moveResponseChan <- d.beginMove(req)
+		case <-d.moveEndChan:
+			d.moveResponseChan <- moveResult{err: d.endMove()}
+		case dataPath := <-d.failoverChan:
+			d.failoverResponseChan <- d.failover(dataPath)
+		case dir := <-d.snapshotChan:
+			d.snapshotResponseChan <- d.snapshot(dir)
+		case req := <-d.spliceChan:
+			d.spliceResponseChan <- d.splice(req)
+		case opts := <-d.reconfigureChan:
+			interval := d.syncPolicy.Interval()
+			err = d.reconfigure(opts)
+			if err == nil && d.syncPolicy.Interval() != interval {
+				startSyncTicker()
+			}
+			d.reconfigureResponseChan <- err
+		case req := <-d.scanChan:
+			d.scanResponseChan <- d.scanBatch(req)
+		case <-d.statsChan:
+			d.statsResponseChan <- d.gatherStats()
+		case <-d.verifyChan:
+			report, err := d.verify()
+			d.verifyResponseChan <- verifyResult{report, err}
+		case token := <-d.seekChan:
+			fileNum, pos, err := decodeCheckpoint(token)
+			if err == nil {
+				err = d.seekTo(fileNum, pos)
+			}
+			d.seekResponseChan <- err
+		case t := <-d.seekTimeChan:
+			d.seekResponseChan <- d.seekToTime(t)
+		case fn := <-d.fastBackwardChan:
+			d.seekResponseChan <- d.fastBackward(fn)
+		case req := <-d.fastForwardChan:
+			res, err := d.fastForward(req.ctx, req.fn)
+			d.fastForwardResponseChan <- fastForwardResult{res, err}
+		case dataWrite := <-w:
+			if d.dedup != nil {
+				// every Put is answered on its own, see WithDedup
+				d.writesSinceSync++
+				d.writeResponseChan <- d.ackWrite(d.writeDeduped(dataWrite))
+			} else {
+				d.writeGrouped(d.gatherWrites(dataWrite))
+			}
+		case data := <-wp:
+			d.writesSinceSync++
+			err := d.ackWrite(d.writeOne(data))
+			d.putPosResponseChan <- putPosResult{d.lastWrite, err}
+		case m := <-wmsg:
+			d.writesSinceSync++
+			d.writeResponseChan <- d.ackWrite(d.writeMessage(m))
+		case dw := <-d.writeDelayedChan:
+			d.writesSinceSync++
+			if dw.due.After(time.Now()) {
+				d.writeResponseChan <- d.ackWrite(d.writeDelayed(dw.data, dw.due))
+			} else {
+				d.writeResponseChan <- d.ackWrite(d.writeOne(dw.data))
+			}
+		case batch := <-wm:
+			d.writesSinceSync++
+			d.writeResponseChan <- d.ackWrite(d.writeMany(batch))
+		case msgs := <-wt:
+			d.writesSinceSync++
+			d.writeResponseChan <- d.ackWrite(d.writeTransaction(msgs))
+		case req := <-wmv:
+			d.writesSinceSync++
+			d.writeResponseChan <- d.moveIn(req)
+		case dataWrite := <-wd:
+			d.writesSinceSync++
+			err = d.writeOne(dataWrite)
+			if err == nil {
+				err = d.syncDurable(true)
+			}
+			d.writeResponseChan <- err
+		case rw := <-wr:
+			d.writesSinceSync++
+			d.writeResponseChan <- d.ackWrite(d.writeOneReader(rw.r, rw.size))
+		case <-syncTickerChan:
+			// syncPolicy is consulted at the top of the loop
+		case <-commitTickerChan:
+			// pending reads are committed at the top of the loop
+		case <-retainTickerChan:
+			d.removeFiles()
+		case <-gcTickerChan:
+			d.collectGarbage()
+		case <-rotateTimerChan:
+			d.rotateDue()
+			rotateTimer.Reset(d.untilRotation())
+		case <-delayedTimerChan:
+			// due messages are released at the top of the loop
+			delayedTimerChan = nil
+		case <-inFlightTimerChan:
+			// messages past their timeout are requeued at the top of the loop
+			inFlightTimerChan = nil
 		case <-d.exitChan:
-			goto exit
+			return
 		}
 	}
-
-exit:
-	d.logf(INFO, "DISKQUEUE(%s): closing ... ioLoop", d.name)
-	syncTicker.Stop()
-	d.exitSyncChan <- 1
 }
@@ -3,8 +3,15 @@ package diskqueue
 import (
 	"bufio"
 	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log/slog"
 	"os"
 	"path"
 	"path/filepath"
@@ -131,6 +138,32 @@ func assertFileNotExist(t *testing.T, fn string) {
 	Equal(t, true, os.IsNotExist(err))
 }
 
+// waitForDepth waits for ioLoop to catch up with the messages read (or
+// written) so far, failing the test if dq doesn't reach depth in time
+// waitFor polls cond until it holds, failing the test with what if it
+// doesn't within 5s
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func waitForDepth(t *testing.T, dq interface{ Depth() int64 }, depth int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for dq.Depth() != depth {
+		if time.Now().After(deadline) {
+			t.Fatalf("depth is %d, expected %d", dq.Depth(), depth)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func TestDiskQueueEmpty(t *testing.T) {
 	l := NewTestLogger(t)
 	dqName := "test_disk_queue_empty" + strconv.Itoa(int(time.Now().Unix()))
@@ -244,16 +277,83 @@ func TestDiskQueueCorruption(t *testing.T) {
 	Equal(t, msg, <-dq.ReadChan())
 }
 
+func TestDiskQueueFileEndMarker(t *testing.T) {
+	l := NewTestLogger(t)
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for i, opts := range [][]Option{
+		{WithRotateCount(3)},
+		{WithRotateCount(3), WithFileFormat(2)},
+		// the markers fall a byte short of the end of a block
+		{WithRotateCount(3), WithFileFormat(2), WithBlockPacking(40)},
+	} {
+		dqName := "test_disk_queue_file_end_marker" + strconv.Itoa(i) + strconv.Itoa(int(time.Now().Unix()))
+		dq := New(dqName, tmpDir, 1000, 1, 1<<10, 2500, 2*time.Second, l, opts...)
+		for j := 0; j < 9; j++ {
+			err = dq.Put(bytes.Repeat([]byte{byte(j)}, 4))
+			Nil(t, err)
+		}
+		Equal(t, int64(3), dq.(*diskQueue).writeFileNum)
+		dq.Close()
+
+		// the rolled files are read through across a restart
+		dq = New(dqName, tmpDir, 1000, 1, 1<<10, 2500, 2*time.Second, l, opts...)
+		for j := 0; j < 6; j++ {
+			Equal(t, bytes.Repeat([]byte{byte(j)}, 4), <-dq.ReadChan())
+		}
+		for j := 9; j < 12; j++ {
+			err = dq.Put(bytes.Repeat([]byte{byte(j)}, 4))
+			Nil(t, err)
+		}
+		for j := 6; j < 12; j++ {
+			Equal(t, bytes.Repeat([]byte{byte(j)}, 4), <-dq.ReadChan())
+		}
+		waitForDepth(t, dq, 0)
+		Equal(t, int64(0), dq.DepthBytes())
+		Equal(t, int64(0), dq.Stats().ReadErrors)
+		dq.Close()
+	}
+
+	// a rolled file cut short is corrupt, even at a frame boundary
+	dqName := "test_disk_queue_file_end_marker_cut" + strconv.Itoa(int(time.Now().Unix()))
+	dq := New(dqName, tmpDir, 1000, 1, 1<<10, 2500, 2*time.Second, l, WithRotateCount(3))
+	for j := 0; j < 6; j++ {
+		err = dq.Put([]byte{byte(j)})
+		Nil(t, err)
+	}
+	dq.Close()
+	fileName := dq.(*diskQueue).fileName(0)
+	err = os.Truncate(fileName, 10)
+	Nil(t, err)
+
+	dq = New(dqName, tmpDir, 1000, 1, 1<<10, 2500, 2*time.Second, l, WithRotateCount(3))
+	defer dq.Close()
+	for j := 0; j < 2; j++ {
+		Equal(t, []byte{byte(j)}, <-dq.ReadChan())
+	}
+	for j := 3; j < 6; j++ {
+		Equal(t, []byte{byte(j)}, <-dq.ReadChan())
+	}
+	Equal(t, int64(1), dq.Stats().ReadErrors)
+	_, err = os.Stat(fileName + ".bad")
+	Nil(t, err)
+}
+
 type md struct {
 	depth        int64
 	readFileNum  int64
 	writeFileNum int64
 	readPos      int64
 	writePos     int64
+	depthBytes   int64
 }
 
 func readMetaDataFile(fileName string, retried int) md {
-	f, err := os.OpenFile(fileName, os.O_RDONLY, 0600)
+	m, err := readMetaData(fileName)
 	if err != nil {
 		// provide a simple retry that results in up to
 		// another 500ms for the file to be written.
@@ -264,17 +364,96 @@ func readMetaDataFile(fileName string, retried int) md {
 		}
 		panic(err)
 	}
-	defer f.Close()
+	return md{
+		depth:        m.depth,
+		depthBytes:   m.depthBytes,
+		readFileNum:  m.readFileNum,
+		readPos:      m.readPos,
+		writeFileNum: m.writeFileNum,
+		writePos:     m.writePos,
+	}
+}
+
+func TestMetaDataEncoding(t *testing.T) {
+	m := metaData{
+		depth:        5,
+		depthBytes:   45,
+		readFileNum:  1,
+		readPos:      18,
+		writeFileNum: 2,
+		writePos:     27,
+		cursors:      []cursorMetaData{{"a", 1, 9}, {"b c", 2, 0}},
+	}
+	b := m.encode()
+	Equal(t, []byte(metaDataMagic), b[:len(metaDataMagic)])
+	decoded, err := decodeMetaData(b)
+	Nil(t, err)
+	Equal(t, m, decoded)
+
+	// truncated or garbled metadata is rejected rather than misread
+	for i := 0; i < len(b); i++ {
+		_, err = decodeMetaData(b[:i])
+		NotNil(t, err)
+	}
+	b[len(b)/2] ^= 0x01
+	_, err = decodeMetaData(b)
+	NotNil(t, err)
+
+	// as written by older versions
+	decoded, err = decodeMetaData([]byte("5 45\n1,18\n2,27\na 1,9\n"))
+	Nil(t, err)
+	m.cursors = m.cursors[:1]
+	Equal(t, m, decoded)
+	decoded, err = decodeMetaData([]byte("5\n1,18\n2,27\n"))
+	Nil(t, err)
+	Equal(t, int64(-1), decoded.depthBytes)
+}
 
-	var ret md
-	_, err = fmt.Fscanf(f, "%d\n%d,%d\n%d,%d\n",
-		&ret.depth,
-		&ret.readFileNum, &ret.readPos,
-		&ret.writeFileNum, &ret.writePos)
+func TestDiskQueueMetaDataSlots(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_meta_data_slots" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
 	if err != nil {
 		panic(err)
 	}
-	return ret
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 1, 1<<10, 1, 2*time.Second, l)
+	for i := 0; i < 3; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+	metaDataFileName := dq.(*diskQueue).metaDataFileName()
+	dq.Close()
+
+	// the two files are written in turn
+	slots := metaDataSlots(metaDataFileName)
+	var generations [2]uint64
+	for i, slot := range slots {
+		b, err := ioutil.ReadFile(slot)
+		Nil(t, err)
+		m, err := decodeMetaData(b)
+		Nil(t, err)
+		Equal(t, int64(3), m.depth)
+		generations[i] = m.generation
+	}
+	newest, older := 0, 1
+	if generations[1] > generations[0] {
+		newest, older = 1, 0
+	}
+	Equal(t, generations[newest]-1, generations[older])
+
+	// metadata that didn't make it to disk falls back to the other file
+	err = ioutil.WriteFile(slots[newest], nil, 0600)
+	Nil(t, err)
+	m, err := readMetaData(metaDataFileName)
+	Nil(t, err)
+	Equal(t, generations[older], m.generation)
+	dq = New(dqName, tmpDir, 1024, 1, 1<<10, 1, 2*time.Second, l)
+	defer dq.Close()
+	Equal(t, int64(3), dq.Depth())
+	for i := 0; i < 3; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
 }
 
 func TestDiskQueueSyncAfterRead(t *testing.T) {
@@ -415,6 +594,4703 @@ func TestDiskQueueTorture(t *testing.T) {
 	Equal(t, depth, read)
 }
 
+func TestDiskQueuePutReader(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_put_reader" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 4, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+
+	msg := bytes.Repeat([]byte("abcd"), 100)
+	err = dq.PutReader(bytes.NewReader(msg), int64(len(msg)))
+	Nil(t, err)
+	Equal(t, int64(1), dq.Depth())
+
+	// a short stream must not leave a partial message behind
+	err = dq.PutReader(bytes.NewReader(msg[:10]), int64(len(msg)))
+	NotNil(t, err)
+	Equal(t, int64(1), dq.Depth())
+	Equal(t, int64(len(msg)+4), dq.(*diskQueue).writePos)
+
+	err = dq.PutReader(bytes.NewReader(msg), 1<<11)
+	NotNil(t, err)
+
+	err = dq.Put([]byte("test"))
+	Nil(t, err)
+
+	Equal(t, msg, <-dq.ReadChan())
+	Equal(t, []byte("test"), <-dq.ReadChan())
+}
+
+func TestDiskQueueReadInto(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_read_into" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 4, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+
+	msg := []byte("test message")
+	for i := 0; i < 3; i++ {
+		err = dq.Put(msg)
+		Nil(t, err)
+	}
+
+	n, err := dq.ReadInto(make([]byte, 4))
+	Equal(t, io.ErrShortBuffer, err)
+	Equal(t, len(msg), n)
+	Equal(t, int64(3), dq.Depth())
+
+	buf := make([]byte, 64)
+	for i := 0; i < 3; i++ {
+		n, err = dq.ReadInto(buf)
+		Nil(t, err)
+		Equal(t, msg, buf[:n])
+	}
+	Equal(t, int64(0), dq.Depth())
+}
+
+func TestDiskQueueReadWith(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_read_with" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 4, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+
+	for i := 0; i < 3; i++ {
+		err = dq.Put([]byte("message " + strconv.Itoa(i)))
+		Nil(t, err)
+	}
+
+	// the message is consumed whatever fn returns
+	errHandler := errors.New("handler failed")
+	err = dq.ReadWith(func(data []byte) error {
+		Equal(t, []byte("message 0"), data)
+		return errHandler
+	})
+	Equal(t, errHandler, err)
+	for i := 1; i < 3; i++ {
+		err = dq.ReadWith(func(data []byte) error {
+			Equal(t, []byte("message "+strconv.Itoa(i)), data)
+			return nil
+		})
+		Nil(t, err)
+	}
+	// the read position moves once ReadWith has been handed the message
+	waitForDepth(t, dq, 0)
+}
+
+func TestDiskQueueSubscribe(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_subscribe" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+
+	for i := 0; i < 5; i++ {
+		err = dq.Put([]byte(strconv.Itoa(i)))
+		Nil(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var seen []string
+	failed := false
+	err = dq.Subscribe(ctx, func(m Message) error {
+		seen = append(seen, string(m.Data))
+		if string(m.Data) == "2" && !failed {
+			failed = true
+			return errors.New("try again later")
+		}
+		if len(seen) == 6 {
+			cancel()
+		}
+		return nil
+	})
+	Equal(t, context.Canceled, err)
+	Equal(t, []string{"0", "1", "2", "3", "4", "2"}, seen)
+
+	waitForDepth(t, dq, 0)
+}
+
+func TestDiskQueueCheckpoint(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_checkpoint" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// 5 bytes per message, 10 messages per file
+	dq := New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l)
+
+	for i := 0; i < 30; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+	token := dq.Checkpoint()
+	for i := 2; i < 5; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+
+	// rewind within the current file
+	err = dq.SeekCheckpoint(token)
+	Nil(t, err)
+	Equal(t, int64(28), dq.Depth())
+	Equal(t, []byte{2}, <-dq.ReadChan())
+
+	// forward across files
+	for i := 3; i < 25; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+	token = dq.Checkpoint()
+	err = dq.SeekCheckpoint(encodeCheckpoint(0, 5))
+	NotNil(t, err)
+	dq.Close()
+
+	dq = New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+	err = dq.SeekCheckpoint(token)
+	Nil(t, err)
+	Equal(t, int64(5), dq.Depth())
+	Equal(t, []byte{25}, <-dq.ReadChan())
+
+	err = dq.SeekCheckpoint([]byte("garbage"))
+	NotNil(t, err)
+}
+
+func TestDiskQueueSyncPolicy(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_sync_policy" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 0, 1<<10, 1, time.Millisecond, l,
+		WithSyncPolicy(ThresholdSyncPolicy{Bytes: 100}))
+	defer dq.Close()
+
+	msg := make([]byte, 40)
+	dq.Put(msg)
+	dq.Put(msg)
+	assertFileNotExist(t, dq.(*diskQueue).metaDataFileName())
+
+	dq.Put(msg)
+	d := readMetaDataFile(dq.(*diskQueue).metaDataFileName(), 0)
+	Equal(t, int64(3), d.depth)
+	Equal(t, int64(132), d.writePos)
+}
+
+func TestDiskQueuePutDurable(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_put_durable" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+
+	msg := make([]byte, 10)
+	err = dq.Put(msg)
+	Nil(t, err)
+	assertFileNotExist(t, dq.(*diskQueue).metaDataFileName())
+
+	err = dq.PutDurable(msg)
+	Nil(t, err)
+	d := readMetaDataFile(dq.(*diskQueue).metaDataFileName(), 9)
+	Equal(t, int64(2), d.depth)
+	Equal(t, int64(28), d.writePos)
+}
+
+func TestDiskQueueWriteBarrier(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_write_barrier" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+
+	msg := make([]byte, 10)
+	for i := 0; i < 5; i++ {
+		err = dq.Put(msg)
+		Nil(t, err)
+	}
+	assertFileNotExist(t, dq.(*diskQueue).metaDataFileName())
+
+	err = dq.WriteBarrier()
+	Nil(t, err)
+	d := readMetaDataFile(dq.(*diskQueue).metaDataFileName(), 9)
+	Equal(t, int64(5), d.depth)
+	Equal(t, int64(70), d.writePos)
+
+	err = dq.Put(msg)
+	Nil(t, err)
+	<-dq.ReadChan()
+	err = dq.Sync()
+	Nil(t, err)
+	d = readMetaDataFile(dq.(*diskQueue).metaDataFileName(), 9)
+	Equal(t, int64(5), d.depth)
+	Equal(t, int64(84), d.writePos)
+	Equal(t, int64(14), d.readPos)
+}
+
+func TestDiskQueueReadCommitBatch(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_read_commit_batch" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// 14 bytes per message, 4 messages per file
+	dq := New(dqName, tmpDir, 50, 0, 1<<10, 1, time.Second, l,
+		WithReadCommitBatch(3, 0))
+	defer dq.Close()
+
+	msg := make([]byte, 10)
+	for i := 0; i < 10; i++ {
+		err = dq.Put(msg)
+		Nil(t, err)
+	}
+
+	for i := 0; i < 5; i++ {
+		<-dq.ReadChan()
+	}
+	err = dq.WriteBarrier()
+	Nil(t, err)
+	d := readMetaDataFile(dq.(*diskQueue).metaDataFileName(), 0)
+	Equal(t, int64(7), d.depth)
+	Equal(t, int64(0), d.readFileNum)
+	Equal(t, int64(42), d.readPos)
+
+	// the first file has been read in full but is not committed yet
+	_, err = os.Stat(dq.(*diskQueue).fileName(0))
+	Nil(t, err)
+
+	// rewinding to the committed position redelivers
+	err = dq.SeekCheckpoint(encodeCheckpoint(0, 42))
+	Nil(t, err)
+	Equal(t, int64(7), dq.Depth())
+
+	for i := 0; i < 3; i++ {
+		<-dq.ReadChan()
+	}
+	err = dq.WriteBarrier()
+	Nil(t, err)
+	d = readMetaDataFile(dq.(*diskQueue).metaDataFileName(), 0)
+	Equal(t, int64(4), d.depth)
+	Equal(t, int64(1), d.readFileNum)
+	Equal(t, int64(28), d.readPos)
+	assertFileNotExist(t, dq.(*diskQueue).fileName(0))
+}
+
+func TestDiskQueueDeliveryLedger(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_delivery_ledger" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, l,
+		WithDeliveryLedger(3, nil))
+
+	for i := 0; i < 5; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+	for i := 0; i < 3; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+	metaDataFileName := dq.(*diskQueue).metaDataFileName()
+	dq.Close()
+
+	// simulate a crash before the read position was persisted
+	err = ioutil.WriteFile(metaDataFileName, []byte("5\n0,0\n0,25\n"), 0600)
+	Nil(t, err)
+	os.Remove(metaDataSlots(metaDataFileName)[1])
+
+	var redelivered [][]byte
+	dq = New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, l,
+		WithDeliveryLedger(3, func(data []byte) bool {
+			redelivered = append(redelivered, data)
+			return data[0] == 1
+		}))
+	defer dq.Close()
+
+	Equal(t, []byte{1}, <-dq.ReadChan())
+	Equal(t, []byte{3}, <-dq.ReadChan())
+	Equal(t, [][]byte{{0}, {1}, {2}}, redelivered)
+}
+
+func TestDiskQueueDeliveryLedgerEmpty(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_delivery_ledger_empty" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, l,
+		WithDeliveryLedger(3, nil))
+	for i := 0; i < 3; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+	for i := 0; i < 3; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+	err = dq.Empty()
+	Nil(t, err)
+	metaDataFileName := dq.(*diskQueue).metaDataFileName()
+	dq.Close()
+
+	// a crash before the metadata was written again, the queue starts
+	// over from the first position of the first file
+	for _, slot := range metaDataSlots(metaDataFileName) {
+		os.Remove(slot)
+	}
+	dq = New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, l,
+		WithDeliveryLedger(3, nil))
+	err = dq.Put([]byte{10})
+	Nil(t, err)
+	dq.Close()
+
+	dq = New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, l,
+		WithDeliveryLedger(3, nil))
+	defer dq.Close()
+	Equal(t, int64(1), dq.Depth())
+	Equal(t, []byte{10}, <-dq.ReadChan())
+	waitForDepth(t, dq, 0)
+}
+
+func TestDiskQueueFrameTrailer(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_frame_trailer" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 1, 1<<10, 1, time.Second, l, WithFrameTrailer())
+	defer dq.Close()
+
+	for i := 1; i <= 5; i++ {
+		err = dq.Put(bytes.Repeat([]byte{byte(i)}, i))
+		Nil(t, err)
+	}
+	err = dq.PutReader(bytes.NewReader([]byte{6, 6, 6, 6, 6, 6}), 6)
+	Nil(t, err)
+	Equal(t, int64(1+2+3+4+5+6+6*12), dq.(*diskQueue).writePos)
+
+	// walk the file backwards from the write position
+	f, err := os.Open(dq.(*diskQueue).fileName(0))
+	Nil(t, err)
+	defer f.Close()
+	end := dq.(*diskQueue).writePos
+	for i := 6; i >= 1; i-- {
+		var data []byte
+		data, _, end, err = readFrameBefore(f, end, fileFormatV1, 1, 1<<10)
+		Nil(t, err)
+		Equal(t, bytes.Repeat([]byte{byte(i)}, i), data)
+	}
+	Equal(t, int64(0), end)
+
+	// flip a bit in the 3rd message, the rest of the file is skipped
+	dqFn := dq.(*diskQueue).fileName(0)
+	b, err := ioutil.ReadFile(dqFn)
+	Nil(t, err)
+	b[1+2+2*12+frameHeaderSize] ^= 0x01
+	err = ioutil.WriteFile(dqFn, b, 0600)
+	Nil(t, err)
+
+	Equal(t, []byte{1}, <-dq.ReadChan())
+	Equal(t, []byte{2, 2}, <-dq.ReadChan())
+	dq.Put([]byte{7})
+	Equal(t, []byte{7}, <-dq.ReadChan())
+}
+
+func TestDiskQueueStats(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_stats" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+
+	msg := make([]byte, 10)
+	for i := 0; i < 5; i++ {
+		err = dq.Put(msg)
+		Nil(t, err)
+	}
+	for i := 0; i < 3; i++ {
+		<-dq.ReadChan()
+	}
+	err = dq.WriteBarrier()
+	Nil(t, err)
+
+	s := dq.Stats()
+	Equal(t, int64(5), s.PutWaits)
+	Equal(t, int64(3), s.ReadChanSends)
+	Equal(t, int64(2), s.FileOpens)
+	Equal(t, int64(1), s.Syncs)
+	Equal(t, true, s.SyncTime > 0)
+	Equal(t, true, s.PutWaitTime > 0)
+	Equal(t, int64(5), s.Writes)
+	Equal(t, int64(3), s.Reads)
+	Equal(t, int64(0), s.ReadErrors)
+	Equal(t, int64(42), s.ReadPos)
+	Equal(t, int64(70), s.WritePos)
+	Equal(t, int64(2), s.Depth)
+	Equal(t, int64(28), s.DepthBytes)
+}
+
+func TestDiskQueueFairAdmission(t *testing.T) {
+	var g fifoGate
+	var wg sync.WaitGroup
+	var order []int
+
+	g.enter()
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			g.enter()
+			order = append(order, i)
+			g.leave()
+		}(i)
+		// wait for each goroutine to queue up before starting the next
+		waitFor(t, "the goroutine didn't queue up", func() bool {
+			return g.waiting() == i+1
+		})
+	}
+	g.leave()
+	wg.Wait()
+	Equal(t, []int{0, 1, 2, 3, 4}, order)
+
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_fair_admission" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l, WithFairAdmission())
+	defer dq.Close()
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				err := dq.Put([]byte("test"))
+				Nil(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	Equal(t, int64(100), dq.Depth())
+}
+
+func TestDiskQueueBlockPacking(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_block_packing" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// 14 bytes per message, 4 messages per 64 byte block
+	dq := New(dqName, tmpDir, 640, 0, 1<<10, 2500, 2*time.Second, l, WithBlockPacking(64))
+
+	for i := 0; i < 10; i++ {
+		err = dq.Put(bytes.Repeat([]byte{byte(i)}, 10))
+		Nil(t, err)
+	}
+	Equal(t, int64(128+28), dq.(*diskQueue).writePos)
+
+	// only complete blocks have been written
+	fi, err := os.Stat(dq.(*diskQueue).fileName(0))
+	Nil(t, err)
+	Equal(t, int64(128), fi.Size())
+
+	// a message larger than a block
+	err = dq.Put(bytes.Repeat([]byte{10}, 100))
+	Nil(t, err)
+	Equal(t, int64(11), dq.Depth())
+	Equal(t, int64(192+104), dq.(*diskQueue).writePos)
+
+	for i := 0; i < 5; i++ {
+		Equal(t, bytes.Repeat([]byte{byte(i)}, 10), <-dq.ReadChan())
+	}
+	dq.Close()
+
+	dq = New(dqName, tmpDir, 640, 0, 1<<10, 2500, 2*time.Second, l, WithBlockPacking(64))
+	defer dq.Close()
+	Equal(t, int64(6), dq.Depth())
+	err = dq.Put(bytes.Repeat([]byte{11}, 10))
+	Nil(t, err)
+	for i := 5; i < 10; i++ {
+		Equal(t, bytes.Repeat([]byte{byte(i)}, 10), <-dq.ReadChan())
+	}
+	Equal(t, bytes.Repeat([]byte{10}, 100), <-dq.ReadChan())
+	Equal(t, bytes.Repeat([]byte{11}, 10), <-dq.ReadChan())
+
+	err = dq.SeekCheckpoint(dq.Checkpoint())
+	Nil(t, err)
+	Equal(t, int64(0), dq.Depth())
+}
+
+func TestDiskQueueWriteBuffer(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_write_buffer" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	_, err = NewWithOptions(dqName, tmpDir, WithLogger(l), WithWriteBuffer(64), WithBlockPacking(64))
+	NotNil(t, err)
+
+	// 14 bytes per message, written out 4 at a time
+	dq := New(dqName, tmpDir, 140, 0, 1<<10, 2500, 2*time.Second, l, WithWriteBuffer(50))
+	for i := 0; i < 4; i++ {
+		err = dq.Put(bytes.Repeat([]byte{byte(i)}, 10))
+		Nil(t, err)
+	}
+	Equal(t, int64(56), dq.(*diskQueue).writePos)
+	// the first message was written out for the (waiting) reader
+	Equal(t, int64(14), dq.(*diskQueue).fileSize(0))
+	err = dq.Put(bytes.Repeat([]byte{4}, 10))
+	Nil(t, err)
+	Equal(t, int64(70), dq.(*diskQueue).fileSize(0))
+	for i := 0; i < 5; i++ {
+		Equal(t, bytes.Repeat([]byte{byte(i)}, 10), <-dq.ReadChan())
+	}
+
+	// rolls over to the next file
+	var batch [][]byte
+	for i := 5; i < 11; i++ {
+		batch = append(batch, bytes.Repeat([]byte{byte(i)}, 10))
+	}
+	err = dq.PutMany(batch)
+	Nil(t, err)
+	Equal(t, int64(1), dq.(*diskQueue).writeFileNum)
+	Equal(t, int64(154), dq.(*diskQueue).fileSize(0))
+	dq.Close()
+
+	dq = New(dqName, tmpDir, 140, 0, 1<<10, 2500, 2*time.Second, l, WithWriteBuffer(50))
+	defer dq.Close()
+	Equal(t, int64(6), dq.Depth())
+	for i := 5; i < 11; i++ {
+		Equal(t, bytes.Repeat([]byte{byte(i)}, 10), <-dq.ReadChan())
+	}
+}
+
+func TestAdaptiveSyncPolicy(t *testing.T) {
+	p := &AdaptiveSyncPolicy{MinInterval: 10 * time.Millisecond, MaxInterval: 50 * time.Millisecond}
+	Equal(t, 10*time.Millisecond, p.CurrentInterval())
+	Equal(t, false, p.ShouldSync(SyncState{Elapsed: time.Second}))
+	Equal(t, true, p.ShouldSync(SyncState{Writes: 1, Elapsed: 10 * time.Millisecond}))
+
+	// slow fsyncs under a high write rate stretch the interval up to the max
+	for i := 0; i < 20; i++ {
+		p.SyncDone(10*time.Millisecond, SyncState{Writes: 100, Elapsed: 10 * time.Millisecond})
+	}
+	Equal(t, 50*time.Millisecond, p.CurrentInterval())
+	Equal(t, false, p.ShouldSync(SyncState{Writes: 1, Elapsed: 20 * time.Millisecond}))
+
+	// a trickle of writes gains nothing from waiting
+	for i := 0; i < 50; i++ {
+		p.SyncDone(4*time.Millisecond, SyncState{Writes: 1, Elapsed: time.Second})
+	}
+	Equal(t, 10*time.Millisecond, p.CurrentInterval())
+
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_adaptive_sync" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 0, 1<<10, 1, time.Second, l,
+		WithSyncPolicy(&AdaptiveSyncPolicy{MinInterval: 10 * time.Millisecond, MaxInterval: time.Second}))
+	defer dq.Close()
+
+	err = dq.Put(make([]byte, 10))
+	Nil(t, err)
+	d := readMetaDataFile(dq.(*diskQueue).metaDataFileName(), 0)
+	Equal(t, int64(1), d.depth)
+}
+
+func TestDiskQueueReadPreopen(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_read_preopen" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// 5 bytes per message, 10 messages per file
+	dq := New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l, WithReadPreopen(16))
+	defer dq.Close()
+
+	for i := 0; i < 35; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+
+	for i := 0; i < 15; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+	token := dq.Checkpoint()
+	for i := 15; i < 19; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+
+	// rewinding discards the handle opened ahead of time
+	err = dq.SeekCheckpoint(token)
+	Nil(t, err)
+	for i := 15; i < 35; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+
+	// the head read ahead of the write file is what had been written, the
+	// rest is read from the file
+	dq = New(dqName+"_write", tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l, WithReadPreopen(1<<10))
+	defer dq.Close()
+	for i := 0; i < 25; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+	for i := 0; i < 18; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+	for i := 25; i < 30; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+	for i := 18; i < 30; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+}
+
+func TestDiskQueueMmapWrites(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_mmap_writes" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// 5 bytes per message, 10 messages per file
+	dq := New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l, WithMmapWrites())
+	for i := 0; i < 25; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+
+	// rolled files are trimmed back to the frames written to them
+	stat, err := os.Stat(dq.(*diskQueue).fileName(0))
+	Nil(t, err)
+	Equal(t, int64(50), stat.Size())
+
+	for i := 0; i < 5; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+	dq.Close()
+
+	stat, err = os.Stat(dq.(*diskQueue).fileName(2))
+	Nil(t, err)
+	Equal(t, int64(25), stat.Size())
+
+	dq = New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l, WithMmapWrites())
+	defer dq.Close()
+	Equal(t, int64(20), dq.Depth())
+	err = dq.Put([]byte{25})
+	Nil(t, err)
+	for i := 5; i < 26; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+}
+
+func TestDiskQueueAppendWrites(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_append_writes" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, l, WithAppendWrites())
+	for i := 0; i < 5; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+	dq.Close()
+
+	// simulate a crash after a write that never made it into the metadata
+	// followed by a torn write
+	fn := dq.(*diskQueue).fileName(0)
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0600)
+	Nil(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 1, 5, 0, 0, 0, 1})
+	Nil(t, err)
+	f.Close()
+
+	dq = New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, l, WithAppendWrites())
+	defer dq.Close()
+	Equal(t, int64(6), dq.Depth())
+	Equal(t, int64(30), dq.(*diskQueue).writePos)
+	stat, err := os.Stat(fn)
+	Nil(t, err)
+	Equal(t, int64(30), stat.Size())
+
+	err = dq.Put([]byte{6})
+	Nil(t, err)
+	for i := 0; i < 7; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+}
+
+func TestDiskQueueSegmentFootersEarlyRoll(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_segment_footers_early_roll" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// rolled by count, well before maxBytesPerFile
+	dq := New(dqName, tmpDir, 49, 0, 1<<10, 2500, 2*time.Second, l, WithSegmentFooters(), WithRotateCount(3))
+	for i := 0; i < 7; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+	d := dq.(*diskQueue)
+	_, ok := d.readSegmentFooter(d.fileName(0))
+	Equal(t, false, ok)
+	for i := 0; i < 7; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+	waitForDepth(t, dq, 0)
+	dq.Close()
+
+	// and by interval
+	dq = New(dqName+"_interval", tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l,
+		WithSegmentFooters(), WithRotateInterval(50*time.Millisecond))
+	defer dq.Close()
+	for i := 0; i < 2; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+	start := time.Now()
+	for dq.Stats().WriteFileNum == 0 {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("write file wasn't rolled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	err = dq.Put([]byte{2})
+	Nil(t, err)
+	for i := 0; i < 3; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+	waitForDepth(t, dq, 0)
+}
+
+func TestDiskQueueSegmentFooters(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_segment_footers" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// 5 bytes per message, 10 messages per file
+	dq := New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l, WithSegmentFooters())
+	for i := 0; i < 25; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+	dq.Close()
+
+	d := dq.(*diskQueue)
+	stat, err := os.Stat(d.fileName(0))
+	Nil(t, err)
+	Equal(t, int64(50+segmentFooterSize), stat.Size())
+	footer, ok := d.readSegmentFooter(d.fileName(1))
+	Equal(t, true, ok)
+	Equal(t, int64(10), footer.count)
+	Equal(t, int64(50), footer.span)
+	Nil(t, d.checkSegment(d.fileName(1)))
+	_, ok = d.readSegmentFooter(d.fileName(2))
+	Equal(t, false, ok)
+	NotNil(t, d.checkSegment(d.fileName(2)))
+
+	// full files are counted from their footers alone
+	orig, err := ioutil.ReadFile(d.fileName(0))
+	Nil(t, err)
+	corrupt := append(make([]byte, 50), orig[50:]...)
+	err = ioutil.WriteFile(d.fileName(0), corrupt, 0600)
+	Nil(t, err)
+	depth, err := d.depthInFiles(0, 0)
+	Nil(t, err)
+	Equal(t, int64(25), depth)
+	NotNil(t, d.checkSegment(d.fileName(0)))
+
+	// footers written without a checksum are still understood
+	v1 := append(append([]byte{}, orig[:66]...), orig[70:]...)
+	binary.BigEndian.PutUint32(v1[len(v1)-4:], segmentFooterMagicV1)
+	err = ioutil.WriteFile(d.fileName(0), v1, 0600)
+	Nil(t, err)
+	footer, ok = d.readSegmentFooter(d.fileName(0))
+	Equal(t, true, ok)
+	Equal(t, segmentFooter{count: 10, span: 50}, footer)
+	Nil(t, d.checkSegment(d.fileName(0)))
+
+	err = ioutil.WriteFile(d.fileName(0), orig, 0600)
+	Nil(t, err)
+
+	dq = New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l, WithSegmentFooters())
+	defer dq.Close()
+	d = dq.(*diskQueue)
+	Equal(t, int64(5), d.writeFileCount)
+
+	for i := 0; i < 5; i++ {
+		err = dq.Put([]byte{byte(25 + i)})
+		Nil(t, err)
+	}
+	for i := 0; i < 30; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+}
+
+type panickingSyncPolicy struct {
+	ThresholdSyncPolicy
+	panics int32
+}
+
+func (p *panickingSyncPolicy) ShouldSync(s SyncState) bool {
+	if atomic.AddInt32(&p.panics, -1) >= 0 {
+		panic("boom")
+	}
+	return p.ThresholdSyncPolicy.ShouldSync(s)
+}
+
+func TestDiskQueuePanicRecovery(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_panic_recovery" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	policy := &panickingSyncPolicy{ThresholdSyncPolicy: ThresholdSyncPolicy{Ops: 1}}
+	dq := New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, l, WithSyncPolicy(policy))
+	defer dq.Close()
+
+	for i := 0; i < 5; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+	Nil(t, dq.LastError())
+	err = dq.WriteBarrier()
+	Nil(t, err)
+
+	// the loop restarts from the persisted state
+	atomic.StoreInt32(&policy.panics, 1)
+	err = dq.PutDurable([]byte{5})
+	Nil(t, err)
+	err = dq.Put([]byte{6})
+	Nil(t, err)
+	NotNil(t, dq.LastError())
+	for i := 0; i < 7; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+
+	// until it has panicked too many times
+	atomic.StoreInt32(&policy.panics, ioLoopMaxRestarts+1)
+	// (the write racing the first panic may still go through)
+	for i := 0; err == nil && i < 2; i++ {
+		err = dq.Put([]byte{7})
+	}
+	NotNil(t, err)
+	Equal(t, dq.LastError(), err)
+	_, err = dq.ReadInto(make([]byte, 1))
+	Equal(t, dq.LastError(), err)
+}
+
+func TestDiskQueuePanicFailsReaders(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_panic_fails_readers" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	policy := &panickingSyncPolicy{ThresholdSyncPolicy: ThresholdSyncPolicy{Ops: 1}}
+	dq := New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, l, WithSyncPolicy(policy))
+	defer dq.Close()
+	c, err := dq.NewCursor("reader")
+	Nil(t, err)
+
+	// both wait on the empty queue when it fails
+	readWithErr := make(chan error, 1)
+	go func() {
+		readWithErr <- dq.ReadWith(func([]byte) error { return nil })
+	}()
+	cursorOK := make(chan bool, 1)
+	go func() {
+		_, ok := <-c.ReadChan()
+		cursorOK <- ok
+	}()
+
+	atomic.StoreInt32(&policy.panics, ioLoopMaxRestarts+1)
+	for i := 0; err == nil && i < 2; i++ {
+		err = dq.WriteBarrier()
+	}
+	NotNil(t, err)
+
+	select {
+	case err = <-readWithErr:
+		Equal(t, dq.LastError(), err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadWith wasn't failed")
+	}
+	select {
+	case ok := <-cursorOK:
+		Equal(t, false, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the cursor wasn't failed")
+	}
+	err = dq.ReadWith(func([]byte) error { return nil })
+	Equal(t, dq.LastError(), err)
+}
+
+func TestDiskQueuePutMany(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_put_many" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// 5 bytes per message, 10 messages per file
+	dq := New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+
+	var batch [][]byte
+	for i := 0; i < 25; i++ {
+		batch = append(batch, []byte{byte(i)})
+	}
+	err = dq.PutMany(batch)
+	Nil(t, err)
+	Equal(t, int64(25), dq.Depth())
+	Equal(t, int64(2), dq.(*diskQueue).writeFileNum)
+	Equal(t, int64(25), dq.(*diskQueue).writePos)
+
+	// nothing is written if any message is invalid
+	err = dq.PutMany([][]byte{{25}, {}})
+	NotNil(t, err)
+	Equal(t, int64(25), dq.Depth())
+
+	for i := 0; i < 25; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+}
+
+// stallingSyncPolicy blocks ioLoop once the given number of writes is reached
+type stallingSyncPolicy struct {
+	ThresholdSyncPolicy
+	writes int64
+	stall  chan struct{}
+}
+
+func (p *stallingSyncPolicy) ShouldSync(s SyncState) bool {
+	if s.Writes >= p.writes {
+		<-p.stall
+	}
+	return p.ThresholdSyncPolicy.ShouldSync(s)
+}
+
+func TestDiskQueuePutContext(t *testing.T) {
+	var g fifoGate
+	g.enter()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := g.enterContext(ctx)
+	Equal(t, context.Canceled, err)
+	Equal(t, 0, g.waiting())
+	g.leave()
+
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_put_context" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	policy := &stallingSyncPolicy{
+		ThresholdSyncPolicy: ThresholdSyncPolicy{Ops: 2500},
+		writes:              2,
+		stall:               make(chan struct{}),
+	}
+	dq := New(dqName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l,
+		WithSyncPolicy(policy), WithFairAdmission())
+
+	err = dq.PutContext(context.Background(), []byte("test"))
+	Nil(t, err)
+
+	// ioLoop stalls after the next write
+	err = dq.Put([]byte("test"))
+	Nil(t, err)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = dq.PutContext(ctx, []byte("test"))
+	Equal(t, context.DeadlineExceeded, err)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = dq.CloseContext(ctx)
+	Equal(t, context.DeadlineExceeded, err)
+
+	// the close completes in the background once ioLoop is unstuck
+	close(policy.stall)
+	md := readMetaDataFile(dq.(*diskQueue).metaDataFileName(), 0)
+	Equal(t, int64(2), md.depth)
+}
+
+func TestDiskQueueManualCommit(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_manual_commit" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// 5 bytes per message, 10 messages per file
+	dq := New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l, WithManualCommit())
+	for i := 0; i < 25; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+
+	for i := 0; i < 12; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+	token := dq.Checkpoint()
+	Equal(t, []byte{12}, <-dq.ReadChan())
+	err = dq.Commit(token)
+	Nil(t, err)
+	assertFileNotExist(t, dq.(*diskQueue).fileName(0))
+
+	// positions already committed or not yet read are rejected
+	err = dq.Commit(encodeCheckpoint(0, 0))
+	NotNil(t, err)
+	err = dq.Commit(encodeCheckpoint(2, 0))
+	NotNil(t, err)
+
+	for i := 13; i < 15; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+	dq.Close()
+
+	// messages read but not committed are redelivered
+	dq = New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l, WithManualCommit())
+	defer dq.Close()
+	Equal(t, int64(13), dq.Depth())
+	for i := 12; i < 25; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+}
+
+func TestDiskQueueNewWithOptions(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_new_with_options" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	invalid := [][]Option{
+		{WithMaxBytesPerFile(0)},
+		{WithMsgSize(10, 4)},
+		{WithMsgSize(-1, 4)},
+		{WithSyncEvery(-1)},
+		{WithSyncEvery(1), WithSyncPolicy(ThresholdSyncPolicy{Bytes: 100})},
+		{WithSyncPolicy(&AdaptiveSyncPolicy{MaxInterval: time.Second}), WithSyncTimeout(time.Second)},
+		{WithLogger(nil)},
+		{WithMaxBytesPerFile(1000), WithBlockPacking(512)},
+		{WithMmapWrites(), WithAppendWrites()},
+	}
+	for _, opts := range invalid {
+		dq, err := NewWithOptions(dqName, tmpDir, opts...)
+		NotNil(t, err)
+		Equal(t, nil, dq)
+	}
+	_, err = NewWithOptions(dqName, path.Join(tmpDir, "missing"))
+	NotNil(t, err)
+	_, err = NewWithOptions("", tmpDir)
+	NotNil(t, err)
+
+	dq, err := NewWithOptions(dqName, tmpDir, WithLogger(l),
+		WithMaxBytesPerFile(49), WithMsgSize(1, 1<<10), WithSyncEvery(1))
+	Nil(t, err)
+	defer dq.Close()
+	for i := 0; i < 15; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+	Equal(t, int64(1), dq.(*diskQueue).writeFileNum)
+	err = dq.Put(nil)
+	NotNil(t, err)
+	for i := 0; i < 15; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+}
+
+func TestDiskQueueChecksumHandler(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_checksum_handler" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 1, 1<<10, 1, time.Second, l, WithFrameTrailer())
+	for i := 1; i <= 6; i++ {
+		err = dq.Put(bytes.Repeat([]byte{byte(i)}, i))
+		Nil(t, err)
+	}
+	dq.Close()
+
+	// flip a bit in the 3rd and 4th messages
+	dqFn := dq.(*diskQueue).fileName(0)
+	b, err := ioutil.ReadFile(dqFn)
+	Nil(t, err)
+	b[1+2+2*12+frameHeaderSize] ^= 0x01
+	b[1+2+3+3*12+frameHeaderSize] ^= 0x01
+	err = ioutil.WriteFile(dqFn, b, 0600)
+	Nil(t, err)
+
+	var corrupt [][]byte
+	handler := func(data []byte, err error) bool {
+		corrupt = append(corrupt, append([]byte{}, data...))
+		Equal(t, errChecksumMismatch, err)
+		// deliver the first, drop the second
+		return len(corrupt) == 1
+	}
+	dq = New(dqName, tmpDir, 1024, 1, 1<<10, 1, time.Second, l,
+		WithFrameTrailer(), WithChecksumHandler(handler))
+	defer dq.Close()
+
+	Equal(t, []byte{1}, <-dq.ReadChan())
+	Equal(t, []byte{2, 2}, <-dq.ReadChan())
+	Equal(t, []byte{2, 3, 3}, <-dq.ReadChan())
+	Equal(t, bytes.Repeat([]byte{5}, 5), <-dq.ReadChan())
+	Equal(t, bytes.Repeat([]byte{6}, 6), <-dq.ReadChan())
+	Equal(t, [][]byte{{2, 3, 3}, {5, 4, 4, 4}}, corrupt)
+}
+
+func TestDiskQueueCorruptionHandler(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_corruption_handler" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	quarantineDir := path.Join(tmpDir, "quarantine")
+	err = os.Mkdir(quarantineDir, 0700)
+	Nil(t, err)
+
+	corruptions := make(chan Corruption, 10)
+	action := SkipCorruptRecord()
+	handler := CorruptionHandlerFunc(func(c Corruption) CorruptionAction {
+		corruptions <- c
+		return action
+	})
+	frameSize := 5 + frameHeaderSize + frameTrailerSize
+	for i, corrupt := range []func(b []byte){
+		// flip a bit in the data of the 3rd message
+		func(b []byte) { b[2*frameSize+frameHeaderSize] ^= 0x01 },
+		// corrupt the size of the 3rd message
+		func(b []byte) { binary.BigEndian.PutUint32(b[2*frameSize:], 1<<20) },
+	} {
+		name := dqName + strconv.Itoa(i)
+		dq := New(name, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, l, WithFrameTrailer())
+		for j := 0; j < 6; j++ {
+			err = dq.Put([]byte(fmt.Sprintf("msg-%d", j)))
+			Nil(t, err)
+		}
+		dq.Close()
+
+		dqFn := dq.(*diskQueue).fileName(0)
+		b, err := ioutil.ReadFile(dqFn)
+		Nil(t, err)
+		corrupt(b)
+		err = ioutil.WriteFile(dqFn, b, 0600)
+		Nil(t, err)
+
+		dq = New(name, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, l,
+			WithFrameTrailer(), WithCorruptionHandler(handler))
+		Equal(t, []byte("msg-0"), <-dq.ReadChan())
+		Equal(t, []byte("msg-1"), <-dq.ReadChan())
+		c := <-corruptions
+		Equal(t, dqFn, c.FileName)
+		Equal(t, int64(2*frameSize), c.Pos)
+		NotNil(t, c.Err)
+		if i == 0 {
+			// only the corrupt message is skipped
+			Equal(t, true, c.Intact)
+			Equal(t, []byte("msg-3"), <-dq.ReadChan())
+			Equal(t, []byte("msg-4"), <-dq.ReadChan())
+			Equal(t, []byte("msg-5"), <-dq.ReadChan())
+			_, err = os.Stat(dqFn + ".bad")
+			NotNil(t, err)
+			action = QuarantineCorruptFile(quarantineDir)
+		} else {
+			// the file is skipped
+			Equal(t, false, c.Intact)
+			for {
+				_, err = os.Stat(path.Join(quarantineDir, path.Base(dqFn)))
+				if err == nil {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+			_, err = os.Stat(dqFn)
+			NotNil(t, err)
+		}
+		dq.Close()
+	}
+}
+
+func TestDiskQueueMaxMsgSizeClamped(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_max_msg_size_clamped" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// sizes from 1<<28 on would collide with the frame's flags
+	dq := New(dqName, tmpDir, 1024, 1, 1<<28, 2500, 2*time.Second, l)
+	defer dq.Close()
+	Equal(t, int32(frameMaxSize-envelopeMaxOverhead-encryptionOverhead), dq.(*diskQueue).maxMsgSize)
+
+	err = dq.PutMessage(Message{Data: []byte("job"), Headers: map[string]string{"k": "v"}})
+	Nil(t, err)
+	m := <-dq.ReadMessageChan()
+	Equal(t, []byte("job"), m.Data)
+	Equal(t, map[string]string{"k": "v"}, m.Headers)
+}
+
+func TestDiskQueueCompression(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_compression" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	c, err := NewFlateCompressor(flate.BestSpeed)
+	Nil(t, err)
+	dq := New(dqName, tmpDir, 1<<20, 100, 1<<12, 2500, 2*time.Second, l,
+		WithCompression(c, 512), WithFrameTrailer())
+	defer dq.Close()
+
+	large := bytes.Repeat([]byte("compressible "), 200)
+	small := bytes.Repeat([]byte("x"), 200)
+	err = dq.Put(large)
+	Nil(t, err)
+	// compressed data may be smaller than minMsgSize
+	Equal(t, true, dq.(*diskQueue).writePos < 100)
+	pos := dq.(*diskQueue).writePos
+	err = dq.Put(small)
+	Nil(t, err)
+	Equal(t, pos+int64(len(small))+12, dq.(*diskQueue).writePos)
+	err = dq.PutMany([][]byte{large, small, large})
+	Nil(t, err)
+
+	Equal(t, large, <-dq.ReadChan())
+	Equal(t, small, <-dq.ReadChan())
+	Equal(t, large, <-dq.ReadChan())
+	Equal(t, small, <-dq.ReadChan())
+	Equal(t, large, <-dq.ReadChan())
+
+	// the frames can still be walked
+	depth, err := dq.(*diskQueue).depthInFiles(0, 0)
+	Nil(t, err)
+	Equal(t, int64(5), depth)
+}
+
+func TestDecompressLimit(t *testing.T) {
+	c, err := NewFlateCompressor(flate.BestSpeed)
+	Nil(t, err)
+	bomb, err := c.Compress(nil, make([]byte, 1<<24))
+	Nil(t, err)
+	Equal(t, true, len(bomb) < 1<<16)
+
+	d := &diskQueue{compressor: c, maxMsgSize: 1 << 12}
+	_, err = d.decompress(bomb)
+	NotNil(t, err)
+	fits, err := c.Compress(nil, make([]byte, 1<<12))
+	Nil(t, err)
+	data, err := d.decompress(fits)
+	Nil(t, err)
+	Equal(t, 1<<12, len(data))
+}
+
+func TestDiskQueueEncryption(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_encryption" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	keys := KeyRing{
+		Current: 1,
+		Keys:    map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)},
+	}
+	c, err := NewFlateCompressor(flate.BestSpeed)
+	Nil(t, err)
+	// messages at maxMsgSize still fit once encrypted
+	dq := New(dqName, tmpDir, 1<<20, 1, 64, 2500, 2*time.Second, l,
+		WithEncryption(keys), WithCompression(c, 32))
+	secret := []byte("secret")
+	err = dq.Put(secret)
+	Nil(t, err)
+	err = dq.Put(bytes.Repeat(secret, 11)[:64])
+	Nil(t, err)
+	dq.Close()
+
+	b, err := ioutil.ReadFile(dq.(*diskQueue).fileName(0))
+	Nil(t, err)
+	Equal(t, -1, bytes.Index(b, secret))
+
+	// rotate the key, older messages are still readable
+	keys.Current = 2
+	keys.Keys[2] = bytes.Repeat([]byte{2}, 16)
+	dq = New(dqName, tmpDir, 1<<20, 1, 64, 2500, 2*time.Second, l,
+		WithEncryption(keys), WithCompression(c, 32))
+	defer dq.Close()
+	err = dq.Put(secret)
+	Nil(t, err)
+	Equal(t, secret, <-dq.ReadChan())
+	Equal(t, bytes.Repeat(secret, 11)[:64], <-dq.ReadChan())
+	Equal(t, secret, <-dq.ReadChan())
+
+	// writes fail rather than falling back to plain text
+	delete(keys.Keys, 2)
+	err = dq.Put(secret)
+	NotNil(t, err)
+	Equal(t, int64(0), dq.Depth())
+}
+
+func TestDiskQueueMessageEnvelope(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_message_envelope" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 3, 1<<10, 2500, 2*time.Second, l)
+	ts := time.Unix(1500000000, 123)
+	err = dq.PutMessage(Message{
+		Data:      []byte("test"),
+		Timestamp: ts,
+		Headers:   map[string]string{"k": "v", "empty": ""},
+	})
+	Nil(t, err)
+	err = dq.Put([]byte("plain"))
+	Nil(t, err)
+	err = dq.PutMessage(Message{Data: []byte("now")})
+	Nil(t, err)
+	// headers don't count towards the message size
+	err = dq.PutMessage(Message{Data: []byte("x"), Headers: map[string]string{"k": "v"}})
+	NotNil(t, err)
+	err = dq.PutMessage(Message{Data: []byte("huge"), Headers: map[string]string{"k": string(bytes.Repeat([]byte("v"), 1<<16))}})
+	NotNil(t, err)
+	Equal(t, int64(3), dq.Depth())
+	dq.Close()
+
+	dq = New(dqName, tmpDir, 1024, 3, 1<<10, 2500, 2*time.Second, l, WithTimestamps())
+	defer dq.Close()
+	m := <-dq.ReadMessageChan()
+	Equal(t, []byte("test"), m.Data)
+	Equal(t, ts.UnixNano(), m.Timestamp.UnixNano())
+	Equal(t, map[string]string{"k": "v", "empty": ""}, m.Headers)
+	m = <-dq.ReadMessageChan()
+	Equal(t, Message{Data: []byte("plain")}, m)
+	// ReadChan only delivers the data
+	Equal(t, []byte("now"), <-dq.ReadChan())
+
+	before := time.Now()
+	err = dq.Put([]byte("stamped"))
+	Nil(t, err)
+	m = <-dq.ReadMessageChan()
+	Equal(t, []byte("stamped"), m.Data)
+	Equal(t, false, m.Timestamp.Before(before.Truncate(time.Second)))
+	Equal(t, false, m.Timestamp.After(time.Now()))
+}
+
+func TestDiskQueueTrimBefore(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_trim_before" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 100, 1, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+	msg := []byte("0123456789")
+
+	// fill the first file with plain messages, dated by its mtime
+	for i := 0; i < 8; i++ {
+		err = dq.Put(msg)
+		Nil(t, err)
+	}
+	hourAgo := time.Now().Add(-time.Hour)
+	err = os.Chtimes(dq.(*diskQueue).fileName(0), hourAgo, hourAgo)
+	Nil(t, err)
+
+	for i := 0; i < 2; i++ {
+		err = dq.PutMessage(Message{Data: msg, Timestamp: hourAgo})
+		Nil(t, err)
+	}
+	err = dq.PutMessage(Message{Data: []byte("new")})
+	Nil(t, err)
+	err = dq.Put([]byte("plain"))
+	Nil(t, err)
+	Equal(t, int64(12), dq.Depth())
+
+	n, err := dq.TrimBefore(time.Now().Add(-time.Minute))
+	Nil(t, err)
+	Equal(t, int64(10), n)
+	Equal(t, int64(2), dq.Depth())
+	_, err = os.Stat(dq.(*diskQueue).fileName(0))
+	Equal(t, true, os.IsNotExist(err))
+	Equal(t, []byte("new"), <-dq.ReadChan())
+
+	n, err = dq.TrimBefore(time.Now().Add(time.Hour))
+	Nil(t, err)
+	Equal(t, int64(1), n)
+	Equal(t, int64(0), dq.Depth())
+}
+
+func TestDiskQueueMaxBytes(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_max_bytes" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// 8 messages fill a file, 14 fit in 200 bytes
+	dq := New(dqName, tmpDir, 100, 1, 1<<10, 2500, 2*time.Second, l,
+		WithMaxBytes(200, OverflowReject))
+	for i := 0; i < 14; i++ {
+		err = dq.Put([]byte(fmt.Sprintf("message%03d", i)))
+		Nil(t, err)
+	}
+	err = dq.Put([]byte("message014"))
+	Equal(t, ErrQueueFull, err)
+	for i := 0; i < 8; i++ {
+		Equal(t, []byte(fmt.Sprintf("message%03d", i)), <-dq.ReadChan())
+	}
+	err = dq.Put([]byte("message014"))
+	Nil(t, err)
+	dq.Close()
+
+	dq = New(dqName+"_drop", tmpDir, 100, 1, 1<<10, 2500, 2*time.Second, l,
+		WithMaxBytes(200, OverflowDropOldest))
+	for i := 0; i < 20; i++ {
+		err = dq.Put([]byte(fmt.Sprintf("message%03d", i)))
+		Nil(t, err)
+	}
+	Equal(t, int64(12), dq.Depth())
+	Equal(t, []byte("message008"), <-dq.ReadChan())
+	dq.Close()
+
+	dq = New(dqName+"_block", tmpDir, 100, 1, 1<<10, 2500, 2*time.Second, l,
+		WithMaxBytes(200, OverflowBlock))
+	put := func() chan error {
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- dq.Put([]byte("message999"))
+		}()
+		return errChan
+	}
+	// the write crossing the limit is let through
+	for i := 0; i < 15; i++ {
+		err = dq.Put([]byte(fmt.Sprintf("message%03d", i)))
+		Nil(t, err)
+	}
+	errChan := put()
+	select {
+	case <-errChan:
+		t.Fatal("write was not blocked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	for i := 0; i < 8; i++ {
+		<-dq.ReadChan()
+	}
+	Nil(t, <-errChan)
+
+	// closing releases blocked writers
+	for i := 0; i < 7; i++ {
+		err = dq.Put([]byte(fmt.Sprintf("message%03d", i)))
+		Nil(t, err)
+	}
+	errChan = put()
+	select {
+	case <-errChan:
+		t.Fatal("write was not blocked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	dq.Close()
+	NotNil(t, <-errChan)
+}
+
+func TestDiskQueueDeadLetterQueue(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_dead_letter_queue" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, l, WithFrameTrailer())
+	for i := 0; i < 6; i++ {
+		err = dq.Put([]byte(fmt.Sprintf("msg-%d", i)))
+		Nil(t, err)
+	}
+	dq.Close()
+
+	// corrupt the size of the 3rd message
+	frameSize := 5 + frameHeaderSize + frameTrailerSize
+	dqFn := dq.(*diskQueue).fileName(0)
+	b, err := ioutil.ReadFile(dqFn)
+	Nil(t, err)
+	binary.BigEndian.PutUint32(b[2*frameSize:], 1<<20)
+	err = ioutil.WriteFile(dqFn, b, 0600)
+	Nil(t, err)
+
+	dq = New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, l,
+		WithFrameTrailer(), WithDeadLetterQueue())
+	defer dq.Close()
+	Equal(t, []byte("msg-0"), <-dq.ReadChan())
+	Equal(t, []byte("msg-1"), <-dq.ReadChan())
+
+	// the messages following the corruption are found walking backwards
+	dlq := dq.DeadLetterQueue()
+	Equal(t, []byte("msg-3"), <-dlq.ReadChan())
+	Equal(t, []byte("msg-4"), <-dlq.ReadChan())
+	Equal(t, []byte("msg-5"), <-dlq.ReadChan())
+	_, err = os.Stat(dqFn + ".bad")
+	Nil(t, err)
+}
+
+func TestPriorityQueue(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_priority_queue" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	_, err = NewPriorityQueue(dqName, tmpDir, 0, WithLogger(l))
+	NotNil(t, err)
+	pq, err := NewPriorityQueue(dqName, tmpDir, 3, WithLogger(l))
+	Nil(t, err)
+
+	err = pq.Put([]byte("low"))
+	Nil(t, err)
+	Equal(t, []byte("low"), <-pq.ReadChan())
+	err = pq.PutWithPriority([]byte("high"), 3)
+	NotNil(t, err)
+
+	// the message held for delivery is delivered again after reopening
+	for _, prio := range []int{0, 1, 2, 1} {
+		err = pq.PutWithPriority([]byte(fmt.Sprintf("prio%d", prio)), prio)
+		Nil(t, err)
+	}
+	Equal(t, int64(4), pq.Depth())
+	pq.Close()
+
+	pq, err = NewPriorityQueue(dqName, tmpDir, 3, WithLogger(l))
+	Nil(t, err)
+	defer pq.Close()
+	Equal(t, int64(4), pq.Depth())
+	Equal(t, []byte("prio2"), <-pq.ReadChan())
+	Equal(t, []byte("prio1"), <-pq.ReadChan())
+	Equal(t, []byte("prio1"), <-pq.ReadChan())
+	Equal(t, []byte("prio0"), <-pq.ReadChan())
+}
+
+func TestDiskQueuePutDelayed(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_put_delayed" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, l)
+	now := time.Now()
+	err = dq.PutDelayed([]byte("later"), now.Add(400*time.Millisecond))
+	Nil(t, err)
+	err = dq.PutDelayed([]byte("sooner"), now.Add(200*time.Millisecond))
+	Nil(t, err)
+	err = dq.PutDelayed([]byte("past"), now.Add(-time.Second))
+	Nil(t, err)
+	Equal(t, int64(1), dq.Depth())
+	Equal(t, []byte("past"), <-dq.ReadChan())
+	dq.Close()
+
+	// delayed messages survive a restart
+	dq = New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+	Equal(t, int64(0), dq.Depth())
+	Equal(t, []byte("sooner"), <-dq.ReadChan())
+	Equal(t, false, time.Now().Before(now.Add(200*time.Millisecond)))
+	Equal(t, []byte("later"), <-dq.ReadChan())
+	Equal(t, false, time.Now().Before(now.Add(400*time.Millisecond)))
+	_, err = os.Stat(dq.(*diskQueue).delayedFileName())
+	Equal(t, true, os.IsNotExist(err))
+}
+
+func TestDiskQueueCursors(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_cursors" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// 8 messages fill a file
+	dq := New(dqName, tmpDir, 100, 1, 1<<10, 2500, 2*time.Second, l)
+	for i := 0; i < 10; i++ {
+		err = dq.Put([]byte(fmt.Sprintf("message%03d", i)))
+		Nil(t, err)
+	}
+	_, err = dq.NewCursor("bad name")
+	NotNil(t, err)
+	c, err := dq.NewCursor("a")
+	Nil(t, err)
+	Equal(t, int64(10), c.Depth())
+	_, err = dq.NewCursor("a")
+	NotNil(t, err)
+
+	// the queue's own reader doesn't remove files the cursor still needs
+	for i := 0; i < 10; i++ {
+		Equal(t, []byte(fmt.Sprintf("message%03d", i)), <-dq.ReadChan())
+	}
+	_, err = os.Stat(dq.(*diskQueue).fileName(0))
+	Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		Equal(t, []byte(fmt.Sprintf("message%03d", i)), <-c.ReadChan())
+	}
+	err = c.Close()
+	Nil(t, err)
+	c, err = dq.NewCursor("a")
+	Nil(t, err)
+	Equal(t, int64(7), c.Depth())
+	for i := 3; i < 10; i++ {
+		Equal(t, []byte(fmt.Sprintf("message%03d", i)), <-c.ReadChan())
+	}
+	err = c.Close()
+	Nil(t, err)
+	Equal(t, int64(0), c.Depth())
+	_, err = os.Stat(dq.(*diskQueue).fileName(0))
+	Equal(t, true, os.IsNotExist(err))
+	dq.Close()
+
+	// positions are persisted along with the queue's
+	dq = New(dqName, tmpDir, 100, 1, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+	err = dq.Put([]byte("new"))
+	Nil(t, err)
+	c, err = dq.NewCursor("a")
+	Nil(t, err)
+	Equal(t, int64(1), c.Depth())
+	c2, err := dq.NewCursor("b")
+	Nil(t, err)
+	Equal(t, []byte("new"), <-c.ReadChan())
+	Equal(t, []byte("new"), <-c2.ReadChan())
+	Equal(t, []byte("new"), <-dq.ReadChan())
+	err = c.Delete()
+	Nil(t, err)
+	err = c2.Close()
+	Nil(t, err)
+	Equal(t, []string{"b"}, dq.(*diskQueue).cursorNames())
+}
+
+func TestPartitioned(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_partitioned" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	_, err = NewPartitioned(dqName, tmpDir, 0, WithLogger(l))
+	NotNil(t, err)
+	pq, err := NewPartitioned(dqName, tmpDir, 4, WithLogger(l))
+	Nil(t, err)
+	Equal(t, 4, pq.Partitions())
+
+	for i := 0; i < 8; i++ {
+		err = pq.Put([]byte(fmt.Sprintf("message%03d", i)))
+		Nil(t, err)
+	}
+	for i := 0; i < 4; i++ {
+		Equal(t, int64(2), pq.PartitionDepth(i))
+	}
+	key := []byte("key")
+	for i := 0; i < 10; i++ {
+		err = pq.PutKey(key, []byte(fmt.Sprintf("keyed%03d", i)))
+		Nil(t, err)
+	}
+	Equal(t, int64(12), pq.PartitionDepth(pq.Partition(key)))
+	Equal(t, int64(18), pq.Depth())
+	pq.Close()
+
+	pq, err = NewPartitioned(dqName, tmpDir, 4, WithLogger(l))
+	Nil(t, err)
+	defer pq.Close()
+	Equal(t, int64(18), pq.Depth())
+	// messages with the same key are read in order
+	seen := make(map[string]bool)
+	next := 0
+	for i := 0; i < 18; i++ {
+		msg := <-pq.ReadChan()
+		if bytes.HasPrefix(msg, []byte("keyed")) {
+			Equal(t, []byte(fmt.Sprintf("keyed%03d", next)), msg)
+			next++
+		}
+		seen[string(msg)] = true
+	}
+	Equal(t, 10, next)
+	Equal(t, 18, len(seen))
+}
+
+func TestDiskQueueMirror(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_mirror" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	primary := path.Join(tmpDir, "primary")
+	mirror := path.Join(tmpDir, "mirror")
+	os.Mkdir(primary, 0700)
+	os.Mkdir(mirror, 0700)
+
+	_, err = NewWithOptions(dqName, primary, WithLogger(l), WithMirror(primary))
+	NotNil(t, err)
+
+	// files written before the mirror was added are copied over
+	dq, err := NewWithOptions(dqName, primary, WithLogger(l), WithMaxBytesPerFile(100))
+	Nil(t, err)
+	for i := 0; i < 5; i++ {
+		err = dq.Put([]byte(fmt.Sprintf("message%03d", i)))
+		Nil(t, err)
+	}
+	dq.Close()
+	dq, err = NewWithOptions(dqName, primary, WithLogger(l), WithMaxBytesPerFile(100), WithMirror(mirror))
+	Nil(t, err)
+	defer dq.Close()
+	for i := 5; i < 20; i++ {
+		err = dq.Put([]byte(fmt.Sprintf("message%03d", i)))
+		Nil(t, err)
+	}
+	mirrored := path.Join(mirror, path.Base(dq.(*diskQueue).fileName(0)))
+	_, err = os.Stat(mirrored)
+	Nil(t, err)
+	for i := 0; i < 9; i++ {
+		Equal(t, []byte(fmt.Sprintf("message%03d", i)), <-dq.ReadChan())
+	}
+	_, err = os.Stat(mirrored)
+	Equal(t, true, os.IsNotExist(err))
+
+	err = dq.FailoverTo(tmpDir)
+	NotNil(t, err)
+	os.RemoveAll(primary)
+	err = dq.FailoverTo(mirror)
+	Nil(t, err)
+	err = dq.Put([]byte("message020"))
+	Nil(t, err)
+	Equal(t, int64(12), dq.Depth())
+	for i := 9; i < 21; i++ {
+		Equal(t, []byte(fmt.Sprintf("message%03d", i)), <-dq.ReadChan())
+	}
+	_, err = os.Stat(dq.(*diskQueue).metaDataFileName())
+	Nil(t, err)
+}
+
+func TestDiskQueueSnapshot(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_snapshot" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	snapshotDir := path.Join(tmpDir, "snapshot")
+	restoreDir := path.Join(tmpDir, "restore")
+	os.Mkdir(restoreDir, 0700)
+
+	dq, err := NewWithOptions(dqName, tmpDir, WithLogger(l), WithMaxBytesPerFile(100))
+	Nil(t, err)
+	defer dq.Close()
+	for i := 0; i < 10; i++ {
+		err = dq.Put([]byte(fmt.Sprintf("message%03d", i)))
+		Nil(t, err)
+	}
+	for i := 0; i < 3; i++ {
+		Equal(t, []byte(fmt.Sprintf("message%03d", i)), <-dq.ReadChan())
+	}
+	err = dq.Snapshot(snapshotDir)
+	Nil(t, err)
+	err = dq.Snapshot(snapshotDir)
+	NotNil(t, err)
+
+	// changes after the snapshot aren't part of it
+	for i := 3; i < 10; i++ {
+		Equal(t, []byte(fmt.Sprintf("message%03d", i)), <-dq.ReadChan())
+	}
+	err = dq.Put([]byte("message010"))
+	Nil(t, err)
+
+	err = RestoreFromSnapshot(dqName, snapshotDir, tmpDir)
+	NotNil(t, err)
+	err = RestoreFromSnapshot(dqName, snapshotDir, restoreDir)
+	Nil(t, err)
+	restored, err := NewWithOptions(dqName, restoreDir, WithLogger(l), WithMaxBytesPerFile(100))
+	Nil(t, err)
+	defer restored.Close()
+	Equal(t, int64(7), restored.Depth())
+	for i := 3; i < 10; i++ {
+		Equal(t, []byte(fmt.Sprintf("message%03d", i)), <-restored.ReadChan())
+	}
+}
+
+func TestDiskQueueExportImport(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_export" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq, err := NewWithOptions(dqName, tmpDir, WithLogger(l), WithMaxBytesPerFile(100))
+	Nil(t, err)
+	defer dq.Close()
+	for i := 0; i < 300; i++ {
+		err = dq.Put([]byte(fmt.Sprintf("message%03d", i)))
+		Nil(t, err)
+	}
+	ts := time.Unix(1500000000, 0)
+	err = dq.PutMessage(Message{Data: []byte("with headers"), Timestamp: ts, Headers: map[string]string{"k": "v"}})
+	Nil(t, err)
+	for i := 0; i < 2; i++ {
+		Equal(t, []byte(fmt.Sprintf("message%03d", i)), <-dq.ReadChan())
+	}
+
+	var buf bytes.Buffer
+	err = dq.Export(&buf)
+	Nil(t, err)
+	Equal(t, int64(299), dq.Depth())
+	Equal(t, []byte("message002"), <-dq.ReadChan())
+
+	imported, err := NewWithOptions(dqName+"_imported", tmpDir, WithLogger(l))
+	Nil(t, err)
+	defer imported.Close()
+	err = imported.Import(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	NotNil(t, err)
+	err = imported.Empty()
+	Nil(t, err)
+	err = imported.Import(bytes.NewReader([]byte("not an export")))
+	NotNil(t, err)
+	err = imported.Import(&buf)
+	Nil(t, err)
+	Equal(t, int64(299), imported.Depth())
+	for i := 2; i < 300; i++ {
+		m := <-imported.ReadMessageChan()
+		Equal(t, []byte(fmt.Sprintf("message%03d", i)), m.Data)
+		Equal(t, true, m.Timestamp.IsZero())
+	}
+	m := <-imported.ReadMessageChan()
+	Equal(t, []byte("with headers"), m.Data)
+	Equal(t, ts.UnixNano(), m.Timestamp.UnixNano())
+	Equal(t, map[string]string{"k": "v"}, m.Headers)
+}
+
+func TestDiskQueueScan(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_scan" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq, err := NewWithOptions(dqName, tmpDir, WithLogger(l), WithMaxBytesPerFile(100))
+	Nil(t, err)
+	defer dq.Close()
+	for i := 0; i < 300; i++ {
+		err = dq.Put([]byte(fmt.Sprintf("message%03d", i)))
+		Nil(t, err)
+	}
+	for i := 0; i < 2; i++ {
+		Equal(t, []byte(fmt.Sprintf("message%03d", i)), <-dq.ReadChan())
+	}
+
+	var positions []Position
+	n := 2
+	err = dq.Scan(func(pos Position, data []byte) bool {
+		Equal(t, []byte(fmt.Sprintf("message%03d", n)), data)
+		positions = append(positions, pos)
+		n++
+		return true
+	})
+	Nil(t, err)
+	Equal(t, 300, n)
+	Equal(t, Position{0, 28}, positions[0])
+	Equal(t, Position{1, 0}, positions[6])
+	Equal(t, int64(298), dq.Depth())
+
+	n = 0
+	err = dq.Scan(func(pos Position, data []byte) bool {
+		n++
+		return n < 3
+	})
+	Nil(t, err)
+	Equal(t, 3, n)
+	Equal(t, []byte("message002"), <-dq.ReadChan())
+}
+
+func TestDiskQueueDepthBytes(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_depth_bytes" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// 14 byte frames, 8 to a file
+	dq, err := NewWithOptions(dqName, tmpDir, WithLogger(l), WithMaxBytesPerFile(100), WithManualCommit())
+	Nil(t, err)
+	for i := 0; i < 20; i++ {
+		err = dq.Put([]byte(fmt.Sprintf("message%03d", i)))
+		Nil(t, err)
+	}
+	Equal(t, int64(20*14), dq.DepthBytes())
+	for i := 0; i < 10; i++ {
+		<-dq.ReadChan()
+	}
+	dq.Checkpoint()
+	Equal(t, int64(10*14), dq.DepthBytes())
+	dq.Close()
+
+	// the uncommitted reads are read again
+	dq, err = NewWithOptions(dqName, tmpDir, WithLogger(l), WithMaxBytesPerFile(100))
+	Nil(t, err)
+	Equal(t, int64(20*14), dq.DepthBytes())
+	md := readMetaDataFile(dq.(*diskQueue).metaDataFileName(), 0)
+	Equal(t, int64(20*14), md.depthBytes)
+	for i := 0; i < 10; i++ {
+		<-dq.ReadChan()
+	}
+	dq.Close()
+
+	// metadata without the depth in bytes
+	metaDataFileName := dq.(*diskQueue).metaDataFileName()
+	err = ioutil.WriteFile(metaDataFileName, []byte("10\n1,28\n2,56\n"), 0600)
+	Nil(t, err)
+	os.Remove(metaDataSlots(metaDataFileName)[1])
+	dq, err = NewWithOptions(dqName, tmpDir, WithLogger(l), WithMaxBytesPerFile(100))
+	Nil(t, err)
+	defer dq.Close()
+	Equal(t, int64(10*14), dq.DepthBytes())
+}
+
+func TestDiskQueueSyncMode(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_sync_mode" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	_, err = NewWithOptions(dqName, tmpDir, WithLogger(l), WithSyncMode(SyncNever+1))
+	NotNil(t, err)
+
+	// every write is synced before Put returns
+	dq, err := NewWithOptions(dqName, tmpDir, WithLogger(l), WithSyncMode(SyncAlways),
+		WithSyncEvery(0), WithSyncTimeout(0))
+	Nil(t, err)
+	for i := 0; i < 3; i++ {
+		err = dq.Put([]byte("message"))
+		Nil(t, err)
+		md := readMetaDataFile(dq.(*diskQueue).metaDataFileName(), 0)
+		Equal(t, int64(i+1), md.depth)
+		Equal(t, int64(11*(i+1)), md.writePos)
+	}
+	Equal(t, int64(3), dq.Stats().Syncs)
+	dq.Close()
+
+	// metadata is still persisted without fsync
+	dq, err = NewWithOptions(dqName+"_never", tmpDir, WithLogger(l), WithSyncMode(SyncNever),
+		WithSyncEvery(1))
+	Nil(t, err)
+	err = dq.Put([]byte("message"))
+	Nil(t, err)
+	err = dq.WriteBarrier()
+	Nil(t, err)
+	md := readMetaDataFile(dq.(*diskQueue).metaDataFileName(), 0)
+	Equal(t, int64(11), md.writePos)
+	dq.Close()
+}
+
+func TestDiskQueueGroupCommit(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_group_commit" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq, err := NewWithOptions(dqName, tmpDir, WithLogger(l), WithSyncMode(SyncAlways),
+		WithMaxBytesPerFile(1000), WithMsgSize(0, 100))
+	Nil(t, err)
+	defer dq.Close()
+
+	// rejected before it can be grouped with other Puts
+	err = dq.Put(make([]byte, 101))
+	NotNil(t, err)
+
+	const producers, puts = 10, 100
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < puts; i++ {
+				err := dq.Put([]byte(fmt.Sprintf("%d-%d", p, i)))
+				Nil(t, err)
+			}
+		}(p)
+	}
+	wg.Wait()
+	Equal(t, int64(producers*puts), dq.Depth())
+	stats := dq.Stats()
+	Equal(t, int64(producers*puts), stats.Writes)
+	t.Logf("%d writes, %d syncs", stats.Writes, stats.Syncs)
+
+	// each producer's messages are in the order it wrote them
+	next := make([]int, producers)
+	for i := 0; i < producers*puts; i++ {
+		var p, n int
+		_, err = fmt.Sscanf(string(<-dq.ReadChan()), "%d-%d", &p, &n)
+		Nil(t, err)
+		Equal(t, next[p], n)
+		next[p]++
+	}
+}
+
+func TestDiskQueueFileFormat(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_file_format" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	_, err = NewWithOptions(dqName, tmpDir, WithLogger(l), WithFileFormat(3))
+	NotNil(t, err)
+
+	// written in version 1 to begin with
+	opts := []Option{WithLogger(l), WithMaxBytesPerFile(4096), WithMsgSize(0, 1<<12)}
+	dq, err := NewWithOptions(dqName, tmpDir, opts...)
+	Nil(t, err)
+	msgs := [][]byte{[]byte("a"), bytes.Repeat([]byte{'b'}, 100)}
+	for _, msg := range msgs {
+		err = dq.Put(msg)
+		Nil(t, err)
+	}
+	Equal(t, int64(4+1+4+100), dq.(*diskQueue).writePos)
+	dq.Close()
+
+	// the version 1 file is kept as is, new files are version 2
+	opts = append(opts, WithFileFormat(2))
+	dq, err = NewWithOptions(dqName, tmpDir, opts...)
+	Nil(t, err)
+	msgs = append(msgs, bytes.Repeat([]byte{'c'}, 2000))
+	err = dq.Put(msgs[2])
+	Nil(t, err)
+	msgs = append(msgs, bytes.Repeat([]byte{'d'}, 2000))
+	err = dq.PutReader(bytes.NewReader(msgs[3]), 2000)
+	Nil(t, err)
+	Equal(t, int64(1), dq.(*diskQueue).writeFileNum)
+	msgs = append(msgs, []byte("e"), bytes.Repeat([]byte{'f'}, 100))
+	err = dq.PutMany(msgs[4:])
+	Nil(t, err)
+	// varint sizes of 1 and 2 bytes
+	Equal(t, int64(fileHeaderSize+1+1+2+100), dq.(*diskQueue).writePos)
+
+	b, err := ioutil.ReadFile(dq.(*diskQueue).fileName(0))
+	Nil(t, err)
+	Equal(t, []byte{0, 0, 0, 1, 'a'}, b[:5])
+	b, err = ioutil.ReadFile(dq.(*diskQueue).fileName(1))
+	Nil(t, err)
+	Equal(t, []byte(fileMagic), b[:4])
+	Equal(t, byte(fileFormatV2), b[4])
+	Equal(t, []byte{1 << 4, 'e'}, b[fileHeaderSize:fileHeaderSize+2])
+
+	for i := 0; i < 3; i++ {
+		Equal(t, msgs[i], <-dq.ReadChan())
+	}
+	dq.Close()
+
+	dq, err = NewWithOptions(dqName, tmpDir, opts...)
+	Nil(t, err)
+	defer dq.Close()
+	Equal(t, int64(3), dq.Depth())
+	err = dq.SeekCheckpoint(dq.Checkpoint())
+	Nil(t, err)
+	Equal(t, int64(3), dq.Depth())
+	var scanned [][]byte
+	err = dq.Scan(func(pos Position, data []byte) bool {
+		scanned = append(scanned, data)
+		return true
+	})
+	Nil(t, err)
+	Equal(t, msgs[3:], scanned)
+	for i := 3; i < len(msgs); i++ {
+		Equal(t, msgs[i], <-dq.ReadChan())
+	}
+}
+
+func TestDiskQueueFileMaxBytes(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_file_max_bytes" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// 12 bytes per message, 7 messages per file
+	dq, err := NewWithOptions(dqName, tmpDir, WithLogger(l), WithFileFormat(2), WithMaxBytesPerFile(100))
+	Nil(t, err)
+	for i := 0; i < 10; i++ {
+		err = dq.Put(bytes.Repeat([]byte{byte(i)}, 10))
+		Nil(t, err)
+	}
+	Equal(t, int64(1), dq.(*diskQueue).writeFileNum)
+	dq.Close()
+
+	// files roll at the maxBytesPerFile they were created with
+	dq, err = NewWithOptions(dqName, tmpDir, WithLogger(l), WithFileFormat(2), WithMaxBytesPerFile(1000))
+	Nil(t, err)
+	defer dq.Close()
+	for i := 10; i < 15; i++ {
+		err = dq.Put(bytes.Repeat([]byte{byte(i)}, 10))
+		Nil(t, err)
+	}
+	Equal(t, int64(2), dq.(*diskQueue).writeFileNum)
+	header, err := readFileHeaderOf(dq.(*diskQueue).fileName(1))
+	Nil(t, err)
+	Equal(t, int64(100), header.maxBytesPerFile)
+	header, err = readFileHeaderOf(dq.(*diskQueue).fileName(2))
+	Nil(t, err)
+	Equal(t, int64(1000), header.maxBytesPerFile)
+	Equal(t, true, time.Since(header.created) < time.Minute)
+
+	for i := 0; i < 15; i++ {
+		Equal(t, bytes.Repeat([]byte{byte(i)}, 10), <-dq.ReadChan())
+	}
+}
+
+func TestDiskQueueReconfigure(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_reconfigure" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// 12 bytes per message, 7 messages per file
+	dq, err := NewWithOptions(dqName, tmpDir, WithLogger(l), WithFileFormat(2),
+		WithMaxBytesPerFile(100), WithMsgSize(0, 10))
+	Nil(t, err)
+
+	err = dq.Put(make([]byte, 20))
+	NotNil(t, err)
+	err = dq.Reconfigure(WithMsgSize(0, 20))
+	Nil(t, err)
+	err = dq.Put(make([]byte, 20))
+	Nil(t, err)
+	Equal(t, make([]byte, 20), <-dq.ReadChan())
+
+	err = dq.Reconfigure(WithSyncEvery(1), WithSyncTimeout(10*time.Millisecond))
+	Nil(t, err)
+
+	for i := 0; i < 10; i++ {
+		err = dq.Put(bytes.Repeat([]byte{byte(i)}, 10))
+		Nil(t, err)
+	}
+	// the file being written to still rolls at the size it was created with
+	err = dq.Reconfigure(WithMaxBytesPerFile(1000))
+	Nil(t, err)
+	for i := 10; i < 30; i++ {
+		err = dq.Put(bytes.Repeat([]byte{byte(i)}, 10))
+		Nil(t, err)
+	}
+	Equal(t, int64(2), dq.(*diskQueue).writeFileNum)
+	header, err := readFileHeaderOf(dq.(*diskQueue).fileName(2))
+	Nil(t, err)
+	Equal(t, int64(1000), header.maxBytesPerFile)
+	for i := 0; i < 30; i++ {
+		Equal(t, bytes.Repeat([]byte{byte(i)}, 10), <-dq.ReadChan())
+	}
+
+	err = dq.Reconfigure(WithDirectIO())
+	NotNil(t, err)
+	err = dq.Reconfigure(WithMsgSize(10, 5))
+	NotNil(t, err)
+	err = dq.Reconfigure(WithMaxBytesPerFile(0))
+	NotNil(t, err)
+	dq.Close()
+
+	p := dq.(*diskQueue).syncPolicy.(ThresholdSyncPolicy)
+	Equal(t, int64(1), p.Ops)
+	Equal(t, 10*time.Millisecond, p.MaxDelay)
+	Equal(t, int32(20), dq.(*diskQueue).maxMsgSize)
+
+	// v1 files don't record the size they roll at
+	dq, err = NewWithOptions(dqName+"_v1", tmpDir, WithLogger(l))
+	Nil(t, err)
+	defer dq.Close()
+	err = dq.Reconfigure(WithMaxBytesPerFile(1000))
+	NotNil(t, err)
+
+	// thresholds mean nothing to any other policy
+	adaptive := &AdaptiveSyncPolicy{MaxInterval: time.Second}
+	err = dq.Reconfigure(WithSyncPolicy(adaptive), WithSyncEvery(1))
+	NotNil(t, err)
+	err = dq.Reconfigure(WithSyncPolicy(adaptive))
+	Nil(t, err)
+	err = dq.Reconfigure(WithSyncTimeout(time.Millisecond))
+	NotNil(t, err)
+	Equal(t, SyncPolicy(adaptive), dq.(*diskQueue).syncPolicy)
+
+	// New keeps the policy whichever comes first
+	dq2 := New(dqName+"_new", tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, l,
+		WithSyncEvery(1), WithSyncPolicy(ThresholdSyncPolicy{Bytes: 100}), WithSyncTimeout(time.Millisecond))
+	defer dq2.Close()
+	Equal(t, SyncPolicy(ThresholdSyncPolicy{Bytes: 100}), dq2.(*diskQueue).syncPolicy)
+}
+
+func TestDiskQueueDrain(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_drain" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq, err := NewWithOptions(dqName, tmpDir, WithLogger(l))
+	Nil(t, err)
+	for i := 0; i < 10; i++ {
+		err = dq.Put([]byte("test"))
+		Nil(t, err)
+	}
+
+	// nobody reads, Drain gives up but still closes the queue
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- dq.Drain(ctx)
+	}()
+	for atomic.LoadInt32(&dq.(*diskQueue).draining) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	err = dq.Put([]byte("test"))
+	NotNil(t, err)
+	Equal(t, context.DeadlineExceeded, <-errChan)
+	cancel()
+	err = dq.Put([]byte("test"))
+	NotNil(t, err)
+
+	dq, err = NewWithOptions(dqName, tmpDir, WithLogger(l))
+	Nil(t, err)
+	Equal(t, int64(10), dq.Depth())
+	go func() {
+		for i := 0; i < 10; i++ {
+			time.Sleep(5 * time.Millisecond)
+			<-dq.ReadChan()
+		}
+	}()
+	err = dq.Drain(context.Background())
+	Nil(t, err)
+	Equal(t, int64(0), dq.Depth())
+
+	dq, err = NewWithOptions(dqName, tmpDir, WithLogger(l))
+	Nil(t, err)
+	defer dq.Close()
+	Equal(t, int64(0), dq.Depth())
+}
+
+func TestDiskQueueTryPut(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_try_put" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq, err := NewWithOptions(dqName, tmpDir, WithLogger(l), WithMaxBytesPerFile(100),
+		WithMaxBytes(200, OverflowBlock))
+	Nil(t, err)
+	defer dq.Close()
+
+	// held back by OverflowBlock
+	for i := 0; i < 15; i++ {
+		err = dq.Put([]byte(fmt.Sprintf("message%03d", i)))
+		Nil(t, err)
+	}
+	Equal(t, ErrWouldBlock, dq.TryPut([]byte("message999")))
+	start := time.Now()
+	Equal(t, ErrWouldBlock, dq.PutTimeout([]byte("message999"), 20*time.Millisecond))
+	Equal(t, true, time.Since(start) >= 20*time.Millisecond)
+
+	for i := 0; i < 8; i++ {
+		<-dq.ReadChan()
+	}
+	// ioLoop may be busy between iterations
+	for i := 0; ; i++ {
+		err = dq.TryPut([]byte("message015"))
+		if err != ErrWouldBlock || i == 1000 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	Nil(t, err)
+	err = dq.PutTimeout([]byte("message016"), time.Second)
+	Nil(t, err)
+	Equal(t, int64(9), dq.Depth())
+	NotNil(t, dq.TryPut(make([]byte, defaultMaxMsgSize+1)))
+}
+
+func TestDiskQueueReadBatch(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_read_batch" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// spread over several data files
+	dq, err := NewWithOptions(dqName, tmpDir, WithLogger(l), WithMaxBytesPerFile(50))
+	Nil(t, err)
+	for i := 0; i < 10; i++ {
+		err = dq.Put([]byte(fmt.Sprintf("message%03d", i)))
+		Nil(t, err)
+	}
+
+	batch, err := dq.ReadBatch(4, time.Second)
+	Nil(t, err)
+	Equal(t, 4, len(batch))
+	for i, data := range batch {
+		Equal(t, []byte(fmt.Sprintf("message%03d", i)), data)
+	}
+	Equal(t, int64(6), dq.Depth())
+
+	batch, err = dq.ReadBatch(100, time.Second)
+	Nil(t, err)
+	Equal(t, 6, len(batch))
+	Equal(t, []byte("message004"), batch[0])
+	Equal(t, []byte("message009"), batch[5])
+	Equal(t, int64(0), dq.Depth())
+
+	start := time.Now()
+	batch, err = dq.ReadBatch(10, 20*time.Millisecond)
+	Nil(t, err)
+	Equal(t, 0, len(batch))
+	Equal(t, true, time.Since(start) >= 20*time.Millisecond)
+	_, err = dq.ReadBatch(0, time.Second)
+	NotNil(t, err)
+
+	err = dq.Put([]byte("message010"))
+	Nil(t, err)
+	// not allocated up front
+	batch, err = dq.ReadBatch(int(^uint(0)>>1), time.Second)
+	Nil(t, err)
+	Equal(t, [][]byte{[]byte("message010")}, batch)
+	Nil(t, dq.LastError())
+	err = dq.Put([]byte("message011"))
+	Nil(t, err)
+	dq.Close()
+
+	dq, err = NewWithOptions(dqName, tmpDir, WithLogger(l), WithMaxBytesPerFile(50))
+	Nil(t, err)
+	defer dq.Close()
+	Equal(t, int64(1), dq.Depth())
+	Equal(t, []byte("message011"), <-dq.ReadChan())
+}
+
+func TestDiskQueueTransaction(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_transaction" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq, err := NewWithOptions(dqName, tmpDir, WithLogger(l), WithMsgSize(1, 64))
+	Nil(t, err)
+	err = dq.Put([]byte("before"))
+	Nil(t, err)
+	err = dq.PutTransaction([][]byte{[]byte("txn0"), []byte("txn1"), []byte("txn2")})
+	Nil(t, err)
+	err = dq.Put([]byte("after"))
+	Nil(t, err)
+	Equal(t, int64(5), dq.Depth())
+
+	err = dq.PutTransaction(nil)
+	NotNil(t, err)
+	err = dq.PutTransaction([][]byte{[]byte("ok"), make([]byte, 65)})
+	NotNil(t, err)
+	// each message fits but the transaction doesn't
+	err = dq.PutTransaction([][]byte{make([]byte, 60), make([]byte, 60)})
+	NotNil(t, err)
+	Equal(t, int64(5), dq.Depth())
+
+	c, err := dq.NewCursor("a")
+	Nil(t, err)
+	for _, s := range []string{"before", "txn0", "txn1", "txn2", "after"} {
+		Equal(t, []byte(s), <-c.ReadChan())
+	}
+	err = c.Close()
+	Nil(t, err)
+
+	Equal(t, []byte("before"), <-dq.ReadChan())
+	Equal(t, []byte("txn0"), <-dq.ReadChan())
+	// the transaction is only consumed once all of it has been read
+	Equal(t, int64(4), dq.Depth())
+	dq.Close()
+
+	dq, err = NewWithOptions(dqName, tmpDir, WithLogger(l), WithMsgSize(1, 64))
+	Nil(t, err)
+	defer dq.Close()
+	Equal(t, int64(4), dq.Depth())
+	for _, s := range []string{"txn0", "txn1", "txn2", "after"} {
+		Equal(t, []byte(s), <-dq.ReadChan())
+	}
+	waitForDepth(t, dq, 0)
+}
+
+func TestDiskQueueSeekTo(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_seek_to" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// 5 bytes per message, 10 messages per file
+	dq := New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l)
+	for i := 0; i < 25; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+
+	for i := 0; i < 3; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+	p := dq.ReadPosition()
+	Equal(t, Position{0, 15}, p)
+	// stay within the first file, which is removed once read past
+	for i := 3; i < 9; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+
+	err = dq.SeekTo(p)
+	Nil(t, err)
+	Equal(t, int64(22), dq.Depth())
+	Equal(t, []byte{3}, <-dq.ReadChan())
+	err = dq.SeekTo(Position{2, 1000})
+	NotNil(t, err)
+	// not where a message starts
+	err = dq.SeekTo(Position{1, 12})
+	NotNil(t, err)
+	Equal(t, int64(21), dq.Depth())
+
+	// positions round trip through the checkpoint token format
+	token, err := Position{1, 10}.MarshalBinary()
+	Nil(t, err)
+	var restored Position
+	err = restored.UnmarshalBinary(token)
+	Nil(t, err)
+	Equal(t, Position{1, 10}, restored)
+	err = restored.UnmarshalBinary(token[1:])
+	NotNil(t, err)
+	err = dq.SeekCheckpoint(token)
+	Nil(t, err)
+	Equal(t, []byte{12}, <-dq.ReadChan())
+	dq.Close()
+
+	dq = New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+	err = dq.SeekTo(Position{2, 0})
+	Nil(t, err)
+	Equal(t, int64(5), dq.Depth())
+	Equal(t, []byte{20}, <-dq.ReadChan())
+}
+
+func TestDiskQueueSeekToTime(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_seek_to_time" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq, err := NewWithOptions(dqName, tmpDir, WithLogger(l), WithMaxBytesPerFile(100))
+	Nil(t, err)
+	defer dq.Close()
+	base := time.Now().Add(-time.Hour)
+	for i := 0; i < 20; i++ {
+		err = dq.PutMessage(Message{
+			Data:      []byte{byte(i)},
+			Timestamp: base.Add(time.Duration(i) * time.Minute),
+		})
+		Nil(t, err)
+	}
+	Equal(t, true, dq.(*diskQueue).writeFileNum > 1)
+
+	err = dq.SeekToTime(base.Add(12*time.Minute - time.Second))
+	Nil(t, err)
+	Equal(t, int64(8), dq.Depth())
+	m := <-dq.ReadMessageChan()
+	Equal(t, []byte{12}, m.Data)
+
+	// back to a message still on disk
+	err = dq.SeekToTime(base.Add(8 * time.Minute))
+	Nil(t, err)
+	Equal(t, []byte{8}, (<-dq.ReadMessageChan()).Data)
+
+	err = dq.SeekToTime(base.Add(time.Hour))
+	Nil(t, err)
+	Equal(t, int64(0), dq.Depth())
+
+	// messages without an envelope are dated by their data file
+	err = dq.Put([]byte{20})
+	Nil(t, err)
+	err = dq.SeekToTime(base)
+	Nil(t, err)
+	err = dq.SeekToTime(time.Now().Add(-time.Minute))
+	Nil(t, err)
+	Equal(t, int64(1), dq.Depth())
+	Equal(t, []byte{20}, <-dq.ReadChan())
+}
+
+func TestDiskQueueReplayRetention(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_replay_retention" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// 5 bytes per message, 10 messages per file
+	dq := New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l,
+		WithReplayRetention(time.Hour, 0))
+	for i := 0; i < 25; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+	for i := 0; i < 25; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+	_, err = os.Stat(dq.(*diskQueue).fileName(0))
+	Nil(t, err)
+
+	n, err := dq.Rewind(5)
+	Nil(t, err)
+	Equal(t, int64(5), n)
+	Equal(t, int64(5), dq.Depth())
+	Equal(t, []byte{20}, <-dq.ReadChan())
+
+	// as far back as the files kept go
+	n, err = dq.Rewind(100)
+	Nil(t, err)
+	Equal(t, int64(21), n)
+	Equal(t, int64(25), dq.Depth())
+	Equal(t, []byte{0}, <-dq.ReadChan())
+	err = dq.SeekTo(Position{1, 0})
+	Nil(t, err)
+	Equal(t, []byte{10}, <-dq.ReadChan())
+	_, err = dq.Rewind(-1)
+	NotNil(t, err)
+	err = dq.SeekTo(Position{2, 25})
+	Nil(t, err)
+	dq.Close()
+
+	// files kept are picked up again, subject to the new limits
+	dq = New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l,
+		WithReplayRetention(time.Hour, 60))
+	defer dq.Close()
+	_, err = os.Stat(dq.(*diskQueue).fileName(0))
+	Equal(t, true, os.IsNotExist(err))
+	n, err = dq.Rewind(100)
+	Nil(t, err)
+	Equal(t, int64(15), n)
+	Equal(t, []byte{10}, <-dq.ReadChan())
+}
+
+func TestDiskQueueFastBackward(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_fast_backward" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// 5 bytes per message, 10 messages per file
+	dq := New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l,
+		WithReplayRetention(0, 0))
+	defer dq.Close()
+	for i := 0; i < 25; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+	for i := 0; i < 25; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+
+	var seen []byte
+	err = dq.FastBackward(func(data []byte) int {
+		seen = append(seen, data[0])
+		if len(seen) == 12 {
+			return 0
+		}
+		return 1
+	})
+	Nil(t, err)
+	Equal(t, []byte{24, 23, 22, 21, 20, 19, 18, 17, 16, 15, 14, 13}, seen)
+	Equal(t, int64(12), dq.Depth())
+	Equal(t, []byte{13}, <-dq.ReadChan())
+	Equal(t, []byte{14}, <-dq.ReadChan())
+	Equal(t, []byte{15}, <-dq.ReadChan())
+
+	err = dq.FastBackward(func(data []byte) int {
+		if data[0] == 13 {
+			return -1
+		}
+		return 1
+	})
+	Nil(t, err)
+	Equal(t, []byte{14}, <-dq.ReadChan())
+
+	err = dq.FastBackward(func(data []byte) int {
+		return 1
+	})
+	Nil(t, err)
+	Equal(t, int64(25), dq.Depth())
+	Equal(t, []byte{0}, <-dq.ReadChan())
+}
+
+func TestDiskQueueSkip(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_skip" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// 5 bytes per message, 10 messages per file
+	dq := New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l)
+	for i := 0; i < 25; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+	Equal(t, []byte{0}, <-dq.ReadChan())
+
+	n, err := dq.Skip(12)
+	Nil(t, err)
+	Equal(t, int64(12), n)
+	Equal(t, int64(12), dq.Depth())
+	_, err = os.Stat(dq.(*diskQueue).fileName(0))
+	Equal(t, true, os.IsNotExist(err))
+	Equal(t, []byte{13}, <-dq.ReadChan())
+
+	_, err = dq.Skip(-1)
+	NotNil(t, err)
+	n, err = dq.Skip(100)
+	Nil(t, err)
+	Equal(t, int64(11), n)
+	Equal(t, int64(0), dq.Depth())
+	dq.Close()
+
+	dq = New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+	Equal(t, int64(0), dq.Depth())
+	err = dq.Put([]byte{25})
+	Nil(t, err)
+	Equal(t, []byte{25}, <-dq.ReadChan())
+}
+
+func TestDiskQueueFastForward(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_fast_forward" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// 6 bytes per message, 100 messages per file
+	dq := New(dqName, tmpDir, 599, 1, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+	for i := 0; i < 3000; i++ {
+		err = dq.Put([]byte(fmt.Sprintf("%02d", i%100)))
+		Nil(t, err)
+	}
+
+	res, err := dq.FastForward(context.Background(), func(data []byte) int {
+		if string(data) == "50" {
+			return 0
+		}
+		return 1
+	})
+	Nil(t, err)
+	Equal(t, FastForwardResult{Skipped: 51, Position: Position{0, 51 * 6}}, res)
+	res, err = dq.FastForward(context.Background(), func(data []byte) int {
+		if string(data) == "20" {
+			return -1
+		}
+		return 1
+	})
+	Nil(t, err)
+	Equal(t, FastForwardResult{Skipped: 69, FilesRemoved: 1, Position: Position{1, 20 * 6}}, res)
+	Equal(t, []byte("20"), <-dq.ReadChan())
+
+	// the context is checked every fastForwardCheckEvery messages
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var seen int
+	res, err = dq.FastForward(ctx, func(data []byte) int {
+		seen++
+		if seen == 100 {
+			cancel()
+		}
+		return 1
+	})
+	Equal(t, context.Canceled, err)
+	Equal(t, int64(fastForwardCheckEvery), res.Skipped)
+	Equal(t, int64(3000-121-fastForwardCheckEvery), dq.Depth())
+}
+
+func TestDiskQueueSparseIndex(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_sparse_index" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	opts := []Option{WithLogger(l), WithMaxBytesPerFile(5000), WithSparseIndex(10)}
+	dq, err := NewWithOptions(dqName, tmpDir, opts...)
+	Nil(t, err)
+	base := time.Now().Add(-time.Hour)
+	for i := 0; i < 1000; i++ {
+		err = dq.PutMessage(Message{
+			Data:      []byte(fmt.Sprintf("%04d", i)),
+			Timestamp: base.Add(time.Duration(i) * time.Second),
+		})
+		Nil(t, err)
+	}
+	d := dq.(*diskQueue)
+	_, err = os.Stat(indexFileName(d.fileName(1)))
+	Nil(t, err)
+	entries := d.readIndex(0)
+	Equal(t, true, len(entries) > 10)
+	Equal(t, int64(10), entries[0].count)
+	Equal(t, base.Add(10*time.Second).UnixNano(), entries[0].ts)
+	writeEntries := len(d.writeIndex)
+	Equal(t, true, writeEntries > 0)
+	pos, n, err := d.indexedSkip(0, 0, 55)
+	Nil(t, err)
+	Equal(t, int64(50), n)
+	Equal(t, entries[4].pos, pos)
+
+	n, err = dq.Skip(555)
+	Nil(t, err)
+	Equal(t, int64(555), n)
+	Equal(t, int64(445), dq.Depth())
+	m := <-dq.ReadMessageChan()
+	Equal(t, []byte("0555"), m.Data)
+
+	err = dq.SeekToTime(base.Add(777 * time.Second))
+	Nil(t, err)
+	Equal(t, int64(223), dq.Depth())
+	m = <-dq.ReadMessageChan()
+	Equal(t, []byte("0777"), m.Data)
+	dq.Close()
+
+	// the write file's index is rebuilt on startup
+	dq, err = NewWithOptions(dqName, tmpDir, opts...)
+	Nil(t, err)
+	defer dq.Close()
+	d = dq.(*diskQueue)
+	Equal(t, writeEntries, len(d.writeIndex))
+	n, err = dq.Skip(200)
+	Nil(t, err)
+	Equal(t, int64(200), n)
+	m = <-dq.ReadMessageChan()
+	Equal(t, []byte("0978"), m.Data)
+
+	// indexes go along with their data files
+	_, err = os.Stat(indexFileName(d.fileName(0)))
+	Equal(t, true, os.IsNotExist(err))
+}
+
+func TestDiskQueueVerify(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_verify" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// 13 bytes per message, 16 messages per file
+	dq := New(dqName, tmpDir, 200, 1, 1<<10, 2500, 2*time.Second, l, WithFrameTrailer())
+	defer dq.Close()
+	for i := 0; i < 25; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+	for i := 0; i < 3; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+
+	report, err := dq.Verify()
+	Nil(t, err)
+	Equal(t, true, report.OK())
+	Equal(t, int64(22), report.Depth)
+	Equal(t, int64(22), report.CountedDepth)
+	Equal(t, []FileReport{
+		{FileNum: 0, Messages: 13, CorruptPos: -1},
+		{FileNum: 1, Messages: 9, CorruptPos: -1},
+	}, report.Files)
+
+	// flip a byte of the third message in the second file
+	f, err := os.OpenFile(dq.(*diskQueue).fileName(1), os.O_RDWR, 0600)
+	Nil(t, err)
+	_, err = f.WriteAt([]byte{0xff}, 2*13+4)
+	Nil(t, err)
+	f.Close()
+
+	report, err = dq.Verify()
+	Nil(t, err)
+	Equal(t, false, report.OK())
+	Equal(t, int64(22), report.Depth)
+	Equal(t, int64(15), report.CountedDepth)
+	Equal(t, int64(2), report.Files[1].Messages)
+	Equal(t, int64(26), report.Files[1].CorruptPos)
+	Equal(t, errChecksumMismatch, report.Files[1].Err)
+}
+
+func TestDiskQueueRecover(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_recover" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, l)
+	for i := 0; i < 6; i++ {
+		err = dq.Put([]byte(fmt.Sprintf("msg-%d", i)))
+		Nil(t, err)
+	}
+	dq.Close()
+
+	// corrupt the size of the 3rd message
+	frameSize := 5 + frameHeaderSize
+	dqFn := dq.(*diskQueue).fileName(0)
+	b, err := ioutil.ReadFile(dqFn)
+	Nil(t, err)
+	binary.BigEndian.PutUint32(b[2*frameSize:], 1<<20)
+	err = ioutil.WriteFile(dqFn, b, 0600)
+	Nil(t, err)
+
+	dq = New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+	Equal(t, []byte("msg-0"), <-dq.ReadChan())
+	Equal(t, []byte("msg-1"), <-dq.ReadChan())
+	for {
+		_, err = os.Stat(dqFn + ".bad")
+		if err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	_, err = dq.Recover(dq.(*diskQueue).fileName(1))
+	NotNil(t, err)
+	_, err = dq.Recover(dqFn)
+	NotNil(t, err)
+
+	// everything but the corrupted message is written again
+	depth := dq.Depth()
+	n, err := dq.Recover(dqFn + ".bad")
+	Nil(t, err)
+	Equal(t, int64(5), n)
+	Equal(t, depth+5, dq.Depth())
+	for _, i := range []int{0, 1, 3, 4, 5} {
+		Equal(t, []byte(fmt.Sprintf("msg-%d", i)), <-dq.ReadChan())
+	}
+	_, err = os.Stat(dqFn + ".bad")
+	Nil(t, err)
+}
+
+func TestDiskQueueLock(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_lock" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 1, 1<<10, 1, 2*time.Second, l)
+	err = dq.Put([]byte("msg"))
+	Nil(t, err)
+
+	_, err = NewWithOptions(dqName, tmpDir, WithLogger(l))
+	NotNil(t, err)
+	dq2 := New(dqName, tmpDir, 1024, 1, 1<<10, 1, 2*time.Second, l)
+	NotNil(t, dq2.LastError())
+	NotNil(t, dq2.Put([]byte("msg")))
+	// the state of the queue holding the lock is left alone
+	dq2.Close()
+	Equal(t, int64(1), dq.Depth())
+	dq.Close()
+
+	dq, err = NewWithOptions(dqName, tmpDir, WithLogger(l))
+	Nil(t, err)
+	defer dq.Close()
+	Equal(t, int64(1), dq.Depth())
+	Equal(t, []byte("msg"), <-dq.ReadChan())
+}
+
+func TestDiskQueuePreallocate(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_preallocate" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 49, 1, 1<<10, 1, 2*time.Second, l, WithPreallocate())
+	defer dq.Close()
+	for i := 0; i < 15; i++ {
+		err = dq.Put([]byte(fmt.Sprintf("%05d", i)))
+		Nil(t, err)
+	}
+
+	// files are only as large as what was written to them
+	stat, err := os.Stat(dq.(*diskQueue).fileName(0))
+	Nil(t, err)
+	Equal(t, int64(54), stat.Size())
+	stat, err = os.Stat(dq.(*diskQueue).fileName(2))
+	Nil(t, err)
+	Equal(t, int64(27), stat.Size())
+	for i := 0; i < 15; i++ {
+		Equal(t, []byte(fmt.Sprintf("%05d", i)), <-dq.ReadChan())
+	}
+}
+
+func TestDiskQueueFileRecycling(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_file_recycling" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 49, 1, 1<<10, 1, 2*time.Second, l, WithFileRecycling(2))
+	for i := 0; i < 24; i++ {
+		err = dq.Put([]byte(fmt.Sprintf("%05d", i)))
+		Nil(t, err)
+	}
+	for i := 0; i < 24; i++ {
+		Equal(t, []byte(fmt.Sprintf("%05d", i)), <-dq.ReadChan())
+	}
+	waitForDepth(t, dq, 0)
+
+	// 4 files were read, only 2 are kept
+	spares := dq.(*diskQueue).spareFiles
+	Equal(t, 2, len(spares))
+	for i := int64(0); i < 4; i++ {
+		_, err = os.Stat(dq.(*diskQueue).fileName(i))
+		NotNil(t, err)
+	}
+	spare, err := os.Stat(spares[1])
+	Nil(t, err)
+	Equal(t, int64(0), spare.Size())
+	dq.Close()
+
+	// spares are picked up on startup and reused for new files
+	dq = New(dqName, tmpDir, 49, 1, 1<<10, 1, 2*time.Second, l, WithFileRecycling(2))
+	defer dq.Close()
+	Equal(t, 2, len(dq.(*diskQueue).spareFiles))
+	for i := 0; i < 7; i++ {
+		err = dq.Put([]byte(fmt.Sprintf("%05d", i)))
+		Nil(t, err)
+	}
+	stat, err := os.Stat(dq.(*diskQueue).fileName(4))
+	Nil(t, err)
+	Equal(t, true, os.SameFile(spare, stat))
+	Equal(t, int64(54), stat.Size())
+	Equal(t, 0, len(dq.(*diskQueue).spareFiles))
+	for i := 0; i < 7; i++ {
+		Equal(t, []byte(fmt.Sprintf("%05d", i)), <-dq.ReadChan())
+	}
+}
+
+func TestDiskQueueDirSync(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_dir_sync" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var mtx sync.Mutex
+	var synced []string
+	defer func() { syncDirHook = syncDir }()
+	syncDirHook = func(dir string) error {
+		mtx.Lock()
+		synced = append(synced, dir)
+		mtx.Unlock()
+		return syncDir(dir)
+	}
+
+	// 2 files are created and metadata is synced at least once per put
+	dq := New(dqName, tmpDir, 49, 1, 1<<10, 1, 2*time.Second, l, WithDirSync(true))
+	for i := 0; i < 7; i++ {
+		err = dq.Put([]byte(fmt.Sprintf("%05d", i)))
+		Nil(t, err)
+	}
+	dq.Close()
+	mtx.Lock()
+	Equal(t, true, len(synced) >= 2+7)
+	for _, dir := range synced {
+		Equal(t, tmpDir, dir)
+	}
+	synced = nil
+	mtx.Unlock()
+
+	dq = New(dqName, tmpDir, 49, 1, 1<<10, 1, 2*time.Second, l, WithDirSync(false))
+	err = dq.Put([]byte("00007"))
+	Nil(t, err)
+	dq.Close()
+	mtx.Lock()
+	Equal(t, 0, len(synced))
+	mtx.Unlock()
+}
+
+func TestDiskQueueStartupScan(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_startup_scan" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 1, 1<<10, 1, 2*time.Second, l)
+	for i := 0; i < 5; i++ {
+		err = dq.Put([]byte(fmt.Sprintf("msg-%d", i)))
+		Nil(t, err)
+	}
+	metaDataFileName := dq.(*diskQueue).metaDataFileName()
+	dq.Close()
+
+	// positions in the middle of a message and past the end of the file
+	err = ioutil.WriteFile(metaDataFileName, []byte("7\n0,13\n0,50\n"), 0600)
+	Nil(t, err)
+	os.Remove(metaDataSlots(metaDataFileName)[1])
+
+	dq = New(dqName, tmpDir, 1024, 1, 1<<10, 1, 2*time.Second, l, WithStartupScan())
+	defer dq.Close()
+	Equal(t, int64(4), dq.Depth())
+	Equal(t, int64(9), dq.(*diskQueue).readPos)
+	Equal(t, int64(45), dq.(*diskQueue).writePos)
+	for i := 1; i < 5; i++ {
+		Equal(t, []byte(fmt.Sprintf("msg-%d", i)), <-dq.ReadChan())
+	}
+}
+
+func TestDiskQueueCleanShutdown(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_clean_shutdown" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 1, 1<<10, 1, 2*time.Second, l)
+	for i := 0; i < 5; i++ {
+		err = dq.Put([]byte(fmt.Sprintf("msg-%d", i)))
+		Nil(t, err)
+	}
+	metaDataFileName := dq.(*diskQueue).metaDataFileName()
+	dq.Close()
+
+	// a depth the startup scan would correct if it ran
+	md, err := readMetaData(metaDataFileName)
+	Nil(t, err)
+	Equal(t, true, md.clean)
+	md.depth = 7
+	err = ioutil.WriteFile(metaDataSlots(metaDataFileName)[md.generation%2], md.encode(), 0600)
+	Nil(t, err)
+
+	dq = New(dqName, tmpDir, 1024, 1, 1<<10, 1, 2*time.Second, l, WithStartupScan())
+	Equal(t, int64(7), dq.Depth())
+	md, err = readMetaData(metaDataFileName)
+	Nil(t, err)
+	Equal(t, true, md.clean)
+
+	// cleared by the first write
+	err = dq.Put([]byte("msg-5"))
+	Nil(t, err)
+	for {
+		md, err = readMetaData(metaDataFileName)
+		if err == nil && !md.clean {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	dq.Close()
+
+	// simulate a crash before the queue was closed again
+	md.depth = 7
+	err = ioutil.WriteFile(metaDataFileName, md.encode(), 0600)
+	Nil(t, err)
+	os.Remove(metaDataSlots(metaDataFileName)[1])
+	dq = New(dqName, tmpDir, 1024, 1, 1<<10, 1, 2*time.Second, l, WithStartupScan())
+	defer dq.Close()
+	Equal(t, int64(6), dq.Depth())
+}
+
+func TestDiskQueueGarbageCollection(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_gc" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	prefix := path.Join(tmpDir, dqName+".diskqueue.")
+	tmpFiles := []string{prefix + "meta.dat.123.tmp", prefix + "meta.b.dat.456.tmp", prefix + "delayed.dat.789.tmp"}
+	for _, fn := range tmpFiles {
+		err = ioutil.WriteFile(fn, []byte("partial"), 0600)
+		Nil(t, err)
+	}
+	now := time.Now()
+	for i, age := range []time.Duration{2 * time.Hour, 10 * time.Minute, time.Minute} {
+		fn := fmt.Sprintf("%s%06d.dat.bad", prefix, i)
+		err = ioutil.WriteFile(fn, make([]byte, 60), 0600)
+		Nil(t, err)
+		err = os.Chtimes(fn, now.Add(-age), now.Add(-age))
+		Nil(t, err)
+	}
+	other := path.Join(tmpDir, "other.diskqueue.000000.dat.bad")
+	err = ioutil.WriteFile(other, nil, 0600)
+	Nil(t, err)
+
+	dq := New(dqName, tmpDir, 1024, 1, 1<<10, 1, 2*time.Second, l,
+		WithBadFileRetention(time.Hour, 100))
+	defer dq.Close()
+	for _, fn := range tmpFiles {
+		assertFileNotExist(t, fn)
+	}
+	// the first is too old and the second doesn't fit in maxBytes
+	assertFileNotExist(t, prefix+"000000.dat.bad")
+	assertFileNotExist(t, prefix+"000001.dat.bad")
+	_, err = os.Stat(prefix + "000002.dat.bad")
+	Nil(t, err)
+	_, err = os.Stat(other)
+	Nil(t, err)
+}
+
+func TestDiskQueueErrors(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_errors" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 4, 16, 1, 2*time.Second, l)
+
+	err = dq.Put([]byte("abc"))
+	Equal(t, true, errors.Is(err, ErrMsgTooSmall))
+	err = dq.Put(make([]byte, 17))
+	Equal(t, true, errors.Is(err, ErrMsgTooLarge))
+	var sizeErr *MsgSizeError
+	Equal(t, true, errors.As(err, &sizeErr))
+	Equal(t, int64(17), sizeErr.Size)
+	for i := 0; i < 3; i++ {
+		err = dq.Put([]byte(fmt.Sprintf("msg-%d", i)))
+		Nil(t, err)
+	}
+	dq.Close()
+
+	err = dq.Put([]byte("msg-3"))
+	Equal(t, ErrExiting, err)
+	err = dq.Empty()
+	Equal(t, ErrExiting, err)
+
+	// the second message's size is garbled
+	f, err := os.OpenFile(dq.(*diskQueue).fileName(0), os.O_RDWR, 0600)
+	Nil(t, err)
+	_, err = f.WriteAt([]byte{0x0f, 0xff, 0xff, 0xff}, 9)
+	Nil(t, err)
+	f.Close()
+
+	dq = New(dqName, tmpDir, 1024, 4, 16, 1, 2*time.Second, l)
+	defer dq.Close()
+	_, err = dq.FastForward(context.Background(), func(data []byte) int {
+		return 1
+	})
+	Equal(t, true, errors.Is(err, ErrCorruptRecord))
+	var corruptErr *CorruptionError
+	Equal(t, true, errors.As(err, &corruptErr))
+	Equal(t, int64(9), corruptErr.Pos)
+	Equal(t, dq.(*diskQueue).fileName(0), corruptErr.FileName)
+}
+
+func TestDiskQueueOldestMessageAge(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_oldest_message_age" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 1, 1<<10, 1, 2*time.Second, l)
+	defer dq.Close()
+	Equal(t, time.Duration(0), dq.OldestMessageAge())
+
+	err = dq.PutMessage(Message{Data: []byte("old"), Timestamp: time.Now().Add(-time.Hour)})
+	Nil(t, err)
+	err = dq.Put([]byte("new"))
+	Nil(t, err)
+	waitFor(t, "the old message's age wasn't reported", func() bool {
+		return dq.OldestMessageAge() >= time.Hour
+	})
+
+	// dated by the mtime of the data file
+	Equal(t, []byte("old"), <-dq.ReadChan())
+	waitFor(t, "the new message's age wasn't reported", func() bool {
+		return dq.OldestMessageAge() < time.Hour
+	})
+	Equal(t, true, dq.OldestMessageAge() < time.Minute)
+
+	Equal(t, []byte("new"), <-dq.ReadChan())
+	waitFor(t, "the age of an empty queue wasn't reported", func() bool {
+		return dq.OldestMessageAge() == 0
+	})
+}
+
+func TestDiskQueueDepthWatermarks(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_depth_watermarks" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	above := make(chan int64, 10)
+	below := make(chan int64, 10)
+	dq := New(dqName, tmpDir, 1024, 1, 1<<10, 1, 2*time.Second, l,
+		OnDepthAbove(3, func(depth int64) { above <- depth }),
+		OnDepthBelow(2, func(depth int64) { below <- depth }))
+	defer dq.Close()
+
+	// an empty queue starts out below
+	Equal(t, int64(0), <-below)
+	for i := 0; i < 6; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+	Equal(t, int64(4), <-above)
+	for i := 0; i < 5; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+	Equal(t, int64(1), <-below)
+
+	// once per crossing
+	Equal(t, 0, len(above))
+	Equal(t, 0, len(below))
+}
+
+func TestManager(t *testing.T) {
+	l := NewTestLogger(t)
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	_, err = NewManager(tmpDir, -1)
+	NotNil(t, err)
+	m, err := NewManager(tmpDir, 100, WithLogger(l), WithMaxBytesPerFile(1024))
+	Nil(t, err)
+
+	a, err := m.Open("a")
+	Nil(t, err)
+	b, err := m.Open("b")
+	Nil(t, err)
+	again, err := m.Open("a")
+	Nil(t, err)
+	Equal(t, a, again)
+	names, err := m.ListQueues()
+	Nil(t, err)
+	Equal(t, []string{"a", "b"}, names)
+
+	// the quota is shared
+	msg := make([]byte, 10)
+	n := 0
+	for ; n < 100; n++ {
+		err = a.Put(msg)
+		if err != nil {
+			break
+		}
+	}
+	Equal(t, ErrQueueFull, err)
+	Equal(t, true, n > 0 && n < 10)
+	waitFor(t, "the disk usage wasn't reported", func() bool {
+		return m.DiskBytes() > 0
+	})
+	Equal(t, true, m.DiskBytes() <= 100)
+	Equal(t, ErrQueueFull, b.Put(msg))
+
+	// a closed queue is opened again
+	a.Close()
+	a, err = m.Open("a")
+	Nil(t, err)
+	Equal(t, int64(n), a.Depth())
+
+	Nil(t, m.Close())
+	_, err = m.Open("a")
+	Equal(t, ErrExiting, err)
+
+	m, err = NewManager(tmpDir, 0, WithLogger(l))
+	Nil(t, err)
+	names, err = m.ListQueues()
+	Nil(t, err)
+	Equal(t, []string{"a", "b"}, names)
+	c, err := m.Open("c")
+	Nil(t, err)
+	Nil(t, c.Put(make([]byte, 1000)))
+	Nil(t, m.Close())
+}
+
+func TestHybrid(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_hybrid" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	_, err = NewHybrid(dqName, tmpDir, 0, WithLogger(l))
+	NotNil(t, err)
+	h, err := NewHybrid(dqName, tmpDir, 3, WithLogger(l), WithMsgSize(1, 16))
+	Nil(t, err)
+	NotNil(t, h.Put(make([]byte, 17)))
+
+	// overflowing memory moves it to disk
+	for i := 0; i < 6; i++ {
+		Nil(t, h.Put([]byte{byte(i)}))
+	}
+	Equal(t, int64(6), h.Depth())
+	Equal(t, int64(0), h.MemDepth())
+	for i := 0; i < 6; i++ {
+		Equal(t, []byte{byte(i)}, <-h.ReadChan())
+	}
+
+	// memory is used again once disk is read in full
+	waitForDepth(t, h, 0)
+	Nil(t, h.Put([]byte{6}))
+	Nil(t, h.Put([]byte{7}))
+	Equal(t, int64(2), h.Depth())
+	Equal(t, int64(0), h.d.Depth())
+
+	// and written to disk on close
+	Nil(t, h.Close())
+	Equal(t, ErrExiting, h.Put([]byte{8}))
+	h, err = NewHybrid(dqName, tmpDir, 3, WithLogger(l))
+	Nil(t, err)
+	Equal(t, int64(2), h.Depth())
+	Equal(t, []byte{6}, <-h.ReadChan())
+	Equal(t, []byte{7}, <-h.ReadChan())
+	Nil(t, h.Close())
+}
+
+func TestDiskQueueReadBuffer(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_read_buffer" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	_, err = NewWithOptions(dqName, tmpDir, WithLogger(l), WithReadBuffer(4), WithManualCommit())
+	NotNil(t, err)
+	// 5 bytes per message, 6 messages per file
+	dq := New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l, WithReadBuffer(4))
+	for i := 0; i < 10; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+	for i := 0; i < 4; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+	waitFor(t, "the read buffer wasn't filled", func() bool {
+		return len(dq.ReadChan()) >= 4
+	})
+	// those in the buffer are read
+	waitForDepth(t, dq, 2)
+
+	// and taken back on close
+	dq.Close()
+	dq = New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+	Equal(t, int64(6), dq.Depth())
+	for i := 4; i < 10; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+}
+
+func TestDiskQueueReadBufferSkip(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_read_buffer_skip" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l, WithReadBuffer(4))
+	defer dq.Close()
+	for i := 0; i < 10; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+	waitFor(t, "the read buffer wasn't filled", func() bool {
+		return len(dq.ReadChan()) >= 4
+	})
+
+	// the oldest messages are those in the buffer
+	n, err := dq.Skip(3)
+	Nil(t, err)
+	Equal(t, int64(3), n)
+	Equal(t, []byte{3}, <-dq.ReadChan())
+	n, err = dq.TrimToDepth(2)
+	Nil(t, err)
+	Equal(t, int64(4), n)
+	Equal(t, []byte{8}, <-dq.ReadChan())
+	Equal(t, []byte{9}, <-dq.ReadChan())
+}
+
+func TestBufPool(t *testing.T) {
+	var p bufPool
+	buf := p.get(10)
+	Equal(t, 10, len(buf))
+	Equal(t, 1<<10, cap(buf))
+	buf = p.get(300 << 10)
+	Equal(t, 300<<10, cap(buf))
+
+	// a large buffer is only reused for large messages
+	p.put(buf)
+	p.put(make([]byte, 10))
+	Equal(t, true, cap(p.get(10)) <= 1<<10)
+	Equal(t, true, cap(p.get(2<<10)) <= 16<<10)
+	buf = p.get(200 << 10)
+	Equal(t, 200<<10, len(buf))
+	Equal(t, 256<<10, cap(buf))
+}
+
+func TestDiskQueueOwnedReads(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_owned_reads" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, l, WithOwnedReads())
+	defer dq.Close()
+
+	err = dq.PutTransaction([][]byte{[]byte("a"), []byte("bb")})
+	Nil(t, err)
+	err = dq.PutMessage(Message{Data: []byte("ccc"), Timestamp: time.Now()})
+	Nil(t, err)
+	err = dq.Put([]byte("dddd"))
+	Nil(t, err)
+
+	var msgs [][]byte
+	for i := 0; i < 4; i++ {
+		msg := <-dq.ReadChan()
+		Equal(t, len(msg), cap(msg))
+		msgs = append(msgs, msg)
+	}
+	// not overwritten by the reads that followed
+	Equal(t, [][]byte{[]byte("a"), []byte("bb"), []byte("ccc"), []byte("dddd")}, msgs)
+}
+
+func TestDiskQueueReadEnvelope(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_read_envelope" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+
+	now := time.Now()
+	err = dq.PutMessage(Message{Data: []byte("a"), Timestamp: now})
+	Nil(t, err)
+	err = dq.Put([]byte("b"))
+	Nil(t, err)
+
+	e := <-dq.ReadEnvelopeChan()
+	Equal(t, []byte("a"), e.Data)
+	Equal(t, now.UnixNano(), e.Timestamp.UnixNano())
+	e.Release()
+
+	// shared with another goroutine
+	e = <-dq.ReadEnvelopeChan()
+	e.Retain()
+	done := make(chan []byte)
+	go func() {
+		defer e.Release()
+		done <- append([]byte(nil), e.Data...)
+	}()
+	Equal(t, []byte("b"), <-done)
+	e.Release()
+
+	defer func() {
+		NotNil(t, recover())
+	}()
+	e.Release()
+}
+
+func TestDiskQueueDeleteWhere(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_delete_where" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// 5 bytes per message, 6 messages per file
+	dq := New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l)
+	for i := 0; i < 20; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+	err = dq.PutTransaction([][]byte{{100}, {101}, {102}})
+	Nil(t, err)
+	Equal(t, []byte{0}, <-dq.ReadChan())
+	Equal(t, []byte{1}, <-dq.ReadChan())
+
+	even := func(data []byte) bool {
+		return data[0]%2 == 0
+	}
+	n, err := dq.DeleteWhere(even)
+	Nil(t, err)
+	Equal(t, int64(11), n)
+	Equal(t, int64(10), dq.Depth())
+	_, err = os.Stat(dq.(*diskQueue).fileName(0))
+	Equal(t, true, os.IsNotExist(err))
+
+	// kept in order, and across a restart
+	for i := 3; i < 10; i += 2 {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+	dq.Close()
+	dq = New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+	Equal(t, int64(6), dq.Depth())
+	for i := 11; i < 20; i += 2 {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+	Equal(t, []byte{101}, <-dq.ReadChan())
+
+	_, err = dq.NewCursor("c")
+	Nil(t, err)
+	_, err = dq.DeleteWhere(even)
+	NotNil(t, err)
+}
+
+func TestDiskQueueCompact(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_compact" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dataFiles := func() int {
+		files, _ := filepath.Glob(filepath.Join(tmpDir, dqName+".diskqueue.*[0-9].dat"))
+		return len(files)
+	}
+
+	// small data files, which are kept as they are once it's larger
+	dq := New(dqName, tmpDir, 40, 1, 1<<10, 2500, 2*time.Second, l, WithFileFormat(2))
+	for i := 0; i < 20; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+	Equal(t, []byte{0}, <-dq.ReadChan())
+	dq.Close()
+	before := dataFiles()
+	dq = New(dqName, tmpDir, 1<<10, 1, 1<<10, 2500, 2*time.Second, l, WithFileFormat(2))
+	defer dq.Close()
+
+	n, err := dq.Compact()
+	Nil(t, err)
+	Equal(t, true, n > 0)
+	Equal(t, before-int(n), dataFiles())
+	Equal(t, int64(19), dq.Depth())
+	n, err = dq.Compact()
+	Nil(t, err)
+	Equal(t, int64(0), n)
+
+	for i := 1; i < 20; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+}
+
+func TestDiskQueueDedup(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_dedup" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1<<10, 1, 1<<10, 2500, 2*time.Second, l, WithDedup(2, false))
+	Nil(t, dq.Put([]byte("a")))
+	Nil(t, dq.Put([]byte("a")))
+	Nil(t, dq.Put([]byte("b")))
+	Equal(t, int64(2), dq.Depth())
+	dq.Close()
+
+	// the window is persisted, "a" drops out of it once "c" is written
+	dq = New(dqName, tmpDir, 1<<10, 1, 1<<10, 2500, 2*time.Second, l, WithDedup(2, true))
+	defer dq.Close()
+	Equal(t, ErrDuplicate, dq.Put([]byte("b")))
+	Nil(t, dq.Put([]byte("c")))
+	Nil(t, dq.Put([]byte("a")))
+	Equal(t, int64(4), dq.Depth())
+	for _, s := range []string{"a", "b", "c", "a"} {
+		Equal(t, []byte(s), <-dq.ReadChan())
+	}
+}
+
+func TestDiskQueuePutPosition(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_put_position" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// 5 bytes per message, 10 messages per file
+	dq := New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+
+	var positions []Position
+	for i := 0; i < 12; i++ {
+		p, err := dq.PutPosition([]byte{byte(i)})
+		Nil(t, err)
+		positions = append(positions, p)
+	}
+	Equal(t, Position{0, 0}, positions[0])
+	Equal(t, Position{0, 5}, positions[1])
+	Equal(t, Position{1, 0}, positions[10])
+
+	err = dq.SeekTo(positions[11])
+	Nil(t, err)
+	Equal(t, []byte{11}, <-dq.ReadChan())
+	// file 0 has been read and removed
+	err = dq.SeekTo(positions[10])
+	Nil(t, err)
+	Equal(t, []byte{10}, <-dq.ReadChan())
+}
+
+func TestTopic(t *testing.T) {
+	l := NewTestLogger(t)
+	name := "test_topic" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// 5 bytes per message, 10 messages per file
+	opts := []Option{WithMaxBytesPerFile(49), WithLogger(l), WithSyncEvery(1)}
+	topic, err := NewTopic(name, tmpDir, opts...)
+	Nil(t, err)
+
+	// the first channel gets what was written before it
+	Nil(t, topic.Put([]byte{0}))
+	a, err := topic.Channel("a")
+	Nil(t, err)
+	b, err := topic.Channel("b")
+	Nil(t, err)
+	for i := 1; i < 25; i++ {
+		Nil(t, topic.Put([]byte{byte(i)}))
+	}
+	Equal(t, int64(25), a.Depth())
+	Equal(t, int64(24), b.Depth())
+
+	for i := 0; i < 25; i++ {
+		Equal(t, []byte{byte(i)}, <-a.ReadChan())
+	}
+	// b holds on to the files a has read
+	dq := topic.d
+	_, err = os.Stat(dq.fileName(0))
+	Nil(t, err)
+	for i := 1; i < 22; i++ {
+		Equal(t, []byte{byte(i)}, <-b.ReadChan())
+	}
+	Equal(t, []byte{22}, <-b.ReadChan())
+	Nil(t, b.Close())
+	_, err = os.Stat(dq.fileName(1))
+	Equal(t, true, os.IsNotExist(err))
+
+	// channels carry on where they left off
+	Nil(t, a.Close())
+	Nil(t, topic.Close())
+	topic, err = NewTopic(name, tmpDir, opts...)
+	Nil(t, err)
+	defer topic.Close()
+	b, err = topic.Channel("b")
+	Nil(t, err)
+	Equal(t, []byte{23}, <-b.ReadChan())
+	Nil(t, b.Delete())
+
+	_, err = NewTopic(name+"_manual", tmpDir, WithManualCommit())
+	NotNil(t, err)
+}
+
+func TestDiskQueueMoveTo(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_move_to" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l)
+	dst := New(dqName+"_dst", tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l)
+	for i := 0; i < 30; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+	Equal(t, []byte{0}, <-dq.ReadChan())
+
+	n, err := dq.MoveTo(dst, 4)
+	Nil(t, err)
+	Equal(t, int64(4), n)
+	Equal(t, int64(25), dq.Depth())
+	Equal(t, int64(4), dst.Depth())
+
+	// a move interrupted after writing part of its batch, dst having been
+	// written a message identical to the first of it before
+	res := dq.(*diskQueue).sendMove(moveRequest{
+		dstPath:    tmpDir,
+		dstName:    dqName + "_dst",
+		max:        3,
+		maxMsgSize: 1 << 10,
+	})
+	Nil(t, res.err)
+	Equal(t, 3, len(res.msgs))
+	err = dst.Put(res.msgs[0])
+	Nil(t, err)
+	stats := dst.Stats()
+	err = dst.(*diskQueue).sendMoveIn(moveInRequest{
+		srcPath: tmpDir,
+		srcName: dqName,
+		batch:   res.move.batch,
+		msgs:    res.msgs[:1],
+	})
+	Nil(t, err)
+	dst.Close()
+	dq.Close()
+
+	// the record as written before the batch
+	err = ioutil.WriteFile(dst.(*diskQueue).moveInFileName(), []byte(fmt.Sprintf("%q %q %d %d,%d 0 3\n",
+		tmpDir, dqName, res.move.batch, stats.WriteFileNum, stats.WritePos)), 0600)
+	Nil(t, err)
+	dst = New(dqName+"_dst", tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l)
+	defer dst.Close()
+	Equal(t, int64(6), dst.Depth())
+
+	dq = New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+	Equal(t, int64(22), dq.Depth())
+	other := New(dqName+"_other", tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l)
+	defer other.Close()
+	_, err = dq.MoveTo(other, 1)
+	NotNil(t, err)
+
+	// the rest of the batch, and two more
+	n, err = dq.MoveTo(dst, 5)
+	Nil(t, err)
+	Equal(t, int64(5), n)
+	Equal(t, int64(20), dq.Depth())
+	Equal(t, int64(10), dst.Depth())
+	for i := 1; i < 6; i++ {
+		Equal(t, []byte{byte(i)}, <-dst.ReadChan())
+	}
+	for i := 5; i < 10; i++ {
+		Equal(t, []byte{byte(i)}, <-dst.ReadChan())
+	}
+	Equal(t, []byte{10}, <-dq.ReadChan())
+
+	// a batch written in full isn't written again
+	res = dq.(*diskQueue).sendMove(moveRequest{
+		dstPath:    tmpDir,
+		dstName:    dqName + "_dst",
+		max:        2,
+		maxMsgSize: 1 << 10,
+	})
+	Nil(t, res.err)
+	req := moveInRequest{srcPath: tmpDir, srcName: dqName, batch: res.move.batch, msgs: res.msgs}
+	Nil(t, dst.(*diskQueue).sendMoveIn(req))
+	Nil(t, dst.(*diskQueue).sendMoveIn(req))
+	n, err = dq.MoveTo(dst, 2)
+	Nil(t, err)
+	Equal(t, int64(2), n)
+	Equal(t, int64(17), dq.Depth())
+	Equal(t, []byte{11}, <-dst.ReadChan())
+	Equal(t, []byte{12}, <-dst.ReadChan())
+	waitForDepth(t, dst, 0)
+}
+
+func TestDiskQueueSpliceFrom(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_splice_from" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l)
+	for i := 0; i < 3; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+	Equal(t, []byte{0}, <-dq.ReadChan())
+
+	// three data files, the first of which was read in part
+	other := New(dqName+"_other", tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l)
+	for i := 0; i < 25; i++ {
+		err = other.Put([]byte{byte(100 + i)})
+		Nil(t, err)
+	}
+	for i := 0; i < 3; i++ {
+		Equal(t, []byte{byte(100 + i)}, <-other.ReadChan())
+	}
+	err = dq.SpliceFrom(tmpDir, dqName+"_other")
+	NotNil(t, err)
+	other.Close()
+
+	err = dq.SpliceFrom(tmpDir, dqName+"_other")
+	Nil(t, err)
+	Equal(t, int64(24), dq.Depth())
+	for _, fileName := range []string{
+		fmt.Sprintf(path.Join(tmpDir, "%s_other.diskqueue.000000.dat"), dqName),
+		fmt.Sprintf(path.Join(tmpDir, "%s_other.diskqueue.000002.dat"), dqName),
+		fmt.Sprintf(path.Join(tmpDir, "%s_other.diskqueue.meta.dat"), dqName),
+	} {
+		_, err = os.Stat(fileName)
+		Equal(t, true, os.IsNotExist(err))
+	}
+	err = dq.Put([]byte{200})
+	Nil(t, err)
+	dq.Close()
+
+	dq = New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+	Equal(t, int64(25), dq.Depth())
+	for i := 1; i < 3; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+	for i := 3; i < 25; i++ {
+		Equal(t, []byte{byte(100 + i)}, <-dq.ReadChan())
+	}
+	Equal(t, []byte{200}, <-dq.ReadChan())
+	waitForDepth(t, dq, 0)
+}
+
+func TestDiskQueueSpliceFromV1(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_splice_from_v1" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l, WithFileFormat(fileFormatV1))
+	defer dq.Close()
+
+	// files that would be read as ending at 49 bytes
+	other := New(dqName+"_other", tmpDir, 1<<10, 1, 1<<10, 2500, 2*time.Second, l, WithFileFormat(fileFormatV1))
+	for i := 0; i < 25; i++ {
+		err = other.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+	other.Close()
+	err = dq.SpliceFrom(tmpDir, dqName+"_other")
+	NotNil(t, err)
+	Equal(t, int64(0), dq.Depth())
+	_, err = os.Stat(fmt.Sprintf(path.Join(tmpDir, "%s_other.diskqueue.000000.dat"), dqName))
+	Nil(t, err)
+
+	// written with the same maxBytesPerFile
+	other = New(dqName+"_same", tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l, WithFileFormat(fileFormatV1))
+	for i := 0; i < 25; i++ {
+		err = other.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+	other.Close()
+	err = dq.SpliceFrom(tmpDir, dqName+"_same")
+	Nil(t, err)
+	Equal(t, int64(25), dq.Depth())
+	for i := 0; i < 25; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+	waitForDepth(t, dq, 0)
+}
+
+func TestDiskQueueInFlight(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_in_flight" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, l, WithInFlight(100*time.Millisecond))
+	for i := 0; i < 3; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+
+	m := <-dq.ReadInFlightChan()
+	Equal(t, []byte{0}, m.Data)
+	Nil(t, m.Finish())
+	Equal(t, ErrNotInFlight, m.Finish())
+	timedOut := <-dq.ReadInFlightChan()
+	Equal(t, []byte{1}, timedOut.Data)
+	m = <-dq.ReadInFlightChan()
+	Equal(t, []byte{2}, m.Data)
+	Nil(t, m.Finish())
+	Equal(t, int64(0), dq.Depth())
+
+	// put back on the queue after the timeout
+	select {
+	case m = <-dq.ReadInFlightChan():
+	case <-time.After(2 * time.Second):
+		t.Fatal("message in flight wasn't requeued")
+	}
+	Equal(t, []byte{1}, m.Data)
+	NotEqual(t, timedOut.ID, m.ID)
+	Equal(t, ErrNotInFlight, timedOut.Finish())
+	dq.Close()
+
+	// and again once reopened
+	dq = New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, l, WithInFlight(time.Minute))
+	defer dq.Close()
+	m = <-dq.ReadInFlightChan()
+	Equal(t, []byte{1}, m.Data)
+	Nil(t, m.Finish())
+	_, err = os.Stat(dq.(*diskQueue).inFlightFileName())
+	Equal(t, true, os.IsNotExist(err))
+}
+
+func TestDiskQueueMaxAttempts(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_max_attempts" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	_, err = NewWithOptions(dqName, tmpDir, WithLogger(l), WithInFlight(time.Second), WithMaxAttempts(2))
+	NotNil(t, err)
+
+	dq, err := NewWithOptions(dqName, tmpDir, WithLogger(l), WithDeadLetterQueue(),
+		WithInFlight(50*time.Millisecond), WithMaxAttempts(2))
+	Nil(t, err)
+	defer dq.Close()
+	err = dq.PutMessage(Message{Data: []byte("job"), Headers: map[string]string{"k": "v"}})
+	Nil(t, err)
+
+	for i := 1; i <= 2; i++ {
+		select {
+		case m := <-dq.ReadInFlightChan():
+			Equal(t, []byte("job"), m.Data)
+			Equal(t, i, m.Attempts)
+			Equal(t, map[string]string{"k": "v"}, m.Headers)
+		case <-time.After(2 * time.Second):
+			t.Fatal("message in flight wasn't requeued")
+		}
+	}
+
+	// not put back on the queue after the second attempt
+	var m Message
+	select {
+	case m = <-dq.DeadLetterQueue().ReadMessageChan():
+	case <-time.After(2 * time.Second):
+		t.Fatal("message wasn't moved to the dead letter queue")
+	}
+	Equal(t, []byte("job"), m.Data)
+	Equal(t, map[string]string{"k": "v"}, m.Headers)
+	Equal(t, int64(0), dq.Depth())
+}
+
+func TestDiskQueueAttemptsHeader(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_attempts_header" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, l, WithInFlight(50*time.Millisecond))
+	defer dq.Close()
+	err = dq.PutMessage(Message{Data: []byte("job"), Headers: map[string]string{"k": "v"}})
+	Nil(t, err)
+
+	// put back on the queue after each timeout
+	for i := 1; i <= 2; i++ {
+		select {
+		case m := <-dq.ReadInFlightChan():
+			Equal(t, i, m.Attempts)
+			Equal(t, map[string]string{"k": "v"}, m.Headers)
+		case <-time.After(2 * time.Second):
+			t.Fatal("message in flight wasn't requeued")
+		}
+	}
+
+	select {
+	case m := <-dq.ReadMessageChan():
+		Equal(t, []byte("job"), m.Data)
+		Equal(t, map[string]string{"k": "v"}, m.Headers)
+	case <-time.After(2 * time.Second):
+		t.Fatal("message in flight wasn't requeued")
+	}
+}
+
+func TestDiskQueueEmptyTo(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_empty_to" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+	var positions []Position
+	for i := 0; i < 30; i++ {
+		p, err := dq.PutPosition([]byte{byte(i)})
+		Nil(t, err)
+		positions = append(positions, p)
+	}
+	Equal(t, []byte{0}, <-dq.ReadChan())
+
+	err = dq.EmptyTo(positions[15])
+	Nil(t, err)
+	Equal(t, int64(15), dq.Depth())
+	assertFileNotExist(t, dq.(*diskQueue).fileName(0))
+	Equal(t, []byte{15}, <-dq.ReadChan())
+
+	err = dq.EmptyTo(positions[10])
+	NotNil(t, err)
+	// not the start of a message
+	err = dq.EmptyTo(Position{positions[20].FileNum, positions[20].Pos + 1})
+	NotNil(t, err)
+	waitForDepth(t, dq, 14)
+	Equal(t, []byte{16}, <-dq.ReadChan())
+	err = dq.EmptyTo(Position{dq.Stats().WriteFileNum, dq.Stats().WritePos})
+	Nil(t, err)
+	Equal(t, int64(0), dq.Depth())
+	assertFileNotExist(t, dq.(*diskQueue).fileName(1))
+}
+
+func TestDiskQueueTrimToDepth(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_trim_to_depth" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l, WithSegmentFooters())
+	defer dq.Close()
+	for i := 0; i < 30; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+	Equal(t, []byte{0}, <-dq.ReadChan())
+
+	_, err = dq.TrimToDepth(-1)
+	NotNil(t, err)
+	n, err := dq.TrimToDepth(12)
+	Nil(t, err)
+	Equal(t, int64(17), n)
+	Equal(t, int64(12), dq.Depth())
+	assertFileNotExist(t, dq.(*diskQueue).fileName(0))
+	Equal(t, []byte{18}, <-dq.ReadChan())
+
+	n, err = dq.TrimToDepth(20)
+	Nil(t, err)
+	Equal(t, int64(0), n)
+	Equal(t, []byte{19}, <-dq.ReadChan())
+}
+
+func TestDiskQueueRotation(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_rotation" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	_, err = NewWithOptions(dqName, tmpDir, WithLogger(l), WithRotateCount(-1))
+	NotNil(t, err)
+
+	dq := New(dqName, tmpDir, 1<<20, 1, 1<<10, 2500, 2*time.Second, l, WithRotateCount(3))
+	err = dq.PutMany([][]byte{{0}, {1}, {2}, {3}, {4}})
+	Nil(t, err)
+	Equal(t, int64(1), dq.Stats().WriteFileNum)
+	err = dq.PutMany([][]byte{{5}, {6}})
+	Nil(t, err)
+	Equal(t, int64(2), dq.Stats().WriteFileNum)
+	dq.Close()
+
+	// the write file's count survives a restart
+	dq = New(dqName, tmpDir, 1<<20, 1, 1<<10, 2500, 2*time.Second, l, WithRotateCount(3))
+	for i := 7; i < 9; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+	Equal(t, int64(3), dq.Stats().WriteFileNum)
+	Equal(t, int64(9), dq.Depth())
+	for i := 0; i < 9; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+	dq.Close()
+
+	dqName += "_interval"
+	dq = New(dqName, tmpDir, 1<<20, 1, 1<<10, 2500, 2*time.Second, l, WithRotateInterval(time.Second))
+	err = dq.Put([]byte{0})
+	Nil(t, err)
+	for i := 0; i < 300 && dq.Stats().WriteFileNum == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	Equal(t, int64(1), dq.Stats().WriteFileNum)
+	err = dq.Put([]byte{1})
+	Nil(t, err)
+	Equal(t, []byte{0}, <-dq.ReadChan())
+	Equal(t, []byte{1}, <-dq.ReadChan())
+	dq.Close()
+
+	// last written to in an earlier hour
+	err = os.Chtimes(dq.(*diskQueue).fileName(1), time.Now().Add(-2*time.Hour), time.Now().Add(-2*time.Hour))
+	Nil(t, err)
+	dq = New(dqName, tmpDir, 1<<20, 1, 1<<10, 2500, 2*time.Second, l, WithRotateInterval(time.Hour))
+	defer dq.Close()
+	Equal(t, int64(2), dq.Stats().WriteFileNum)
+}
+
+func TestDiskQueueHooks(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_hooks" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var mu sync.Mutex
+	var events []string
+	var syncs int
+	record := func(event string) func(string) {
+		return func(fileName string) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, event+" "+path.Base(fileName))
+		}
+	}
+	dq := New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l,
+		OnFileCreate(record("create")),
+		OnFileRotate(record("rotate")),
+		OnFileDelete(record("delete")),
+		OnBadFile(record("bad")),
+		OnSync(func(latency time.Duration) {
+			mu.Lock()
+			defer mu.Unlock()
+			syncs++
+		}))
+	defer dq.Close()
+	fileName := func(fileNum int64) string {
+		return path.Base(dq.(*diskQueue).fileName(fileNum))
+	}
+
+	for i := 0; i < 11; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+	for i := 0; i < 10; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+	// corrupt the rest of the 2nd file
+	dq.(*diskQueue).writeFile.Write([]byte{0, 0, 0, 0})
+	err = dq.Put([]byte{11})
+	Nil(t, err)
+	Equal(t, []byte{10}, <-dq.ReadChan())
+	err = dq.Sync()
+	Nil(t, err)
+
+	expected := []string{
+		"create " + fileName(0),
+		"rotate " + fileName(0),
+		"create " + fileName(1),
+		"delete " + fileName(0),
+		"bad " + fileName(1) + ".bad",
+	}
+	for i := 0; i < 100; i++ {
+		mu.Lock()
+		n := len(events)
+		mu.Unlock()
+		if n >= len(expected) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	Equal(t, expected, events)
+	NotEqual(t, 0, syncs)
+}
+
+func TestDiskQueueHooksOnClose(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_hooks_on_close" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var deletes, syncs int32
+	dq := New(dqName, tmpDir, 49, 1, 1<<10, 2500, 2*time.Second, l,
+		WithReadCommitBatch(1000, time.Hour),
+		OnFileDelete(func(fileName string) {
+			atomic.AddInt32(&deletes, 1)
+		}),
+		OnSync(func(latency time.Duration) {
+			atomic.AddInt32(&syncs, 1)
+		}))
+	for i := 0; i < 11; i++ {
+		err = dq.Put([]byte{byte(i)})
+		Nil(t, err)
+	}
+	for i := 0; i < 10; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+	waitForDepth(t, dq, 1)
+	err = dq.Sync()
+	Nil(t, err)
+	start := time.Now()
+	for atomic.LoadInt32(&syncs) == 0 {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("OnSync wasn't called")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	Equal(t, int32(0), atomic.LoadInt32(&deletes))
+	synced := atomic.LoadInt32(&syncs)
+
+	// the first file is only removed once the reads are committed on close
+	err = dq.Close()
+	Nil(t, err)
+	start = time.Now()
+	for atomic.LoadInt32(&deletes) == 0 || atomic.LoadInt32(&syncs) == synced {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("hooks weren't called on close")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	Equal(t, int32(1), atomic.LoadInt32(&deletes))
+	assertFileNotExist(t, dq.(*diskQueue).fileName(0))
+}
+
+func TestRetrySharing(t *testing.T) {
+	errSharing := errors.New("sharing violation")
+	defer func() { sharingViolationHook = isSharingViolation }()
+	sharingViolationHook = func(err error) bool {
+		return err == errSharing
+	}
+
+	// retried until it succeeds
+	calls := 0
+	err := retrySharing(func() error {
+		calls++
+		if calls < 3 {
+			return errSharing
+		}
+		return nil
+	})
+	Nil(t, err)
+	Equal(t, 3, calls)
+
+	// then given up on
+	calls = 0
+	err = retrySharing(func() error {
+		calls++
+		return errSharing
+	})
+	Equal(t, errSharing, err)
+	Equal(t, sharingRetries+1, calls)
+
+	// other errors aren't retried
+	calls = 0
+	errOther := errors.New("other")
+	err = retrySharing(func() error {
+		calls++
+		return errOther
+	})
+	Equal(t, errOther, err)
+	Equal(t, 1, calls)
+}
+
+type lockedBuffer struct {
+	sync.Mutex
+	bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func TestDiskQueueSlog(t *testing.T) {
+	dqName := "test_disk_queue_slog" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	var buf lockedBuffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	dq := NewWithSlog(dqName, tmpDir, 1024, 1, 1<<10, 1, 2*time.Second, logger)
+	err = dq.Put([]byte("msg"))
+	Nil(t, err)
+	dq.Close()
+
+	var opened map[string]interface{}
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var rec map[string]interface{}
+		err = json.Unmarshal(line, &rec)
+		Nil(t, err)
+		Equal(t, dqName, rec["queue"])
+		if rec["msg"] == "writeOne() opened file" {
+			opened = rec
+		}
+	}
+	NotNil(t, opened)
+	Equal(t, "INFO", opened["level"])
+	Equal(t, dq.(*diskQueue).fileName(0), opened["file"])
+
+	// formatted for an AppLogFunc otherwise
+	var logged string
+	d := &diskQueue{name: "q", logf: func(lvl LogLevel, f string, args ...interface{}) {
+		logged = lvl.String() + " " + fmt.Sprintf(f, args...)
+	}}
+	d.log(ERROR, "failed to read message", "file", "q.dat", "pos", 9, "err", errors.New("bad size"))
+	Equal(t, `ERROR DISKQUEUE(q) failed to read message file=q.dat pos=9 err="bad size"`, logged)
+}
+
+type testTelemetry struct {
+	sync.Mutex
+	spans    map[string]int
+	attrs    map[string]interface{}
+	counters map[string]int64
+}
+
+type testSpan struct {
+	tt   *testTelemetry
+	name string
+}
+
+func (tt *testTelemetry) Start(ctx context.Context, spanName string) (context.Context, Span) {
+	return ctx, testSpan{tt, spanName}
+}
+
+func (s testSpan) SetAttribute(key string, value interface{}) {
+	s.tt.Lock()
+	defer s.tt.Unlock()
+	s.tt.attrs[s.name+" "+key] = value
+}
+
+func (s testSpan) RecordError(err error) {}
+
+func (s testSpan) End() {
+	s.tt.Lock()
+	defer s.tt.Unlock()
+	s.tt.spans[s.name]++
+}
+
+type testCounter struct {
+	tt   *testTelemetry
+	name string
+}
+
+func (tt *testTelemetry) Int64Counter(name string) Int64Counter {
+	return testCounter{tt, name}
+}
+
+func (c testCounter) Add(ctx context.Context, incr int64) {
+	c.tt.Lock()
+	defer c.tt.Unlock()
+	c.tt.counters[c.name] += incr
+}
+
+func TestDiskQueueTelemetry(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_telemetry" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tt := &testTelemetry{
+		spans:    make(map[string]int),
+		attrs:    make(map[string]interface{}),
+		counters: make(map[string]int64),
+	}
+	dq := New(dqName, tmpDir, 49, 1, 1<<10, 1, 2*time.Second, l, WithTelemetry(tt, tt))
+	for i := 0; i < 8; i++ {
+		err = dq.Put([]byte(fmt.Sprintf("msg-%d", i)))
+		Nil(t, err)
+	}
+	Equal(t, []byte("msg-0"), <-dq.ReadChan())
+	res, err := dq.FastForward(context.Background(), func(data []byte) int {
+		return 1
+	})
+	Nil(t, err)
+	Equal(t, int64(7), res.Skipped)
+	dq.Close()
+
+	tt.Lock()
+	defer tt.Unlock()
+	Equal(t, 1, tt.spans["diskqueue.rotate"])
+	Equal(t, 1, tt.spans["diskqueue.fast_forward"])
+	Equal(t, true, tt.spans["diskqueue.sync"] >= 8)
+	Equal(t, int64(7), tt.attrs["diskqueue.fast_forward diskqueue.skipped"])
+	Equal(t, dqName, tt.attrs["diskqueue.sync diskqueue.name"])
+	Equal(t, int64(8), tt.counters["diskqueue.writes"])
+	Equal(t, int64(1), tt.counters["diskqueue.reads"])
+	Equal(t, int64(1), tt.counters["diskqueue.rotations"])
+	Equal(t, int64(tt.spans["diskqueue.sync"]), tt.counters["diskqueue.syncs"])
+}
+
+func TestInspector(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_inspector" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 49, 1, 1<<10, 1, 2*time.Second, l)
+	defer dq.Close()
+	for i := 0; i < 8; i++ {
+		err = dq.Put([]byte(fmt.Sprintf("msg-%d", i)))
+		Nil(t, err)
+	}
+	err = dq.PutTransaction([][]byte{[]byte("txn-0"), []byte("txn-1")})
+	Nil(t, err)
+	Equal(t, []byte("msg-0"), <-dq.ReadChan())
+	err = dq.WriteBarrier()
+	Nil(t, err)
+
+	// alongside the open queue
+	i := NewInspector(dqName, tmpDir, WithMaxBytesPerFile(49), WithMsgSize(1, 1<<10))
+	md, err := i.MetaData()
+	Nil(t, err)
+	Equal(t, int64(9), md.Depth)
+	Equal(t, Position{0, 9}, md.Read)
+
+	var positions []Position
+	var got []string
+	end, err := i.Walk(md.Read, func(pos Position, m Message) bool {
+		positions = append(positions, pos)
+		got = append(got, string(m.Data))
+		return true
+	})
+	Nil(t, err)
+	Equal(t, md.Write, end)
+	Equal(t, []string{"msg-1", "msg-2", "msg-3", "msg-4", "msg-5", "msg-6", "msg-7", "txn-0", "txn-1"}, got)
+	Equal(t, Position{1, 0}, positions[5])
+	Equal(t, positions[7], positions[8])
+
+	// stops where fn says to
+	end, err = i.Walk(md.Read, func(pos Position, m Message) bool {
+		return string(m.Data) != "msg-3"
+	})
+	Nil(t, err)
+	Equal(t, Position{0, 27}, end)
+}
+
+func TestDirectFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	fileName := path.Join(tmpDir, "direct")
+	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0600)
+	Nil(t, err)
+
+	w := newDirectFile(f)
+	var want []byte
+	for i, n := range []int{10, directIOAlign, 5000, 3, directIOBufferSize + 100} {
+		b := bytes.Repeat([]byte{byte('a' + i)}, n)
+		_, err = w.Write(b)
+		Nil(t, err)
+		want = append(want, b...)
+	}
+	// padded to whole blocks while open
+	stat, err := f.Stat()
+	Nil(t, err)
+	Equal(t, int64(0), stat.Size()%directIOAlign)
+	err = w.Truncate(int64(len(want) - 50))
+	Nil(t, err)
+	want = want[:len(want)-50]
+	_, err = w.Write([]byte("tail"))
+	Nil(t, err)
+	want = append(want, "tail"...)
+	err = w.Close()
+	Nil(t, err)
+	got, err := ioutil.ReadFile(fileName)
+	Nil(t, err)
+	Equal(t, want, got)
+
+	f, err = os.OpenFile(fileName, os.O_RDWR, 0600)
+	Nil(t, err)
+	w = newDirectFile(f)
+	_, err = w.Seek(int64(len(want)), 0)
+	Nil(t, err)
+	_, err = w.Write([]byte("more"))
+	Nil(t, err)
+	want = append(want, "more"...)
+	err = w.Close()
+	Nil(t, err)
+	got, err = ioutil.ReadFile(fileName)
+	Nil(t, err)
+	Equal(t, want, got)
+}
+
+func TestDiskQueueDirectIO(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_direct_io" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	_, err = NewWithOptions(dqName, tmpDir, WithLogger(l), WithDirectIO(), WithAppendWrites())
+	NotNil(t, err)
+
+	dq, err := NewWithOptions(dqName, tmpDir, WithLogger(l), WithDirectIO(), WithMaxBytesPerFile(10000))
+	Nil(t, err)
+	for i := 0; i < 100; i++ {
+		err = dq.Put(bytes.Repeat([]byte{byte(i)}, i*10+1))
+		Nil(t, err)
+		if i%2 == 1 {
+			// reads catch up with the block being written
+			Equal(t, bytes.Repeat([]byte{byte(i / 2)}, i/2*10+1), <-dq.ReadChan())
+		}
+	}
+	dq.Close()
+
+	dq, err = NewWithOptions(dqName, tmpDir, WithLogger(l), WithDirectIO(), WithMaxBytesPerFile(10000))
+	Nil(t, err)
+	defer dq.Close()
+	Equal(t, int64(50), dq.Depth())
+	Equal(t, int64(dq.(*diskQueue).writePos), dq.(*diskQueue).fileSize(dq.(*diskQueue).writeFileNum))
+	for i := 50; i < 100; i++ {
+		Equal(t, bytes.Repeat([]byte{byte(i)}, i*10+1), <-dq.ReadChan())
+	}
+}
+
 func BenchmarkDiskQueuePut16(b *testing.B) {
 	benchmarkDiskQueuePut(16, b)
 }
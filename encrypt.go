@@ -0,0 +1,128 @@
+package diskqueue
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// KeyProvider supplies the AES keys messages are encrypted with, see
+// WithEncryption
+//
+// every encrypted message records the id of its key so keys can be rotated
+// by changing CurrentKey while Key keeps returning the older ones for as
+// long as messages encrypted with them remain in the queue
+type KeyProvider interface {
+	// CurrentKey returns the id and the 16, 24 or 32 byte key new
+	// messages are encrypted with
+	CurrentKey() (uint32, []byte, error)
+	// Key returns the key with the given id
+	Key(id uint32) ([]byte, error)
+}
+
+// KeyRing is a KeyProvider backed by a fixed set of keys
+type KeyRing struct {
+	Current uint32
+	Keys    map[uint32][]byte
+}
+
+func (k KeyRing) CurrentKey() (uint32, []byte, error) {
+	key, err := k.Key(k.Current)
+	return k.Current, key, err
+}
+
+func (k KeyRing) Key(id uint32) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %d", id)
+	}
+	return key, nil
+}
+
+// encrypted data is stored as:
+//
+//	[4-byte key id][12-byte nonce][ciphertext][16-byte GCM tag]
+const (
+	encryptionNonceSize = 12
+	encryptionOverhead  = 4 + encryptionNonceSize + 16
+)
+
+// aead returns the (cached) AES-GCM cipher for the key with the given id
+func (d *diskQueue) aead(id uint32, key []byte) (cipher.AEAD, error) {
+	if aead, ok := d.ciphers[id]; ok {
+		return aead, nil
+	}
+
+	var err error
+	if key == nil {
+		key, err = d.keys.Key(id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.ciphers == nil {
+		d.ciphers = make(map[uint32]cipher.AEAD)
+	}
+	d.ciphers[id] = aead
+	return aead, nil
+}
+
+// encrypt seals data with the provider's current key
+func (d *diskQueue) encrypt(data []byte) ([]byte, error) {
+	id, key, err := d.keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := d.aead(id, key)
+	if err != nil {
+		return nil, err
+	}
+
+	out := d.encryptBuf[:0]
+	if cap(out) < len(data)+encryptionOverhead {
+		out = make([]byte, 0, len(data)+encryptionOverhead)
+	}
+	out = out[:4+encryptionNonceSize]
+	binary.BigEndian.PutUint32(out[:4], id)
+	_, err = io.ReadFull(rand.Reader, out[4:])
+	if err != nil {
+		return nil, err
+	}
+	out = aead.Seal(out, out[4:], data, nil)
+	d.encryptBuf = out
+	return out, nil
+}
+
+// decrypt opens data sealed by encrypt
+func (d *diskQueue) decrypt(data []byte) ([]byte, error) {
+	if d.keys == nil {
+		return nil, fmt.Errorf("encrypted message but no key provider configured")
+	}
+	if len(data) < encryptionOverhead {
+		return nil, fmt.Errorf("invalid encrypted message size (%d)", len(data))
+	}
+
+	id := binary.BigEndian.Uint32(data[:4])
+	aead, err := d.aead(id, nil)
+	if err != nil {
+		return nil, err
+	}
+	nonce := data[4 : 4+encryptionNonceSize]
+	out, err := aead.Open(nil, nonce, data[4+encryptionNonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt message - %s", err)
+	}
+	return out, nil
+}
@@ -0,0 +1,110 @@
+package diskqueue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// messages written with PutMessage (or any message, see WithTimestamps) are
+// stored in an envelope carrying their metadata ahead of the data:
+//
+//	[8-byte write time (unix nanoseconds)][2-byte size of headers][headers][data]
+//
+// with each header stored as:
+//
+//	[2-byte key size][key][2-byte value size][value]
+//
+// the envelope is what gets compressed and/or encrypted, frames holding one
+// are marked with frameFlagEnvelope
+const (
+	envelopeFixedSize = 8 + 2
+	// headers are limited to what fits in the 2-byte size
+	envelopeMaxOverhead = envelopeFixedSize + 0xffff
+)
+
+var errHeadersTooLarge = errors.New("message headers too large")
+
+// appendEnvelope appends the envelope of m to dst
+func appendEnvelope(dst []byte, m Message) ([]byte, error) {
+	var hdr [8]byte
+
+	headersSize := 0
+	keys := make([]string, 0, len(m.Headers))
+	for k, v := range m.Headers {
+		if len(k) > 0xffff || len(v) > 0xffff {
+			return nil, errHeadersTooLarge
+		}
+		headersSize += 4 + len(k) + len(v)
+		keys = append(keys, k)
+	}
+	if headersSize > 0xffff {
+		return nil, errHeadersTooLarge
+	}
+	// a stable order keeps identical messages identical on disk
+	sort.Strings(keys)
+
+	binary.BigEndian.PutUint64(hdr[:], uint64(m.Timestamp.UnixNano()))
+	dst = append(dst, hdr[:]...)
+	binary.BigEndian.PutUint16(hdr[:], uint16(headersSize))
+	dst = append(dst, hdr[:2]...)
+	for _, k := range keys {
+		binary.BigEndian.PutUint16(hdr[:], uint16(len(k)))
+		dst = append(dst, hdr[:2]...)
+		dst = append(dst, k...)
+		binary.BigEndian.PutUint16(hdr[:], uint16(len(m.Headers[k])))
+		dst = append(dst, hdr[:2]...)
+		dst = append(dst, m.Headers[k]...)
+	}
+	return append(dst, m.Data...), nil
+}
+
+// decodeEnvelope returns the message stored in an envelope, its Data refers
+// to the envelope's memory
+func decodeEnvelope(b []byte) (Message, error) {
+	var m Message
+
+	if len(b) < envelopeFixedSize {
+		return m, fmt.Errorf("invalid message envelope size (%d)", len(b))
+	}
+	m.Timestamp = time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+	headersSize := int(binary.BigEndian.Uint16(b[8:]))
+	b = b[envelopeFixedSize:]
+	if len(b) < headersSize {
+		return m, fmt.Errorf("invalid message headers size (%d)", headersSize)
+	}
+
+	headers := b[:headersSize]
+	for len(headers) > 0 {
+		var k, v []byte
+		var err error
+		k, headers, err = readEnvelopeField(headers)
+		if err == nil {
+			v, headers, err = readEnvelopeField(headers)
+		}
+		if err != nil {
+			return m, err
+		}
+		if m.Headers == nil {
+			m.Headers = make(map[string]string)
+		}
+		m.Headers[string(k)] = string(v)
+	}
+
+	m.Data = b[headersSize:]
+	return m, nil
+}
+
+// readEnvelopeField splits a size prefixed header key or value off b
+func readEnvelopeField(b []byte) ([]byte, []byte, error) {
+	if len(b) < 2 {
+		return nil, nil, errors.New("truncated message header")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return nil, nil, errors.New("truncated message header")
+	}
+	return b[2 : 2+n], b[2+n:], nil
+}
@@ -0,0 +1,41 @@
+package diskqueue
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errors returned by the queue's methods, to be matched with errors.Is,
+// along with ErrQueueFull (see WithMaxBytes), ErrWouldBlock (see TryPut),
+// ErrDuplicate (see WithDedup) and ErrNotInFlight (see WithInFlight)
+var (
+	// the queue is closed or closing
+	ErrExiting = errors.New("exiting")
+	// the queue is being drained, see Drain
+	ErrDraining = errors.New("draining")
+	// a message is smaller than minMsgSize, see MsgSizeError
+	ErrMsgTooSmall = errors.New("message too small")
+	// a message is larger than maxMsgSize, see MsgSizeError
+	ErrMsgTooLarge = errors.New("message too large")
+	// a message failed to read, see CorruptionError
+	ErrCorruptRecord = errors.New("corrupt record")
+)
+
+// MsgSizeError is returned for a write of a message the queue doesn't
+// accept the size of, it matches ErrMsgTooSmall or ErrMsgTooLarge
+type MsgSizeError struct {
+	Size       int64
+	MinMsgSize int32
+	MaxMsgSize int32
+}
+
+func (e *MsgSizeError) Error() string {
+	return fmt.Sprintf("invalid message write size (%d) maxMsgSize=%d", e.Size, e.MaxMsgSize)
+}
+
+func (e *MsgSizeError) Is(target error) bool {
+	if e.Size < int64(e.MinMsgSize) {
+		return target == ErrMsgTooSmall
+	}
+	return target == ErrMsgTooLarge
+}
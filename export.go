@@ -0,0 +1,120 @@
+package diskqueue
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Export writes (and Import reads) a stream independent of the data file
+// layout and of the options the queue was written with:
+//
+//	[8-byte magic "DQEXPORT"][1-byte version]
+//	[4-byte size][message envelope]...
+//	[4-byte 0]
+//
+// each message is stored in an envelope (see envelope.go), messages without
+// metadata are stored with a zero (unix) timestamp and no headers
+const (
+	exportMagic   = "DQEXPORT"
+	exportVersion = 1
+)
+
+var errExportTruncated = errors.New("truncated export")
+
+// Export writes the messages not yet consumed (committed, with
+// WithManualCommit) to w, see Import, the queue itself is left untouched
+//
+// messages written while exporting are not included, data files are kept
+// until the export is done
+func (d *diskQueue) Export(w io.Writer) error {
+	var buf []byte
+	var size [4]byte
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(exportMagic)
+	bw.WriteByte(exportVersion)
+
+	req := &scanRequest{}
+	for !req.done {
+		err := d.nextScanBatch(req)
+		if err != nil {
+			return err
+		}
+		for _, m := range req.batch {
+			if m.Timestamp.IsZero() && m.Headers == nil {
+				m.Timestamp = time.Unix(0, 0)
+			}
+			buf, err = appendEnvelope(buf[:0], m)
+			if err == nil {
+				binary.BigEndian.PutUint32(size[:], uint32(len(buf)))
+				bw.Write(size[:])
+				_, err = bw.Write(buf)
+			}
+			if err != nil {
+				req.release = true
+				d.nextScanBatch(req)
+				return err
+			}
+		}
+	}
+
+	binary.BigEndian.PutUint32(size[:], 0)
+	bw.Write(size[:])
+	return bw.Flush()
+}
+
+// Import writes the messages of a stream written by Export to the queue,
+// on failure the messages imported so far stay in the queue
+func (d *diskQueue) Import(r io.Reader) error {
+	var header [len(exportMagic) + 1]byte
+	var size [4]byte
+
+	br := bufio.NewReader(r)
+	_, err := io.ReadFull(br, header[:])
+	if err != nil {
+		return err
+	}
+	if string(header[:len(exportMagic)]) != exportMagic {
+		return errors.New("not an export")
+	}
+	if header[len(exportMagic)] != exportVersion {
+		return fmt.Errorf("unsupported export version (%d)", header[len(exportMagic)])
+	}
+
+	maxSize := uint32(atomic.LoadInt32(&d.maxMsgSize)) + envelopeMaxOverhead
+	for {
+		_, err = io.ReadFull(br, size[:])
+		if err != nil {
+			return errExportTruncated
+		}
+		n := binary.BigEndian.Uint32(size[:])
+		if n == 0 {
+			return nil
+		}
+		if n > maxSize {
+			return fmt.Errorf("invalid export record size (%d)", n)
+		}
+		buf := make([]byte, n)
+		_, err = io.ReadFull(br, buf)
+		if err != nil {
+			return errExportTruncated
+		}
+		m, err := decodeEnvelope(buf)
+		if err != nil {
+			return err
+		}
+		if m.Timestamp.UnixNano() == 0 && m.Headers == nil {
+			err = d.Put(m.Data)
+		} else {
+			err = d.PutMessage(m)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package diskqueue
+
+import (
+	"context"
+	"sync"
+)
+
+// fifoGate is a mutex that is handed to waiters strictly in the order
+// they called enter, unlike sync.Mutex which lets a goroutine that has
+// just released it barge ahead of goroutines already waiting
+type fifoGate struct {
+	mu      sync.Mutex
+	busy    bool
+	waiters []chan struct{}
+}
+
+func (g *fifoGate) enter() {
+	g.mu.Lock()
+	if !g.busy {
+		g.busy = true
+		g.mu.Unlock()
+		return
+	}
+	ch := make(chan struct{})
+	g.waiters = append(g.waiters, ch)
+	g.mu.Unlock()
+
+	// ownership is handed over directly by leave
+	<-ch
+}
+
+// tryEnter is enter but returns false (without entering) rather than
+// wait if the gate is busy
+func (g *fifoGate) tryEnter() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.busy {
+		return false
+	}
+	g.busy = true
+	return true
+}
+
+// enterContext is enter but gives up (without entering) once ctx is done
+func (g *fifoGate) enterContext(ctx context.Context) error {
+	g.mu.Lock()
+	if !g.busy {
+		g.busy = true
+		g.mu.Unlock()
+		return nil
+	}
+	ch := make(chan struct{})
+	g.waiters = append(g.waiters, ch)
+	g.mu.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+	}
+
+	g.mu.Lock()
+	for i, w := range g.waiters {
+		if w == ch {
+			g.waiters = append(g.waiters[:i], g.waiters[i+1:]...)
+			g.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+	g.mu.Unlock()
+
+	// ownership was handed over just as ctx was done, pass it on
+	g.leave()
+	return ctx.Err()
+}
+
+func (g *fifoGate) leave() {
+	g.mu.Lock()
+	if len(g.waiters) == 0 {
+		g.busy = false
+		g.mu.Unlock()
+		return
+	}
+	ch := g.waiters[0]
+	g.waiters[0] = nil
+	g.waiters = g.waiters[1:]
+	g.mu.Unlock()
+
+	close(ch)
+}
+
+func (g *fifoGate) waiting() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.waiters)
+}
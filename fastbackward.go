@@ -0,0 +1,154 @@
+package diskqueue
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// fastBackward moves the read position back one message at a time for as
+// long as fn asks to, see FastBackward
+func (d *diskQueue) fastBackward(fn func([]byte) int) error {
+	// the message pending delivery (if any) is read again
+	d.rewindRead()
+
+	target := Position{d.readFileNum, d.readPos}
+	end := d.readPos
+	for fileNum := d.readFileNum; fileNum >= d.firstFileNum; fileNum-- {
+		starts, err := d.frameStarts(fileNum, end)
+		if err != nil {
+			return err
+		}
+		end = -1
+
+		f, err := os.Open(d.fileName(fileNum))
+		if err != nil {
+			return err
+		}
+		header, err := readFileHeader(f)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		for i := len(starts) - 1; i >= 0; i-- {
+			msgs, _, err := d.readFrameAt(f, starts[i], header)
+			if err != nil {
+				f.Close()
+				return fmt.Errorf("failed to read message at %d of %s - %s",
+					starts[i], d.fileName(fileNum), err)
+			}
+
+			// the messages of a transaction are replayed together
+			include, stop := true, false
+			for j := len(msgs) - 1; j >= 0 && !stop; j-- {
+				switch r := fn(msgs[j].Data); {
+				case r < 0:
+					include = j < len(msgs)-1
+					stop = true
+				case r == 0:
+					stop = true
+				}
+			}
+			if include {
+				target = Position{fileNum, starts[i]}
+			}
+			if stop {
+				f.Close()
+				return d.seekTo(target.FileNum, target.Pos)
+			}
+		}
+		f.Close()
+	}
+	return d.seekTo(target.FileNum, target.Pos)
+}
+
+// frameStarts returns the positions of the frames in fileNum preceding
+// end, or all of them if end is -1
+func (d *diskQueue) frameStarts(fileNum int64, end int64) ([]int64, error) {
+	f, err := os.Open(d.fileName(fileNum))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header, err := readFileHeader(f)
+	if err == nil {
+		_, err = f.Seek(0, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(f)
+
+	var starts []int64
+	var pos int64
+	for end < 0 || pos < end {
+		if fileNum == d.writeFileNum && pos >= d.writePos {
+			break
+		}
+		padding, msgSize, _, err := d.readFrameStart(reader, pos, header)
+		if fileEnded(err, fileNum, d.writeFileNum) {
+			break
+		}
+		if err == nil {
+			_, err = reader.Discard(int(d.frameOverhead(header.version, msgSize) - frameHeaderLen(header.version, msgSize) + int64(msgSize)))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read message at %d of %s - %s",
+				pos, d.fileName(fileNum), err)
+		}
+		starts = append(starts, pos)
+		pos += padding + int64(msgSize) + d.frameOverhead(header.version, msgSize)
+		if pos > d.maxBytesOf(header) {
+			break
+		}
+	}
+	return starts, nil
+}
+
+// readFrameAt returns the messages in the frame at pos in f, a data file
+// written with header, along with the size of the frame
+func (d *diskQueue) readFrameAt(f *os.File, pos int64, header fileHeader) ([]Message, int64, error) {
+	// only a few bytes are read ahead, see recoverFile
+	reader := bufio.NewReaderSize(io.NewSectionReader(f, pos, 1<<62), 16)
+	padding, msgSize, flags, err := d.readFrameStart(reader, pos, header)
+	if err != nil {
+		return nil, 0, err
+	}
+	data := make([]byte, msgSize)
+	_, err = io.ReadFull(reader, data)
+	if err == nil && d.frameTrailer {
+		var trailer [frameTrailerSize]byte
+		_, err = io.ReadFull(reader, trailer[:])
+		if err == nil {
+			err = checkFrameTrailer(trailer[:], data)
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	msgs, err := d.decodeFrameMessages(data, flags)
+	return msgs, padding + int64(msgSize) + d.frameOverhead(header.version, msgSize), err
+}
+
+// FastBackward moves the read position back through the messages already
+// read, newest first, for as long as fn asks to, so that they are
+// delivered again
+//
+// fn returns 1 to move back past the message and carry on, 0 to move back
+// past it and stop or -1 to stop without doing so, it stops by itself at
+// the oldest message still on disk, see WithReplayRetention, the messages
+// of a transaction (see PutTransaction) are only replayed together
+//
+// fn is called from ioLoop and must not call into the queue
+func (d *diskQueue) FastBackward(fn func([]byte) int) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+
+	d.fastBackwardChan <- fn
+	return <-d.seekResponseChan
+}
@@ -0,0 +1,120 @@
+package diskqueue
+
+import (
+	"context"
+)
+
+// fastForwardCheckEvery is the number of messages FastForward skips
+// between checks of its context
+const fastForwardCheckEvery = 1024
+
+// FastForwardResult reports what a call to FastForward did
+type FastForwardResult struct {
+	// messages dropped
+	Skipped int64
+	// data files removed as a result
+	FilesRemoved int64
+	// the read position it stopped at
+	Position Position
+}
+
+type fastForwardRequest struct {
+	ctx context.Context
+	fn  func([]byte) int
+}
+
+type fastForwardResult struct {
+	res FastForwardResult
+	err error
+}
+
+// fastForward moves the read position forward one message at a time for
+// as long as fn asks to, see FastForward
+func (d *diskQueue) fastForward(ctx context.Context, fn func([]byte) int) (FastForwardResult, error) {
+	span := d.startSpan(ctx, "diskqueue.fast_forward")
+	if d.writeFile != nil {
+		d.flushPending()
+	}
+
+	// the message pending delivery (if any) is passed to fn as well
+	d.rewindRead()
+
+	var res FastForwardResult
+	var err error
+	firstFileNum := d.firstFileNum
+	fileNum, pos := d.readFileNum, d.readPos
+	var sinceCheck int64
+	stop := false
+	end := Position{d.writeFileNum, d.writePos}
+	_, err = d.walkFrames(Position{fileNum, pos}, end, func(_ Position, next Position, msgs []Message) bool {
+		// the messages of a transaction are skipped together
+		include := true
+		for j := 0; j < len(msgs) && !stop; j++ {
+			switch r := fn(msgs[j].Data); {
+			case r < 0:
+				include = j > 0
+				stop = true
+			case r == 0:
+				stop = true
+			}
+		}
+		if include {
+			if next.FileNum != fileNum && next.FileNum < end.FileNum {
+				d.log(INFO, "fast forwarding", "skipped", res.Skipped+int64(len(msgs)))
+			}
+			fileNum, pos = next.FileNum, next.Pos
+			res.Skipped += int64(len(msgs))
+			sinceCheck += int64(len(msgs))
+		}
+		if sinceCheck >= fastForwardCheckEvery {
+			sinceCheck = 0
+			stop = stop || ctx.Err() != nil
+		}
+		return !stop
+	})
+	if !stop && err == nil {
+		// dropped everything, including past the end of any file that was
+		// abandoned early
+		fileNum, pos = end.FileNum, end.Pos
+	}
+
+	if res.Skipped > 0 {
+		d.skipReadTo(fileNum, pos, res.Skipped)
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	res.FilesRemoved = d.firstFileNum - firstFileNum
+	res.Position = Position{d.readFileNum, d.readPos}
+	span.SetAttribute("diskqueue.skipped", res.Skipped)
+	span.SetAttribute("diskqueue.files_removed", res.FilesRemoved)
+	endSpan(span, err)
+	return res, err
+}
+
+// FastForward drops messages from the read side of the queue, oldest
+// first, for as long as fn asks to, without delivering them
+//
+// fn returns 1 to drop the message and carry on, 0 to drop it and stop or
+// -1 to stop without doing so, it stops by itself once the queue is empty,
+// a transaction (see PutTransaction) is only dropped as a whole
+//
+// fn is called from ioLoop and must not call into the queue, ctx is checked
+// every so often, once it is done the messages dropped so far stay dropped
+// and its error is returned along with the result
+func (d *diskQueue) FastForward(ctx context.Context, fn func([]byte) int) (FastForwardResult, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return FastForwardResult{}, ErrExiting
+	}
+
+	select {
+	case d.fastForwardChan <- fastForwardRequest{ctx, fn}:
+	case <-ctx.Done():
+		return FastForwardResult{}, ctx.Err()
+	}
+	r := <-d.fastForwardResponseChan
+	return r.res, r.err
+}
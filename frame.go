@@ -0,0 +1,292 @@
+package diskqueue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// each message is stored as a frame:
+//
+//	[4-byte size][size bytes of data]
+//
+// the top 4 bits of the size are flags describing how the data is stored
+// (compressed, see WithCompression, encrypted, see WithEncryption, and/or
+// wrapped in an envelope, see PutMessage, or holding the messages of a
+// transaction, see txn.go), which limits messages to frameMaxSize bytes
+//
+// with the optional trailer (see WithFrameTrailer) followed by:
+//
+//	[4-byte CRC32-C of data][4-byte size]
+//
+// repeating the size at the end of the frame makes it possible to walk
+// a data file backwards from any frame boundary
+//
+// files in format version 2 (see format.go) replace the 4-byte size with
+// the varint of size<<4 | flags>>28, i.e. with the flags in the low bits
+//
+// a file rolled before it reaches maxBytesPerFile (see WithRotateCount,
+// WithRotateInterval and SpliceFrom) ends with an end marker, the header
+// of a transaction frame without data, which is never written otherwise
+// (a transaction holds at least one message), so that readers can tell
+// the end of the file apart from a file cut short, see fileEnded
+
+const (
+	frameHeaderSize  = 4
+	frameTrailerSize = 8
+
+	frameMaxHeaderSize = binary.MaxVarintLen32
+
+	frameFlagMask       = 0xf0000000
+	frameFlagCompressed = 0x80000000
+	frameFlagEncrypted  = 0x40000000
+	frameFlagEnvelope   = 0x20000000
+	frameFlagTxn        = 0x10000000
+	frameFlagsKnown     = frameFlagCompressed | frameFlagEncrypted | frameFlagEnvelope | frameFlagTxn
+	frameMaxSize        = 1<<28 - 1
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errChecksumMismatch is returned for a frame whose data doesn't match the
+// CRC in its trailer, unlike other read errors the frame's bounds are intact
+var errChecksumMismatch = errors.New("invalid message checksum")
+
+// frameOverhead returns the number of bytes a frame of size bytes of data
+// adds to it in a file of the given format version
+func (d *diskQueue) frameOverhead(version byte, size int32) int64 {
+	if d.frameTrailer {
+		return frameHeaderLen(version, size) + frameTrailerSize
+	}
+	return frameHeaderLen(version, size)
+}
+
+// frameHeaderLen returns the size of the header of a frame of size bytes
+// of data, which doesn't depend on its flags
+func frameHeaderLen(version byte, size int32) int64 {
+	if version == fileFormatV1 {
+		return frameHeaderSize
+	}
+	n := int64(1)
+	for v := uint64(size) << 4; v >= 0x80; v >>= 7 {
+		n++
+	}
+	return n
+}
+
+// putFrameHeader encodes the header of a frame into b, which must hold
+// frameMaxHeaderSize bytes, returning its length
+func putFrameHeader(b []byte, version byte, size int32, flags uint32) int {
+	if version == fileFormatV1 {
+		binary.BigEndian.PutUint32(b, uint32(size)|flags)
+		return frameHeaderSize
+	}
+	return binary.PutUvarint(b, uint64(size)<<4|uint64(flags>>28))
+}
+
+// endMarker returns the end marker of a data file written with h, preceded
+// by the block padding it needs to be read at pos
+func (d *diskQueue) endMarker(pos int64, h fileHeader) []byte {
+	var b []byte
+	if d.blockSize > 0 {
+		// readers skip what's left of a block too small for a frame header
+		if room := d.blockSize - pos%d.blockSize; room < frameHeaderSize {
+			b = bytes.Repeat([]byte{blockPaddingByte}, int(room))
+		}
+	}
+	var header [frameMaxHeaderSize]byte
+	n := putFrameHeader(header[:], h.version, 0, frameFlagTxn)
+	return append(b, header[:n]...)
+}
+
+// decodeFrameHeader returns the size and flags of the encoded header at
+// the start of b along with its length, which is 0 if b is incomplete
+func decodeFrameHeader(b []byte, version byte) (int32, uint32, int) {
+	if version == fileFormatV1 {
+		if len(b) < frameHeaderSize {
+			return 0, 0, 0
+		}
+		raw := binary.BigEndian.Uint32(b)
+		return int32(raw &^ frameFlagMask), raw & frameFlagMask, frameHeaderSize
+	}
+	v, n := binary.Uvarint(b)
+	if n <= 0 || n > frameMaxHeaderSize || v>>4 > frameMaxSize {
+		return -1, 0, n
+	}
+	return int32(v >> 4), uint32(v&0xf) << 28, n
+}
+
+// readFrameHeader reads and validates a frame's size prefix, returning the
+// size of the stored data and its flags, flagged data is only bound by
+// maxMsgSize (plus the envelope and encryption overhead) since e.g.
+// compressed data can be smaller than minMsgSize
+func (d *diskQueue) readFrameHeader(r io.Reader, version byte) (int32, uint32, error) {
+	var header [frameMaxHeaderSize]byte
+	var size int32
+	var flags uint32
+
+	if version == fileFormatV1 {
+		_, err := io.ReadFull(r, header[:frameHeaderSize])
+		if err != nil {
+			return 0, 0, err
+		}
+		size, flags, _ = decodeFrameHeader(header[:], version)
+	} else {
+		br, ok := r.(io.ByteReader)
+		if !ok {
+			return 0, 0, errors.New("varint frame header needs an io.ByteReader")
+		}
+		var n int
+		for n = 0; ; n++ {
+			b, err := br.ReadByte()
+			if err == io.EOF && n > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				return 0, 0, err
+			}
+			header[n] = b
+			if b < 0x80 || n == len(header)-1 {
+				break
+			}
+		}
+		// frame sizes are worked out from the data size, so only the
+		// shortest encoding is valid
+		size, flags, _ = decodeFrameHeader(header[:n+1], version)
+		if size < 0 || int64(n+1) != frameHeaderLen(version, size) {
+			return 0, 0, errors.New("invalid message size varint")
+		}
+	}
+
+	raw := uint32(size) | flags
+	if flags&^frameFlagsKnown != 0 {
+		return 0, 0, fmt.Errorf("unsupported message flags (%#x)", flags)
+	}
+	minSize := d.minMsgSize
+	maxSize := d.maxMsgSize
+	if flags != 0 {
+		minSize = 0
+	}
+	if flags&frameFlagEnvelope != 0 {
+		maxSize += envelopeMaxOverhead
+	}
+	if flags&frameFlagEncrypted != 0 {
+		maxSize += encryptionOverhead
+	}
+	if flags&frameFlagTxn != 0 {
+		maxSize = d.maxMsgSize
+	}
+	if size < minSize || size > maxSize {
+		return 0, 0, fmt.Errorf("invalid message read size (%d)", int32(raw))
+	}
+	return size, flags, nil
+}
+
+// decodeFrame returns the message stored as data in a frame with flags
+func (d *diskQueue) decodeFrame(data []byte, flags uint32) (Message, error) {
+	var err error
+
+	if flags&frameFlagTxn != 0 {
+		return Message{}, errors.New("unexpected transaction frame")
+	}
+
+	if flags&frameFlagEncrypted != 0 {
+		var plain []byte
+		plain, err = d.decrypt(data)
+		if err == nil {
+			d.spareReadBuf = data
+			data = plain
+		}
+	}
+	if err == nil && flags&frameFlagCompressed != 0 {
+		data, err = d.decompress(data)
+	}
+	if err != nil {
+		return Message{}, err
+	}
+
+	m := Message{Data: data}
+	if flags&frameFlagEnvelope != 0 {
+		m, err = decodeEnvelope(data)
+		if err != nil {
+			return Message{}, err
+		}
+	}
+	if flags != 0 && (int32(len(m.Data)) < d.minMsgSize || int32(len(m.Data)) > d.maxMsgSize) {
+		return Message{}, fmt.Errorf("invalid message size (%d) after decoding", len(m.Data))
+	}
+	return m, nil
+}
+
+func putFrameTrailer(b []byte, checksum uint32, size int32) {
+	binary.BigEndian.PutUint32(b[:4], checksum)
+	binary.BigEndian.PutUint32(b[4:], uint32(size))
+}
+
+// checkFrameTrailer validates a trailer read after data
+func checkFrameTrailer(b []byte, data []byte) error {
+	size := int32(binary.BigEndian.Uint32(b[4:]))
+	if size != int32(len(data)) {
+		return fmt.Errorf("invalid message trailer size (%d != %d)", size, len(data))
+	}
+	if binary.BigEndian.Uint32(b[:4]) != crc32.Checksum(data, crc32cTable) {
+		return errChecksumMismatch
+	}
+	return nil
+}
+
+// readFrameBefore reads the frame ending at end in r, which must have been
+// written with trailers, returning the data as stored (i.e. still compressed),
+// its flags and the position the frame starts at
+func readFrameBefore(r io.ReaderAt, end int64, version byte, minMsgSize int32, maxMsgSize int32) ([]byte, uint32, int64, error) {
+	var trailer [frameTrailerSize]byte
+	var header [frameMaxHeaderSize]byte
+
+	if end < frameHeaderLen(version, 0)+frameTrailerSize {
+		return nil, 0, 0, fmt.Errorf("no frame before position %d", end)
+	}
+
+	_, err := r.ReadAt(trailer[:], end-frameTrailerSize)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	msgSize := int32(binary.BigEndian.Uint32(trailer[4:]))
+	if msgSize < 0 || msgSize > maxMsgSize {
+		return nil, 0, 0, fmt.Errorf("invalid message trailer size (%d)", msgSize)
+	}
+
+	headerLen := frameHeaderLen(version, msgSize)
+	start := end - frameTrailerSize - int64(msgSize) - headerLen
+	if start < 0 {
+		return nil, 0, 0, fmt.Errorf("invalid message trailer size (%d) at %d", msgSize, end)
+	}
+
+	_, err = r.ReadAt(header[:headerLen], start)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	size, flags, n := decodeFrameHeader(header[:headerLen], version)
+	if size != msgSize || int64(n) != headerLen {
+		return nil, 0, 0, fmt.Errorf("message header does not match trailer at %d", start)
+	}
+	if flags == 0 && msgSize < minMsgSize {
+		return nil, 0, 0, fmt.Errorf("invalid message trailer size (%d)", msgSize)
+	}
+
+	data := make([]byte, msgSize)
+	_, err = r.ReadAt(data, start+headerLen)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	err = checkFrameTrailer(trailer[:], data)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	return data, flags, start, nil
+}
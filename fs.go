@@ -0,0 +1,57 @@
+package diskqueue
+
+import (
+	"os"
+	"time"
+)
+
+// data and metadata files are renamed and removed while other handles to
+// them can be open (e.g. held by a virus scanner or a backup tool), which
+// Windows refuses with a sharing violation until they're closed, so these
+// operations are retried a few times before giving up
+
+const (
+	sharingRetries    = 5
+	sharingRetryDelay = 10 * time.Millisecond
+)
+
+// sharingViolationHook tells sharing violations apart, tests replace it
+// since they only happen on Windows
+var sharingViolationHook = isSharingViolation
+
+// retrySharing runs fn until it succeeds, fails for some other reason
+// than a sharing violation or sharingRetries is reached
+func retrySharing(fn func() error) error {
+	err := fn()
+	for i := 1; i <= sharingRetries && sharingViolationHook(err); i++ {
+		time.Sleep(time.Duration(i) * sharingRetryDelay)
+		err = fn()
+	}
+	return err
+}
+
+// renameFile atomically replaces newpath (if it exists) with oldpath
+func renameFile(oldpath string, newpath string) error {
+	return retrySharing(func() error {
+		return replaceFile(oldpath, newpath)
+	})
+}
+
+func removeFile(name string) error {
+	return retrySharing(func() error {
+		return os.Remove(name)
+	})
+}
+
+// openReadFile opens fileName for reading without keeping it from being
+// renamed or removed, handles to the read file (see readOne), the next one
+// (see WithReadPreopen) and those of cursors are held for a long time
+func openReadFile(fileName string) (*os.File, error) {
+	var f *os.File
+	err := retrySharing(func() error {
+		var err error
+		f, err = openShared(fileName)
+		return err
+	})
+	return f, err
+}
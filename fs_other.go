@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package diskqueue
+
+import (
+	"os"
+)
+
+func isSharingViolation(err error) bool {
+	return false
+}
+
+func replaceFile(oldpath string, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func openShared(fileName string) (*os.File, error) {
+	return os.OpenFile(fileName, os.O_RDONLY, 0600)
+}
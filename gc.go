@@ -0,0 +1,116 @@
+package diskqueue
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// files left behind by earlier runs are cleaned up on startup:
+//
+//	<name>.diskqueue.*.tmp
+//
+// being the temporary files metadata and delayed messages are written to
+// before they're renamed into place, which only outlive a write that
+// crashed, and with WithBadFileRetention:
+//
+//	<name>.diskqueue.<n>.dat.bad
+//
+// being data files that failed to read, removed once last modified more
+// than maxAge ago or, oldest first, while those kept exceed maxBytes, this
+// is repeated every badFileCheckInterval (or maxAge, if shorter)
+
+const badFileCheckInterval = time.Minute
+
+// collectGarbage removes the temporary files left behind by a crash and
+// the bad files past the retention (if any), only called from ioLoop or
+// before it starts, so that no temporary file is being written to
+func (d *diskQueue) collectGarbage() {
+	dirs := []string{d.dataPath}
+	if d.mirrorPath != "" {
+		dirs = append(dirs, d.mirrorPath)
+	}
+	for _, dir := range dirs {
+		err := d.removeTmpFiles(dir)
+		if err != nil && !os.IsNotExist(err) {
+			d.log(ERROR, "failed to remove temporary files", "dir", dir, "err", err)
+		}
+	}
+
+	if d.badRetain {
+		err := d.removeBadFiles(time.Now())
+		if err != nil && !os.IsNotExist(err) {
+			d.log(ERROR, "failed to remove bad files", "err", err)
+		}
+	}
+}
+
+// removeTmpFiles removes the temporary files of the queue in dir
+func (d *diskQueue) removeTmpFiles(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	prefix := d.name + ".diskqueue."
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		d.log(WARN, "removing stale temporary file", "file", path.Join(dir, name))
+		err = removeFile(path.Join(dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeBadFiles applies the retention of WithBadFileRetention as of now
+func (d *diskQueue) removeBadFiles(now time.Time) error {
+	files, err := ioutil.ReadDir(d.dataPath)
+	if err != nil {
+		return err
+	}
+	prefix := d.name + ".diskqueue."
+	var bad []os.FileInfo
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".dat.bad") {
+			continue
+		}
+		bad = append(bad, fi)
+	}
+
+	// newest first, those beyond maxBytes are the oldest
+	sort.Slice(bad, func(i, j int) bool {
+		return bad[i].ModTime().After(bad[j].ModTime())
+	})
+	var kept int64
+	full := false
+	for _, fi := range bad {
+		expired := d.badRetainAge > 0 && now.Sub(fi.ModTime()) > d.badRetainAge
+		full = full || (d.badRetainBytes > 0 && kept+fi.Size() > d.badRetainBytes)
+		if !expired && !full {
+			kept += fi.Size()
+			continue
+		}
+		d.log(INFO, "removing bad file", "file", path.Join(d.dataPath, fi.Name()))
+		err = removeFile(path.Join(d.dataPath, fi.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// badFileCheckEvery returns how often the bad file retention is applied
+func (d *diskQueue) badFileCheckEvery() time.Duration {
+	if d.badRetainAge > 0 && d.badRetainAge < badFileCheckInterval {
+		return d.badRetainAge
+	}
+	return badFileCheckInterval
+}
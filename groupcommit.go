@@ -0,0 +1,57 @@
+package diskqueue
+
+import (
+	"sync/atomic"
+)
+
+// maxWriteGroup is the most Puts ioLoop coalesces into a single write
+const maxWriteGroup = 128
+
+// checkMsgSize returns the error ioLoop would reject a message of size n
+// with, Put checks it upfront so that a group write never has a member
+// that fails on its own
+func (d *diskQueue) checkMsgSize(n int) error {
+	// may change under us, see Reconfigure
+	minMsgSize, maxMsgSize := atomic.LoadInt32(&d.minMsgSize), atomic.LoadInt32(&d.maxMsgSize)
+	if int32(n) < minMsgSize || int32(n) > maxMsgSize {
+		return &MsgSizeError{int64(n), minMsgSize, maxMsgSize}
+	}
+	return nil
+}
+
+// gatherWrites returns data along with the Puts already waiting on
+// writeChan, without waiting for more
+func (d *diskQueue) gatherWrites(data []byte) [][]byte {
+	group := append(d.writeGroup[:0], data)
+	for len(group) < maxWriteGroup {
+		select {
+		case data = <-d.writeChan:
+			group = append(group, data)
+		default:
+			return group
+		}
+	}
+	return group
+}
+
+// writeGrouped writes the Puts gathered by gatherWrites with a single write
+// (per data file) and, depending on the SyncMode, a single fsync, every Put
+// of the group is answered with the outcome of the group as a whole
+func (d *diskQueue) writeGrouped(group [][]byte) {
+	var err error
+	d.inFlightWrites = len(group)
+	if len(group) == 1 {
+		err = d.writeOne(group[0])
+	} else {
+		err = d.writeMany(group)
+	}
+	d.writesSinceSync += int64(len(group))
+	err = d.ackWrite(err)
+
+	for i := range group {
+		group[i] = nil
+		d.writeResponseChan <- err
+		d.inFlightWrites--
+	}
+	d.writeGroup = group[:0]
+}
@@ -0,0 +1,104 @@
+package diskqueue
+
+import (
+	"sync"
+	"time"
+)
+
+// hookQueue calls the funcs set with OnFileCreate and the like, in the
+// order the events happened, from a goroutine of its own so that a slow
+// one (e.g. archiving a rotated file) doesn't hold up ioLoop, the events
+// that happen in the meantime are queued
+type hookQueue struct {
+	sync.Mutex
+	cond    *sync.Cond
+	pending []func()
+	closed  bool
+}
+
+func newHookQueue() *hookQueue {
+	q := &hookQueue{}
+	q.cond = sync.NewCond(q)
+	go q.run()
+	return q
+}
+
+// push queues fn, returning false if q was closed, fn being dropped
+func (q *hookQueue) push(fn func()) bool {
+	q.Lock()
+	if q.closed {
+		q.Unlock()
+		return false
+	}
+	q.pending = append(q.pending, fn)
+	q.Unlock()
+	q.cond.Signal()
+	return true
+}
+
+// close has run return once the events already queued have been handled,
+// no more can be queued
+func (q *hookQueue) close() {
+	q.Lock()
+	q.closed = true
+	q.Unlock()
+	q.cond.Signal()
+}
+
+func (q *hookQueue) run() {
+	for {
+		q.Lock()
+		for len(q.pending) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if len(q.pending) == 0 {
+			q.Unlock()
+			return
+		}
+		fn := q.pending[0]
+		q.pending[0] = nil
+		q.pending = q.pending[1:]
+		q.Unlock()
+
+		fn()
+	}
+}
+
+func (d *diskQueue) hasHooks() bool {
+	return d.onFileCreate != nil || d.onFileRotate != nil || d.onFileDelete != nil ||
+		d.onBadFile != nil || d.onSync != nil
+}
+
+// closeHooks is called once the queue is done closing, the events that
+// happened up to then (its final sync included) are still handled
+func (d *diskQueue) closeHooks() {
+	if d.hooks != nil {
+		d.hooks.close()
+	}
+}
+
+// fileHook queues a call of fn (if set) with fileName
+func (d *diskQueue) fileHook(fn func(fileName string), fileName string) {
+	if fn == nil || d.hooks == nil {
+		return
+	}
+	ok := d.hooks.push(func() {
+		fn(fileName)
+	})
+	if !ok {
+		d.log(WARN, "dropped file event after close", "file", fileName)
+	}
+}
+
+// syncHook queues a call of the func set with OnSync
+func (d *diskQueue) syncHook(latency time.Duration) {
+	if d.onSync == nil || d.hooks == nil {
+		return
+	}
+	ok := d.hooks.push(func() {
+		d.onSync(latency)
+	})
+	if !ok {
+		d.log(WARN, "dropped sync event after close", "latency", latency)
+	}
+}
@@ -0,0 +1,225 @@
+package diskqueue
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Hybrid keeps messages in memory while its consumer keeps up, and only
+// writes them to a queue on disk once more than memSize are waiting, much
+// like an nsqd channel
+//
+// messages are read in the order they were written, once the memory
+// buffer overflows it is written to disk along with the message that
+// overflowed it, and messages keep going to disk until it has been read
+// in full, so that there is never anything in memory while there are
+// messages on disk
+//
+// the messages in memory are written to disk on Close, but are lost if
+// the process crashes, those on disk are delivered at least once as with
+// Partitioned
+type Hybrid struct {
+	d       *diskQueue
+	memSize int
+
+	// guards mem and held, so that a message moving from memory to
+	// readLoop is counted exactly once by Depth, one moving from disk may
+	// briefly be missed as it isn't received with the lock held
+	sync.Mutex
+	mem  [][]byte
+	held int64
+
+	readChan chan []byte
+	wakeChan chan int
+	exitChan chan int
+	exitWg   sync.WaitGroup
+	exited   bool
+}
+
+// NewHybrid creates (or reopens) a Hybrid holding up to memSize messages
+// in memory, opts apply to the queue on disk (see NewWithOptions)
+func NewHybrid(name string, dataPath string, memSize int, opts ...Option) (*Hybrid, error) {
+	if memSize < 1 {
+		return nil, fmt.Errorf("invalid memory size (%d)", memSize)
+	}
+
+	// only the message handed out on readChan is committed
+	opts = append(opts[:len(opts):len(opts)], WithManualCommit())
+	dq, err := NewWithOptions(name, dataPath, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Hybrid{
+		d:        dq.(*diskQueue),
+		memSize:  memSize,
+		readChan: make(chan []byte),
+		wakeChan: make(chan int, 1),
+		exitChan: make(chan int),
+	}
+	h.exitWg.Add(1)
+	go h.readLoop()
+	return h, nil
+}
+
+// Put writes data to memory if there's room and nothing is waiting on
+// disk, or else to disk
+func (h *Hybrid) Put(data []byte) error {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.exited {
+		return ErrExiting
+	}
+
+	dataLen := int32(len(data))
+	if dataLen < h.d.minMsgSize || dataLen > h.d.maxMsgSize {
+		return &MsgSizeError{int64(dataLen), h.d.minMsgSize, h.d.maxMsgSize}
+	}
+
+	var err error
+	if len(h.mem) < h.memSize && h.d.Depth() == 0 {
+		h.mem = append(h.mem, append([]byte(nil), data...))
+	} else if len(h.mem) == 0 {
+		err = h.d.Put(data)
+	} else {
+		// the messages in memory are older
+		err = h.d.PutMany(append(h.mem[:len(h.mem):len(h.mem)], data))
+		if err == nil {
+			h.mem = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	select {
+	case h.wakeChan <- 1:
+	default:
+	}
+	return nil
+}
+
+// ReadChan returns the channel messages are read from
+func (h *Hybrid) ReadChan() chan []byte {
+	return h.readChan
+}
+
+// Depth returns the number of messages in memory and on disk
+func (h *Hybrid) Depth() int64 {
+	h.Lock()
+	defer h.Unlock()
+	return int64(len(h.mem)) + h.held + h.d.Depth()
+}
+
+// MemDepth returns the number of messages in memory
+func (h *Hybrid) MemDepth() int64 {
+	h.Lock()
+	defer h.Unlock()
+	return int64(len(h.mem))
+}
+
+// Close writes the messages in memory to disk and closes the queue
+func (h *Hybrid) Close() error {
+	err := h.exit()
+	if err != nil {
+		return err
+	}
+
+	var putErr error
+	if len(h.mem) > 0 {
+		putErr = h.d.PutMany(h.mem)
+		h.mem = nil
+	}
+	err = h.d.Close()
+	if putErr != nil {
+		return putErr
+	}
+	return err
+}
+
+// Delete drops the messages in memory and deletes the queue
+func (h *Hybrid) Delete() error {
+	err := h.exit()
+	if err != nil {
+		return err
+	}
+	h.mem = nil
+	return h.d.Delete()
+}
+
+func (h *Hybrid) exit() error {
+	h.Lock()
+	if h.exited {
+		h.Unlock()
+		return ErrExiting
+	}
+	h.exited = true
+	h.Unlock()
+
+	close(h.exitChan)
+	h.exitWg.Wait()
+	return nil
+}
+
+// readLoop hands out the messages in memory, or else those on disk,
+// committing each of the latter once it has been received
+func (h *Hybrid) readLoop() {
+	defer h.exitWg.Done()
+
+	for {
+		h.Lock()
+		if len(h.mem) == 0 && h.d.Depth() == 0 {
+			h.Unlock()
+			select {
+			case <-h.wakeChan:
+				continue
+			case <-h.exitChan:
+				return
+			}
+		}
+
+		var data, position []byte
+		fromMem := len(h.mem) > 0
+		if fromMem {
+			data = h.mem[0]
+			h.mem[0] = nil
+			h.mem = h.mem[1:]
+		} else {
+			// not held while waiting, or Put would wait along
+			h.Unlock()
+			select {
+			case data = <-h.d.ReadChan():
+			case <-h.exitChan:
+				return
+			}
+			// this also waits for the queue's depth to account for the read
+			position = h.d.Checkpoint()
+			h.Lock()
+		}
+		h.held = 1
+		h.Unlock()
+
+		select {
+		case h.readChan <- data:
+		case <-h.exitChan:
+			if fromMem {
+				// still the oldest, for Close to write to disk
+				h.Lock()
+				h.mem = append([][]byte{data}, h.mem...)
+				h.Unlock()
+			}
+			return
+		}
+		h.Lock()
+		h.held = 0
+		h.Unlock()
+
+		if !fromMem {
+			err := h.d.Commit(position)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package diskqueue
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+// with WithSparseIndex every data file gets a sidecar index, named after
+// it with an ".idx" suffix, once it rolls:
+//
+//	[8-byte position][8-byte count][8-byte timestamp]...[4-byte CRC32-C]
+//
+// with an entry for a frame every so many messages, count being the number
+// of messages preceding it in the file and timestamp the UnixNano of the
+// last message encoded along with it, which is no earlier than its own as
+// long as timestamps don't decrease, or 0 once a message without an
+// envelope (dated by the file's mtime, see SeekToTime) has been written
+// to the file
+//
+// the index of the write file is kept in memory (and rebuilt from the
+// file on startup), an index that is missing or fails its CRC is ignored
+
+const indexEntrySize = 24
+
+type indexEntry struct {
+	pos   int64
+	count int64
+	ts    int64
+}
+
+// indexFileName returns the name of the index of the data file fileName
+func indexFileName(fileName string) string {
+	return fileName + ".idx"
+}
+
+// indexFrame adds the frame about to be written at pos in the write file,
+// the last message of which has timestamp ts, to its index if it is due
+// an entry
+func (d *diskQueue) indexFrame(pos int64, ts time.Time) {
+	if d.writeIndexFileNum != d.writeFileNum {
+		// rolled (or skipped) without writeIndexFile
+		d.writeIndex = d.writeIndex[:0]
+		d.writeIndexFileNum = d.writeFileNum
+		d.writeIndexUndated = false
+	}
+	if ts.IsZero() {
+		d.writeIndexUndated = true
+	}
+	var last int64
+	if len(d.writeIndex) > 0 {
+		last = d.writeIndex[len(d.writeIndex)-1].count
+	}
+	if d.writeFileCount-last < d.indexEvery {
+		return
+	}
+	var unixNano int64
+	if !d.writeIndexUndated {
+		unixNano = ts.UnixNano()
+	}
+	d.writeIndex = append(d.writeIndex, indexEntry{pos, d.writeFileCount, unixNano})
+}
+
+// unindexFrom drops the entries of the write file's index at or past pos,
+// e.g. for pending frames that failed to be written
+func (d *diskQueue) unindexFrom(pos int64) {
+	for len(d.writeIndex) > 0 && d.writeIndex[len(d.writeIndex)-1].pos >= pos {
+		d.writeIndex = d.writeIndex[:len(d.writeIndex)-1]
+	}
+}
+
+// writeIndexFile writes out the index of the write file, it must be
+// called once writePos has passed maxBytesPerFile and before rolling
+func (d *diskQueue) writeIndexFile() error {
+	var entries []indexEntry
+	if d.writeIndexFileNum == d.writeFileNum {
+		entries = d.writeIndex
+	}
+	b := make([]byte, len(entries)*indexEntrySize+4)
+	for i, e := range entries {
+		binary.BigEndian.PutUint64(b[i*indexEntrySize:], uint64(e.pos))
+		binary.BigEndian.PutUint64(b[i*indexEntrySize+8:], uint64(e.count))
+		binary.BigEndian.PutUint64(b[i*indexEntrySize+16:], uint64(e.ts))
+	}
+	n := len(entries) * indexEntrySize
+	binary.BigEndian.PutUint32(b[n:], crc32.Checksum(b[:n], crc32cTable))
+
+	d.writeIndex = d.writeIndex[:0]
+	d.writeIndexUndated = false
+	return ioutil.WriteFile(indexFileName(d.fileName(d.writeFileNum)), b, 0600)
+}
+
+// readIndex returns the index of fileNum, nil if there is none
+func (d *diskQueue) readIndex(fileNum int64) []indexEntry {
+	if fileNum == d.writeFileNum {
+		if d.writeIndexFileNum != d.writeFileNum {
+			return nil
+		}
+		return d.writeIndex
+	}
+
+	b, err := ioutil.ReadFile(indexFileName(d.fileName(fileNum)))
+	if err != nil || len(b)%indexEntrySize != 4 {
+		return nil
+	}
+	n := len(b) - 4
+	if binary.BigEndian.Uint32(b[n:]) != crc32.Checksum(b[:n], crc32cTable) {
+		d.log(WARN, "ignoring corrupt index", "file", d.fileName(fileNum))
+		return nil
+	}
+	entries := make([]indexEntry, n/indexEntrySize)
+	for i := range entries {
+		entries[i] = indexEntry{
+			pos:   int64(binary.BigEndian.Uint64(b[i*indexEntrySize:])),
+			count: int64(binary.BigEndian.Uint64(b[i*indexEntrySize+8:])),
+			ts:    int64(binary.BigEndian.Uint64(b[i*indexEntrySize+16:])),
+		}
+	}
+	return entries
+}
+
+// loadWriteIndex rebuilds the index of the write file, along with its
+// message count, from its frames
+func (d *diskQueue) loadWriteIndex() error {
+	d.writeIndex = d.writeIndex[:0]
+	d.writeIndexFileNum = d.writeFileNum
+	d.writeIndexUndated = false
+	d.writeFileCount = 0
+	if d.writePos == 0 {
+		return nil
+	}
+
+	return d.walkMessages(d.writeFileNum, 0, func(pos int64, _ Position, msgs []Message) bool {
+		d.indexFrame(pos, msgs[len(msgs)-1].Timestamp)
+		d.writeFileCount += int64(len(msgs))
+		return true
+	})
+}
+
+// indexedSkip returns how far the messages between pos in fileNum and
+// up to max more can be skipped by way of its index
+func (d *diskQueue) indexedSkip(fileNum int64, pos int64, max int64) (int64, int64, error) {
+	entries := d.readIndex(fileNum)
+	if len(entries) == 0 {
+		return pos, 0, nil
+	}
+
+	// the number of messages preceding pos is counted from the entry
+	// at or before it
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].pos > pos })
+	var base indexEntry
+	if i > 0 {
+		base = entries[i-1]
+	}
+	n, err := d.framesBetween(fileNum, base.pos, fileNum, pos)
+	if err != nil {
+		return pos, 0, err
+	}
+	count := base.count + n
+
+	j := sort.Search(len(entries), func(j int) bool { return entries[j].count > count+max })
+	if j == 0 || entries[j-1].pos <= pos {
+		return pos, 0, nil
+	}
+	return entries[j-1].pos, entries[j-1].count - count, nil
+}
+
+// indexedBefore returns the position of the last indexed frame in fileNum
+// known to hold messages written before t, 0 if there is none
+func (d *diskQueue) indexedBefore(fileNum int64, t time.Time) int64 {
+	entries := d.readIndex(fileNum)
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].ts == 0 || !time.Unix(0, entries[i].ts).Before(t)
+	})
+	if i == 0 {
+		return 0
+	}
+	return entries[i-1].pos
+}
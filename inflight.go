@@ -0,0 +1,367 @@
+package diskqueue
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// messages read from ReadInFlightChan are kept aside in a journal of:
+//
+//	'D' [8-byte id][frame]
+//	'F' [8-byte id]
+//
+// recording their delivery and when they were finished (or put back on the
+// queue after their timeout), the journal is rewritten with only the
+// messages still in flight once it holds inFlightCompactMin finished ones
+// and removed once there are none left, on startup the messages it holds
+// are put back on the queue
+//
+// the number of times a message was delivered is kept in its envelope as
+// the header attemptsHeader, so that it's put back on the queue with it,
+// the header is left out of the headers of the message when it's read
+
+// ErrNotInFlight is returned by InFlight.Finish for a message that was
+// already finished or put back on the queue after its timeout
+var ErrNotInFlight = errors.New("message not in flight")
+
+const (
+	inFlightDelivered  = 'D'
+	inFlightFinished   = 'F'
+	inFlightCompactMin = 1024
+
+	attemptsHeader = "diskqueue-attempts"
+)
+
+// InFlight is a message read from ReadInFlightChan (see WithInFlight), it
+// must be finished within the timeout or it's put back on the queue
+type InFlight struct {
+	Message
+	// identifies the message among those in flight
+	ID uint64
+	// how many times the message was delivered, this one included
+	Attempts int
+
+	d *diskQueue
+}
+
+// Finish marks m as processed, ErrNotInFlight means it was too late and m
+// is (or was) delivered again
+func (m *InFlight) Finish() error {
+	return m.d.finish(m.ID)
+}
+
+type inFlightEntry struct {
+	id    uint64
+	due   time.Time
+	frame []byte
+}
+
+func (d *diskQueue) inFlightFileName() string {
+	return fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.inflight.dat"), d.name)
+}
+
+// ReadInFlightChan returns the channel for reading messages that must be
+// finished, nothing is delivered on it unless the queue was created with
+// WithInFlight, it can be used alongside ReadChan
+func (d *diskQueue) ReadInFlightChan() chan *InFlight {
+	return d.readInFlightChan
+}
+
+// newInFlight returns the InFlight of the message pending delivery, data
+func (d *diskQueue) newInFlight(data []byte) *InFlight {
+	d.inFlightSeq++
+	return &InFlight{
+		Message:  Message{Data: data, Timestamp: d.readTimestamp, Headers: d.readHeaders},
+		ID:       d.inFlightSeq,
+		Attempts: d.readAttempts + 1,
+		d:        d,
+	}
+}
+
+// setReadEnvelope keeps the envelope metadata of m, the message pending
+// delivery, apart from the number of attempts recorded by trackInFlight
+func (d *diskQueue) setReadEnvelope(m Message) {
+	d.readTimestamp, d.readHeaders, d.readAttempts = m.Timestamp, m.Headers, 0
+	v, ok := m.Headers[attemptsHeader]
+	if !ok {
+		return
+	}
+	n, err := strconv.Atoi(v)
+	if err == nil && n > 0 {
+		d.readAttempts = n
+	}
+	d.readHeaders = nil
+	for k, v := range m.Headers {
+		if k == attemptsHeader {
+			continue
+		}
+		if d.readHeaders == nil {
+			d.readHeaders = make(map[string]string)
+		}
+		d.readHeaders[k] = v
+	}
+}
+
+// attempts returns how many times m was delivered, as recorded in its
+// headers by trackInFlight
+func attempts(m Message) int {
+	n, _ := strconv.Atoi(m.Headers[attemptsHeader])
+	return n
+}
+
+// trackInFlight journals the delivery of m, which is put back on the queue
+// if it isn't finished by the timeout
+func (d *diskQueue) trackInFlight(m *InFlight) {
+	d.writeBuf.Reset()
+	d.writeBuf.WriteByte(inFlightDelivered)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], m.ID)
+	d.writeBuf.Write(b[:])
+	journaled := Message{Data: m.Data, Timestamp: m.Timestamp, Headers: map[string]string{
+		attemptsHeader: strconv.Itoa(m.Attempts),
+	}}
+	for k, v := range m.Headers {
+		journaled.Headers[k] = v
+	}
+	// the journal is always written in format version 1
+	_, err := d.appendFrame(journaled, 0, fileHeader{version: fileFormatV1})
+	if err != nil {
+		d.log(ERROR, "failed to track message in flight", "err", err)
+		return
+	}
+	e := &inFlightEntry{
+		id:    m.ID,
+		due:   time.Now().Add(d.inFlightTimeout),
+		frame: append([]byte(nil), d.writeBuf.Bytes()[9:]...),
+	}
+	d.inFlight[e.id] = e
+	d.inFlightOrder = append(d.inFlightOrder, e)
+
+	err = d.appendInFlight(d.writeBuf.Bytes())
+	if err != nil {
+		d.log(ERROR, "failed to journal message in flight", "err", err)
+	}
+}
+
+// finishInFlight forgets the message in flight id, see Finish
+func (d *diskQueue) finishInFlight(id uint64) error {
+	_, ok := d.inFlight[id]
+	if !ok {
+		return ErrNotInFlight
+	}
+	d.forgetInFlight(id)
+	return nil
+}
+
+// forgetInFlight drops the message in flight id, from the journal too
+func (d *diskQueue) forgetInFlight(id uint64) {
+	delete(d.inFlight, id)
+	for len(d.inFlightOrder) > 0 && d.inFlight[d.inFlightOrder[0].id] == nil {
+		d.inFlightOrder[0] = nil
+		d.inFlightOrder = d.inFlightOrder[1:]
+	}
+	d.inFlightDone++
+
+	var err error
+	if len(d.inFlight) == 0 || d.inFlightDone >= inFlightCompactMin {
+		err = d.rewriteInFlight()
+	} else {
+		var b [9]byte
+		b[0] = inFlightFinished
+		binary.BigEndian.PutUint64(b[1:], id)
+		err = d.appendInFlight(b[:])
+	}
+	if err != nil {
+		d.log(ERROR, "failed to journal finished message", "err", err)
+	}
+}
+
+// requeueInFlight puts the messages in flight whose timeout has passed back
+// on the queue, or moves them to the dead letter queue once they've been
+// delivered maxAttempts times
+func (d *diskQueue) requeueInFlight() {
+	now := time.Now()
+	for len(d.inFlightOrder) > 0 && !d.inFlightOrder[0].due.After(now) {
+		e := d.inFlightOrder[0]
+		m, err := d.decodeDelayed(e.frame)
+		n := attempts(m)
+		deadLetter := err == nil && d.maxAttempts > 0 && n >= d.maxAttempts
+		if deadLetter {
+			// every message there was delivered maxAttempts times
+			delete(m.Headers, attemptsHeader)
+			if len(m.Headers) == 0 {
+				m.Headers = nil
+			}
+			err = d.dlq.PutMessage(m)
+		} else if err == nil {
+			err = d.writeMessage(m)
+		}
+		if err != nil {
+			d.log(ERROR, "failed to requeue message in flight", "err", err)
+			e.due = now.Add(delayRetryInterval)
+			return
+		}
+		if deadLetter {
+			d.log(WARN, "moved message to dead letter queue", "id", e.id, "attempts", n)
+		} else {
+			d.writesSinceSync++
+			d.log(DEBUG, "requeued message in flight", "id", e.id)
+		}
+		d.forgetInFlight(e.id)
+	}
+}
+
+// appendInFlight appends a record to the journal
+func (d *diskQueue) appendInFlight(b []byte) error {
+	var err error
+	if d.inFlightFile == nil {
+		d.inFlightFile, err = os.OpenFile(d.inFlightFileName(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = d.inFlightFile.Write(b)
+	if err != nil {
+		d.inFlightFile.Close()
+		d.inFlightFile = nil
+	}
+	return err
+}
+
+// rewriteInFlight atomically replaces the journal with one holding only
+// the messages still in flight
+func (d *diskQueue) rewriteInFlight() error {
+	if d.inFlightFile != nil {
+		d.inFlightFile.Close()
+		d.inFlightFile = nil
+	}
+	d.inFlightDone = 0
+
+	fileName := d.inFlightFileName()
+	if len(d.inFlight) == 0 {
+		err := removeFile(fileName)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
+	f, err := os.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, e := range d.inFlightOrder {
+		if d.inFlight[e.id] == nil {
+			continue
+		}
+		var b [9]byte
+		b[0] = inFlightDelivered
+		binary.BigEndian.PutUint64(b[1:], e.id)
+		w.Write(b[:])
+		w.Write(e.frame)
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmpFileName)
+		return err
+	}
+
+	return renameFile(tmpFileName, fileName)
+}
+
+// loadInFlight reads the journal, the messages that were still in flight
+// are put back on the queue right away, a journal cut short by a crash is
+// rewritten without its last (partial) record
+func (d *diskQueue) loadInFlight() error {
+	if d.inFlightFile != nil {
+		d.inFlightFile.Close()
+		d.inFlightFile = nil
+	}
+	d.inFlight = make(map[uint64]*inFlightEntry)
+	d.inFlightOrder = nil
+	d.inFlightDone = 0
+
+	f, err := os.Open(d.inFlightFileName())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	now := time.Now()
+	reader := bufio.NewReader(f)
+	for {
+		var b [9]byte
+		_, err = io.ReadFull(reader, b[:])
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		var frame []byte
+		if err == nil && b[0] == inFlightDelivered {
+			frame, err = d.readDelayedFrame(reader)
+		} else if err == nil && b[0] != inFlightFinished {
+			err = fmt.Errorf("invalid record type (%#x)", b[0])
+		}
+		if err != nil {
+			d.log(WARN, "discarding corrupt in flight journal records", "err", err)
+			break
+		}
+
+		id := binary.BigEndian.Uint64(b[1:])
+		if id > d.inFlightSeq {
+			d.inFlightSeq = id
+		}
+		if b[0] == inFlightFinished {
+			delete(d.inFlight, id)
+			d.inFlightDone++
+			continue
+		}
+		e := &inFlightEntry{id: id, due: now, frame: frame}
+		d.inFlight[id] = e
+		d.inFlightOrder = append(d.inFlightOrder, e)
+	}
+
+	order := d.inFlightOrder[:0]
+	for _, e := range d.inFlightOrder {
+		if d.inFlight[e.id] != nil {
+			order = append(order, e)
+		}
+	}
+	d.inFlightOrder = order
+	if len(d.inFlight) > 0 {
+		d.log(WARN, "requeueing messages that were in flight", "count", len(d.inFlight))
+	}
+	if err != nil {
+		return d.rewriteInFlight()
+	}
+	return nil
+}
+
+func (d *diskQueue) finish(id uint64) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+
+	d.finishChan <- id
+	return <-d.finishResponseChan
+}
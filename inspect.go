@@ -0,0 +1,92 @@
+package diskqueue
+
+import "os"
+
+// Inspector reads the files of a queue without opening it, it takes no
+// lock (see lock.go) and writes nothing so that it can be pointed at a
+// queue that is open elsewhere, as cmd/diskqueue does
+//
+// the options must include those that decide how messages are stored
+// (e.g. WithMaxBytesPerFile, WithMsgSize, WithFrameTrailer, WithCompression
+// and WithEncryption), any others are ignored
+type Inspector struct {
+	d *diskQueue
+}
+
+// QueueMetaData is the persisted state of a queue, see Inspector.MetaData
+type QueueMetaData struct {
+	Depth      int64
+	DepthBytes int64 // -1 if it wasn't recorded
+	Read       Position
+	Write      Position
+	Cursors    map[string]Position
+	// see metadata.go
+	Generation uint64
+	Clean      bool
+}
+
+// NewInspector returns an Inspector of the queue name in dataPath
+func NewInspector(name string, dataPath string, opts ...Option) *Inspector {
+	d := newDiskQueue(name, dataPath, defaultMaxBytesPerFile, 0, defaultMaxMsgSize,
+		func(LogLevel, string, ...interface{}) {})
+	for _, opt := range opts {
+		opt(d)
+	}
+	return &Inspector{d}
+}
+
+// MetaData reads the queue's metadata as last persisted
+func (i *Inspector) MetaData() (QueueMetaData, error) {
+	md, err := readMetaData(i.d.metaDataFileName())
+	if err != nil {
+		return QueueMetaData{}, err
+	}
+	qmd := QueueMetaData{
+		Depth:      md.depth,
+		DepthBytes: md.depthBytes,
+		Read:       Position{md.readFileNum, md.readPos},
+		Write:      Position{md.writeFileNum, md.writePos},
+		Cursors:    make(map[string]Position),
+		Generation: md.generation,
+		Clean:      md.clean,
+	}
+	for _, c := range md.cursors {
+		qmd.Cursors[c.name] = Position{c.fileNum, c.pos}
+	}
+	return qmd, nil
+}
+
+// Walk calls fn with each message from the one at from up to the write
+// position as last persisted, along with the position of its frame (which
+// the messages of a transaction share), until fn returns false
+//
+// it returns the position it stopped at, i.e. that of the message fn
+// returned false for or the write position, data files that have been
+// removed in the meantime are skipped
+func (i *Inspector) Walk(from Position, fn func(pos Position, m Message) bool) (Position, error) {
+	d := i.d
+	md, err := readMetaData(d.metaDataFileName())
+	if err != nil {
+		return from, err
+	}
+	d.writeFileNum, d.writePos = md.writeFileNum, md.writePos
+
+	end := Position{d.writeFileNum, d.writePos}
+	p := from
+	for {
+		p, err = d.walkFrames(p, end, func(pos Position, _ Position, msgs []Message) bool {
+			for _, m := range msgs {
+				if !fn(pos, m) {
+					return false
+				}
+			}
+			return true
+		})
+		if os.IsNotExist(err) && p.FileNum < end.FileNum {
+			// already read and removed
+			p = Position{p.FileNum + 1, 0}
+			continue
+		}
+		return p, err
+	}
+}
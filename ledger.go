@@ -0,0 +1,128 @@
+package diskqueue
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"os"
+)
+
+const ledgerSlotSize = 16
+
+// deliveryLedger is a fixed size ring of the ids of recently delivered
+// messages, persisted so that messages redelivered after a crash-induced
+// rewind of the read position can be recognized
+//
+// each slot is stored on disk as a sequence number followed by an id,
+// the slot with the highest sequence number is the most recently written
+type deliveryLedger struct {
+	f    *os.File
+	ids  []uint64
+	seen map[uint64]struct{}
+	next int
+	seq  uint64
+	buf  [ledgerSlotSize]byte
+}
+
+func openDeliveryLedger(fileName string, size int) (*deliveryLedger, error) {
+	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &deliveryLedger{
+		f:    f,
+		ids:  make([]uint64, size),
+		seen: make(map[uint64]struct{}, size),
+	}
+
+	for i := 0; i < size; i++ {
+		_, err = f.ReadAt(l.buf[:], int64(i*ledgerSlotSize))
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		seq := binary.BigEndian.Uint64(l.buf[:8])
+		id := binary.BigEndian.Uint64(l.buf[8:])
+		if id == 0 {
+			continue
+		}
+		l.ids[i] = id
+		l.seen[id] = struct{}{}
+		if seq >= l.seq {
+			l.seq = seq
+			l.next = (i + 1) % size
+		}
+	}
+
+	return l, nil
+}
+
+// messageID identifies the message stored at pos in fileNum, data file numbers
+// only ever increase so a position is never reused for a different message,
+// short of emptying the queue which resets the ledger
+func messageID(fileNum int64, pos int64) uint64 {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(fileNum))
+	binary.BigEndian.PutUint64(b[8:], uint64(pos))
+	h := fnv.New64a()
+	h.Write(b[:])
+	id := h.Sum64()
+	if id == 0 {
+		// zero marks an empty slot
+		id = 1
+	}
+	return id
+}
+
+func (l *deliveryLedger) contains(id uint64) bool {
+	_, ok := l.seen[id]
+	return ok
+}
+
+// record adds id to the ledger, evicting the oldest entry
+func (l *deliveryLedger) record(id uint64) error {
+	if l.contains(id) {
+		return nil
+	}
+
+	delete(l.seen, l.ids[l.next])
+	l.ids[l.next] = id
+	l.seen[id] = struct{}{}
+	l.seq++
+
+	binary.BigEndian.PutUint64(l.buf[:8], l.seq)
+	binary.BigEndian.PutUint64(l.buf[8:], id)
+	_, err := l.f.WriteAt(l.buf[:], int64(l.next*ledgerSlotSize))
+
+	l.next = (l.next + 1) % len(l.ids)
+	return err
+}
+
+// reset forgets every id, for the positions they were derived from to be
+// written to again once the queue was emptied
+func (l *deliveryLedger) reset() error {
+	for i := range l.ids {
+		l.ids[i] = 0
+	}
+	l.seen = make(map[uint64]struct{}, len(l.ids))
+	l.next = 0
+	l.seq = 0
+
+	err := l.f.Truncate(0)
+	if err == nil {
+		err = l.f.Sync()
+	}
+	return err
+}
+
+func (l *deliveryLedger) sync() error {
+	return l.f.Sync()
+}
+
+func (l *deliveryLedger) close() error {
+	return l.f.Close()
+}
@@ -0,0 +1,43 @@
+package diskqueue
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+// the queue holds an exclusive advisory lock on its lock file while it is
+// open, so that two processes (or two queues in the same process) pointed
+// at the same name and dataPath don't write over each other
+//
+// the metadata file itself is replaced on every sync (see writeMetaData),
+// which would leave a lock taken on it behind, hence the separate file
+
+func (d *diskQueue) lockFileName() string {
+	return fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.lock"), d.name)
+}
+
+// lock takes the lock on the queue's lock file, failing right away if
+// it is held elsewhere
+func (d *diskQueue) lock() error {
+	f, err := os.OpenFile(d.lockFileName(), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	err = flock(f)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("queue %s in %s is in use by another process - %s", d.name, d.dataPath, err)
+	}
+	d.lockFile = f
+	return nil
+}
+
+// unlock releases the lock taken by lock, the lock file is left behind
+// since removing it would race with another process locking it
+func (d *diskQueue) unlock() {
+	if d.lockFile != nil {
+		d.lockFile.Close()
+		d.lockFile = nil
+	}
+}
@@ -0,0 +1,13 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package diskqueue
+
+import (
+	"os"
+	"syscall"
+)
+
+func flock(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
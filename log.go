@@ -0,0 +1,55 @@
+package diskqueue
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// log emits msg at lvl along with attrs, given as key/value pairs (or
+// slog.Attrs) like slog.Logger.Log takes them, to the slog.Logger set
+// with WithSlogLogger along with the queue's name, or else to the
+// AppLogFunc formatted as:
+//
+//	DISKQUEUE(<name>) <msg> key=value...
+func (d *diskQueue) log(lvl LogLevel, msg string, attrs ...interface{}) {
+	if d.slogger != nil {
+		d.slogger.Log(context.Background(), slogLevel(lvl), msg,
+			append([]interface{}{"queue", d.name}, attrs...)...)
+		return
+	}
+	if d.logf == nil {
+		return
+	}
+
+	var b strings.Builder
+	r := slog.NewRecord(time.Time{}, slogLevel(lvl), msg, 0)
+	r.Add(attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		v := a.Value.String()
+		if strings.ContainsAny(v, " \t\n\"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		fmt.Fprintf(&b, " %s=%s", a.Key, v)
+		return true
+	})
+	d.logf(lvl, "DISKQUEUE(%s) %s%s", d.name, msg, b.String())
+}
+
+// slogLevel returns the slog.Level lvl corresponds to, FATAL being above
+// slog.LevelError
+func slogLevel(lvl LogLevel) slog.Level {
+	switch lvl {
+	case DEBUG:
+		return slog.LevelDebug
+	case INFO:
+		return slog.LevelInfo
+	case WARN:
+		return slog.LevelWarn
+	case ERROR:
+		return slog.LevelError
+	}
+	return slog.LevelError + 4
+}
@@ -0,0 +1,184 @@
+package diskqueue
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Manager opens the queues kept in a single dataPath on demand and
+// enforces a quota on the size of their data files taken together
+//
+// only the queues opened through the Manager count towards the quota,
+// writes that would take them past it fail with ErrQueueFull whatever
+// their OverflowPolicy, the sizes of the other queues are those as of
+// their last ioLoop iteration so the quota can be exceeded by the writes
+// in flight
+type Manager struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	diskBytes int64
+
+	dataPath string
+	maxBytes int64
+	opts     []Option
+
+	sync.Mutex
+	queues map[string]*diskQueue
+	closed bool
+}
+
+// NewManager returns a Manager of the queues in dataPath, opts apply to
+// every queue it opens (see NewWithOptions)
+//
+// a maxBytes of 0 doesn't limit the size of the queues
+func NewManager(dataPath string, maxBytes int64, opts ...Option) (*Manager, error) {
+	if maxBytes < 0 {
+		return nil, fmt.Errorf("invalid quota (%d)", maxBytes)
+	}
+	return &Manager{
+		dataPath: dataPath,
+		maxBytes: maxBytes,
+		opts:     opts,
+		queues:   make(map[string]*diskQueue),
+	}, nil
+}
+
+// ListQueues returns the names of the queues in dataPath, whether open or
+// not, sorted
+func (m *Manager) ListQueues() ([]string, error) {
+	files, err := ioutil.ReadDir(m.dataPath)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]bool)
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() {
+			continue
+		}
+		for _, suffix := range []string{".diskqueue.meta.dat", ".diskqueue.meta.b.dat"} {
+			if strings.HasSuffix(name, suffix) && len(name) > len(suffix) {
+				found[strings.TrimSuffix(name, suffix)] = true
+			}
+		}
+	}
+
+	m.Lock()
+	for name := range m.queues {
+		// not yet synced
+		found[name] = true
+	}
+	m.Unlock()
+
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Open returns the queue name, opening (or creating) it if it isn't open
+// already, opts apply in addition to those of the Manager and only when
+// the queue is opened
+//
+// a queue closed (or deleted) other than with Manager.Close is opened
+// again by the next call
+func (m *Manager) Open(name string, opts ...Option) (Interface, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.closed {
+		return nil, ErrExiting
+	}
+	if d, ok := m.queues[name]; ok {
+		if !queueExited(d) {
+			return d, nil
+		}
+		delete(m.queues, name)
+	}
+
+	all := make([]Option, 0, len(m.opts)+len(opts)+1)
+	all = append(all, m.opts...)
+	all = append(all, opts...)
+	all = append(all, func(d *diskQueue) {
+		d.manager = m
+	})
+	dq, err := NewWithOptions(name, m.dataPath, all...)
+	if err != nil {
+		return nil, err
+	}
+	m.queues[name] = dq.(*diskQueue)
+	return dq, nil
+}
+
+// DiskBytes returns the size of the data files of the queues opened, as
+// counted against the quota
+func (m *Manager) DiskBytes() int64 {
+	return atomic.LoadInt64(&m.diskBytes)
+}
+
+// Close closes every queue opened, returning the first error, after which
+// Open fails with ErrExiting
+func (m *Manager) Close() error {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.closed {
+		return errors.New("manager already closed")
+	}
+	m.closed = true
+
+	var firstErr error
+	for name, d := range m.queues {
+		delete(m.queues, name)
+		if queueExited(d) {
+			continue
+		}
+		err := d.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// queueExited returns whether d has been closed or deleted
+func queueExited(d *diskQueue) bool {
+	d.RLock()
+	defer d.RUnlock()
+	return d.exitFlag == 1
+}
+
+// hasRoom returns whether n more bytes can be written to d without
+// exceeding the quota, called from d's ioLoop
+func (m *Manager) hasRoom(d *diskQueue, n int64) bool {
+	if m.maxBytes <= 0 {
+		return true
+	}
+	others := atomic.LoadInt64(&m.diskBytes) - d.reportedBytes
+	return others+d.diskBytes()+n <= m.maxBytes
+}
+
+// forget stops counting the data files of d, which has been deleted
+func (m *Manager) forget(d *diskQueue) {
+	atomic.AddInt64(&m.diskBytes, -d.reportedBytes)
+	d.reportedBytes = 0
+}
+
+// reportDiskBytes updates the size of the data files counted against the
+// quota of the Manager that opened the queue (if any), called from ioLoop
+func (d *diskQueue) reportDiskBytes() {
+	if d.manager == nil {
+		return
+	}
+	n := d.diskBytes()
+	if n != d.reportedBytes {
+		atomic.AddInt64(&d.manager.diskBytes, n-d.reportedBytes)
+		d.reportedBytes = n
+	}
+}
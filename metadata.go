@@ -0,0 +1,243 @@
+package diskqueue
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// the metadata file holds the queue's positions as:
+//
+//	[4-byte magic][1-byte version][8-byte generation][1-byte flags]
+//	[8-byte depth][8-byte depth in bytes]
+//	[8-byte read file][8-byte read position]
+//	[8-byte write file][8-byte write position]
+//	[4-byte number of cursors]
+//	[2-byte name length][name][8-byte file][8-byte position]...
+//	[4-byte CRC32-C of the rest]
+//
+// metadata written by older versions is text instead:
+//
+//	<depth> <depth in bytes>
+//	<read file>,<read position>
+//	<write file>,<write position>
+//	<cursor name> <file>,<position>...
+//
+// with the depth in bytes missing from even older versions
+//
+// the flags mark whether the queue was closed cleanly and hasn't been
+// written to since, in which case the startup scan (see WithStartupScan)
+// has nothing to check
+//
+// metadata is written to two files in turn, the one named after the queue
+// and the same with a .b.dat suffix, every write with a generation one
+// higher than the last, the newest of the two that can be read is used on
+// startup so that the other one is there to fall back on if the metadata
+// last written didn't make it to disk
+
+const (
+	metaDataMagic   = "DQMD"
+	metaDataVersion = 1
+
+	metaDataFlagClean = 0x01
+)
+
+// metaData is the content of the metadata file
+type metaData struct {
+	generation   uint64
+	clean        bool
+	depth        int64
+	depthBytes   int64 // -1 if it wasn't recorded
+	readFileNum  int64
+	readPos      int64
+	writeFileNum int64
+	writePos     int64
+	cursors      []cursorMetaData
+}
+
+type cursorMetaData struct {
+	name    string
+	fileNum int64
+	pos     int64
+}
+
+// metaData returns the queue's state as it is persisted, i.e. with reads
+// that haven't been committed yet still to be read
+func (d *diskQueue) metaData() metaData {
+	// reading resumes from the committed position after a restart
+	depthBytes := atomic.LoadInt64(&d.depthBytes)
+	if d.uncommittedReads > 0 {
+		depthBytes += d.bytesBetween(d.commitReadFileNum, d.commitReadPos, d.readFileNum, d.readPos)
+	}
+
+	md := metaData{
+		generation:   d.metaGeneration,
+		clean:        d.clean,
+		depth:        atomic.LoadInt64(&d.depth) + d.uncommittedReads,
+		depthBytes:   depthBytes,
+		readFileNum:  d.commitReadFileNum,
+		readPos:      d.commitReadPos,
+		writeFileNum: d.writeFileNum,
+		writePos:     d.writePos,
+	}
+	for _, name := range d.cursorNames() {
+		c := d.cursors[name]
+		if c.transient {
+			continue
+		}
+		md.cursors = append(md.cursors, cursorMetaData{name, c.fileNum, c.pos})
+	}
+	return md
+}
+
+// encode returns the binary encoding of md
+func (md metaData) encode() []byte {
+	b := make([]byte, 0, 64)
+	b = append(b, metaDataMagic...)
+	b = append(b, metaDataVersion)
+	var generation [8]byte
+	binary.BigEndian.PutUint64(generation[:], md.generation)
+	b = append(b, generation[:]...)
+	var flags byte
+	if md.clean {
+		flags |= metaDataFlagClean
+	}
+	b = append(b, flags)
+	for _, v := range []int64{md.depth, md.depthBytes,
+		md.readFileNum, md.readPos, md.writeFileNum, md.writePos} {
+		b = binary.BigEndian.AppendUint64(b, uint64(v))
+	}
+	b = binary.BigEndian.AppendUint32(b, uint32(len(md.cursors)))
+	for _, c := range md.cursors {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(c.name)))
+		b = append(b, c.name...)
+		b = binary.BigEndian.AppendUint64(b, uint64(c.fileNum))
+		b = binary.BigEndian.AppendUint64(b, uint64(c.pos))
+	}
+	return binary.BigEndian.AppendUint32(b, crc32.Checksum(b, crc32cTable))
+}
+
+// decodeMetaData decodes the content of a metadata file in either format
+func decodeMetaData(b []byte) (metaData, error) {
+	if !bytes.HasPrefix(b, []byte(metaDataMagic)) {
+		return decodeTextMetaData(b)
+	}
+
+	var md metaData
+	if len(b) < len(metaDataMagic)+1+8+1+6*8+4+4 {
+		return md, errors.New("truncated metadata")
+	}
+	end := len(b) - 4
+	if binary.BigEndian.Uint32(b[end:]) != crc32.Checksum(b[:end], crc32cTable) {
+		return md, errors.New("invalid metadata checksum")
+	}
+	if version := b[len(metaDataMagic)]; version != metaDataVersion {
+		return md, fmt.Errorf("unsupported metadata version (%d)", version)
+	}
+	rest := b[len(metaDataMagic)+1 : end]
+	md.generation = binary.BigEndian.Uint64(rest)
+	md.clean = rest[8]&metaDataFlagClean != 0
+	rest = rest[9:]
+	for _, v := range []*int64{&md.depth, &md.depthBytes,
+		&md.readFileNum, &md.readPos, &md.writeFileNum, &md.writePos} {
+		*v = int64(binary.BigEndian.Uint64(rest))
+		rest = rest[8:]
+	}
+	cursors := binary.BigEndian.Uint32(rest)
+	rest = rest[4:]
+	for i := uint32(0); i < cursors; i++ {
+		if len(rest) < 2 || len(rest) < 2+int(binary.BigEndian.Uint16(rest))+16 {
+			return md, errors.New("truncated metadata")
+		}
+		n := 2 + int(binary.BigEndian.Uint16(rest))
+		md.cursors = append(md.cursors, cursorMetaData{
+			name:    string(rest[2:n]),
+			fileNum: int64(binary.BigEndian.Uint64(rest[n:])),
+			pos:     int64(binary.BigEndian.Uint64(rest[n+8:])),
+		})
+		rest = rest[n+16:]
+	}
+	if len(rest) != 0 {
+		return md, errors.New("invalid metadata length")
+	}
+	return md, nil
+}
+
+// metaDataSlots returns the names of the two files metadata is written to
+// in turn, the first being fileName
+func metaDataSlots(fileName string) [2]string {
+	return [2]string{fileName, strings.TrimSuffix(fileName, ".dat") + ".b.dat"}
+}
+
+// readMetaData returns the newest metadata of the two files written in
+// turn, see metaDataSlots, failing only if neither can be read
+func readMetaData(fileName string) (metaData, error) {
+	var newest metaData
+	var found bool
+	var firstErr error
+	for _, slot := range metaDataSlots(fileName) {
+		b, err := ioutil.ReadFile(slot)
+		var md metaData
+		if err == nil {
+			md, err = decodeMetaData(b)
+		}
+		if err != nil {
+			if firstErr == nil || os.IsNotExist(firstErr) {
+				firstErr = err
+			}
+			continue
+		}
+		if !found || md.generation > newest.generation {
+			newest = md
+			found = true
+		}
+	}
+	if !found {
+		return newest, firstErr
+	}
+	return newest, nil
+}
+
+// decodeTextMetaData decodes metadata written by older versions
+func decodeTextMetaData(b []byte) (metaData, error) {
+	var md metaData
+
+	// the first line holds the depth, followed by the depth in bytes
+	// unless written by an older version
+	r := bufio.NewReader(bytes.NewReader(b))
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return md, err
+	}
+	n, _ := fmt.Sscanf(line, "%d %d", &md.depth, &md.depthBytes)
+	if n == 0 {
+		return md, fmt.Errorf("invalid depth %q", line)
+	}
+	if n == 1 {
+		md.depthBytes = -1
+	}
+	_, err = fmt.Fscanf(r, "%d,%d\n%d,%d\n",
+		&md.readFileNum, &md.readPos,
+		&md.writeFileNum, &md.writePos)
+	if err != nil {
+		return md, err
+	}
+
+	// followed by a line per cursor
+	for {
+		var c cursorMetaData
+		_, err = fmt.Fscanf(r, "%s %d,%d\n", &c.name, &c.fileNum, &c.pos)
+		if err != nil {
+			break
+		}
+		md.cursors = append(md.cursors, c)
+	}
+	return md, nil
+}
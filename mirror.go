@@ -0,0 +1,194 @@
+package diskqueue
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// mirrorFile appends to both the write file and its copy in the mirror
+// path, a write only succeeds once it made it to both
+type mirrorFile struct {
+	writeHandle
+	mirror *os.File
+}
+
+func (m *mirrorFile) Write(p []byte) (int, error) {
+	n, err := m.writeHandle.Write(p)
+	if err != nil {
+		return n, err
+	}
+	_, err = m.mirror.Write(p)
+	return n, err
+}
+
+func (m *mirrorFile) Seek(offset int64, whence int) (int64, error) {
+	ret, err := m.writeHandle.Seek(offset, whence)
+	if err != nil {
+		return ret, err
+	}
+	_, err = m.mirror.Seek(offset, whence)
+	return ret, err
+}
+
+func (m *mirrorFile) Truncate(size int64) error {
+	err := m.writeHandle.Truncate(size)
+	if err != nil {
+		return err
+	}
+	return m.mirror.Truncate(size)
+}
+
+func (m *mirrorFile) Sync() error {
+	err := syncWriteHandle(m.writeHandle)
+	if err != nil {
+		return err
+	}
+	return fdatasync(m.mirror)
+}
+
+func (m *mirrorFile) Close() error {
+	err := m.writeHandle.Close()
+	innerErr := m.mirror.Close()
+	if err == nil {
+		err = innerErr
+	}
+	return err
+}
+
+// mirrorFileName returns where the copy of fileName is kept in the mirror path
+func (d *diskQueue) mirrorFileName(fileName string) string {
+	return path.Join(d.mirrorPath, path.Base(fileName))
+}
+
+// openMirrorFile wraps the write file so that writes are mirrored, see
+// WithMirror
+func (d *diskQueue) openMirrorFile(flag int) error {
+	f, err := os.OpenFile(d.mirrorFileName(d.fileName(d.writeFileNum)), flag, 0600)
+	if err != nil {
+		return err
+	}
+	d.writeFile = &mirrorFile{writeHandle: d.writeFile, mirror: f}
+	return nil
+}
+
+// removeDataFile removes fileName along with its index and its copy in the
+// mirror path
+func (d *diskQueue) removeDataFile(fileName string) error {
+	err := removeFile(fileName)
+	d.removeDataFileCopies(fileName)
+	if err == nil {
+		d.fileHook(d.onFileDelete, fileName)
+	}
+	return err
+}
+
+// removeDataFileCopies removes the index of fileName and its copy in the
+// mirror path
+func (d *diskQueue) removeDataFileCopies(fileName string) {
+	if d.indexEvery > 0 {
+		removeFile(indexFileName(fileName))
+	}
+	if d.mirrorPath != "" {
+		innerErr := removeFile(d.mirrorFileName(fileName))
+		if innerErr != nil && !os.IsNotExist(innerErr) {
+			d.log(ERROR, "failed to remove mirrored file", "file", fileName, "err", innerErr)
+		}
+	}
+}
+
+// syncMirror copies the data files that differ from their copy in the
+// mirror path, e.g. those written before the mirror was added
+func (d *diskQueue) syncMirror() error {
+	for i := d.firstFileNum; i <= d.writeFileNum; i++ {
+		fileName := d.fileName(i)
+		stat, err := os.Stat(fileName)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		mirrorStat, err := os.Stat(d.mirrorFileName(fileName))
+		if err == nil && mirrorStat.Size() == stat.Size() {
+			continue
+		}
+		d.log(INFO, "copying file to mirror", "file", fileName, "dir", d.mirrorPath)
+		err = copyFile(fileName, d.mirrorFileName(fileName), stat.Size())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile replaces dst with a synced copy of the first n bytes of src
+func copyFile(src string, dst string, n int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(out, in, n)
+	if err == nil {
+		err = out.Sync()
+	}
+	innerErr := out.Close()
+	if err == nil {
+		err = innerErr
+	}
+	return err
+}
+
+// failover switches the queue over to its mirror, which becomes the
+// queue's dataPath
+func (d *diskQueue) failover(dataPath string) error {
+	if d.mirrorPath == "" || path.Clean(dataPath) != path.Clean(d.mirrorPath) {
+		return fmt.Errorf("no mirror at %s", dataPath)
+	}
+	d.log(WARN, "failing over", "dir", d.dataPath, "to", dataPath)
+
+	if d.writeFile != nil {
+		d.flushPending()
+	}
+	if d.writeFile != nil {
+		// the primary may be gone along with its disk, the mirror
+		// already has everything that was written successfully
+		d.writeFile.Close()
+		d.writeFile = nil
+	}
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
+	}
+	d.takePreopened(-1)
+	d.closeCursorFiles()
+	d.closeLedger()
+
+	d.dataPath = d.mirrorPath
+	d.mirrorPath = ""
+
+	var err error
+	if d.ledgerSize > 0 {
+		d.ledger, err = openDeliveryLedger(d.ledgerFileName(), d.ledgerSize)
+		if err != nil {
+			d.log(ERROR, "failed to open delivery ledger", "err", err)
+		}
+	}
+	d.openDedup()
+	// moves the pending delayed messages and those in flight over
+	err = d.rewriteDelayed()
+	if err == nil {
+		err = d.rewriteInFlight()
+	}
+	if err != nil {
+		return err
+	}
+	return d.sync()
+}
@@ -0,0 +1,123 @@
+package diskqueue
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// writeHandle is the subset of *os.File used to append to the current
+// write file, it is satisfied by *os.File and *mmapFile
+type writeHandle interface {
+	io.Writer
+	io.Seeker
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+var errMmapFull = errors.New("mmap segment full")
+
+// mmapFile appends to a file through a shared memory mapping of a
+// preallocated region of it, Sync() msyncs the mapping and Close() trims
+// the file back to the bytes actually written
+type mmapFile struct {
+	f    *os.File
+	data []byte
+	off  int64
+	end  int64
+}
+
+func (m *mmapFile) Write(b []byte) (int, error) {
+	if m.off+int64(len(b)) > int64(len(m.data)) {
+		return 0, errMmapFull
+	}
+	n := copy(m.data[m.off:], b)
+	m.off += int64(n)
+	if m.off > m.end {
+		m.end = m.off
+	}
+	return n, nil
+}
+
+func (m *mmapFile) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekStart || offset < 0 || offset > int64(len(m.data)) {
+		return m.off, errors.New("invalid seek on mmap segment")
+	}
+	m.off = offset
+	if m.off > m.end {
+		m.end = m.off
+	}
+	return m.off, nil
+}
+
+// Truncate only moves the logical end of the segment, the mapped region
+// itself stays allocated until Close()
+func (m *mmapFile) Truncate(size int64) error {
+	if size < 0 || size > int64(len(m.data)) {
+		return errors.New("invalid truncate on mmap segment")
+	}
+	m.end = size
+	return nil
+}
+
+func (m *mmapFile) Sync() error {
+	return msync(m.data)
+}
+
+func (m *mmapFile) Close() error {
+	err := munmap(m.data)
+	m.data = nil
+	if terr := m.f.Truncate(m.end); err == nil {
+		err = terr
+	}
+	if cerr := m.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// openMmapFile maps the first size bytes of f, growing it if necessary
+func openMmapFile(f *os.File, size int64) (*mmapFile, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() < size {
+		err = f.Truncate(size)
+		if err != nil {
+			return nil, err
+		}
+	}
+	data, err := mmap(f, size)
+	if err != nil {
+		f.Truncate(stat.Size())
+		return nil, err
+	}
+	return &mmapFile{f: f, data: data}, nil
+}
+
+// mmapReader reads the current read file, capping reads of the write file
+// at writePos so that its preallocated (zeroed) tail, or the padding of its
+// last block with WithDirectIO, is never buffered
+type mmapReader struct {
+	d       *diskQueue
+	f       *os.File
+	fileNum int64
+	off     int64
+}
+
+func (r *mmapReader) Read(b []byte) (int, error) {
+	if r.fileNum == r.d.writeFileNum {
+		room := r.d.writePos - r.off
+		if room <= 0 {
+			return 0, io.EOF
+		}
+		if int64(len(b)) > room {
+			b = b[:room]
+		}
+	}
+	n, err := r.f.Read(b)
+	r.off += int64(n)
+	return n, err
+}
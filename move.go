@@ -0,0 +1,493 @@
+package diskqueue
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"sync/atomic"
+	"time"
+)
+
+// a move (see MoveTo) takes messages from the read side of the queue in
+// batches, each of which is recorded in a journal before the read position
+// is moved past it:
+//
+//	<destination dataPath> <destination name> (quoted)
+//	<batch id>
+//	<first file>,<first position> <end file>,<end position> <count>
+//
+// the batch is then written to the destination, and the journal removed
+// once that has been fsync'd, the data files holding the batch are kept
+// until then
+//
+// the destination records, per queue moving messages to it, the batch it
+// was last given before writing any of it:
+//
+//	<source dataPath> <source name> (quoted) <batch id> <file>,<position> <moved> <count>
+//
+// i.e. that the messages of the batch from moved on are written from
+// file,position on, as nothing else is written in between the ones found
+// there on startup (up to count) are those of the batch
+//
+// on startup a journal means the batch may or may not have made it to the
+// destination, it is not read from the queue again and the next MoveTo to
+// the same destination finishes the move, the destination only writing
+// the messages of the batch its record doesn't account for
+
+// moveBatchSize is the most messages a move journals at a time
+const moveBatchSize = 1024
+
+// pendingMove is the batch of a move that is on its way to the destination
+type pendingMove struct {
+	dstPath string
+	dstName string
+	batch   int64
+	from    Position
+	to      Position
+	count   int64
+}
+
+type moveRequest struct {
+	dstPath    string
+	dstName    string
+	max        int64
+	minMsgSize int32
+	maxMsgSize int32
+}
+
+type moveResult struct {
+	move pendingMove
+	msgs [][]byte
+	err  error
+}
+
+// incomingMove is the destination's record of the last batch a queue
+// moved to it
+type incomingMove struct {
+	srcPath string
+	srcName string
+	batch   int64
+	from    Position // where the messages of the batch from moved on go
+	moved   int64
+	count   int64
+}
+
+type moveInRequest struct {
+	srcPath string
+	srcName string
+	batch   int64
+	msgs    [][]byte
+}
+
+func (d *diskQueue) moveFileName() string {
+	return fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.move.dat"), d.name)
+}
+
+func (d *diskQueue) moveInFileName() string {
+	return fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.movein.dat"), d.name)
+}
+
+// beginMove journals the next batch of up to req.max messages and moves
+// the read position past it, or returns the batch of the move still
+// pending
+func (d *diskQueue) beginMove(req moveRequest) moveResult {
+	if d.move != nil {
+		if d.move.dstPath != req.dstPath || d.move.dstName != req.dstName {
+			return moveResult{err: fmt.Errorf("a move to %s in %s is pending", d.move.dstName, d.move.dstPath)}
+		}
+		msgs, _, err := d.collectMessages(d.move.from, d.move.to, d.move.count, nil)
+		return moveResult{move: *d.move, msgs: msgs, err: err}
+	}
+
+	if d.writeFile != nil {
+		err := d.flushPending()
+		if err != nil {
+			return moveResult{err: err}
+		}
+	}
+	// the message pending delivery (if any) is moved as well
+	d.rewindRead()
+
+	from := Position{d.readFileNum, d.readPos}
+	check := func(data []byte) error {
+		if int32(len(data)) < req.minMsgSize || int32(len(data)) > req.maxMsgSize {
+			return &MsgSizeError{int64(len(data)), req.minMsgSize, req.maxMsgSize}
+		}
+		return nil
+	}
+	msgs, to, err := d.collectMessages(from, Position{d.writeFileNum, d.writePos}, req.max, check)
+	if err != nil || len(msgs) == 0 {
+		return moveResult{err: err}
+	}
+
+	mv := pendingMove{
+		dstPath: req.dstPath,
+		dstName: req.dstName,
+		batch:   time.Now().UnixNano(),
+		from:    from,
+		to:      to,
+		count:   int64(len(msgs)),
+	}
+	err = d.writeMoveJournal(mv)
+	if err != nil {
+		return moveResult{err: err}
+	}
+	d.move = &mv
+	d.skipReadTo(to.FileNum, to.Pos, mv.count)
+	return moveResult{move: mv, msgs: msgs}
+}
+
+// collectMessages returns the messages from from up to end, stopping
+// before the frame that would take them past max or holds a message check
+// fails (which is only returned if it's the first), along with where it
+// stopped
+func (d *diskQueue) collectMessages(from Position, end Position, max int64, check func([]byte) error) ([][]byte, Position, error) {
+	var msgs [][]byte
+	var checkErr error
+	to, err := d.walkFrames(from, end, func(_ Position, _ Position, frame []Message) bool {
+		if int64(len(msgs)+len(frame)) > max {
+			return false
+		}
+		for _, m := range frame {
+			if check != nil {
+				checkErr = check(m.Data)
+			}
+			if checkErr != nil {
+				return false
+			}
+		}
+		for _, m := range frame {
+			msgs = append(msgs, m.Data)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, from, err
+	}
+	if len(msgs) == 0 && checkErr != nil {
+		return nil, from, checkErr
+	}
+	return msgs, to, nil
+}
+
+// endMove forgets the pending move once its batch has made it to the
+// destination, allowing the data files that held it to be removed
+func (d *diskQueue) endMove() error {
+	err := removeFile(d.moveFileName())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	d.move = nil
+	d.removeFiles()
+	d.needSync = true
+	return nil
+}
+
+// writeMoveJournal atomically writes the journal of mv
+func (d *diskQueue) writeMoveJournal(mv pendingMove) error {
+	fileName := d.moveFileName()
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
+	f, err := os.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%q %q\n%d\n%d,%d %d,%d %d\n",
+		mv.dstPath, mv.dstName, mv.batch,
+		mv.from.FileNum, mv.from.Pos, mv.to.FileNum, mv.to.Pos, mv.count)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmpFileName)
+		return err
+	}
+
+	err = renameFile(tmpFileName, fileName)
+	if err == nil && d.dirSync {
+		err = syncDirHook(d.dataPath)
+	}
+	return err
+}
+
+// loadMove reads the journal of a move that was interrupted, making sure
+// its batch isn't read from the queue again
+func (d *diskQueue) loadMove() error {
+	d.move = nil
+	b, err := ioutil.ReadFile(d.moveFileName())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var mv pendingMove
+	_, err = fmt.Sscanf(string(b), "%q %q\n%d\n%d,%d %d,%d %d\n",
+		&mv.dstPath, &mv.dstName, &mv.batch,
+		&mv.from.FileNum, &mv.from.Pos, &mv.to.FileNum, &mv.to.Pos, &mv.count)
+	if err != nil {
+		return fmt.Errorf("invalid move journal - %s", err)
+	}
+	d.move = &mv
+
+	if d.readFileNum == mv.from.FileNum && d.readPos == mv.from.Pos {
+		// the read position didn't make it to disk
+		d.readFileNum, d.readPos = mv.to.FileNum, mv.to.Pos
+		d.nextReadFileNum, d.nextReadPos = mv.to.FileNum, mv.to.Pos
+		d.commitReadFileNum, d.commitReadPos = mv.to.FileNum, mv.to.Pos
+		atomic.AddInt64(&d.depth, -mv.count)
+		atomic.StoreInt64(&d.depthBytes, d.unreadBytes(mv.to.FileNum, mv.to.Pos))
+		d.needSync = true
+	}
+	d.log(WARN, "a move was interrupted", "to", mv.dstName, "count", mv.count)
+	return nil
+}
+
+// moveIn writes the part of the batch req isn't already in the queue,
+// recording it first, see move.go
+func (d *diskQueue) moveIn(req moveInRequest) error {
+	key := req.srcPath + "\x00" + req.srcName
+	prev := d.movesIn[key]
+	var moved int64
+	if prev != nil && prev.batch == req.batch {
+		moved = prev.moved
+	}
+	rec := &incomingMove{
+		srcPath: req.srcPath,
+		srcName: req.srcName,
+		batch:   req.batch,
+		from:    Position{d.writeFileNum, d.writePos},
+		moved:   moved,
+		count:   int64(len(req.msgs)),
+	}
+	if rec.moved >= rec.count {
+		return d.sync()
+	}
+	for _, data := range req.msgs[rec.moved:] {
+		dataLen := int32(len(data))
+		if dataLen < d.minMsgSize || dataLen > d.maxMsgSize {
+			return &MsgSizeError{int64(dataLen), d.minMsgSize, d.maxMsgSize}
+		}
+	}
+
+	if d.movesIn == nil {
+		d.movesIn = make(map[string]*incomingMove)
+	}
+	d.movesIn[key] = rec
+	err := d.writeMovesIn()
+	if err != nil {
+		if prev != nil {
+			d.movesIn[key] = prev
+		} else {
+			delete(d.movesIn, key)
+		}
+		return err
+	}
+
+	for _, data := range req.msgs[rec.moved:] {
+		err = d.writeOne(data)
+		if err != nil {
+			break
+		}
+		rec.moved++
+	}
+	if err == nil {
+		err = d.sync()
+	}
+	// what's left of the batch (if anything) goes after what's there now
+	rec.from = Position{d.writeFileNum, d.writePos}
+	innerErr := d.writeMovesIn()
+	if innerErr != nil {
+		d.log(ERROR, "failed to record moved messages", "from", rec.srcName, "err", innerErr)
+	}
+	return err
+}
+
+// writeMovesIn atomically writes the records of the batches moved to the
+// queue
+func (d *diskQueue) writeMovesIn() error {
+	fileName := d.moveInFileName()
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
+	f, err := os.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, rec := range d.movesIn {
+		fmt.Fprintf(w, "%q %q %d %d,%d %d %d\n",
+			rec.srcPath, rec.srcName, rec.batch, rec.from.FileNum, rec.from.Pos, rec.moved, rec.count)
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmpFileName)
+		return err
+	}
+
+	err = renameFile(tmpFileName, fileName)
+	if err == nil && d.dirSync {
+		err = syncDirHook(d.dataPath)
+	}
+	return err
+}
+
+// loadMovesIn reads the records of the batches moved to the queue, working
+// out how much of each made it to disk
+func (d *diskQueue) loadMovesIn() error {
+	d.movesIn = nil
+	f, err := os.Open(d.moveInFileName())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	d.movesIn = make(map[string]*incomingMove)
+	end := Position{d.writeFileNum, d.writePos}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec incomingMove
+		_, err = fmt.Sscanf(scanner.Text(), "%q %q %d %d,%d %d %d",
+			&rec.srcPath, &rec.srcName, &rec.batch, &rec.from.FileNum, &rec.from.Pos, &rec.moved, &rec.count)
+		if err != nil {
+			return fmt.Errorf("invalid move record - %s", err)
+		}
+
+		switch {
+		case rec.from.FileNum < d.firstFileNum:
+			// written and read since, which can't happen while a batch
+			// is being written
+			rec.moved = rec.count
+		case rec.from.FileNum < end.FileNum || (rec.from.FileNum == end.FileNum && rec.from.Pos < end.Pos):
+			_, err = d.walkFrames(rec.from, end, func(_ Position, _ Position, frame []Message) bool {
+				rec.moved += int64(len(frame))
+				return rec.moved < rec.count
+			})
+			if err != nil {
+				return err
+			}
+			if rec.moved > rec.count {
+				rec.moved = rec.count
+			}
+		}
+		rec.from = end
+		d.movesIn[rec.srcPath+"\x00"+rec.srcName] = &rec
+	}
+	err = scanner.Err()
+	if err != nil {
+		return err
+	}
+	return d.writeMovesIn()
+}
+
+// MoveTo moves up to n messages from the read side of the queue to dst,
+// which must be another queue of this package, returning how many were
+// moved
+//
+// messages are moved in batches that are journaled so that a crash
+// neither loses nor duplicates them, the batch of a move that was
+// interrupted (by a crash or a failure to write to dst) isn't read from
+// the queue, the next MoveTo to the same dst finishes moving it (counting
+// it towards n) and a MoveTo to any other queue fails until then
+//
+// messages read but not committed (see WithManualCommit) are consumed, as
+// with Skip a transaction is moved as a whole, to dst as separate messages
+func (d *diskQueue) MoveTo(dst Interface, n int64) (int64, error) {
+	dq, ok := dst.(*diskQueue)
+	if !ok || dq == d {
+		return 0, errors.New("can only move messages to another queue of this package")
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("invalid move count (%d)", n)
+	}
+
+	var moved int64
+	for moved < n {
+		max := n - moved
+		if max > moveBatchSize {
+			max = moveBatchSize
+		}
+		res := d.sendMove(moveRequest{
+			dstPath:    dq.dataPath,
+			dstName:    dq.name,
+			max:        max,
+			minMsgSize: atomic.LoadInt32(&dq.minMsgSize),
+			maxMsgSize: atomic.LoadInt32(&dq.maxMsgSize),
+		})
+		if res.err != nil {
+			return moved, res.err
+		}
+		if len(res.msgs) == 0 {
+			break
+		}
+
+		err := dq.sendMoveIn(moveInRequest{
+			srcPath: d.dataPath,
+			srcName: d.name,
+			batch:   res.move.batch,
+			msgs:    res.msgs,
+		})
+		if err != nil {
+			return moved, err
+		}
+		err = d.sendEndMove()
+		if err != nil {
+			return moved, err
+		}
+		moved += res.move.count
+	}
+	return moved, nil
+}
+
+func (d *diskQueue) sendMove(req moveRequest) moveResult {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return moveResult{err: ErrExiting}
+	}
+
+	d.moveChan <- req
+	return <-d.moveResponseChan
+}
+
+func (d *diskQueue) sendEndMove() error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+
+	d.moveEndChan <- 1
+	return (<-d.moveResponseChan).err
+}
+
+func (d *diskQueue) sendMoveIn(req moveInRequest) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+	if atomic.LoadInt32(&d.draining) == 1 {
+		return ErrDraining
+	}
+
+	select {
+	case d.moveInChan <- req:
+	case <-d.closingChan:
+		return ErrExiting
+	}
+	return <-d.writeResponseChan
+}
@@ -0,0 +1,124 @@
+package diskqueue
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrQueueFull is returned by writes that would take the queue past the
+// limit set with WithMaxBytes
+var ErrQueueFull = errors.New("queue full")
+
+// OverflowPolicy decides what happens to writes once the queue reaches
+// the limit set with WithMaxBytes
+type OverflowPolicy int
+
+const (
+	// OverflowReject fails writes with ErrQueueFull
+	OverflowReject OverflowPolicy = iota
+	// OverflowBlock blocks writers until enough data files have been
+	// consumed (and, with WithManualCommit, committed) to get back under
+	// the limit, the last write let through may exceed it
+	OverflowBlock
+	// OverflowDropOldest deletes the oldest data files, along with any
+	// unread messages in them, to make room
+	OverflowDropOldest
+)
+
+// diskBytes returns the size of the data files on disk
+func (d *diskQueue) diskBytes() int64 {
+	return d.doneFileBytes + d.writePos
+}
+
+// overflowBlocked returns true while writes are held back by OverflowBlock
+func (d *diskQueue) overflowBlocked() bool {
+	return d.maxBytes > 0 && d.overflowPolicy == OverflowBlock && d.diskBytes() >= d.maxBytes
+}
+
+// makeRoom checks that n more bytes can be written without exceeding
+// maxBytes (or the quota of the Manager that opened the queue), dropping
+// data files with OverflowDropOldest
+func (d *diskQueue) makeRoom(n int64) error {
+	if d.manager != nil && !d.manager.hasRoom(d, n) {
+		return ErrQueueFull
+	}
+	if d.maxBytes <= 0 {
+		return nil
+	}
+	for d.diskBytes()+n > d.maxBytes {
+		if d.dropReplayFile() {
+			continue
+		}
+		if d.overflowPolicy == OverflowBlock {
+			return nil
+		}
+		if d.overflowPolicy != OverflowDropOldest || d.firstFileNum == d.writeFileNum {
+			return ErrQueueFull
+		}
+		err := d.dropOldestFile()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropReplayFile removes the oldest data file if it is only kept for
+// replay (see WithReplayRetention), returning whether it did
+func (d *diskQueue) dropReplayFile() bool {
+	if !d.retain || d.firstFileNum >= d.consumedFileNum() {
+		return false
+	}
+	d.removeFilesBefore(d.firstFileNum + 1)
+	return true
+}
+
+// dropOldestFile removes the oldest data file, skipping the read position
+// (and cursors) past it if it has not been read in full
+func (d *diskQueue) dropOldestFile() error {
+	fileNum := d.firstFileNum
+	d.skipCursorsIn(fileNum)
+
+	if fileNum < d.commitReadFileNum {
+		// only kept for cursors
+		d.removeFilesBefore(fileNum + 1)
+		return nil
+	}
+	if fileNum < d.readFileNum {
+		// read but not yet committed
+		d.log(WARN, "queue full, dropping uncommitted file", "file", d.fileName(fileNum))
+		return d.commitTo(fileNum+1, 0)
+	}
+
+	n, err := d.framesBetween(d.readFileNum, d.readPos, fileNum+1, 0)
+	if err != nil {
+		return err
+	}
+	d.log(WARN, "queue full, dropping unread messages", "file", d.fileName(fileNum), "count", n)
+
+	d.skipReadTo(fileNum+1, 0, n)
+	return nil
+}
+
+// loadDoneFileBytes sums up the sizes of the data files preceding the
+// write file
+func (d *diskQueue) loadDoneFileBytes() {
+	d.doneFileBytes = 0
+	for i := d.firstFileNum; i < d.writeFileNum; i++ {
+		d.doneFileBytes += d.fileSize(i)
+	}
+}
+
+// fileSize returns the size of a data file, 0 if it doesn't exist
+func (d *diskQueue) fileSize(fileNum int64) int64 {
+	return fileSizeOf(d.fileName(fileNum))
+}
+
+// fileSizeOf returns the size of a file, 0 if it doesn't exist
+func fileSizeOf(fileName string) int64 {
+	stat, err := os.Stat(fileName)
+	if err != nil {
+		return 0
+	}
+	return stat.Size()
+}
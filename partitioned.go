@@ -0,0 +1,200 @@
+package diskqueue
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// Partitioned spreads messages over a number of queues, each with its own
+// data files and ioLoop, read through a single channel
+//
+// messages with the same key go to the same partition and so are read in
+// the order they were written, there is no ordering between partitions
+type Partitioned struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	next uint64
+
+	partitions []*partition
+	readChan   chan []byte
+	exitChan   chan int
+	exitWg     sync.WaitGroup
+}
+
+type partition struct {
+	Interface
+
+	// guards held, so that a message moving from the partition to
+	// its readLoop is counted exactly once by Depth
+	sync.Mutex
+	held int64
+
+	wakeChan chan int
+}
+
+// NewPartitioned creates (or reopens) a Partitioned with the given number of
+// partitions, opts apply to every partition (see NewWithOptions)
+//
+// partition n uses name + ".part" + n, the number of partitions must not
+// change between runs for keys to keep mapping to the same partition
+//
+// messages are delivered at least once, a message being handed out when
+// the Partitioned was closed is delivered again once reopened
+func NewPartitioned(name string, dataPath string, partitions int, opts ...Option) (*Partitioned, error) {
+	if partitions < 1 {
+		return nil, fmt.Errorf("invalid number of partitions (%d)", partitions)
+	}
+
+	p := &Partitioned{
+		readChan: make(chan []byte),
+		exitChan: make(chan int),
+	}
+	// only the message handed out on readChan is committed
+	opts = append(opts[:len(opts):len(opts)], WithManualCommit())
+	for i := 0; i < partitions; i++ {
+		dq, err := NewWithOptions(fmt.Sprintf("%s.part%d", name, i), dataPath, opts...)
+		if err != nil {
+			for _, part := range p.partitions {
+				part.Close()
+			}
+			return nil, err
+		}
+		p.partitions = append(p.partitions, &partition{
+			Interface: dq,
+			wakeChan:  make(chan int, 1),
+		})
+	}
+
+	for _, part := range p.partitions {
+		p.exitWg.Add(1)
+		go p.readLoop(part)
+	}
+	return p, nil
+}
+
+// Put writes data to the partitions in turn
+func (p *Partitioned) Put(data []byte) error {
+	i := (atomic.AddUint64(&p.next, 1) - 1) % uint64(len(p.partitions))
+	return p.put(p.partitions[i], data)
+}
+
+// PutKey writes data to the partition key hashes to
+func (p *Partitioned) PutKey(key []byte, data []byte) error {
+	return p.put(p.partitions[p.Partition(key)], data)
+}
+
+func (p *Partitioned) put(part *partition, data []byte) error {
+	err := part.Put(data)
+	if err != nil {
+		return err
+	}
+	select {
+	case part.wakeChan <- 1:
+	default:
+	}
+	return nil
+}
+
+// Partition returns the partition key hashes to
+func (p *Partitioned) Partition(key []byte) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(len(p.partitions)))
+}
+
+// Partitions returns the number of partitions
+func (p *Partitioned) Partitions() int {
+	return len(p.partitions)
+}
+
+// ReadChan returns the channel messages of all partitions are read from
+func (p *Partitioned) ReadChan() chan []byte {
+	return p.readChan
+}
+
+// Depth returns the number of messages across all partitions
+func (p *Partitioned) Depth() int64 {
+	var depth int64
+	for i := range p.partitions {
+		depth += p.PartitionDepth(i)
+	}
+	return depth
+}
+
+// PartitionDepth returns the number of messages in partition i
+func (p *Partitioned) PartitionDepth(i int) int64 {
+	part := p.partitions[i]
+	part.Lock()
+	defer part.Unlock()
+	return part.held + part.Depth()
+}
+
+// Close closes every partition
+func (p *Partitioned) Close() error {
+	return p.exit(Interface.Close)
+}
+
+// Delete deletes every partition
+func (p *Partitioned) Delete() error {
+	return p.exit(Interface.Delete)
+}
+
+func (p *Partitioned) exit(closePartition func(Interface) error) error {
+	var err error
+
+	close(p.exitChan)
+	p.exitWg.Wait()
+
+	for _, part := range p.partitions {
+		innerErr := closePartition(part.Interface)
+		if innerErr != nil {
+			err = innerErr
+		}
+	}
+	return err
+}
+
+// readLoop hands out the messages of a partition over readChan, committing
+// each once it has been received
+func (p *Partitioned) readLoop(part *partition) {
+	defer p.exitWg.Done()
+
+	for {
+		if part.Depth() == 0 {
+			select {
+			case <-part.wakeChan:
+				continue
+			case <-p.exitChan:
+				return
+			}
+		}
+
+		var data []byte
+		part.Lock()
+		select {
+		case data = <-part.ReadChan():
+		case <-p.exitChan:
+			part.Unlock()
+			return
+		}
+		// this also waits for the partition's depth to account for the read
+		position := part.Checkpoint()
+		part.held = 1
+		part.Unlock()
+
+		select {
+		case p.readChan <- data:
+		case <-p.exitChan:
+			return
+		}
+		part.Lock()
+		part.held = 0
+		part.Unlock()
+
+		err := part.Commit(position)
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package diskqueue
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Position identifies a message by the data file it is in and its
+// offset in that file
+//
+// a Position serializes to the same bytes as the token returned by
+// Checkpoint, so either can be restored with SeekTo or SeekCheckpoint
+type Position struct {
+	FileNum int64
+	Pos     int64
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (p Position) MarshalBinary() ([]byte, error) {
+	return encodeCheckpoint(p.FileNum, p.Pos), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (p *Position) UnmarshalBinary(data []byte) error {
+	fileNum, pos, err := decodeCheckpoint(data)
+	if err != nil {
+		return err
+	}
+	p.FileNum, p.Pos = fileNum, pos
+	return nil
+}
+
+// ReadPosition returns the position of the next message to be read, see
+// Checkpoint, or the zero Position once the queue has failed (see LastError)
+func (d *diskQueue) ReadPosition() Position {
+	var p Position
+	if p.UnmarshalBinary(d.Checkpoint()) != nil {
+		return Position{}
+	}
+	return p
+}
+
+// SeekTo repositions the reader at p, as returned by ReadPosition or
+// passed to Scan, see SeekCheckpoint
+func (d *diskQueue) SeekTo(p Position) error {
+	return d.SeekCheckpoint(encodeCheckpoint(p.FileNum, p.Pos))
+}
+
+type putPosResult struct {
+	p   Position
+	err error
+}
+
+// PutPosition is Put but also returns the position the message was
+// written at, which can be passed to SeekTo or kept in an external index,
+// the positions of successive messages only ever increase
+//
+// the message isn't grouped with other Puts, nor deduplicated (see
+// WithDedup)
+func (d *diskQueue) PutPosition(data []byte) (Position, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return Position{}, ErrExiting
+	}
+	if atomic.LoadInt32(&d.draining) == 1 {
+		return Position{}, ErrDraining
+	}
+
+	start := time.Now()
+	if d.writeGate != nil {
+		d.writeGate.enter()
+		defer d.writeGate.leave()
+	}
+	select {
+	case d.putPosChan <- data:
+	case <-d.closingChan:
+		return Position{}, ErrExiting
+	}
+	addTiming(&d.stats.putWaits, &d.stats.putWaitNanos, start)
+	res := <-d.putPosResponseChan
+	return res.p, res.err
+}
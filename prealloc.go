@@ -0,0 +1,39 @@
+package diskqueue
+
+import (
+	"errors"
+	"os"
+)
+
+var errPreallocateUnsupported = errors.New("preallocation is not supported on this platform")
+
+// preallocateWriteFile reserves the disk space of a full data file for the
+// newly created write file f without changing its size, so that readers
+// and recovery (see WithAppendWrites) still go by the size of what was
+// written, see WithPreallocate
+func (d *diskQueue) preallocateWriteFile(f *os.File) {
+	size := d.maxBytesOf(d.writeHeader)
+	err := preallocate(f, size)
+	if err == errPreallocateUnsupported {
+		d.log(WARN, "disabling preallocation", "err", err)
+		d.preallocate = false
+		return
+	}
+	if err != nil {
+		d.log(ERROR, "failed to preallocate", "file", f.Name(), "size", size, "err", err)
+	}
+}
+
+// releasePreallocated gives back the space preallocated for the data file
+// fileNum that wasn't written to, once the file is complete
+func (d *diskQueue) releasePreallocated(fileNum int64) {
+	fileName := d.fileName(fileNum)
+	stat, err := os.Stat(fileName)
+	if err == nil {
+		// truncating to the current size drops the blocks past it
+		err = os.Truncate(fileName, stat.Size())
+	}
+	if err != nil {
+		d.log(ERROR, "failed to truncate", "file", fileName, "err", err)
+	}
+}
@@ -0,0 +1,28 @@
+//go:build darwin
+// +build darwin
+
+package diskqueue
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+func preallocate(f *os.File, size int64) error {
+	// contiguous space if there is some, any otherwise
+	store := syscall.Fstore_t{
+		Flags:   syscall.F_ALLOCATECONTIG | syscall.F_ALLOCATEALL,
+		Posmode: syscall.F_PEOFPOSMODE,
+		Length:  size,
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_PREALLOCATE, uintptr(unsafe.Pointer(&store)))
+	if errno != 0 {
+		store.Flags = syscall.F_ALLOCATEALL
+		_, _, errno = syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_PREALLOCATE, uintptr(unsafe.Pointer(&store)))
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
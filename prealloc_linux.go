@@ -0,0 +1,20 @@
+//go:build linux
+// +build linux
+
+package diskqueue
+
+import (
+	"os"
+	"syscall"
+)
+
+const fallocKeepSize = 0x1 // FALLOC_FL_KEEP_SIZE
+
+func preallocate(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size)
+	if err == syscall.EOPNOTSUPP {
+		// e.g. tmpfs before Linux 3.5
+		return errPreallocateUnsupported
+	}
+	return err
+}
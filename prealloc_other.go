@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package diskqueue
+
+import (
+	"os"
+)
+
+func preallocate(f *os.File, size int64) error {
+	return errPreallocateUnsupported
+}
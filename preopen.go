@@ -0,0 +1,89 @@
+package diskqueue
+
+import (
+	"io"
+	"os"
+)
+
+// preopenThreshold is the fraction of maxBytesPerFile the reader has to be
+// past before the next data file is opened in the background
+const preopenThreshold = 0.9
+
+type preopenResult struct {
+	f      *os.File
+	header fileHeader
+	// the first bytes of the file, after which f is positioned
+	head []byte
+	err  error
+}
+
+// maybePreopen starts opening the data file after the current read file
+// once the reader nears the end of it, see WithReadPreopen
+func (d *diskQueue) maybePreopen() {
+	if !d.preopen || d.preopenChan != nil {
+		return
+	}
+	if float64(d.nextReadPos) <= float64(d.maxBytesOf(d.readHeader))*preopenThreshold {
+		return
+	}
+
+	fileNum := d.readFileNum + 1
+	if fileNum > d.writeFileNum || (fileNum == d.writeFileNum && d.writePos == 0) {
+		// not created yet
+		return
+	}
+
+	ch := make(chan preopenResult, 1)
+	d.preopenChan = ch
+	d.preopenFileNum = fileNum
+
+	fileName := d.fileName(fileNum)
+	readahead := d.preopenReadahead
+	go func() {
+		ch <- readAhead(fileName, readahead)
+	}()
+}
+
+// readAhead opens fileName and reads its header and the first readahead
+// bytes, so that the reader can start off from memory
+func readAhead(fileName string, readahead int64) preopenResult {
+	f, err := openReadFile(fileName)
+	if err != nil {
+		return preopenResult{err: err}
+	}
+	res := preopenResult{f: f}
+	res.header, res.err = readFileHeader(f)
+	if res.err == nil && readahead > 0 {
+		res.head = make([]byte, readahead)
+		// the file may not be written in full yet
+		n, err := io.ReadFull(f, res.head)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		res.head, res.err = res.head[:n], err
+	}
+	if res.err != nil {
+		f.Close()
+		res.f = nil
+	}
+	return res
+}
+
+// takePreopened returns what was opened in the background for fileNum, if
+// anything, discarding a handle opened for any other file
+func (d *diskQueue) takePreopened(fileNum int64) preopenResult {
+	if d.preopenChan == nil {
+		return preopenResult{}
+	}
+
+	res := <-d.preopenChan
+	d.preopenChan = nil
+	if res.err != nil {
+		return preopenResult{}
+	}
+	if d.preopenFileNum != fileNum {
+		res.f.Close()
+		return preopenResult{}
+	}
+	return res
+}
@@ -0,0 +1,184 @@
+package diskqueue
+
+import (
+	"fmt"
+	"sync"
+)
+
+// PriorityQueue is a set of queues, one per priority level, read through a
+// single channel that always serves the highest priority with messages
+//
+// each level has its own data files, level 0 uses the queue name as is so
+// an existing queue can be turned into the lowest priority level of a
+// PriorityQueue, level n uses name + ".prio" + n
+type PriorityQueue struct {
+	// guards held, so that a message moving from a level to
+	// readLoop is counted exactly once by Depth
+	sync.Mutex
+	held int64
+
+	levels   []Interface
+	readChan chan []byte
+	wakeChan chan int
+	exitChan chan int
+	exitWg   sync.WaitGroup
+}
+
+// NewPriorityQueue creates (or reopens) a PriorityQueue with the given
+// number of levels, opts apply to every level (see NewWithOptions)
+//
+// messages are delivered at least once, a message the PriorityQueue was
+// holding for delivery when it was closed is delivered again once reopened
+func NewPriorityQueue(name string, dataPath string, levels int, opts ...Option) (*PriorityQueue, error) {
+	if levels < 1 {
+		return nil, fmt.Errorf("invalid number of priority levels (%d)", levels)
+	}
+
+	p := &PriorityQueue{
+		readChan: make(chan []byte),
+		wakeChan: make(chan int, 1),
+		exitChan: make(chan int),
+	}
+	// only the message handed out on readChan is committed
+	opts = append(opts[:len(opts):len(opts)], WithManualCommit())
+	for i := 0; i < levels; i++ {
+		levelName := name
+		if i > 0 {
+			levelName = fmt.Sprintf("%s.prio%d", name, i)
+		}
+		dq, err := NewWithOptions(levelName, dataPath, opts...)
+		if err != nil {
+			for _, level := range p.levels {
+				level.Close()
+			}
+			return nil, err
+		}
+		p.levels = append(p.levels, dq)
+	}
+
+	p.exitWg.Add(1)
+	go p.readLoop()
+	return p, nil
+}
+
+// Put writes data at the lowest priority
+func (p *PriorityQueue) Put(data []byte) error {
+	return p.PutWithPriority(data, 0)
+}
+
+// PutWithPriority writes data at priority prio, higher values are read first
+func (p *PriorityQueue) PutWithPriority(data []byte, prio int) error {
+	if prio < 0 || prio >= len(p.levels) {
+		return fmt.Errorf("invalid priority (%d)", prio)
+	}
+	err := p.levels[prio].Put(data)
+	if err != nil {
+		return err
+	}
+	select {
+	case p.wakeChan <- 1:
+	default:
+	}
+	return nil
+}
+
+// ReadChan returns the channel messages of all levels are read from
+//
+// a message is picked from the highest priority level with messages once
+// the previous one has been received, so a higher priority message written
+// in the meantime is read right after it
+func (p *PriorityQueue) ReadChan() chan []byte {
+	return p.readChan
+}
+
+// Depth returns the number of messages across all levels
+func (p *PriorityQueue) Depth() int64 {
+	p.Lock()
+	defer p.Unlock()
+
+	depth := p.held
+	for _, level := range p.levels {
+		depth += level.Depth()
+	}
+	return depth
+}
+
+// Close closes every level
+func (p *PriorityQueue) Close() error {
+	return p.exit(Interface.Close)
+}
+
+// Delete deletes every level
+func (p *PriorityQueue) Delete() error {
+	return p.exit(Interface.Delete)
+}
+
+func (p *PriorityQueue) exit(closeLevel func(Interface) error) error {
+	var err error
+
+	close(p.exitChan)
+	p.exitWg.Wait()
+
+	for _, level := range p.levels {
+		innerErr := closeLevel(level)
+		if innerErr != nil {
+			err = innerErr
+		}
+	}
+	return err
+}
+
+// readLoop hands out the messages of the highest priority level with
+// messages over readChan, committing each once it has been received
+func (p *PriorityQueue) readLoop() {
+	defer p.exitWg.Done()
+
+	for {
+		level := p.nextLevel()
+		if level == nil {
+			select {
+			case <-p.wakeChan:
+				continue
+			case <-p.exitChan:
+				return
+			}
+		}
+
+		var data []byte
+		p.Lock()
+		select {
+		case data = <-level.ReadChan():
+		case <-p.exitChan:
+			p.Unlock()
+			return
+		}
+		// this also waits for the level's depth to account for the read
+		position := level.Checkpoint()
+		p.held = 1
+		p.Unlock()
+
+		select {
+		case p.readChan <- data:
+		case <-p.exitChan:
+			return
+		}
+		p.Lock()
+		p.held = 0
+		p.Unlock()
+
+		err := level.Commit(position)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// nextLevel returns the highest priority level with messages, if any
+func (p *PriorityQueue) nextLevel() Interface {
+	for i := len(p.levels) - 1; i >= 0; i-- {
+		if p.levels[i].Depth() > 0 {
+			return p.levels[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package diskqueue
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+type readBatchResult struct {
+	batch [][]byte
+	err   error
+}
+
+// readBatch returns first, the message pending delivery, along with the
+// messages following it that can be read right away, up to max in total,
+// advancing the read position past them
+func (d *diskQueue) readBatch(first []byte, max int) [][]byte {
+	// max is up to the caller, the batch can't hold more than depth (which
+	// counts first) though
+	size := max
+	if depth := atomic.LoadInt64(&d.depth); depth < int64(size) {
+		size = int(depth)
+	}
+	batch := append(make([][]byte, 0, size), first)
+	addTiming(&d.stats.readChanSends, &d.stats.readChanSendNanos, d.readReadyTime)
+	d.moveForward()
+
+	for len(batch) < max && (d.readFileNum < d.writeFileNum || d.readPos < d.writePos) {
+		data, ok := d.readNext()
+		if !ok {
+			// left for ioLoop to deal with
+			break
+		}
+		batch = append(batch, data)
+		d.moveForward()
+	}
+	return batch
+}
+
+// ReadBatch returns up to max messages, waiting at most wait for the first
+// one (returning an empty batch if none arrived), the read position is
+// only advanced past the messages returned
+func (d *diskQueue) ReadBatch(max int, wait time.Duration) ([][]byte, error) {
+	if max <= 0 {
+		return nil, fmt.Errorf("invalid batch size (%d)", max)
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+
+	select {
+	case d.readBatchChan <- max:
+	case <-t.C:
+		return nil, nil
+	case <-d.exitChan:
+		return nil, ErrExiting
+	}
+	res := <-d.readBatchResponseChan
+	return res.batch, res.err
+}
@@ -0,0 +1,74 @@
+package diskqueue
+
+// bufferedRead is where a message sent into the buffer of readChan was
+// read from, see WithReadBuffer
+type bufferedRead struct {
+	fileNum int64
+	pos     int64
+	// readSeq before it was read
+	seq int64
+}
+
+// bufferRead records where the message just sent over readChan was read
+// from, called from ioLoop before moveForward
+func (d *diskQueue) bufferRead() {
+	d.trimBufferedReads()
+	d.bufferedReads = append(d.bufferedReads, bufferedRead{d.readFileNum, d.readPos, d.readSeq})
+}
+
+// trimBufferedReads forgets the messages that have since been received
+// from readChan's buffer
+func (d *diskQueue) trimBufferedReads() {
+	received := len(d.bufferedReads) - len(d.readChan)
+	if received > 0 {
+		d.bufferedReads = d.bufferedReads[received:]
+	}
+}
+
+// drainReadBuffer takes back the messages left in readChan's buffer once
+// ioLoop has exited, so that they're committed as unread
+func (d *diskQueue) drainReadBuffer() {
+	d.trimBufferedReads()
+	n := 0
+	for len(d.readChan) > 0 {
+		select {
+		case <-d.readChan:
+			n++
+		default:
+		}
+	}
+	// those received in the meantime are read
+	if n < len(d.bufferedReads) {
+		d.bufferedReads = d.bufferedReads[len(d.bufferedReads)-n:]
+	}
+}
+
+// dropBufferedReads takes up to n of the messages left in readChan's
+// buffer, the oldest unread ones, back out of it, returning how many
+func (d *diskQueue) dropBufferedReads(n int64) int64 {
+	var dropped int64
+	for dropped < n && len(d.readChan) > 0 {
+		select {
+		case <-d.readChan:
+			dropped++
+		default:
+			// received in the meantime
+		}
+	}
+	// forgets those dropped along with those received
+	d.trimBufferedReads()
+	return dropped
+}
+
+// commitBufferedReads marks the messages read up to the oldest one still
+// in readChan's buffer as consumed, returning false if there's none
+func (d *diskQueue) commitBufferedReads() bool {
+	if len(d.bufferedReads) == 0 {
+		return false
+	}
+	b := d.bufferedReads[0]
+	d.removeReadFiles(b.fileNum)
+	d.commitReadPos = b.pos
+	d.uncommittedReads = d.readSeq - b.seq
+	return true
+}
@@ -0,0 +1,57 @@
+package diskqueue
+
+import "sync/atomic"
+
+// Envelope is a message read from ReadEnvelopeChan, whose buffer is handed
+// back for reuse by later reads once it has been released
+//
+// it starts out with a single reference, held by the receiver, Retain adds
+// one for each goroutine it's shared with and each of them calls Release
+// once done, Data must not be used after the last Release
+type Envelope struct {
+	Message
+
+	refs int32
+	pool *bufPool
+}
+
+// Retain adds a reference to e, to be released with Release
+func (e *Envelope) Retain() {
+	if atomic.AddInt32(&e.refs, 1) <= 1 {
+		panic("diskqueue: Envelope retained after being released")
+	}
+}
+
+// Release drops a reference to e, handing back its buffer once there's
+// none left
+func (e *Envelope) Release() {
+	refs := atomic.AddInt32(&e.refs, -1)
+	if refs < 0 {
+		panic("diskqueue: Envelope released more times than retained")
+	}
+	if refs == 0 {
+		e.pool.put(e.Data)
+	}
+}
+
+// ReadEnvelopeChan returns the channel for reading messages as Envelopes,
+// it can be used alongside ReadChan
+func (d *diskQueue) ReadEnvelopeChan() chan *Envelope {
+	if atomic.CompareAndSwapInt32(&d.envelopes, 0, 1) {
+		// for ioLoop to start offering envelopes
+		select {
+		case d.envelopesChan <- 1:
+		default:
+		}
+	}
+	return d.readEnvelopeChan
+}
+
+// newEnvelope returns the Envelope of the message pending delivery, data
+func (d *diskQueue) newEnvelope(data []byte) *Envelope {
+	return &Envelope{
+		Message: Message{Data: data, Timestamp: d.readTimestamp, Headers: d.readHeaders},
+		refs:    1,
+		pool:    &d.readBufPool,
+	}
+}
@@ -0,0 +1,107 @@
+package diskqueue
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sync/atomic"
+)
+
+// reconfigurable returns a queue holding only the settings of d that
+// Reconfigure can change, along with those they are validated against
+func (d *diskQueue) reconfigurable() *diskQueue {
+	return &diskQueue{
+		maxBytesPerFile: d.maxBytesPerFile,
+		minMsgSize:      d.minMsgSize,
+		maxMsgSize:      d.maxMsgSize,
+		syncPolicy:      d.syncPolicy,
+		blockSize:       d.blockSize,
+		maxBytes:        d.maxBytes,
+	}
+}
+
+// reconfigure applies opts to the running queue, see Reconfigure
+func (d *diskQueue) reconfigure(opts []Option) error {
+	c := d.reconfigurable()
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	// any other option leaves its mark on the rest of c
+	unchanged := d.reconfigurable()
+	unchanged.maxBytesPerFile = c.maxBytesPerFile
+	unchanged.minMsgSize, unchanged.maxMsgSize = c.minMsgSize, c.maxMsgSize
+	unchanged.syncPolicy = nil
+	unchanged.syncOptions = c.syncOptions
+	syncPolicy := c.syncPolicy
+	c.syncPolicy = nil
+	if !reflect.DeepEqual(c, unchanged) {
+		return errors.New("only maxBytesPerFile, the message size range and the sync policy can be reconfigured")
+	}
+	c.syncPolicy = syncPolicy
+
+	err := c.validateLimits()
+	if err != nil {
+		return err
+	}
+	if d.mmapWrites && c.maxMsgSize > d.maxMsgSize {
+		// the write file is mapped with room for one frame of up to maxMsgSize
+		return errors.New("maxMsgSize can't be raised with mmap writes")
+	}
+	if c.maxBytesPerFile != d.maxBytesPerFile {
+		err = d.checkFilesMaxBytes()
+		if err != nil {
+			return err
+		}
+	}
+
+	d.log(INFO, "reconfigured", "maxBytesPerFile", c.maxBytesPerFile,
+		"minMsgSize", c.minMsgSize, "maxMsgSize", c.maxMsgSize)
+	d.maxBytesPerFile = c.maxBytesPerFile
+	atomic.StoreInt32(&d.minMsgSize, c.minMsgSize)
+	atomic.StoreInt32(&d.maxMsgSize, c.maxMsgSize)
+	d.syncPolicy = c.syncPolicy
+	return nil
+}
+
+// checkFilesMaxBytes returns an error unless every data file records the
+// maxBytesPerFile it was created with, i.e. maxBytesPerFile can change
+func (d *diskQueue) checkFilesMaxBytes() error {
+	if d.fileFormat == fileFormatV1 {
+		return errors.New("maxBytesPerFile can only change with file format version 2")
+	}
+	for i := d.firstFileNum; i <= d.writeFileNum; i++ {
+		header, err := readFileHeaderOf(d.fileName(i))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if header.maxBytesPerFile == 0 {
+			return fmt.Errorf("maxBytesPerFile can't change while %s (format version %d) is in use",
+				d.fileName(i), header.version)
+		}
+	}
+	return nil
+}
+
+// Reconfigure changes the settings of the running queue, only
+// WithMaxBytesPerFile (applies to data files created from then on, in file
+// format version 2 only), WithMsgSize, WithSyncEvery, WithSyncTimeout and
+// WithSyncPolicy are accepted
+//
+// as with reopening the queue, lowering maxMsgSize makes messages already
+// written above it unreadable
+func (d *diskQueue) Reconfigure(opts ...Option) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+
+	d.reconfigureChan <- opts
+	return <-d.reconfigureResponseChan
+}
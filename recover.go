@@ -0,0 +1,101 @@
+package diskqueue
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// recoverFile writes the messages that can still be read from the data
+// file fileName to the queue, see Recover
+//
+// past a frame that can't be read every following position is tried as
+// the start of a frame, without trailers to check a frame found that way
+// is only trusted if the frame after it can be read as well
+func (d *diskQueue) recoverFile(fileName string) (int64, error) {
+	for i := d.firstFileNum; i <= d.writeFileNum; i++ {
+		if filepath.Clean(fileName) == filepath.Clean(d.fileName(i)) {
+			return 0, fmt.Errorf("%s is in use by the queue", fileName)
+		}
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	header, err := readFileHeader(f)
+	if err != nil {
+		return 0, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	end := stat.Size()
+
+	var msgs []Message
+	var skipped int64
+	inSync := true
+	for pos := int64(0); pos < end && pos <= d.maxBytesOf(header); {
+		frame, size, err := d.readFrameAt(f, pos, header)
+		if err == nil && !inSync && !d.frameTrailer {
+			next := pos + size
+			if next < end && next <= d.maxBytesOf(header) {
+				_, _, err = d.readFrameAt(f, next, header)
+			}
+		}
+		if err != nil {
+			inSync = false
+			skipped++
+			if pos == 0 && header.size > 0 {
+				pos = header.size
+			} else {
+				pos++
+			}
+			continue
+		}
+		inSync = true
+		msgs = append(msgs, frame...)
+		pos += size
+	}
+
+	if skipped > 0 {
+		d.log(WARN, "skipped unreadable positions", "file", fileName, "count", skipped)
+	}
+	var n int64
+	for _, m := range msgs {
+		err = d.writeMessage(m)
+		if err != nil {
+			return n, err
+		}
+		n++
+		d.writesSinceSync++
+	}
+	d.log(INFO, "recovered messages", "file", fileName, "count", n)
+	return n, nil
+}
+
+// Recover writes every message that can still be read from badFile, a
+// data file renamed to .bad after it failed to read, to the end of the
+// queue, returning how many were written
+//
+// data that doesn't make sense is skipped rather than giving up on the
+// rest of the file, messages of the file that were read before it turned
+// out to be bad are written again as well, badFile is left in place
+func (d *diskQueue) Recover(badFile string) (int64, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return 0, ErrExiting
+	}
+	if atomic.LoadInt32(&d.draining) == 1 {
+		return 0, ErrDraining
+	}
+
+	d.recoverChan <- badFile
+	res := <-d.trimResponseChan
+	return res.n, res.err
+}
@@ -0,0 +1,114 @@
+package diskqueue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// with WithFileRecycling data files that have been read are truncated and
+// kept as spares, which are renamed into place as the next write file
+// rather than a new one being created, they're named:
+//
+//	<name>.diskqueue.spare.<n>.dat
+
+func (d *diskQueue) spareFileName(n int64) string {
+	return fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.spare.%06d.dat"), d.name, n)
+}
+
+// loadSpareFiles picks up the spare files left behind by a previous run,
+// removing those beyond the number to keep
+func (d *diskQueue) loadSpareFiles() error {
+	files, err := ioutil.ReadDir(d.dataPath)
+	if err != nil {
+		return err
+	}
+	prefix := d.name + ".diskqueue.spare."
+	d.spareFiles = nil
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".dat") {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".dat"), 10, 64)
+		if err != nil {
+			continue
+		}
+		fileName := path.Join(d.dataPath, name)
+		if len(d.spareFiles) >= d.recycleFiles {
+			err = removeFile(fileName)
+		} else if fi.Size() > 0 {
+			err = os.Truncate(fileName, 0)
+		}
+		if err != nil {
+			return err
+		}
+		if len(d.spareFiles) < d.recycleFiles {
+			d.spareFiles = append(d.spareFiles, fileName)
+		}
+		if n >= d.nextSpare {
+			d.nextSpare = n + 1
+		}
+	}
+	return nil
+}
+
+// recycleDataFile keeps the data file fileName, which has been read, as a
+// spare if there's room for another one and removes it otherwise
+func (d *diskQueue) recycleDataFile(fileName string) error {
+	if len(d.spareFiles) >= d.recycleFiles {
+		return d.removeDataFile(fileName)
+	}
+
+	// truncated first so that a spare never holds any messages
+	spare := d.spareFileName(d.nextSpare)
+	err := os.Truncate(fileName, 0)
+	if os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		err = renameFile(fileName, spare)
+	}
+	if err != nil {
+		d.log(ERROR, "failed to recycle", "file", fileName, "err", err)
+		return d.removeDataFile(fileName)
+	}
+	d.removeDataFileCopies(fileName)
+	d.fileHook(d.onFileDelete, fileName)
+	d.nextSpare++
+	d.spareFiles = append(d.spareFiles, spare)
+
+	if d.preallocate {
+		f, err := os.OpenFile(spare, os.O_RDWR, 0600)
+		if err == nil {
+			err = preallocate(f, d.maxBytesOf(d.newFileHeader()))
+			f.Close()
+		}
+		if err != nil && err != errPreallocateUnsupported {
+			d.log(ERROR, "failed to preallocate", "file", spare, "err", err)
+		}
+	}
+	return nil
+}
+
+// takeSpareFile renames a spare file into place as the new write file
+// fileName, unless it already exists
+func (d *diskQueue) takeSpareFile(fileName string) {
+	if len(d.spareFiles) == 0 {
+		return
+	}
+	_, err := os.Stat(fileName)
+	if !os.IsNotExist(err) {
+		return
+	}
+
+	spare := d.spareFiles[len(d.spareFiles)-1]
+	d.spareFiles = d.spareFiles[:len(d.spareFiles)-1]
+	err = renameFile(spare, fileName)
+	if err != nil {
+		d.log(ERROR, "failed to reuse spare file", "file", spare, "err", err)
+	}
+}
@@ -0,0 +1,155 @@
+package diskqueue
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"time"
+)
+
+// retainedFrom returns the oldest of the data files preceding end, which
+// have been read in full, to keep for replay, see WithReplayRetention
+func (d *diskQueue) retainedFrom(end int64) int64 {
+	var size int64
+	for fileNum := end - 1; fileNum >= d.firstFileNum; fileNum-- {
+		stat, err := os.Stat(d.fileName(fileNum))
+		if err != nil {
+			// e.g. renamed as bad, nothing before it can be replayed
+			return fileNum + 1
+		}
+		size += stat.Size()
+		if (d.retainBytes > 0 && size > d.retainBytes) ||
+			(d.retainAge > 0 && time.Since(stat.ModTime()) > d.retainAge) {
+			return fileNum + 1
+		}
+	}
+	return d.firstFileNum
+}
+
+// rewind moves the read position back by up to n messages, see Rewind
+func (d *diskQueue) rewind(n int64) (int64, error) {
+	if n < 0 {
+		return 0, fmt.Errorf("invalid rewind count (%d)", n)
+	}
+
+	// the message pending delivery (if any) is read again
+	d.rewindRead()
+
+	behind, err := d.framesBetween(d.firstFileNum, 0, d.readFileNum, d.readPos)
+	if err != nil {
+		return 0, err
+	}
+	if n > behind {
+		n = behind
+	}
+	p, skipped, err := d.skipFrames(d.firstFileNum, 0, behind-n)
+	if err != nil {
+		return 0, err
+	}
+	err = d.seekTo(p.FileNum, p.Pos)
+	if err != nil {
+		return 0, err
+	}
+	return behind - skipped, nil
+}
+
+// skipFrames walks the frames from pos in fileNum up to the write
+// position, stopping before the frame that would take the number of
+// messages walked past max, returning where it stopped and that number
+func (d *diskQueue) skipFrames(fileNum int64, pos int64, max int64) (Position, int64, error) {
+	var skipped int64
+
+	for skipped < max && (fileNum < d.writeFileNum || pos < d.writePos) {
+		if d.segmentFooters && fileNum < d.writeFileNum && pos == 0 {
+			footer, ok := d.readSegmentFooter(d.fileName(fileNum))
+			if ok && skipped+footer.count <= max {
+				skipped += footer.count
+				fileNum++
+				continue
+			}
+		}
+
+		if d.indexEvery > 0 {
+			next, n, err := d.indexedSkip(fileNum, pos, max-skipped)
+			if err != nil {
+				return Position{}, 0, err
+			}
+			pos, skipped = next, skipped+n
+		}
+
+		f, err := os.OpenFile(d.fileName(fileNum), os.O_RDONLY, 0600)
+		if err != nil {
+			return Position{}, 0, err
+		}
+		header, err := readFileHeader(f)
+		if err == nil {
+			_, err = f.Seek(pos, 0)
+		}
+		if err != nil {
+			f.Close()
+			return Position{}, 0, err
+		}
+		reader := bufio.NewReader(f)
+
+		for skipped < max && (fileNum < d.writeFileNum || pos < d.writePos) {
+			padding, msgSize, flags, err := d.readFrameStart(reader, pos, header)
+			if fileEnded(err, fileNum, d.writeFileNum) {
+				pos = d.maxBytesOf(header) + 1
+				break
+			}
+			frameSize := padding + int64(msgSize) + d.frameOverhead(header.version, msgSize)
+			msgs := int64(1)
+			if err == nil && flags&frameFlagTxn != 0 {
+				var txnHeader []byte
+				txnHeader, err = reader.Peek(txnHeaderSize)
+				if err == nil {
+					msgs, err = txnCount(txnHeader)
+				}
+			}
+			if err == nil && skipped+msgs > max {
+				f.Close()
+				return Position{fileNum, pos}, skipped, nil
+			}
+			if err == nil {
+				_, err = reader.Discard(int(frameSize - padding - frameHeaderLen(header.version, msgSize)))
+			}
+			if err != nil {
+				f.Close()
+				return Position{}, 0, fmt.Errorf("failed to skip message at %d of %s - %s",
+					pos, d.fileName(fileNum), err)
+			}
+			skipped += msgs
+			pos += frameSize
+			if pos > d.maxBytesOf(header) {
+				break
+			}
+		}
+		f.Close()
+
+		if pos > d.maxBytesOf(header) {
+			fileNum++
+			pos = 0
+		}
+	}
+
+	return Position{fileNum, pos}, skipped, nil
+}
+
+// Rewind moves the read position back by n messages so that they are
+// delivered again, returning by how many it moved, which is fewer if the
+// data files holding them have been removed, see WithReplayRetention
+//
+// the messages of a transaction (see PutTransaction) are only replayed
+// together, so it may move back by more than n
+func (d *diskQueue) Rewind(n int64) (int64, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return 0, ErrExiting
+	}
+
+	d.rewindChan <- n
+	res := <-d.trimResponseChan
+	return res.n, res.err
+}
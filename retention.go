@@ -0,0 +1,116 @@
+package diskqueue
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+type trimResult struct {
+	n   int64
+	err error
+}
+
+// trimBefore drops the messages written before t from the read side of the
+// queue, returning how many were dropped
+//
+// messages without an envelope are dated by the mtime of their data file,
+// which is never earlier than when they were written, so whole data files
+// last modified before t are skipped without reading them
+func (d *diskQueue) trimBefore(t time.Time) (int64, error) {
+	if d.writeFile != nil {
+		d.flushPending()
+	}
+
+	// forget the message pending delivery (if any), it is read again
+	// below or by ioLoop
+	d.rewindRead()
+
+	depth := atomic.LoadInt64(&d.depth)
+
+	// the write file's mtime can lag behind its content (see WithMmapWrites)
+	fileNum := d.readFileNum
+	for fileNum < d.writeFileNum {
+		mtime, err := d.fileModTime(fileNum)
+		if err != nil || !mtime.Before(t) {
+			break
+		}
+		fileNum++
+	}
+	if fileNum > d.readFileNum {
+		err := d.seekTo(fileNum, 0)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := depth - atomic.LoadInt64(&d.depth)
+
+	mtimeFileNum := int64(-1)
+	var mtime time.Time
+	for (d.readFileNum < d.writeFileNum) || (d.readPos < d.writePos) {
+		_, err := d.readOne()
+		if err == errFileEnd {
+			d.skipFileEnd()
+			continue
+		}
+		if err != nil {
+			d.log(ERROR, "failed to read message", "file", d.fileName(d.readFileNum), "pos", d.readPos, "err", err)
+			d.handleCorruption(err)
+			continue
+		}
+
+		written := d.readTimestamp
+		if written.IsZero() && d.mmapWrites && d.readFileNum == d.writeFileNum {
+			break
+		}
+		if written.IsZero() {
+			if mtimeFileNum != d.readFileNum {
+				mtime, err = d.fileModTime(d.readFileNum)
+				if err != nil {
+					break
+				}
+				mtimeFileNum = d.readFileNum
+			}
+			written = mtime
+		}
+		if !written.Before(t) {
+			break
+		}
+
+		d.dropRead = false
+		d.moveForward()
+		n++
+	}
+	d.rewindRead()
+
+	if n > 0 {
+		// dropped messages are consumed even in manual commit mode
+		d.commitReads()
+		d.needSync = true
+	}
+	return n, nil
+}
+
+// rewindRead discards a message read by readOne but not yet delivered
+func (d *diskQueue) rewindRead() {
+	// messages of a transaction already delivered are delivered again
+	d.readTxn = pendingTxn{}
+	if d.nextReadFileNum == d.readFileNum && d.nextReadPos == d.readPos {
+		return
+	}
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
+	}
+	d.nextReadFileNum = d.readFileNum
+	d.nextReadPos = d.readPos
+	d.dropRead = false
+}
+
+func (d *diskQueue) fileModTime(fileNum int64) (time.Time, error) {
+	stat, err := os.Stat(d.fileName(fileNum))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return stat.ModTime(), nil
+}
@@ -0,0 +1,110 @@
+package diskqueue
+
+import (
+	"fmt"
+)
+
+// scanBatchSize is the number of messages ioLoop reads for Scan (and
+// Export) at a time
+const scanBatchSize = 128
+
+type scanRequest struct {
+	fromRead  bool // start at the read position rather than the committed one
+	c         *cursor
+	end       Position
+	batch     []Message
+	positions []Position
+	release   bool // stop scanning early
+	done      bool
+}
+
+// scanBatch reads the next batch of messages for Scan, the messages are
+// read with a transient cursor so that their data files are kept until
+// the scan is done
+func (d *diskQueue) scanBatch(req *scanRequest) error {
+	req.batch = req.batch[:0]
+	req.positions = req.positions[:0]
+	if req.c == nil {
+		if req.release {
+			req.done = true
+			return nil
+		}
+		if d.writeFile != nil {
+			d.flushPending()
+		}
+		// cursor names can't contain spaces
+		req.c = &cursor{
+			d:         d,
+			name:      fmt.Sprintf("scan %p", req),
+			fileNum:   d.commitReadFileNum,
+			pos:       d.commitReadPos,
+			transient: true,
+		}
+		if req.fromRead {
+			req.c.fileNum = d.readFileNum
+			req.c.pos = d.readPos
+		}
+		req.c.resetRead()
+		d.cursors[req.c.name] = req.c
+		req.end = Position{d.writeFileNum, d.writePos}
+	}
+
+	var err error
+	c := req.c
+	for !req.release && len(req.batch) < scanBatchSize {
+		if c.fileNum > req.end.FileNum || (c.fileNum == req.end.FileNum && c.pos >= req.end.Pos) {
+			break
+		}
+		var m Message
+		m, err = d.cursorReadOne(c)
+		if err != nil {
+			break
+		}
+		req.batch = append(req.batch, m)
+		req.positions = append(req.positions, Position{c.fileNum, c.pos})
+		c.fileNum = c.nextFileNum
+		c.pos = c.nextPos
+	}
+	if err == nil && len(req.batch) == scanBatchSize {
+		return nil
+	}
+
+	c.resetRead()
+	delete(d.cursors, c.name)
+	d.removeFiles()
+	req.done = true
+	return err
+}
+
+func (d *diskQueue) nextScanBatch(req *scanRequest) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+
+	d.scanChan <- req
+	return <-d.scanResponseChan
+}
+
+// Scan calls fn with every unread message, in order, without consuming
+// them, until fn returns false
+//
+// messages written while scanning are not included, fn may keep data
+func (d *diskQueue) Scan(fn func(pos Position, data []byte) bool) error {
+	req := &scanRequest{fromRead: true}
+	for !req.done {
+		err := d.nextScanBatch(req)
+		if err != nil {
+			return err
+		}
+		for i, m := range req.batch {
+			if !fn(req.positions[i], m.Data) {
+				req.release = true
+				return d.nextScanBatch(req)
+			}
+		}
+	}
+	return nil
+}
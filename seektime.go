@@ -0,0 +1,197 @@
+package diskqueue
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// seekToTime moves the read position to the first message written at or
+// after t, see SeekToTime
+//
+// the data file holding it is found by a binary search on the date of
+// the first message in each file, so only a few of them are read
+func (d *diskQueue) seekToTime(t time.Time) error {
+	if d.writeFile != nil {
+		d.flushPending()
+	}
+
+	// a file only holds messages older than t if the next one starts
+	// before t
+	first := d.firstFileNum
+	var searchErr error
+	n := sort.Search(int(d.writeFileNum-first), func(i int) bool {
+		var written time.Time
+		ok, err := d.walkDates(first+int64(i)+1, 0, func(_ int64, w time.Time) bool {
+			written = w
+			return false
+		})
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		return !ok || !written.Before(t)
+	})
+	if searchErr != nil {
+		return searchErr
+	}
+	fileNum := first + int64(n)
+
+	pos := int64(-1)
+	start := int64(0)
+	if d.indexEvery > 0 {
+		start = d.indexedBefore(fileNum, t)
+	}
+	_, err := d.walkDates(fileNum, start, func(p int64, written time.Time) bool {
+		if written.Before(t) {
+			return true
+		}
+		pos = p
+		return false
+	})
+	if err != nil {
+		return err
+	}
+	if fileNum < d.writeFileNum && pos < 0 {
+		fileNum, pos = fileNum+1, 0
+	} else if pos < 0 {
+		pos = d.writePos
+	}
+	return d.seekTo(fileNum, pos)
+}
+
+// walkDates calls fn with the position and date of each frame in fileNum
+// from pos on until it returns false, returning whether there were any
+//
+// as with TrimBefore, messages without an envelope are dated by the mtime
+// of their data file, which is never earlier than when they were written
+func (d *diskQueue) walkDates(fileNum int64, pos int64, fn func(pos int64, written time.Time) bool) (bool, error) {
+	mtime, err := d.fileModTime(fileNum)
+	if err != nil {
+		return false, err
+	}
+
+	var found bool
+	err = d.walkMessages(fileNum, pos, func(pos int64, _ Position, msgs []Message) bool {
+		found = true
+		// the messages of a transaction are written together
+		written := msgs[0].Timestamp
+		if written.IsZero() && d.mmapWrites && fileNum == d.writeFileNum {
+			// the write file's mtime can lag behind its content
+			written = time.Now()
+		} else if written.IsZero() {
+			written = mtime
+		}
+		return fn(pos, written)
+	})
+	return found, err
+}
+
+// walkMessages calls fn with the position of each frame in fileNum from
+// pos on, the position of the frame following it (which may be at the
+// start of the next file) and its messages until it returns false or the
+// end of the file (or the write position) is reached
+func (d *diskQueue) walkMessages(fileNum int64, pos int64, fn func(pos int64, next Position, msgs []Message) bool) error {
+	return d.walkMessagesTo(fileNum, pos, Position{d.writeFileNum, d.writePos}, fn)
+}
+
+// walkMessagesTo is walkMessages up to end rather than the write position
+func (d *diskQueue) walkMessagesTo(fileNum int64, pos int64, end Position, fn func(pos int64, next Position, msgs []Message) bool) error {
+	f, err := os.Open(d.fileName(fileNum))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	header, err := readFileHeader(f)
+	if err == nil {
+		_, err = f.Seek(pos, 0)
+	}
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(f)
+
+	for fileNum < end.FileNum || pos < end.Pos {
+		padding, msgSize, flags, err := d.readFrameStart(reader, pos, header)
+		if fileEnded(err, fileNum, end.FileNum) {
+			break
+		}
+		data := make([]byte, msgSize)
+		if err == nil {
+			_, err = io.ReadFull(reader, data)
+		}
+		if err == nil && d.frameTrailer {
+			var trailer [frameTrailerSize]byte
+			_, err = io.ReadFull(reader, trailer[:])
+			if err == nil {
+				err = checkFrameTrailer(trailer[:], data)
+			}
+		}
+		var msgs []Message
+		if err == nil {
+			msgs, err = d.decodeFrameMessages(data, flags)
+		}
+		if err != nil {
+			return &CorruptionError{Corruption{d.fileName(fileNum), pos, err, err == errChecksumMismatch}}
+		}
+
+		next := Position{fileNum, pos + padding + int64(msgSize) + d.frameOverhead(header.version, msgSize)}
+		if next.Pos > d.maxBytesOf(header) {
+			next = Position{fileNum + 1, 0}
+		}
+		if !fn(pos, next, msgs) || next.FileNum != fileNum {
+			break
+		}
+		pos = next.Pos
+	}
+	return nil
+}
+
+// walkFrames calls fn with the position of each frame from from up to end,
+// that of the frame following it and its messages, going from one data
+// file to the next, until fn returns false, it returns the position of the
+// frame fn returned false for, or end
+func (d *diskQueue) walkFrames(from Position, end Position, fn func(pos Position, next Position, msgs []Message) bool) (Position, error) {
+	p := from
+	for p.FileNum < end.FileNum || p.Pos < end.Pos {
+		walked := p.FileNum
+		stop := false
+		err := d.walkMessagesTo(walked, p.Pos, end, func(pos int64, next Position, msgs []Message) bool {
+			if !fn(Position{walked, pos}, next, msgs) {
+				stop = true
+				return false
+			}
+			p = next
+			return true
+		})
+		if err != nil || stop {
+			return p, err
+		}
+		if p.FileNum == walked && walked < end.FileNum {
+			// a file that was abandoned before reaching maxBytesPerFile
+			p = Position{walked + 1, 0}
+		}
+	}
+	return p, nil
+}
+
+// SeekToTime repositions the reader at the first message written at or
+// after t, or at the end of the queue if there is none
+//
+// messages written with PutMessage are dated by their timestamp, any other
+// by the last modification of their data file, dates are assumed not to
+// decrease through the queue, only messages that have not been removed
+// from disk can be sought back to
+func (d *diskQueue) SeekToTime(t time.Time) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+
+	d.seekTimeChan <- t
+	return <-d.seekResponseChan
+}
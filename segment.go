@@ -0,0 +1,163 @@
+package diskqueue
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// with WithSegmentFooters each data file is closed off when it rolls with:
+//
+//	[8-byte message count][8-byte span][4-byte CRC32-C][4-byte magic]
+//
+// where span is the number of bytes of frames (and padding) preceding the
+// footer and the CRC covers all of them, readers never get this far since
+// they roll as soon as they pass maxBytesPerFile and the footer is written
+// after that point, files rolled before reaching it (by WithRotateCount or
+// WithRotateInterval) end with an end marker instead, see frame.go
+//
+// footers written by earlier versions have no CRC and use segmentFooterMagicV1
+
+const (
+	segmentFooterSize    = 24
+	segmentFooterMagic   = 0x44514632 // "DQF2"
+	segmentFooterSizeV1  = 20
+	segmentFooterMagicV1 = 0x44514631 // "DQF1"
+)
+
+type segmentFooter struct {
+	count  int64
+	span   int64
+	crc    uint32
+	hasCRC bool
+}
+
+// segmentHash accumulates the running CRC of the current write file
+type segmentHash struct {
+	d *diskQueue
+}
+
+func (h segmentHash) Write(b []byte) (int, error) {
+	h.d.addSegmentCRC(b)
+	return len(b), nil
+}
+
+func (d *diskQueue) addSegmentCRC(b []byte) {
+	if d.segmentFooters {
+		d.writeFileCRC = crc32.Update(d.writeFileCRC, crc32cTable, b)
+	}
+}
+
+// writeSegmentFooter appends the footer for the current write file, it
+// must be called once writePos has passed maxBytesPerFile and before rolling
+func (d *diskQueue) writeSegmentFooter() error {
+	var b [segmentFooterSize]byte
+
+	err := d.flushPending()
+	if err != nil {
+		return err
+	}
+	if d.writeFile == nil {
+		return nil
+	}
+
+	binary.BigEndian.PutUint64(b[0:8], uint64(d.writeFileCount))
+	binary.BigEndian.PutUint64(b[8:16], uint64(d.writePos))
+	binary.BigEndian.PutUint32(b[16:20], d.writeFileCRC)
+	binary.BigEndian.PutUint32(b[20:24], segmentFooterMagic)
+	_, err = d.writeFile.Write(b[:])
+	return err
+}
+
+// readSegmentFooter returns the footer of a data file, ok is false if
+// the file doesn't end with a valid footer
+func (d *diskQueue) readSegmentFooter(fileName string) (segmentFooter, bool) {
+	var b [segmentFooterSize]byte
+	var footer segmentFooter
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return footer, false
+	}
+	defer f.Close()
+
+	// a footer always follows at least one frame so the file is
+	// larger than the biggest footer
+	stat, err := f.Stat()
+	if err != nil || stat.Size() <= segmentFooterSize {
+		return footer, false
+	}
+	_, err = f.ReadAt(b[:], stat.Size()-segmentFooterSize)
+	if err != nil {
+		return footer, false
+	}
+
+	var size int64
+	switch binary.BigEndian.Uint32(b[segmentFooterSize-4:]) {
+	case segmentFooterMagic:
+		size = segmentFooterSize
+		footer.crc = binary.BigEndian.Uint32(b[16:20])
+		footer.hasCRC = true
+	case segmentFooterMagicV1:
+		size = segmentFooterSizeV1
+		copy(b[:], b[segmentFooterSize-segmentFooterSizeV1:])
+	default:
+		return footer, false
+	}
+
+	header, err := readFileHeader(f)
+	if err != nil {
+		return footer, false
+	}
+
+	footer.count = int64(binary.BigEndian.Uint64(b[0:8]))
+	footer.span = int64(binary.BigEndian.Uint64(b[8:16]))
+	if footer.count < 0 || footer.span <= d.maxBytesOf(header) ||
+		footer.span != stat.Size()-size {
+		return footer, false
+	}
+	return footer, true
+}
+
+// segmentCRC returns the CRC32-C of the first span bytes of a data file
+func segmentCRC(fileName string, span int64) (uint32, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	h := crc32.New(crc32cTable)
+	_, err = io.CopyN(h, bufio.NewReader(f), span)
+	if err == io.EOF {
+		return 0, fmt.Errorf("%s is truncated", fileName)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
+
+// checkSegment validates a rolled data file against its footer in a single
+// sequential pass
+func (d *diskQueue) checkSegment(fileName string) error {
+	footer, ok := d.readSegmentFooter(fileName)
+	if !ok {
+		return fmt.Errorf("%s has no valid segment footer", fileName)
+	}
+	if !footer.hasCRC {
+		return nil
+	}
+	crc, err := segmentCRC(fileName, footer.span)
+	if err != nil {
+		return err
+	}
+	if crc != footer.crc {
+		return errors.New("segment checksum mismatch in " + fileName)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package diskqueue
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// skip moves the read position forward by up to n messages, see Skip
+func (d *diskQueue) skip(n int64) (int64, error) {
+	if n < 0 {
+		return 0, fmt.Errorf("invalid skip count (%d)", n)
+	}
+	if d.writeFile != nil {
+		d.flushPending()
+	}
+
+	// the message pending delivery (if any) is skipped as well
+	d.rewindRead()
+
+	// the messages in readChan's buffer come first
+	var dropped int64
+	if d.readBufferSize > 0 {
+		dropped = d.dropBufferedReads(n)
+	}
+
+	p, skipped, err := d.skipFrames(d.readFileNum, d.readPos, n-dropped)
+	if err == nil && skipped > 0 {
+		d.skipReadTo(p.FileNum, p.Pos, skipped)
+	} else if dropped > 0 {
+		d.commitReads()
+		d.needSync = true
+	}
+	if err != nil {
+		return dropped, err
+	}
+	return dropped + skipped, nil
+}
+
+// trimToDepth drops the oldest messages until there are no more than max,
+// see TrimToDepth
+func (d *diskQueue) trimToDepth(max int64) (int64, error) {
+	if max < 0 {
+		return 0, fmt.Errorf("invalid depth (%d)", max)
+	}
+	// the message pending delivery (if any) counts, skip drops it first,
+	// along with those in readChan's buffer which Depth doesn't count
+	n := atomic.LoadInt64(&d.depth) - max
+	if d.readBufferSize > 0 {
+		d.trimBufferedReads()
+		n += int64(len(d.bufferedReads))
+	}
+	if n <= 0 {
+		return 0, nil
+	}
+	return d.skip(n)
+}
+
+// emptyTo drops the unread messages before p, see EmptyTo
+func (d *diskQueue) emptyTo(p Position) error {
+	if d.writeFile != nil {
+		d.flushPending()
+	}
+	// the message pending delivery (if any) is dropped as well
+	d.rewindRead()
+
+	if p.FileNum < d.readFileNum || (p.FileNum == d.readFileNum && p.Pos < d.readPos) ||
+		p.FileNum > d.writeFileNum || (p.FileNum == d.writeFileNum && p.Pos > d.writePos) {
+		return fmt.Errorf("position %d:%d out of range (%d:%d - %d:%d)",
+			p.FileNum, p.Pos, d.readFileNum, d.readPos, d.writeFileNum, d.writePos)
+	}
+	err := d.checkFrameStart(p.FileNum, p.Pos)
+	if err != nil {
+		return err
+	}
+	n, err := d.framesBetween(d.readFileNum, d.readPos, p.FileNum, p.Pos)
+	if err != nil {
+		return err
+	}
+	d.skipReadTo(p.FileNum, p.Pos, n)
+	return nil
+}
+
+// skipReadTo moves the read position forward to pos in fileNum, past n
+// messages that are dropped unread
+func (d *diskQueue) skipReadTo(fileNum int64, pos int64, n int64) {
+	d.rewindRead()
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
+	}
+	d.readFileNum = fileNum
+	d.readPos = pos
+	d.nextReadFileNum = fileNum
+	d.nextReadPos = pos
+	d.bufferedReads = nil
+	atomic.AddInt64(&d.depth, -n)
+	atomic.StoreInt64(&d.depthBytes, d.unreadBytes(fileNum, pos))
+	d.commitReads()
+	d.needSync = true
+}
+
+// Skip drops up to n messages from the read side of the queue without
+// reading them, removing the data files skipped in full, returning how
+// many were dropped
+//
+// skipped messages are consumed even with WithManualCommit, a transaction
+// (see PutTransaction) is only skipped as a whole, so fewer than n messages
+// may be dropped even if there are more
+func (d *diskQueue) Skip(n int64) (int64, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return 0, ErrExiting
+	}
+
+	d.skipChan <- n
+	res := <-d.trimResponseChan
+	return res.n, res.err
+}
+
+// TrimToDepth drops the oldest unread messages until the queue's depth is
+// no more than max, removing the data files dropped in full, returning how
+// many were dropped, for queues of which only the latest messages matter
+//
+// as with Skip, the messages are consumed even with WithManualCommit and a
+// transaction (see PutTransaction) is only dropped as a whole, so more than
+// max messages may be left
+func (d *diskQueue) TrimToDepth(max int64) (int64, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return 0, ErrExiting
+	}
+
+	d.trimDepthChan <- max
+	res := <-d.trimResponseChan
+	return res.n, res.err
+}
+
+// EmptyTo drops the unread messages before p, as returned by ReadPosition
+// or PutPosition or passed to Scan, removing the data files skipped in
+// full, a middle ground between Empty and reading messages only to discard
+// them
+//
+// p must be the start of a message (or the write position) not before the
+// read position, the messages dropped are consumed even with
+// WithManualCommit
+func (d *diskQueue) EmptyTo(p Position) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+
+	d.emptyToChan <- p
+	return <-d.seekResponseChan
+}
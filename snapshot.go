@@ -0,0 +1,106 @@
+package diskqueue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// snapshot copies the queue's files as they are now to dir, data files
+// that have been rolled are immutable and so are hardlinked if possible
+func (d *diskQueue) snapshot(dir string) error {
+	if path.Clean(dir) == path.Clean(d.dataPath) {
+		return fmt.Errorf("can't snapshot %s into its own dataPath", d.name)
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	metaFileName := path.Join(dir, path.Base(d.metaDataFileName()))
+	_, err = os.Stat(metaFileName)
+	if err == nil {
+		return fmt.Errorf("%s already holds a snapshot of %s", dir, d.name)
+	}
+
+	// get everything accepted so far on disk, the metadata written
+	// below must not refer to data the copies don't have
+	if d.writeFile != nil {
+		d.flushPending()
+	}
+	err = d.sync()
+	if err != nil {
+		return err
+	}
+
+	for i := d.firstFileNum; i <= d.writeFileNum; i++ {
+		fileName := d.fileName(i)
+		dst := path.Join(dir, path.Base(fileName))
+		if i == d.writeFileNum {
+			if d.writePos == 0 {
+				break
+			}
+			// still being appended to
+			err = copyFile(fileName, dst, d.writePos)
+		} else {
+			err = os.Link(fileName, dst)
+			if err != nil {
+				err = copyFile(fileName, dst, d.fileSize(i))
+			}
+		}
+		// bad files have already been renamed
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if len(d.delayed) > 0 {
+		fileName := d.delayedFileName()
+		err = copyFile(fileName, path.Join(dir, path.Base(fileName)), fileSizeOf(fileName))
+		if err != nil {
+			return err
+		}
+	}
+
+	// written last, a snapshot is only complete once it has metadata
+	return d.writeMetaData(metaFileName, true)
+}
+
+// RestoreFromSnapshot copies the snapshot of the queue name held in
+// snapshotDir (see Snapshot) to dataPath, where it can then be opened as
+// usual, the queue must not already exist in dataPath
+func RestoreFromSnapshot(name string, snapshotDir string, dataPath string) error {
+	d := &diskQueue{name: name, dataPath: dataPath}
+	metaFileName := d.metaDataFileName()
+	snapshotMetaFileName := path.Join(snapshotDir, path.Base(metaFileName))
+
+	for _, slot := range metaDataSlots(metaFileName) {
+		_, err := os.Stat(slot)
+		if err == nil {
+			return fmt.Errorf("queue %s already exists in %s", name, dataPath)
+		}
+	}
+	_, err := os.Stat(snapshotMetaFileName)
+	if err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(snapshotDir)
+	if err != nil {
+		return err
+	}
+	prefix := name + ".diskqueue."
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasPrefix(fi.Name(), prefix) || fi.Name() == path.Base(metaFileName) {
+			continue
+		}
+		err = copyFile(path.Join(snapshotDir, fi.Name()), path.Join(dataPath, fi.Name()), fi.Size())
+		if err != nil {
+			return err
+		}
+	}
+
+	// copied last, the queue doesn't exist until it has metadata
+	return copyFile(snapshotMetaFileName, metaFileName, fileSizeOf(snapshotMetaFileName))
+}
@@ -0,0 +1,309 @@
+package diskqueue
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync/atomic"
+)
+
+// spliceRequest names the queue SpliceFrom adopts the data files of
+type spliceRequest struct {
+	dataPath string
+	name     string
+}
+
+// splice appends the unread messages of the queue named by req to the
+// queue, see SpliceFrom
+func (d *diskQueue) splice(req spliceRequest) error {
+	if req.name == d.name && path.Clean(req.dataPath) == path.Clean(d.dataPath) {
+		return errors.New("can't splice a queue into itself")
+	}
+	if d.mirrorPath != "" {
+		return errors.New("can't splice into a mirrored queue")
+	}
+
+	other := &diskQueue{name: req.name, dataPath: req.dataPath}
+	err := other.lock()
+	if err != nil {
+		return err
+	}
+	defer other.unlock()
+	md, err := readMetaData(other.metaDataFileName())
+	if err != nil {
+		return fmt.Errorf("failed to read metadata of %s - %s", req.name, err)
+	}
+	from := Position{md.readFileNum, md.readPos}
+	end := Position{md.writeFileNum, md.writePos}
+	lastFileNum := end.FileNum
+	if end.Pos == 0 {
+		lastFileNum--
+	}
+	for i := from.FileNum; i <= lastFileNum; i++ {
+		fileName := other.fileName(i)
+		h, err := readFileHeaderOf(fileName)
+		if err == nil && h.maxBytesPerFile == 0 {
+			size := fileSizeOf(fileName)
+			if i == end.FileNum {
+				size = end.Pos
+			}
+			err = d.checkFileFits(fileName, h, size)
+		}
+		if err != nil {
+			return fmt.Errorf("can't splice %s - %s", fileName, err)
+		}
+	}
+
+	span := d.startSpan(context.Background(), "diskqueue.splice")
+	if d.writeFile != nil {
+		err = d.flushPending()
+		if err != nil {
+			endSpan(span, err)
+			return err
+		}
+	}
+
+	start := Position{d.writeFileNum, d.writePos}
+	depth, depthBytes := atomic.LoadInt64(&d.depth), atomic.LoadInt64(&d.depthBytes)
+	writeFileCount, writeFileCRC := d.writeFileCount, d.writeFileCRC
+	// the files adopted don't count towards the limits either
+	maxBytes, manager := d.maxBytes, d.manager
+	d.maxBytes, d.manager = 0, nil
+
+	var rewritten int64
+	fileNum := from.FileNum
+	if from.Pos > 0 && fileNum <= lastFileNum {
+		// already read in part, its unread messages are written again
+		rewritten, err = d.spliceReadFile(other, from, end)
+		fileNum++
+	}
+	if err == nil && fileNum <= lastFileNum {
+		err = d.abandonWriteFile()
+	}
+	for ; err == nil && fileNum <= lastFileNum; fileNum++ {
+		err = d.adoptFile(other.fileName(fileNum), fileNum == end.FileNum, end.Pos)
+	}
+	if err == nil && d.dirSync {
+		err = syncDirHook(d.dataPath)
+	}
+	d.maxBytes, d.manager = maxBytes, manager
+	if err != nil {
+		d.dropWritesAfter(start, writeFileCount, writeFileCRC)
+		for _, c := range d.cursors {
+			atomic.AddInt64(&c.depth, depth-atomic.LoadInt64(&d.depth))
+		}
+		atomic.StoreInt64(&d.depth, depth)
+		atomic.StoreInt64(&d.depthBytes, depthBytes)
+		endSpan(span, err)
+		return err
+	}
+
+	adopted := md.depth - rewritten
+	atomic.AddInt64(&d.depth, adopted)
+	for _, c := range d.cursors {
+		atomic.AddInt64(&c.depth, adopted)
+	}
+	atomic.StoreInt64(&d.depthBytes, d.unreadBytes(d.readFileNum, d.readPos))
+	d.loadDoneFileBytes()
+	// the messages must be in this queue before they're removed from the
+	// other one
+	err = d.syncDurable(true)
+	if err != nil {
+		endSpan(span, err)
+		return err
+	}
+
+	for i := from.FileNum; i <= end.FileNum; i++ {
+		fileName := other.fileName(i)
+		err = removeFile(fileName)
+		if err != nil && !os.IsNotExist(err) {
+			d.log(ERROR, "failed to remove spliced data file", "file", fileName, "err", err)
+		}
+		removeFile(indexFileName(fileName))
+	}
+	for _, slot := range metaDataSlots(other.metaDataFileName()) {
+		removeFile(slot)
+	}
+
+	d.log(INFO, "spliced queue", "from", req.name, "count", md.depth)
+	span.SetAttribute("diskqueue.spliced", md.depth)
+	endSpan(span, nil)
+	return nil
+}
+
+// spliceReadFile writes the messages of the other queue's read file from
+// from on (up to end if it's also its write file), returning how many
+// there were
+func (d *diskQueue) spliceReadFile(other *diskQueue, from Position, end Position) (int64, error) {
+	// walked as the queue's next file, which doesn't exist yet
+	fileNum := d.writeFileNum + 1
+	fileName := d.fileName(fileNum)
+	err := os.Link(other.fileName(from.FileNum), fileName)
+	if err != nil {
+		err = copyFile(other.fileName(from.FileNum), fileName, fileSizeOf(other.fileName(from.FileNum)))
+	}
+	if err != nil {
+		return 0, err
+	}
+	walkEnd := Position{fileNum + 1, 0}
+	if from.FileNum == end.FileNum {
+		walkEnd = Position{fileNum, end.Pos}
+	}
+	var frames [][]Message
+	err = d.walkMessagesTo(fileNum, from.Pos, walkEnd, func(_ int64, _ Position, msgs []Message) bool {
+		frames = append(frames, msgs)
+		return true
+	})
+	removeFile(fileName)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	for _, msgs := range frames {
+		err = d.writeKept(msgs)
+		if err != nil {
+			return 0, err
+		}
+		n += int64(len(msgs))
+	}
+	return n, d.flushPending()
+}
+
+// abandonWriteFile closes off the write file before it reaches
+// maxBytesPerFile, so that the files adopted by SpliceFrom follow it, or
+// makes way for them if nothing was written to it
+func (d *diskQueue) abandonWriteFile() error {
+	if d.writePos > 0 {
+		err := d.openWriteFile()
+		if err == nil {
+			err = d.writeEndMarker()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if d.writeFile != nil {
+		err := syncWriteHandle(d.writeFile)
+		d.writeFile.Close()
+		d.writeFile = nil
+		if err != nil {
+			return err
+		}
+	}
+	if d.writePos == 0 {
+		err := d.removeDataFile(d.fileName(d.writeFileNum))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if d.preallocate {
+		d.releasePreallocated(d.writeFileNum)
+	}
+	d.writeFileNum++
+	d.writePos = 0
+	d.writeFileCount = 0
+	d.writeFileCRC = 0
+	return nil
+}
+
+// adoptFile makes fileName the queue's next data file, hardlinked if
+// possible, or a copy of its first size bytes if it was still being
+// written to
+func (d *diskQueue) adoptFile(fileName string, partial bool, size int64) error {
+	dst := d.fileName(d.writeFileNum)
+	var err error
+	if partial {
+		err = copyFile(fileName, dst, size)
+		if err == nil {
+			err = d.appendEndMarker(dst, size)
+		}
+	} else {
+		err = os.Link(fileName, dst)
+		if err != nil {
+			err = copyFile(fileName, dst, fileSizeOf(fileName))
+		}
+		if err == nil && d.indexEvery > 0 {
+			// the index is optional
+			os.Link(indexFileName(fileName), indexFileName(dst))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	d.writeFileNum++
+	return nil
+}
+
+// checkFileFits makes sure the first size bytes of fileName, a data file
+// that doesn't record the maxBytesPerFile it was written with (i.e. in
+// format version 1), are read as a whole with the queue's, i.e. that no
+// frame but the last one ends past it
+func (d *diskQueue) checkFileFits(fileName string, h fileHeader, size int64) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+
+	maxBytes := d.maxBytesOf(h)
+	var pos int64
+	for pos < size {
+		padding, msgSize, _, err := d.readFrameStart(reader, pos, h)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		next := pos + padding + int64(msgSize) + d.frameOverhead(h.version, msgSize)
+		if next > maxBytes && next < size {
+			return fmt.Errorf("written with a maxBytesPerFile above %d", maxBytes)
+		}
+		_, err = reader.Discard(int(next - pos - padding - frameHeaderLen(h.version, msgSize)))
+		if err != nil {
+			return err
+		}
+		pos = next
+	}
+	return nil
+}
+
+// SpliceFrom appends the unread messages of the queue name in dataPath to
+// the queue by adopting its data files, hardlinked where possible, rather
+// than writing every message again, the other queue's data and metadata
+// files are then removed
+//
+// the other queue must not be open and must have been written with the
+// same options affecting the format of its data files (e.g.
+// WithFrameTrailer, WithEncryption), its cursors, delayed messages and
+// the like are not adopted, the messages of its read file are written
+// again if some of them have been read
+//
+// data files in format version 1 don't record the maxBytesPerFile they
+// were written with, they're read with the queue's so those written with
+// a larger one (i.e. with frames past the queue's maxBytesPerFile before
+// their last) are rejected
+//
+// if the queue crashes before it's done, the messages may be found in both
+// queues, limits set with WithMaxBytes don't apply
+func (d *diskQueue) SpliceFrom(dataPath string, name string) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+	if atomic.LoadInt32(&d.draining) == 1 {
+		return ErrDraining
+	}
+
+	d.spliceChan <- spliceRequest{dataPath, name}
+	return <-d.spliceResponseChan
+}
@@ -0,0 +1,100 @@
+package diskqueue
+
+import (
+	"bufio"
+	"os"
+	"sync/atomic"
+)
+
+// scanOnStartup checks that the persisted read and write positions are at
+// message boundaries, moving them back to the one before if not, and
+// counts the depth rather than trusting the persisted one, see
+// WithStartupScan
+func (d *diskQueue) scanOnStartup() error {
+	boundary, err := d.frameBoundaryBefore(d.writeFileNum, d.writePos)
+	if err != nil {
+		return err
+	}
+	if boundary != d.writePos {
+		d.log(WARN, "writePos is not at the end of a message, moving it back",
+			"file", d.fileName(d.writeFileNum), "pos", d.writePos, "to", boundary)
+		d.writePos = boundary
+		d.needSync = true
+	}
+
+	pos := d.readPos
+	if d.readFileNum == d.writeFileNum && pos > d.writePos {
+		pos = d.writePos
+	}
+	boundary, err = d.frameBoundaryBefore(d.readFileNum, pos)
+	if err != nil {
+		return err
+	}
+	if boundary != d.readPos {
+		d.log(WARN, "readPos is not at the end of a message, moving it back",
+			"file", d.fileName(d.readFileNum), "pos", d.readPos, "to", boundary)
+		d.readPos = boundary
+		d.nextReadPos = boundary
+		d.commitReadPos = boundary
+		d.needSync = true
+	}
+
+	depth, err := d.depthInFiles(d.readFileNum, d.readPos)
+	if err != nil {
+		return err
+	}
+	if depth != atomic.LoadInt64(&d.depth) {
+		d.log(WARN, "counted a different depth", "depth", depth, "persisted", atomic.LoadInt64(&d.depth))
+		d.needSync = true
+	}
+	atomic.StoreInt64(&d.depth, depth)
+	atomic.StoreInt64(&d.depthBytes, d.unreadBytes(d.readFileNum, d.readPos))
+	return nil
+}
+
+// frameBoundaryBefore returns the end of the last complete message in the
+// data file fileNum that ends at or before pos, 0 if there's no such file
+func (d *diskQueue) frameBoundaryBefore(fileNum int64, pos int64) (int64, error) {
+	if pos == 0 {
+		return 0, nil
+	}
+	f, err := os.Open(d.fileName(fileNum))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	header, err := readFileHeader(f)
+	if err != nil {
+		return 0, err
+	}
+	stat, err := f.Stat()
+	if err == nil {
+		_, err = f.Seek(0, 0)
+	}
+	if err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReader(f)
+
+	var boundary int64
+	for boundary < pos {
+		padding, msgSize, _, err := d.readFrameStart(reader, boundary, header)
+		if err != nil {
+			break
+		}
+		headerLen := frameHeaderLen(header.version, msgSize)
+		end := boundary + padding + int64(msgSize) + d.frameOverhead(header.version, msgSize)
+		if end > pos || end > stat.Size() {
+			break
+		}
+		_, err = reader.Discard(int(end - boundary - padding - headerLen))
+		if err != nil {
+			break
+		}
+		boundary = end
+	}
+	return boundary, nil
+}
@@ -0,0 +1,93 @@
+package diskqueue
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a point in time snapshot of queue activity, returned by Stats()
+type Stats struct {
+	// fsyncs of the current data file and metadata, and the time spent in them
+	Syncs    int64
+	SyncTime time.Duration
+
+	// data files opened by ioLoop, and the time spent opening them
+	FileOpens    int64
+	FileOpenTime time.Duration
+
+	// messages delivered, and the time they spent waiting for
+	// a consumer once they had been read from disk
+	ReadChanSends    int64
+	ReadChanSendTime time.Duration
+
+	// calls to Put (and friends), and the time they spent waiting
+	// for ioLoop to accept the write
+	PutWaits    int64
+	PutWaitTime time.Duration
+
+	// messages written and consumed, failed reads and the data files
+	// set aside as bad because of them
+	Writes     int64
+	Reads      int64
+	ReadErrors int64
+	BadFiles   int64
+
+	// the queue's positions and depth, as of the same instant
+	ReadFileNum  int64
+	ReadPos      int64
+	WriteFileNum int64
+	WritePos     int64
+	Depth        int64
+	DepthBytes   int64
+}
+
+// queueStats holds the counters behind Stats, updated atomically
+type queueStats struct {
+	syncs             int64
+	syncNanos         int64
+	fileOpens         int64
+	fileOpenNanos     int64
+	readChanSends     int64
+	readChanSendNanos int64
+	putWaits          int64
+	putWaitNanos      int64
+	writes            int64
+	reads             int64
+	readErrors        int64
+	badFiles          int64
+}
+
+func addTiming(count *int64, nanos *int64, start time.Time) {
+	atomic.AddInt64(count, 1)
+	atomic.AddInt64(nanos, int64(time.Since(start)))
+}
+
+func (s *queueStats) snapshot() Stats {
+	return Stats{
+		Syncs:            atomic.LoadInt64(&s.syncs),
+		SyncTime:         time.Duration(atomic.LoadInt64(&s.syncNanos)),
+		FileOpens:        atomic.LoadInt64(&s.fileOpens),
+		FileOpenTime:     time.Duration(atomic.LoadInt64(&s.fileOpenNanos)),
+		ReadChanSends:    atomic.LoadInt64(&s.readChanSends),
+		ReadChanSendTime: time.Duration(atomic.LoadInt64(&s.readChanSendNanos)),
+		PutWaits:         atomic.LoadInt64(&s.putWaits),
+		PutWaitTime:      time.Duration(atomic.LoadInt64(&s.putWaitNanos)),
+		Writes:           atomic.LoadInt64(&s.writes),
+		Reads:            atomic.LoadInt64(&s.reads),
+		ReadErrors:       atomic.LoadInt64(&s.readErrors),
+		BadFiles:         atomic.LoadInt64(&s.badFiles),
+	}
+}
+
+// gatherStats adds the queue's positions and depth to the counters,
+// it is called by ioLoop so that they are consistent with each other
+func (d *diskQueue) gatherStats() Stats {
+	s := d.stats.snapshot()
+	s.ReadFileNum = d.readFileNum
+	s.ReadPos = d.readPos
+	s.WriteFileNum = d.writeFileNum
+	s.WritePos = d.writePos
+	s.Depth = atomic.LoadInt64(&d.depth)
+	s.DepthBytes = atomic.LoadInt64(&d.depthBytes)
+	return s
+}
@@ -0,0 +1,249 @@
+package diskqueue
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ioLoopMaxRestarts is the number of times ioLoop is restarted after a
+	// panic before the queue is considered failed
+	ioLoopMaxRestarts = 3
+	// inFlightReplyTimeout bounds how long a recovered ioLoop waits to fail
+	// the request it was handling when it panicked
+	inFlightReplyTimeout = 100 * time.Millisecond
+)
+
+// ioLoop supervises runIOLoop, a panic is recorded (see LastError) and the
+// loop restarted from the persisted state, after ioLoopMaxRestarts panics
+// the queue is failed: every request returns the error but Depth() etc.
+// still answer and Close() still works
+func (d *diskQueue) ioLoop() {
+	for restarts := 0; ; restarts++ {
+		err := d.runRecovered()
+		if err == nil {
+			break
+		}
+
+		d.errMtx.Lock()
+		d.lastErr = err
+		d.errMtx.Unlock()
+		d.replyInFlight(err)
+
+		if restarts < ioLoopMaxRestarts {
+			d.log(WARN, "restarting ioLoop from persisted state")
+			d.reloadState()
+			continue
+		}
+
+		d.log(ERROR, "ioLoop failed too many times, giving up", "count", restarts+1)
+		d.failed = true
+		d.failedLoop(err)
+		break
+	}
+
+	d.log(INFO, "closing ... ioLoop")
+	d.exitSyncChan <- 1
+}
+
+// runRecovered runs runIOLoop, converting a panic into an error except
+// for that of PanicOnCorruption
+func (d *diskQueue) runRecovered() (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			if _, ok := p.(*CorruptionError); ok {
+				panic(p)
+			}
+			err = fmt.Errorf("ioLoop panic: %v", p)
+			d.log(ERROR, "ioLoop panicked", "err", err, "stack", string(debug.Stack()))
+		}
+	}()
+	d.runIOLoop()
+	return nil
+}
+
+// replyInFlight fails the request (if any) ioLoop was handling when it
+// panicked, its caller is blocked on one of the response channels
+func (d *diskQueue) replyInFlight(err error) {
+	t := time.NewTimer(inFlightReplyTimeout)
+	defer t.Stop()
+
+	if d.inFlightWrites > 0 {
+		// the whole group write is waiting, see gatherWrites
+		for ; d.inFlightWrites > 0; d.inFlightWrites-- {
+			select {
+			case d.writeResponseChan <- err:
+			case <-t.C:
+				d.inFlightWrites = 0
+				return
+			}
+		}
+		return
+	}
+
+	select {
+	case d.writeResponseChan <- err:
+	case d.putPosResponseChan <- putPosResult{err: err}:
+	case d.readIntoResponseChan <- readIntoResult{0, err}:
+	case d.readBatchResponseChan <- readBatchResult{nil, err}:
+	case d.emptyResponseChan <- err:
+	case d.barrierResponseChan <- err:
+	case d.checkpointResponseChan <- nil:
+	case d.seekResponseChan <- err:
+	case d.commitResponseChan <- err:
+	case d.trimResponseChan <- trimResult{0, err}:
+	case d.moveResponseChan <- moveResult{err: err}:
+	case d.fastForwardResponseChan <- fastForwardResult{err: err}:
+	case d.cursorOpenResponseChan <- cursorOpenResult{nil, err}:
+	case d.cursorCloseResponseChan <- err:
+	case d.failoverResponseChan <- err:
+	case d.snapshotResponseChan <- err:
+	case d.finishResponseChan <- err:
+	case d.spliceResponseChan <- err:
+	case d.reconfigureResponseChan <- err:
+	case d.scanResponseChan <- err:
+	case d.statsResponseChan <- d.stats.snapshot():
+	case d.verifyResponseChan <- verifyResult{err: err}:
+	case <-t.C:
+	}
+}
+
+// reloadState discards all in-memory state and reloads it from disk,
+// messages written since the last sync are lost unless they can be
+// recovered (see WithAppendWrites)
+func (d *diskQueue) reloadState() {
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
+	}
+	d.takePreopened(-1)
+	d.closeCursorFiles()
+	// an interrupted Scan (or Export) is failed
+	for name, c := range d.cursors {
+		if c.transient {
+			delete(d.cursors, name)
+		}
+	}
+	if d.writeFile != nil {
+		d.writeFile.Close()
+		d.writeFile = nil
+	}
+	d.pendingWrite.Reset()
+	d.pendingMsgs = 0
+	d.readTxn = pendingTxn{}
+	d.bufferedReads = nil
+	d.uncommittedReads = 0
+	d.needSync = false
+	d.resetSyncState()
+
+	// start from scratch should there be no metadata
+	d.readFileNum, d.readPos = 0, 0
+	d.nextReadFileNum, d.nextReadPos = 0, 0
+	d.commitReadFileNum, d.commitReadPos = 0, 0
+	d.writeFileNum, d.writePos = 0, 0
+	atomic.StoreInt64(&d.depth, 0)
+	atomic.StoreInt64(&d.depthBytes, 0)
+	d.loadState()
+}
+
+// failedLoop answers every request with err until the queue is closed
+//
+// ReadWith and cursors are handed messages rather than answered, they
+// are failed by closing the channels they wait on
+func (d *diskQueue) failedLoop(err error) {
+	close(d.readWithChan)
+	for _, c := range d.cursors {
+		if c.open && c.waiting {
+			c.waiting = false
+			close(c.respChan)
+		}
+	}
+	for {
+		select {
+		case <-d.writeChan:
+			d.writeResponseChan <- err
+		case <-d.writeDurableChan:
+			d.writeResponseChan <- err
+		case <-d.writeManyChan:
+			d.writeResponseChan <- err
+		case <-d.writeMessageChan:
+			d.writeResponseChan <- err
+		case <-d.putPosChan:
+			d.putPosResponseChan <- putPosResult{err: err}
+		case <-d.writeTxnChan:
+			d.writeResponseChan <- err
+		case <-d.writeDelayedChan:
+			d.writeResponseChan <- err
+		case <-d.writeReaderChan:
+			d.writeResponseChan <- err
+		case <-d.readIntoChan:
+			d.readIntoResponseChan <- readIntoResult{0, err}
+		case <-d.readBatchChan:
+			d.readBatchResponseChan <- readBatchResult{nil, err}
+		case <-d.emptyChan:
+			d.emptyResponseChan <- err
+		case <-d.emptyToChan:
+			d.seekResponseChan <- err
+		case <-d.barrierChan:
+			d.barrierResponseChan <- err
+		case <-d.checkpointChan:
+			d.checkpointResponseChan <- nil
+		case <-d.seekChan:
+			d.seekResponseChan <- err
+		case <-d.seekTimeChan:
+			d.seekResponseChan <- err
+		case <-d.fastBackwardChan:
+			d.seekResponseChan <- err
+		case <-d.fastForwardChan:
+			d.fastForwardResponseChan <- fastForwardResult{err: err}
+		case <-d.commitChan:
+			d.commitResponseChan <- err
+		case <-d.trimChan:
+			d.trimResponseChan <- trimResult{0, err}
+		case <-d.rewindChan:
+			d.trimResponseChan <- trimResult{0, err}
+		case <-d.skipChan:
+			d.trimResponseChan <- trimResult{0, err}
+		case <-d.trimDepthChan:
+			d.trimResponseChan <- trimResult{0, err}
+		case <-d.recoverChan:
+			d.trimResponseChan <- trimResult{0, err}
+		case <-d.deleteWhereChan:
+			d.trimResponseChan <- trimResult{0, err}
+		case <-d.compactChan:
+			d.trimResponseChan <- trimResult{0, err}
+		case <-d.moveChan:
+			d.moveResponseChan <- moveResult{err: err}
+		case <-d.moveEndChan:
+			d.moveResponseChan <- moveResult{err: err}
+		case <-d.moveInChan:
+			d.writeResponseChan <- err
+		case <-d.cursorOpenChan:
+			d.cursorOpenResponseChan <- cursorOpenResult{nil, err}
+		case req := <-d.cursorReadChan:
+			close(req.c.respChan)
+		case <-d.cursorCloseChan:
+			d.cursorCloseResponseChan <- err
+		case <-d.failoverChan:
+			d.failoverResponseChan <- err
+		case <-d.snapshotChan:
+			d.snapshotResponseChan <- err
+		case <-d.finishChan:
+			d.finishResponseChan <- err
+		case <-d.spliceChan:
+			d.spliceResponseChan <- err
+		case <-d.reconfigureChan:
+			d.reconfigureResponseChan <- err
+		case <-d.scanChan:
+			d.scanResponseChan <- err
+		case <-d.statsChan:
+			d.statsResponseChan <- d.gatherStats()
+		case <-d.verifyChan:
+			d.verifyResponseChan <- verifyResult{err: err}
+		case <-d.exitChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build linux
+// +build linux
+
+package diskqueue
+
+import (
+	"os"
+	"syscall"
+)
+
+// fdatasync flushes the data of f, along with only the metadata needed
+// to read it back (e.g. its size but not its mtime)
+func fdatasync(f *os.File) error {
+	return syscall.Fdatasync(int(f.Fd()))
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package diskqueue
+
+import (
+	"os"
+)
+
+func fdatasync(f *os.File) error {
+	return f.Sync()
+}
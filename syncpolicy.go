@@ -0,0 +1,166 @@
+package diskqueue
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// SyncMode decides when writes are fsynced, see WithSyncMode
+type SyncMode int
+
+const (
+	// SyncDefault fsyncs whenever the SyncPolicy says so (see
+	// WithSyncEvery, WithSyncTimeout and WithSyncPolicy)
+	SyncDefault SyncMode = iota
+	// SyncAlways fsyncs every write before acknowledging it
+	SyncAlways
+	// SyncNever leaves writing data back to the OS, metadata is still
+	// persisted whenever the SyncPolicy says so but isn't fsynced either,
+	// PutDurable and WriteBarrier still fsync
+	SyncNever
+)
+
+// syncOptions records which of the options setting the sync policy were
+// applied, as they don't combine
+type syncOptions int
+
+const (
+	syncThresholdsSet syncOptions = 1 << iota // WithSyncEvery or WithSyncTimeout
+	syncPolicySet                             // WithSyncPolicy
+)
+
+// checkSyncOptions returns an error if WithSyncEvery or WithSyncTimeout
+// were applied but have no effect, i.e. alongside WithSyncPolicy or to a
+// policy other than ThresholdSyncPolicy
+func (d *diskQueue) checkSyncOptions() error {
+	if d.syncOptions&syncThresholdsSet == 0 {
+		return nil
+	}
+	_, ok := d.syncPolicy.(ThresholdSyncPolicy)
+	if d.syncOptions&syncPolicySet != 0 || !ok {
+		return errors.New("WithSyncEvery and WithSyncTimeout can't be combined with WithSyncPolicy")
+	}
+	return nil
+}
+
+// syncWriteHandle fsyncs h, only flushing the data of plain files where
+// the platform allows
+func syncWriteHandle(h writeHandle) error {
+	if f, ok := h.(*os.File); ok {
+		return fdatasync(f)
+	}
+	return h.Sync()
+}
+
+// SyncState describes the queue activity since the last fsync
+type SyncState struct {
+	Writes  int64         // messages written
+	Reads   int64         // messages read
+	Bytes   int64         // bytes written
+	Elapsed time.Duration // time since the last sync
+	Depth   int64
+}
+
+// SyncPolicy decides when ioLoop fsyncs the current data file and persists metadata
+type SyncPolicy interface {
+	// ShouldSync is consulted after every operation and on every Interval tick
+	ShouldSync(s SyncState) bool
+	// Interval is how often ShouldSync is consulted in the absence of
+	// activity, zero disables the timer
+	Interval() time.Duration
+}
+
+// ThresholdSyncPolicy syncs as soon as any of its non-zero thresholds is reached
+type ThresholdSyncPolicy struct {
+	Ops      int64         // reads plus writes
+	Bytes    int64         // bytes written
+	MaxDelay time.Duration // time since the last sync, if there was any activity
+}
+
+func (p ThresholdSyncPolicy) ShouldSync(s SyncState) bool {
+	ops := s.Writes + s.Reads
+	if ops == 0 {
+		// avoid sync when there's no activity
+		return false
+	}
+	return (p.Ops > 0 && ops >= p.Ops) ||
+		(p.Bytes > 0 && s.Bytes >= p.Bytes) ||
+		(p.MaxDelay > 0 && s.Elapsed >= p.MaxDelay)
+}
+
+func (p ThresholdSyncPolicy) Interval() time.Duration {
+	return p.MaxDelay
+}
+
+// SyncObserver can optionally be implemented by a SyncPolicy
+// to be told about every completed sync
+type SyncObserver interface {
+	// SyncDone is called after a sync that took latency and covered the activity in s
+	SyncDone(latency time.Duration, s SyncState)
+}
+
+// AdaptiveSyncPolicy syncs on a timer whose interval adapts, between
+// MinInterval and MaxInterval, to the observed fsync latency and write rate
+//
+// the interval is stretched so that no more than MaxSyncFraction of the time
+// is spent in fsync, but only while writes arrive often enough for a longer
+// interval to batch them, so at most MaxInterval worth of writes is ever
+// at risk regardless of how many messages that is
+type AdaptiveSyncPolicy struct {
+	MinInterval     time.Duration
+	MaxInterval     time.Duration
+	MaxSyncFraction float64 // defaults to 0.1
+
+	interval time.Duration
+	latency  float64 // moving average of sync latency, in seconds
+	rate     float64 // moving average of writes per second
+}
+
+// adaptiveSyncWeight is the weight given to each new sample in the moving averages
+const adaptiveSyncWeight = 0.2
+
+func (p *AdaptiveSyncPolicy) ShouldSync(s SyncState) bool {
+	if s.Writes+s.Reads == 0 {
+		return false
+	}
+	return s.Elapsed >= p.CurrentInterval()
+}
+
+func (p *AdaptiveSyncPolicy) Interval() time.Duration {
+	return p.MinInterval
+}
+
+func (p *AdaptiveSyncPolicy) SyncDone(latency time.Duration, s SyncState) {
+	p.latency += adaptiveSyncWeight * (latency.Seconds() - p.latency)
+	if s.Elapsed > 0 {
+		rate := float64(s.Writes) / s.Elapsed.Seconds()
+		p.rate += adaptiveSyncWeight * (rate - p.rate)
+	}
+
+	fraction := p.MaxSyncFraction
+	if fraction <= 0 {
+		fraction = 0.1
+	}
+
+	interval := time.Duration(p.latency / fraction * float64(time.Second))
+	if p.rate*interval.Seconds() < 2 {
+		// fewer than two writes would be batched, waiting longer gains nothing
+		interval = p.MinInterval
+	}
+	if interval < p.MinInterval {
+		interval = p.MinInterval
+	}
+	if interval > p.MaxInterval {
+		interval = p.MaxInterval
+	}
+	p.interval = interval
+}
+
+// CurrentInterval returns the interval the policy is currently syncing at
+func (p *AdaptiveSyncPolicy) CurrentInterval() time.Duration {
+	if p.interval == 0 {
+		return p.MinInterval
+	}
+	return p.interval
+}
@@ -0,0 +1,105 @@
+package diskqueue
+
+import "context"
+
+// Tracer starts the spans the queue traces its slower operations with (see
+// WithTelemetry), it is modelled on OpenTelemetry's trace.Tracer so that
+// adapting one takes a few lines
+//
+// the queue's spans are:
+//
+//	diskqueue.sync            a sync of the data and metadata files
+//	diskqueue.rotate          closing off a data file for the next one
+//	diskqueue.fast_forward    a call to FastForward, a child of its ctx
+//	diskqueue.recover_append  the recovery of WithAppendWrites on startup
+//	diskqueue.startup_scan    the scan of WithStartupScan on startup
+//	diskqueue.recover         a call to Recover
+//	diskqueue.delete_where    a call to DeleteWhere
+//	diskqueue.compact         a call to Compact that rewrites the queue
+//	diskqueue.splice          a call to SpliceFrom
+type Tracer interface {
+	Start(ctx context.Context, spanName string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer
+type Span interface {
+	// SetAttribute records a detail of the operation, value being a
+	// string, an int64 or a bool
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+// Meter creates the counters the queue reports its activity to (see
+// WithTelemetry), it is modelled on OpenTelemetry's metric.Meter
+//
+// the queue's counters are diskqueue.writes and diskqueue.reads (messages
+// written and consumed), diskqueue.read_errors, diskqueue.bad_files,
+// diskqueue.syncs and diskqueue.rotations, an adapter can return a no-op
+// counter for one that fails to be created
+type Meter interface {
+	Int64Counter(name string) Int64Counter
+}
+
+// Int64Counter is a counter created by a Meter
+type Int64Counter interface {
+	Add(ctx context.Context, incr int64)
+}
+
+// telemetry holds what was set with WithTelemetry, the tracer and counters
+// being nil without one
+type telemetry struct {
+	tracer Tracer
+
+	writes     Int64Counter
+	reads      Int64Counter
+	readErrors Int64Counter
+	badFiles   Int64Counter
+	syncs      Int64Counter
+	rotations  Int64Counter
+}
+
+func newTelemetry(tracer Tracer, meter Meter) telemetry {
+	t := telemetry{tracer: tracer}
+	if meter != nil {
+		t.writes = meter.Int64Counter("diskqueue.writes")
+		t.reads = meter.Int64Counter("diskqueue.reads")
+		t.readErrors = meter.Int64Counter("diskqueue.read_errors")
+		t.badFiles = meter.Int64Counter("diskqueue.bad_files")
+		t.syncs = meter.Int64Counter("diskqueue.syncs")
+		t.rotations = meter.Int64Counter("diskqueue.rotations")
+	}
+	return t
+}
+
+// startSpan starts a span named name as a child of ctx, with the queue's
+// name as an attribute, the span does nothing without a Tracer
+func (d *diskQueue) startSpan(ctx context.Context, name string) Span {
+	if d.telemetry.tracer == nil {
+		return noopSpan{}
+	}
+	_, span := d.telemetry.tracer.Start(ctx, name)
+	span.SetAttribute("diskqueue.name", d.name)
+	return span
+}
+
+// endSpan ends span, recording err if the operation failed
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+// addCount adds n to c, which is nil without a Meter
+func addCount(c Int64Counter, n int64) {
+	if c != nil {
+		c.Add(context.Background(), n)
+	}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(string, interface{}) {}
+func (noopSpan) RecordError(error)                {}
+func (noopSpan) End()                             {}
@@ -0,0 +1,78 @@
+package diskqueue
+
+import "sync/atomic"
+
+// Topic writes messages once to a single queue and delivers each of them
+// to every one of its named channels, each read at its own pace, much like
+// an nsqd topic
+//
+// channels are cursors of the queue (see NewCursor), which has no reader of
+// its own, a data file is removed once every channel has read past it
+//
+// a new channel gets the messages written from then on, unless it's the
+// only one in which case it also gets those written while there were no
+// channels, deleting the last channel drops what it hadn't read
+type Topic struct {
+	d *diskQueue
+}
+
+// NewTopic creates (or reopens) a Topic, opts apply to its queue (see
+// NewWithOptions) and must not include WithManualCommit or WithReadBuffer
+func NewTopic(name string, dataPath string, opts ...Option) (*Topic, error) {
+	dq, err := NewWithOptions(name, dataPath, append(opts[:len(opts):len(opts)], withoutReader())...)
+	if err != nil {
+		return nil, err
+	}
+	return &Topic{dq.(*diskQueue)}, nil
+}
+
+// withoutReader is set by NewTopic
+func withoutReader() Option {
+	return func(d *diskQueue) {
+		d.readerless = true
+	}
+}
+
+// Put writes data to every channel
+func (t *Topic) Put(data []byte) error {
+	return t.d.Put(data)
+}
+
+// PutMany writes a batch of messages to every channel, see PutMany
+func (t *Topic) PutMany(batch [][]byte) error {
+	return t.d.PutMany(batch)
+}
+
+// Channel opens the named channel, creating it if it doesn't exist, Delete
+// it once it's no longer needed for its messages not to be kept forever
+func (t *Topic) Channel(name string) (Cursor, error) {
+	return t.d.NewCursor(name)
+}
+
+// Close closes the topic, the channels' positions are kept
+func (t *Topic) Close() error {
+	return t.d.Close()
+}
+
+// Delete deletes the topic along with its channels
+func (t *Topic) Delete() error {
+	return t.d.Delete()
+}
+
+// followCursors moves the read position of a queue without a reader of its
+// own up to the slowest cursor, for the data files every cursor has read
+// past to be removed
+func (d *diskQueue) followCursors() {
+	var slowest *cursor
+	for _, c := range d.cursors {
+		if slowest == nil || c.fileNum < slowest.fileNum ||
+			(c.fileNum == slowest.fileNum && c.pos < slowest.pos) {
+			slowest = c
+		}
+	}
+	if slowest == nil || slowest.fileNum < d.readFileNum ||
+		(slowest.fileNum == d.readFileNum && slowest.pos <= d.readPos) {
+		return
+	}
+	d.skipReadTo(slowest.fileNum, slowest.pos, atomic.LoadInt64(&d.depth)-atomic.LoadInt64(&slowest.depth))
+}
@@ -0,0 +1,58 @@
+package diskqueue
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrWouldBlock is returned by TryPut and PutTimeout when ioLoop couldn't
+// accept the write in time, e.g. because it is busy syncing or the queue
+// is held back by OverflowBlock, the message hasn't been written
+var ErrWouldBlock = errors.New("write would block")
+
+// TryPut is Put but returns ErrWouldBlock rather than wait for ioLoop to
+// accept the message, once accepted the message is always written
+func (d *diskQueue) TryPut(data []byte) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+	if atomic.LoadInt32(&d.draining) == 1 {
+		return ErrDraining
+	}
+
+	err := d.checkMsgSize(len(data))
+	if err != nil {
+		return err
+	}
+
+	if d.writeGate != nil {
+		if !d.writeGate.tryEnter() {
+			return ErrWouldBlock
+		}
+		defer d.writeGate.leave()
+	}
+	select {
+	case d.writeChan <- data:
+	default:
+		return ErrWouldBlock
+	}
+	return <-d.writeResponseChan
+}
+
+// PutTimeout is Put but returns ErrWouldBlock if ioLoop hasn't accepted
+// the message within timeout, see PutContext
+func (d *diskQueue) PutTimeout(data []byte, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := d.PutContext(ctx, data)
+	if err == context.DeadlineExceeded {
+		return ErrWouldBlock
+	}
+	return err
+}
@@ -0,0 +1,208 @@
+package diskqueue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sync/atomic"
+	"time"
+)
+
+// the messages of a transaction (see PutTransaction) are stored in a single
+// frame flagged with frameFlagTxn, so that a crash leaves either all or
+// none of them in the queue, its data being:
+//
+//	[4-byte count][4-byte CRC32-C of the rest][sub-frame]...
+//
+// with a sub-frame per message, each encoded like a frame of its own in a
+// format version 1 file without a trailer:
+//
+//	[4-byte size|flags][size bytes of data]
+//
+// the frame counts as count messages towards Depth, it is delivered one
+// message at a time but the read position only moves past it once every
+// message has been read, a restart in between delivers all of them again
+
+const (
+	txnHeaderSize = 8
+
+	// keeps the first byte of a version 1 file from reading as the
+	// file magic, see format.go
+	txnMaxSize = 0x0f000000 - 1
+)
+
+// pendingTxn holds the messages of a transaction frame that are still to
+// be delivered along with where reading carries on after it
+type pendingTxn struct {
+	msgs        []Message
+	count       int64
+	nextFileNum int64
+	nextPos     int64
+}
+
+// PutTransaction writes msgs to the queue as a single record, after a
+// crash either all of them or none are found in the queue
+//
+// the encoded messages (see txn.go) must fit in maxMsgSize, a transaction
+// counts as a single write towards the SyncPolicy
+func (d *diskQueue) PutTransaction(msgs [][]byte) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+	if atomic.LoadInt32(&d.draining) == 1 {
+		return ErrDraining
+	}
+	if len(msgs) == 0 {
+		return errors.New("empty transaction")
+	}
+
+	start := time.Now()
+	if d.writeGate != nil {
+		d.writeGate.enter()
+		defer d.writeGate.leave()
+	}
+	select {
+	case d.writeTxnChan <- msgs:
+	case <-d.closingChan:
+		return ErrExiting
+	}
+	addTiming(&d.stats.putWaits, &d.stats.putWaitNanos, start)
+	return <-d.writeResponseChan
+}
+
+// writeTransaction writes msgs as a single transaction frame
+func (d *diskQueue) writeTransaction(msgs [][]byte) error {
+	// reject the whole transaction rather than writing part of it
+	for _, data := range msgs {
+		dataLen := int32(len(data))
+		if dataLen < d.minMsgSize || dataLen > d.maxMsgSize {
+			return &MsgSizeError{int64(dataLen), d.minMsgSize, d.maxMsgSize}
+		}
+	}
+
+	var err error
+	d.txnBuf, err = d.appendTxn(d.txnBuf[:0], msgs)
+	if err != nil {
+		return err
+	}
+	maxSize := int(d.maxMsgSize)
+	if maxSize > txnMaxSize {
+		maxSize = txnMaxSize
+	}
+	if len(d.txnBuf) > maxSize {
+		return &MsgSizeError{int64(len(d.txnBuf)), d.minMsgSize, int32(maxSize)}
+	}
+
+	err = d.openWriteFile()
+	if err != nil {
+		return err
+	}
+	d.writeBuf.Reset()
+	frameSize := d.appendRawFrame(d.txnBuf, frameFlagTxn, d.writePos, d.writeHeader)
+	return d.writeFrame(frameSize, int64(len(msgs)))
+}
+
+// appendTxn appends the data of the transaction frame for msgs to buf
+func (d *diskQueue) appendTxn(buf []byte, msgs [][]byte) ([]byte, error) {
+	var header [txnHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(msgs)))
+	buf = append(buf, header[:]...)
+
+	for _, data := range msgs {
+		encoded, flags, err := d.encodeMessage(Message{Data: data})
+		if err != nil {
+			return nil, err
+		}
+		var sub [frameHeaderSize]byte
+		putFrameHeader(sub[:], fileFormatV1, int32(len(encoded)), flags)
+		buf = append(buf, sub[:]...)
+		buf = append(buf, encoded...)
+	}
+
+	binary.BigEndian.PutUint32(buf[4:txnHeaderSize], crc32.Checksum(buf[txnHeaderSize:], crc32cTable))
+	return buf, nil
+}
+
+// txnCount returns the number of messages in the transaction frame whose
+// data starts with header
+func txnCount(header []byte) (int64, error) {
+	if len(header) < txnHeaderSize {
+		return 0, errors.New("truncated transaction")
+	}
+	count := int64(binary.BigEndian.Uint32(header))
+	if count == 0 {
+		return 0, errors.New("empty transaction")
+	}
+	return count, nil
+}
+
+// checkTxn validates the checksum of the transaction frame data,
+// returning the number of messages it holds
+func checkTxn(data []byte) (int64, error) {
+	count, err := txnCount(data)
+	if err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint32(data[4:]) != crc32.Checksum(data[txnHeaderSize:], crc32cTable) {
+		return 0, errChecksumMismatch
+	}
+	return count, nil
+}
+
+// decodeTxn returns the messages of the transaction frame data, each in
+// memory of its own
+func (d *diskQueue) decodeTxn(data []byte) ([]Message, error) {
+	count, err := checkTxn(data)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]Message, 0, count)
+	rest := data[txnHeaderSize:]
+	for len(rest) > 0 {
+		size, flags, n := decodeFrameHeader(rest, fileFormatV1)
+		if n == 0 || int(size) > len(rest)-n || flags&frameFlagTxn != 0 {
+			return nil, errors.New("invalid transaction message")
+		}
+		if flags == 0 && (size < d.minMsgSize || size > d.maxMsgSize) {
+			return nil, fmt.Errorf("invalid message read size (%d)", size)
+		}
+		m, err := d.decodeFrame(append([]byte(nil), rest[n:n+int(size)]...), flags)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+		rest = rest[n+int(size):]
+	}
+	if int64(len(msgs)) != count {
+		return nil, fmt.Errorf("invalid transaction message count (%d != %d)", len(msgs), count)
+	}
+	return msgs, nil
+}
+
+// decodeFrameMessages returns the messages stored as data in a frame with
+// flags, several for a transaction frame and one for any other
+func (d *diskQueue) decodeFrameMessages(data []byte, flags uint32) ([]Message, error) {
+	if flags&frameFlagTxn != 0 {
+		return d.decodeTxn(data)
+	}
+	m, err := d.decodeFrame(data, flags)
+	if err != nil {
+		return nil, err
+	}
+	return []Message{m}, nil
+}
+
+// readMessageID returns the id (see WithDeliveryLedger) of the message
+// pending delivery, those of a transaction are told apart by their index
+func (d *diskQueue) readMessageID() uint64 {
+	pos := d.readPos
+	if d.readTxn.count > 0 {
+		pos += d.readTxn.count - int64(len(d.readTxn.msgs)) - 1
+	}
+	return messageID(d.readFileNum, pos)
+}
@@ -0,0 +1,168 @@
+package diskqueue
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// Report is the result of Verify
+type Report struct {
+	Files []FileReport
+	// the depth the queue keeps track of and the number of messages
+	// actually found between the read and write positions
+	Depth        int64
+	CountedDepth int64
+}
+
+// FileReport describes a data file checked by Verify
+type FileReport struct {
+	FileNum int64
+	// the number of unread messages found in the file, up to the
+	// corruption if any
+	Messages int64
+	// where the file stops making sense, -1 if it doesn't, along with why
+	CorruptPos int64
+	Err        error
+}
+
+// OK returns whether the queue was found to be intact, i.e. without any
+// corruption and with a depth matching the messages found
+func (r Report) OK() bool {
+	for _, f := range r.Files {
+		if f.Err != nil {
+			return false
+		}
+	}
+	return r.Depth == r.CountedDepth
+}
+
+type verifyResult struct {
+	report Report
+	err    error
+}
+
+// verify checks the data files from the read position to the write
+// position, see Verify
+func (d *diskQueue) verify() (Report, error) {
+	if d.writeFile != nil {
+		err := d.flushPending()
+		if err != nil {
+			return Report{}, err
+		}
+	}
+
+	report := Report{Depth: atomic.LoadInt64(&d.depth)}
+	pos := d.readPos
+	for fileNum := d.readFileNum; fileNum <= d.writeFileNum; fileNum++ {
+		if fileNum == d.writeFileNum && d.writePos == 0 {
+			break
+		}
+		fr := d.verifyFile(fileNum, pos)
+		report.Files = append(report.Files, fr)
+		report.CountedDepth += fr.Messages
+		pos = 0
+	}
+	return report, nil
+}
+
+// verifyFile checks the frames in fileNum from pos on
+func (d *diskQueue) verifyFile(fileNum int64, pos int64) FileReport {
+	fr := FileReport{FileNum: fileNum, CorruptPos: -1}
+	corrupt := func(at int64, err error) FileReport {
+		fr.CorruptPos = at
+		fr.Err = err
+		return fr
+	}
+
+	f, err := os.Open(d.fileName(fileNum))
+	if err != nil {
+		return corrupt(pos, err)
+	}
+	defer f.Close()
+	header, err := readFileHeader(f)
+	if err == nil {
+		_, err = f.Seek(pos, 0)
+	}
+	if err != nil {
+		return corrupt(pos, err)
+	}
+	reader := bufio.NewReader(f)
+
+	var data []byte
+	for fileNum < d.writeFileNum || pos < d.writePos {
+		padding, msgSize, flags, err := d.readFrameStart(reader, pos, header)
+		if fileEnded(err, fileNum, d.writeFileNum) {
+			break
+		}
+		if err != nil {
+			return corrupt(pos, err)
+		}
+		if cap(data) < int(msgSize) {
+			data = make([]byte, msgSize)
+		}
+		data = data[:msgSize]
+		_, err = io.ReadFull(reader, data)
+		if err == nil && d.frameTrailer {
+			var trailer [frameTrailerSize]byte
+			_, err = io.ReadFull(reader, trailer[:])
+			if err == nil {
+				err = checkFrameTrailer(trailer[:], data)
+			}
+		}
+		msgs := int64(1)
+		if err == nil && flags&frameFlagTxn != 0 {
+			msgs, err = checkTxn(data)
+		}
+		if err != nil {
+			return corrupt(pos, err)
+		}
+
+		fr.Messages += msgs
+		pos += padding + int64(msgSize) + d.frameOverhead(header.version, msgSize)
+		if pos > d.maxBytesOf(header) {
+			break
+		}
+	}
+
+	if fileNum == d.writeFileNum && pos != d.writePos {
+		return corrupt(pos, fmt.Errorf("frames end at %d rather than the write position %d", pos, d.writePos))
+	}
+	if d.segmentFooters && fileNum < d.writeFileNum {
+		footer, ok := d.readSegmentFooter(d.fileName(fileNum))
+		if ok && footer.hasCRC {
+			crc, err := segmentCRC(d.fileName(fileNum), footer.span)
+			if err == nil && crc != footer.crc {
+				err = errors.New("segment footer CRC mismatch")
+			}
+			if err != nil {
+				return corrupt(0, err)
+			}
+		}
+	}
+	return fr
+}
+
+// Verify checks every message between the read and the write position
+// without changing anything, reporting the messages found in each data
+// file, where a file turns out to be corrupt and whether the depth the
+// queue keeps track of matches
+//
+// frames are checked for a valid size prefix, their trailer (see
+// WithFrameTrailer), transaction and segment footer CRCs, but the messages
+// themselves are not decoded
+func (d *diskQueue) Verify() (Report, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return Report{}, ErrExiting
+	}
+
+	d.verifyChan <- 1
+	res := <-d.verifyResponseChan
+	return res.report, res.err
+}
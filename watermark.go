@@ -0,0 +1,30 @@
+package diskqueue
+
+import "sync/atomic"
+
+// watermark is a depth threshold set with OnDepthAbove or OnDepthBelow
+type watermark struct {
+	n     int64
+	above bool // crossed going up rather than down
+	fn    func(depth int64)
+
+	// whether depth was past n when last checked
+	crossed bool
+}
+
+// checkWatermarks calls the func of each watermark that depth has crossed
+// since it was last checked, called from ioLoop
+func (d *diskQueue) checkWatermarks() {
+	depth := atomic.LoadInt64(&d.depth)
+	for i := range d.watermarks {
+		w := &d.watermarks[i]
+		crossed := depth < w.n
+		if w.above {
+			crossed = depth > w.n
+		}
+		if crossed && !w.crossed {
+			w.fn(depth)
+		}
+		w.crossed = crossed
+	}
+}